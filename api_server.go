@@ -0,0 +1,609 @@
+package main
+
+// Local HTTP API for the dashboard and CLI.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const API_DEFAULT_LIMIT = 100
+const API_MAX_LIMIT = 1000
+const API_MAX_BODY = 1 << 20
+const API_CONFIG_CONTENT_TYPE = "application/toml"
+
+// API_TOKEN_FILE keeps the generated token when api.token is empty.
+// CLI는 이 파일에서 token을 읽는다.
+const API_TOKEN_FILE = "api-token"
+
+type apiServer struct {
+	ref   *HandlerRef
+	token string
+	port  string
+}
+
+// apiToken returns api.token, or the token in API_TOKEN_FILE.
+// create: generate the file if it does not exist (service start)
+func apiToken(cfg APIConfig, create bool) (string, error) {
+	if cfg.Token != "" {
+		return cfg.Token, nil
+	}
+	path := appPath(API_TOKEN_FILE)
+	data, err := ioutil.ReadFile(path)
+	if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !create {
+		if err == nil {
+			err = newErr("Empty API token file " + path)
+		}
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// apiProtected returns whether a request needs the API token:
+// every request that changes the state, the config export (secrets) and
+// the trace, which sends real queries to the upstreams.
+func apiProtected(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	return r.URL.Path == "/api/config" || r.URL.Path == "/api/trace"
+}
+
+// guard checks the requests before the routes.
+//
+//	Host   : IP 주소 또는 localhost와 API 포트만 허용한다. (DNS rebinding)
+//	Origin : 다른 사이트의 페이지가 보낸 요청은 거부한다. (CSRF)
+//	token  : 상태를 바꾸는 요청, 설정 내보내기와 trace는 Authorization: Bearer <token>이 필요하다.
+func (a *apiServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.Host)
+		if err != nil || port != a.port || (host != "localhost" && net.ParseIP(host) == nil) {
+			writeAPIError(w, http.StatusForbidden, "invalid host")
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			writeAPIError(w, http.StatusForbidden, "cross-origin request")
+			return
+		}
+		if apiProtected(r) {
+			auth := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(auth, []byte("Bearer "+a.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handler returns the running handler.
+func (a *apiServer) handler() *SecHandler {
+	return a.ref.Get()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		WriteErrorLog(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+type queryLogResponse struct {
+	Total   int             `json:"total"`
+	Offset  int             `json:"offset"`
+	Limit   int             `json:"limit"`
+	Entries []QueryLogEntry `json:"entries"`
+}
+
+// GET /api/querylog?from=&to=&client=&domain=&qtype=&rcode=&blocked=&offset=&limit=
+//
+// from, to : RFC 3339 time
+func (a *apiServer) handleQueryLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	f := QueryLogFilter{
+		Client: q.Get("client"),
+		Domain: q.Get("domain"),
+		Qtype:  q.Get("qtype"),
+		Rcode:  q.Get("rcode"),
+		Limit:  API_DEFAULT_LIMIT,
+	}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = time.Parse(time.RFC3339, v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid 'from': "+err.Error())
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if f.To, err = time.Parse(time.RFC3339, v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid 'to': "+err.Error())
+			return
+		}
+	}
+	if v := q.Get("blocked"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid 'blocked': "+err.Error())
+			return
+		}
+		f.Blocked = &b
+	}
+	if v := q.Get("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid 'offset'")
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 {
+			writeAPIError(w, http.StatusBadRequest, "invalid 'limit'")
+			return
+		}
+		if f.Limit > API_MAX_LIMIT {
+			f.Limit = API_MAX_LIMIT
+		}
+	}
+
+	entries, total := a.handler().QueryLog.Search(f)
+	writeJSON(w, http.StatusOK, queryLogResponse{
+		Total:   total,
+		Offset:  f.Offset,
+		Limit:   f.Limit,
+		Entries: entries,
+	})
+}
+
+// GET /api/stats
+func (a *apiServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	h := a.handler()
+	st := h.Stats.Snapshot()
+	if h.Tunnel != nil {
+		st.Tunneling = h.Tunnel.Scores()
+	}
+	st.Cache = h.NameCache.Stats()
+	writeJSON(w, http.StatusOK, st)
+}
+
+// POST /api/cache/flush : remove all cache entries
+//
+//	domain : remove the entries of the domain and its subdomains only
+func (a *apiServer) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	domain := r.URL.Query().Get("domain")
+	removed := a.handler().NameCache.Flush(domain)
+	if domain == "" {
+		log.Printf("Cache flushed: %d entries removed.", removed)
+	} else {
+		log.Printf("Cache entries of %s flushed: %d entries removed.", domain, removed)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+}
+
+// GET /api/upstreams
+func (a *apiServer) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.handler().Upstreams.Status())
+}
+
+// GET /api/schedule
+func (a *apiServer) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.handler().Scheduler.Status())
+}
+
+// GET /api/quota : query counts of the current periods
+func (a *apiServer) handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.handler().Quotas.Status())
+}
+
+// GET /api/ipsets?name=&format= : resolved-IP sets
+//
+// format : json (default), nftables, ipset
+func (a *apiServer) handleIPSets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	sets := a.handler().IPSets.Status(q.Get("name"))
+	if q.Get("name") != "" && len(sets) == 0 {
+		writeAPIError(w, http.StatusNotFound, "no such IP set")
+		return
+	}
+
+	var body []byte
+	switch q.Get("format") {
+	case "", IPSET_FORMAT_JSON:
+		writeJSON(w, http.StatusOK, sets)
+		return
+	case IPSET_FORMAT_NFTABLES:
+		table := q.Get("table")
+		if table == "" {
+			table = "inet filter"
+		}
+		for _, st := range sets {
+			body = append(body, formatNftables(st, table)...)
+		}
+	case IPSET_FORMAT_IPSET:
+		for _, st := range sets {
+			body = append(body, formatIPSet(st)...)
+		}
+	default:
+		writeAPIError(w, http.StatusBadRequest, "unknown format")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(body)
+}
+
+type traceResponse struct {
+	Name     string      `json:"name"`
+	Qtype    string      `json:"qtype"`
+	Client   string      `json:"client"`
+	Rcode    string      `json:"rcode"`
+	Blocked  bool        `json:"blocked"`
+	Reason   string      `json:"reason,omitempty"`
+	Cached   bool        `json:"cached"`
+	Upstream string      `json:"upstream,omitempty"`
+	EDE      string      `json:"ede,omitempty"` // extended DNS error: "<code> <text>"
+	Steps    []TraceStep `json:"steps"`
+	Answer   []string    `json:"answer"`
+}
+
+// GET /api/trace?name=&type=&client=
+//
+// 주어진 이름을 실제 쿼리와 같은 경로로 처리하고 각 단계를 반환한다.
+// (쿼리 할당량, 터널링 탐지 등에 일반 쿼리와 같이 집계된다)
+// client : 클라이언트 IP (기본 127.0.0.1). 클라이언트별 설정 확인용
+func (a *apiServer) handleTrace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	name := q.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid 'name'")
+		return
+	}
+	qtype := dns.TypeA
+	if v := q.Get("type"); v != "" {
+		t, ok := dns.StringToType[strings.ToUpper(v)]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, "invalid 'type'")
+			return
+		}
+		qtype = t
+	}
+	client := q.Get("client")
+	if client == "" {
+		client = "127.0.0.1"
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	info := queryInfo{client: clientID{IP: client, Listener: "udp"}, trace: newQueryTrace()}
+	h := a.handler()
+	if h.Neighbors != nil {
+		info.client.MAC = h.Neighbors.Lookup(client)
+	}
+	resp := h.resolve(msg, &info)
+
+	tr := traceResponse{
+		Name:     msg.Question[0].Name,
+		Qtype:    dns.TypeToString[qtype],
+		Client:   client,
+		Rcode:    dns.RcodeToString[dns.RcodeServerFailure],
+		Blocked:  info.blocked,
+		Reason:   info.reason,
+		Cached:   info.cached,
+		Upstream: info.upstream,
+		Steps:    info.trace.steps,
+		Answer:   []string{},
+	}
+	if info.ede != nil {
+		tr.EDE = strconv.Itoa(int(info.ede.code)) + " " + info.ede.text
+	}
+	if resp != nil {
+		tr.Rcode = dns.RcodeToString[resp.Rcode]
+		for _, rr := range resp.Answer {
+			tr.Answer = append(tr.Answer, rr.String())
+		}
+	}
+	writeJSON(w, http.StatusOK, tr)
+}
+
+// GET  /api/watchdog : result of the last hijack check
+// POST /api/watchdog : check now
+func (a *apiServer) handleWatchdog(w http.ResponseWriter, r *http.Request) {
+	wd := a.handler().Watchdog
+	if wd == nil {
+		writeAPIError(w, http.StatusNotFound, "watchdog is disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, wd.Status())
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, wd.Check())
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET  /api/nxdomain_hijack : result of the last NXDOMAIN hijack check
+// POST /api/nxdomain_hijack : check now
+func (a *apiServer) handleNXHijack(w http.ResponseWriter, r *http.Request) {
+	nx := a.handler().NXHijack
+	if nx == nil {
+		writeAPIError(w, http.StatusNotFound, "nxdomain hijack detection is disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, nx.Status())
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, nx.Check())
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET  /api/policy : state of the remote policy
+// POST /api/policy : fetch now
+func (a *apiServer) handlePolicy(w http.ResponseWriter, r *http.Request) {
+	p := a.handler().Policy
+	if p == nil {
+		writeAPIError(w, http.StatusNotFound, "no remote policy")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, p.Status())
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, p.Check())
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// GET /api/audit : differences between the primary and the audit upstream
+func (a *apiServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	audit := a.handler().Audit
+	if audit == nil {
+		writeAPIError(w, http.StatusNotFound, "audit is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, audit.Status())
+}
+
+// GET /api/blocklists
+func (a *apiServer) handleBlocklists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.handler().Blocklists.Status())
+}
+
+type backupResponse struct {
+	Created string   `json:"created,omitempty"`
+	Backups []string `json:"backups"`
+}
+
+// GET  /api/backup : list backups
+// POST /api/backup : create a backup now
+func (a *apiServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	h := a.handler()
+	cfg := h.Config.Backup
+	dir := resolveAppPath(cfg.Dir)
+	resp := backupResponse{}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		path, err := CreateBackup(dir, h)
+		if err != nil {
+			WriteErrorLogMsg("Backup failed.", err)
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Backup created: %s", path)
+		if cfg.Keep > 0 {
+			pruneBackups(dir, cfg.Keep)
+		}
+		resp.Created = path
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	list, err := ListBackups(dir)
+	if err != nil && !os.IsNotExist(err) {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp.Backups = append([]string{}, list...)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type configImportResponse struct {
+	Saved           string `json:"saved"`
+	RestartRequired bool   `json:"restart_required"`
+}
+
+// GET /api/config  : export the effective configuration (TOML)
+// PUT /api/config  : import a configuration document and save it to the config file
+func (a *apiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/toml")
+		if err := a.handler().EncodeConfig(w); err != nil {
+			WriteErrorLog(err)
+		}
+
+	case http.MethodPut:
+		if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, API_CONFIG_CONTENT_TYPE) {
+			writeAPIError(w, http.StatusUnsupportedMediaType, "content type must be "+API_CONFIG_CONTENT_TYPE)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, API_MAX_BODY))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		cfg, err := DecodeConfig(string(body))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid config: "+err.Error())
+			return
+		}
+
+		path := configPath()
+		if err := SaveConfig(path, cfg); err != nil {
+			WriteErrorLog(err)
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Printf("Config imported to %s", path)
+
+		writeJSON(w, http.StatusOK, configImportResponse{
+			Saved:           path,
+			RestartRequired: true,
+		})
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// POST /api/reload : reload the configuration file
+func (a *apiServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	result, err := a.ref.Reload()
+	if err != nil {
+		WriteErrorLogMsg("Reload failed. The running configuration is kept.", err)
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func RunAPI(cfg APIConfig, ref *HandlerRef, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+	addr := cfg.Listen
+	token, err := apiToken(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	a := &apiServer{ref: ref, token: token, port: port}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/querylog", a.handleQueryLog)
+	mux.HandleFunc("/api/stats", a.handleStats)
+	mux.HandleFunc("/api/cache/flush", a.handleCacheFlush)
+	mux.HandleFunc("/api/upstreams", a.handleUpstreams)
+	mux.HandleFunc("/api/config", a.handleConfig)
+	mux.HandleFunc("/api/reload", a.handleReload)
+	mux.HandleFunc("/api/schedule", a.handleSchedule)
+	mux.HandleFunc("/api/backup", a.handleBackup)
+	mux.HandleFunc("/api/quota", a.handleQuota)
+	mux.HandleFunc("/api/ipsets", a.handleIPSets)
+	mux.HandleFunc("/api/trace", a.handleTrace)
+	mux.HandleFunc("/api/watchdog", a.handleWatchdog)
+	mux.HandleFunc("/api/nxdomain_hijack", a.handleNXHijack)
+	mux.HandleFunc("/api/policy", a.handlePolicy)
+	mux.HandleFunc("/api/audit", a.handleAudit)
+	mux.HandleFunc("/api/blocklists", a.handleBlocklists)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: a.guard(mux)}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errHandler(err)
+		}
+	}()
+
+	log.Printf("API server listening on %s", addr)
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+// Multi-upstream consistency audit.
+//
+// 실제 쿼리의 일부(sample_rate)를 보조 업스트림에도 보내 응답을 비교하고,
+// 다른 경우(주소가 다름, NXDOMAIN/NOERROR 등) 로그에 [AUDIT]로 기록한다.
+// 새로운 필터링 DNS 서비스로 전환하기 전에 차이를 미리 확인하는 용도.
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const AUDIT_MAX_INFLIGHT = 10 // concurrent mirrored queries. more are skipped
+const AUDIT_RECENT = 100      // differences kept for the API
+
+type AuditDiff struct {
+	Time            time.Time `json:"time"`
+	Name            string    `json:"name"`
+	Qtype           string    `json:"qtype"`
+	Primary         string    `json:"primary"` // rcode
+	PrimaryAnswer   []string  `json:"primary_answer"`
+	Secondary       string    `json:"secondary"`
+	SecondaryAnswer []string  `json:"secondary_answer"`
+}
+
+type AuditStatus struct {
+	Upstream    string      `json:"upstream"`
+	Mirrored    int64       `json:"mirrored"`
+	Differences int64       `json:"differences"`
+	Errors      int64       `json:"errors"`
+	Recent      []AuditDiff `json:"recent"` // newest first
+}
+
+type Audit struct {
+	cfg      AuditConfig
+	url      string
+	dial     dialFunc
+	inflight chan struct{}
+
+	mirrored    int64 // atomic
+	differences int64 // atomic
+	errors      int64 // atomic
+
+	mu     sync.Mutex
+	recent []AuditDiff
+}
+
+func NewAudit(cfg AuditConfig, servers []UpstreamServerConfig, dial dialFunc) (*Audit, error) {
+	url := cfg.Upstream
+	for _, sc := range servers {
+		if sc.Name == cfg.Upstream {
+			url = sc.URL
+		}
+	}
+	if url == "" {
+		return nil, newErr("No audit upstream.")
+	}
+	if cfg.SampleRate <= 0 || cfg.SampleRate > 1 {
+		return nil, newErr("audit.sample_rate must be in (0, 1].")
+	}
+	return &Audit{
+		cfg:      cfg,
+		url:      url,
+		dial:     dial,
+		inflight: make(chan struct{}, AUDIT_MAX_INFLIGHT),
+	}, nil
+}
+
+// Mirror sends a sample of the queries answered by the primary upstream to the
+// secondary upstream in the background.
+func (a *Audit) Mirror(r *dns.Msg, primary *dns.Msg) {
+	if len(r.Question) == 0 || rand.Float64() >= a.cfg.SampleRate {
+		return
+	}
+	select {
+	case a.inflight <- struct{}{}:
+	default:
+		return
+	}
+
+	r = r.Copy()
+	go func() {
+		defer func() { <-a.inflight }()
+		a.compare(r, primary)
+	}()
+}
+
+func (a *Audit) compare(r *dns.Msg, primary *dns.Msg) {
+	atomic.AddInt64(&a.mirrored, 1)
+
+	prcode, pans, _ := answerSet(primary, nil)
+	srcode, sans, serr := answerSet(exchangeURL(a.url, r, a.dial))
+	if serr != "" {
+		atomic.AddInt64(&a.errors, 1)
+		return
+	}
+	if !divergent(prcode, pans, srcode, sans) {
+		return
+	}
+
+	atomic.AddInt64(&a.differences, 1)
+	q := r.Question[0]
+	d := AuditDiff{
+		Time:            time.Now(),
+		Name:            q.Name,
+		Qtype:           dns.TypeToString[q.Qtype],
+		Primary:         prcode,
+		PrimaryAnswer:   pans,
+		Secondary:       srcode,
+		SecondaryAnswer: sans,
+	}
+	log.Printf("[AUDIT] %s %s: primary %s %v, %s %s %v", d.Name, d.Qtype, d.Primary, d.PrimaryAnswer,
+		a.cfg.Upstream, d.Secondary, d.SecondaryAnswer)
+
+	a.mu.Lock()
+	a.recent = append([]AuditDiff{d}, a.recent...)
+	if len(a.recent) > AUDIT_RECENT {
+		a.recent = a.recent[:AUDIT_RECENT]
+	}
+	a.mu.Unlock()
+}
+
+func (a *Audit) Status() AuditStatus {
+	a.mu.Lock()
+	recent := append([]AuditDiff{}, a.recent...)
+	a.mu.Unlock()
+
+	return AuditStatus{
+		Upstream:    a.cfg.Upstream,
+		Mirrored:    atomic.LoadInt64(&a.mirrored),
+		Differences: atomic.LoadInt64(&a.differences),
+		Errors:      atomic.LoadInt64(&a.errors),
+		Recent:      recent,
+	}
+}
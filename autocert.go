@@ -0,0 +1,185 @@
+package main
+
+// Automatic certificates for the local DoT/DoH servers.
+//
+// cert_file, key_file을 지정하지 않으면 로컬 CA(AUTOCERT_CA_FILE)를 만들고, 이 CA로
+// hostname, *.hostname(기기별 이름), PC 이름과 주소를 포함하는 서버 인증서를 발급한다.
+// 클라이언트(브라우저, 휴대폰)에 CA 인증서를 한 번 설치하면 서버 인증서가 다시 발급되어도
+// 신뢰할 수 있다. 서버 인증서는 만료되기 전에 자동으로 다시 발급된다.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AUTOCERT_CA_FILE = "securedns-ca.pem"
+const AUTOCERT_CA_KEY_FILE = "securedns-ca.key"
+const AUTOCERT_CA_VALIDITY = 10 * 365 * 24 * time.Hour
+const AUTOCERT_VALIDITY = 90 * 24 * time.Hour
+const AUTOCERT_RENEW_BEFORE = 7 * 24 * time.Hour
+
+type autoCert struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	names []string // DNS names of the server certificate
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// newAutoCert loads the local CA, creating it if needed.
+// hostname: the server name of the DoT/DoH server, "" if none
+func newAutoCert(hostname string) (*autoCert, error) {
+	ca, caKey, err := loadOrCreateCA(appPath(AUTOCERT_CA_FILE), appPath(AUTOCERT_CA_KEY_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{"localhost"}
+	if hostname = strings.TrimSuffix(hostname, "."); hostname != "" {
+		names = append(names, hostname, "*."+hostname)
+	}
+	if pc, err := os.Hostname(); err == nil && pc != "" {
+		names = append(names, pc)
+	}
+	return &autoCert{ca: ca, caKey: caKey, names: names}, nil
+}
+
+// GetCertificate returns the server certificate, issuing a new one before it expires.
+func (a *autoCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cert != nil && time.Until(a.cert.Leaf.NotAfter) > AUTOCERT_RENEW_BEFORE {
+		return a.cert, nil
+	}
+	cert, err := a.issue()
+	if err != nil {
+		return nil, err
+	}
+	a.cert = cert
+	return cert, nil
+}
+
+// issue creates a server certificate for the names and the local addresses.
+func (a *autoCert) issue() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: a.names[len(a.names)-1]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(AUTOCERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     a.names,
+		IPAddresses:  localIPs(),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.ca, &key.PublicKey, a.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Issued a server certificate for %s (expires %s).", strings.Join(a.names, ", "), leaf.NotAfter.Format("2006-01-02"))
+	return &tls.Certificate{Certificate: [][]byte{der, a.ca.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// localIPs returns the addresses of the interfaces, including the loopback.
+func localIPs() []net.IP {
+	var ips []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
+
+// loadOrCreateCA reads the local CA, or creates it if it does not exist.
+func loadOrCreateCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, newErr("Unsupported key in " + keyPath)
+		}
+		if time.Now().After(ca.NotAfter) {
+			return nil, nil, newErr("The local CA certificate " + certPath + " has expired. Delete it to create a new one.")
+		}
+		return ca, signer, nil
+	}
+	if _, statErr := os.Stat(certPath); !os.IsNotExist(statErr) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "SecureDNS Local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(AUTOCERT_CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Created the local CA %s. Install it on the clients of the DoT/DoH server.", certPath)
+
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
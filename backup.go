@@ -0,0 +1,338 @@
+package main
+
+// Automatic backups of settings and user data files.
+//
+// 설정 파일과 설정에서 참조하는 사용자 파일(허용 목록 등)을
+// 시간이 기록된 zip 파일로 주기적으로 백업하고, 오래된 백업은 삭제한다.
+// 복원은 서비스가 실행 중이 아니어도 가능하도록 명령줄에서 직접 처리한다.
+// 백업에 들어 있는 설정 파일이 참조하는 경로에만 복원하며, 프로그램 디렉토리 밖의 경로는 확인을 받는다.
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const BACKUP_PREFIX = "sec-dns-"
+const BACKUP_TIME_FORMAT = "20060102-150405"
+const BACKUP_MANIFEST = "manifest.json"
+const BACKUP_EFFECTIVE_CONFIG = "effective-config.toml"
+const BACKUP_CONFIG_ENTRY = "files/0_" // backupPaths()[0]
+
+type backupManifest struct {
+	Created time.Time    `json:"created"`
+	Files   []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Entry string `json:"entry"` // name in the zip file
+	Path  string `json:"path"`  // original path
+}
+
+// backupPaths returns the user files referenced by cfg. The first one is the config file.
+func backupPaths(cfg *Config) []string {
+	paths := []string{configPath()}
+	add := func(files ...string) {
+		for _, p := range files {
+			if p != "" {
+				paths = append(paths, resolveAppPath(p))
+			}
+		}
+	}
+	add(cfg.Firewall.AllowFiles...)
+	add(cfg.Allowlist.Files...)
+	for _, bl := range cfg.Blocklists {
+		add(bl.File)
+	}
+	for _, set := range cfg.IPSets {
+		add(set.DomainFiles...)
+	}
+	add(cfg.DGA.ModelFile)
+	add(cfg.Hosts.File) // empty: the system hosts file, not a user file
+	return paths
+}
+
+// inAppDir returns whether path is in the program directory.
+func inAppDir(path string) bool {
+	rel, err := filepath.Rel(appPath(""), path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func addZipFile(zw *zip.Writer, entry string, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := zw.Create(entry)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// CreateBackup writes a backup of the user files and the effective configuration
+// into dir, and returns the backup file path.
+func CreateBackup(dir string, handler *SecHandler) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	path := filepath.Join(dir, BACKUP_PREFIX+now.Format(BACKUP_TIME_FORMAT)+".zip")
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+
+	zw := zip.NewWriter(f)
+	manifest := backupManifest{Created: now}
+
+	for i, p := range backupPaths(handler.Config) {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		entry := "files/" + strconv.Itoa(i) + "_" + filepath.Base(p)
+		if err = addZipFile(zw, entry, p); err != nil {
+			break
+		}
+		manifest.Files = append(manifest.Files, backupFile{entry, p})
+	}
+
+	// 실행 중 변경된 설정(schedule 등)을 포함한 현재 설정. 복원 대상은 아니다.
+	if err == nil {
+		var w io.Writer
+		if w, err = zw.Create(BACKUP_EFFECTIVE_CONFIG); err == nil {
+			err = handler.EncodeConfig(w)
+		}
+	}
+	if err == nil {
+		var w io.Writer
+		if w, err = zw.Create(BACKUP_MANIFEST); err == nil {
+			err = json.NewEncoder(w).Encode(manifest)
+		}
+	}
+
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// ListBackups returns the backup files in dir, newest first.
+func ListBackups(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []string
+	for _, fi := range files {
+		name := fi.Name()
+		if !fi.IsDir() && strings.HasPrefix(name, BACKUP_PREFIX) && strings.HasSuffix(name, ".zip") {
+			list = append(list, filepath.Join(dir, name))
+		}
+	}
+	// file names contain the time
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+	return list, nil
+}
+
+// pruneBackups removes all but the newest keep backups.
+func pruneBackups(dir string, keep int) {
+	list, err := ListBackups(dir)
+	if err != nil {
+		WriteErrorLog(err)
+		return
+	}
+	for i := keep; i < len(list); i++ {
+		if err := os.Remove(list[i]); err != nil {
+			WriteErrorLog(err)
+		}
+	}
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// RestoreBackup writes the files in the backup back to their original paths.
+// 설정 파일은 현재 설정 파일 경로에 복원하며, 다른 파일은 백업된 설정의 backupPaths에 있는
+// 경로에만 복원한다. 프로그램 디렉토리 밖의 경로는 confirm이 true를 반환해야 복원한다.
+func RestoreBackup(path string, confirm func(path string) bool) ([]string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	mf, ok := entries[BACKUP_MANIFEST]
+	if !ok {
+		return nil, newErr("No manifest in backup file.")
+	}
+	r, err := mf.Open()
+	if err != nil {
+		return nil, err
+	}
+	var manifest backupManifest
+	err = json.NewDecoder(r).Decode(&manifest)
+	r.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var cfgData []byte
+	for _, bf := range manifest.Files {
+		zf, ok := entries[bf.Entry]
+		if !ok {
+			return nil, newErr("Missing file in backup: " + bf.Entry)
+		}
+		if strings.HasPrefix(bf.Entry, BACKUP_CONFIG_ENTRY) {
+			if cfgData, err = readZipFile(zf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfgData == nil {
+		return nil, newErr("No config file in backup.")
+	}
+	cfg, err := DecodeConfig(string(cfgData))
+	if err != nil {
+		return nil, newErr("Invalid config file in backup: " + err.Error())
+	}
+
+	// 모든 경로를 확인한 후에 복원한다.
+	allowed := map[string]bool{}
+	for _, p := range backupPaths(cfg) {
+		allowed[strings.ToLower(filepath.Clean(p))] = true
+	}
+	targets := make([]string, len(manifest.Files))
+	for i, bf := range manifest.Files {
+		targets[i] = configPath()
+		if strings.HasPrefix(bf.Entry, BACKUP_CONFIG_ENTRY) {
+			continue
+		}
+		target := filepath.Clean(bf.Path)
+		if !allowed[strings.ToLower(target)] {
+			return nil, newErr("Backup file " + bf.Entry + " is not referenced by the backed up config: " + target)
+		}
+		if !inAppDir(target) && !confirm(target) {
+			return nil, newErr("Restore of " + target + " was not confirmed.")
+		}
+		targets[i] = target
+	}
+
+	var restored []string
+	for i, bf := range manifest.Files {
+		if err := restoreZipFile(entries[bf.Entry], targets[i]); err != nil {
+			return restored, err
+		}
+		restored = append(restored, targets[i])
+	}
+	return restored, nil
+}
+
+func restoreZipFile(zf *zip.File, path string) error {
+	src, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RunBackups creates a backup every interval, counted from the newest backup,
+// until stop is closed.
+func RunBackups(cfg BackupConfig, handler *SecHandler, stop <-chan struct{}) {
+	if cfg.Interval.Duration <= 0 {
+		return
+	}
+
+	dir := resolveAppPath(cfg.Dir)
+	timer := time.NewTimer(nextBackup(dir, cfg.Interval.Duration))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		timer.Reset(cfg.Interval.Duration)
+
+		path, err := CreateBackup(dir, handler)
+		if err != nil {
+			WriteErrorLogMsg("Backup failed.", err)
+			continue
+		}
+		log.Printf("Backup created: %s", path)
+
+		if cfg.Keep > 0 {
+			pruneBackups(dir, cfg.Keep)
+		}
+	}
+}
+
+// nextBackup returns the time until the next backup: interval after the newest
+// backup in dir, or 0 if there is none or it is older than interval.
+// 매일 재부팅하는 PC처럼 interval보다 자주 다시 시작되어도 백업하도록 시작할 때마다 확인한다.
+func nextBackup(dir string, interval time.Duration) time.Duration {
+	list, err := ListBackups(dir)
+	if err != nil || len(list) == 0 {
+		return 0
+	}
+	fi, err := os.Stat(list[0])
+	if err != nil {
+		return 0
+	}
+	if wait := interval - time.Since(fi.ModTime()); wait > 0 {
+		return wait
+	}
+	return 0
+}
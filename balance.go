@@ -0,0 +1,94 @@
+package main
+
+// Upstream load balancing.
+//
+// 정상(demote 되지 않은) 업스트림의 순서를 전략에 따라 정한다. 첫 번째 업스트림이
+// 쿼리를 받고, 나머지는 failover 순서가 된다. demote 된 업스트림은 항상 마지막이다.
+//   failover    : 설정된 순서
+//   round_robin : 쿼리마다 다음 업스트림부터
+//   weighted    : weight에 비례하는 확률로
+//   random      : 무작위
+//   fastest     : 응답 시간 EWMA가 가장 작은 업스트림부터. 측정된 적이 없는 업스트림을 먼저 사용하며,
+//                 다른 업스트림의 변화를 알 수 있도록 일부 쿼리(BALANCE_EXPLORE)는 무작위로 보낸다.
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BALANCE_FAILOVER    = "failover"
+	BALANCE_ROUND_ROBIN = "round_robin"
+	BALANCE_WEIGHTED    = "weighted"
+	BALANCE_RANDOM      = "random"
+	BALANCE_FASTEST     = "fastest"
+)
+
+const BALANCE_EWMA_ALPHA = 0.2
+const BALANCE_ERROR_PENALTY = 2 * time.Second // counted as the latency of a failed query
+const BALANCE_EXPLORE = 0.05
+
+func validBalanceStrategy(s string) bool {
+	switch s {
+	case BALANCE_FAILOVER, BALANCE_ROUND_ROBIN, BALANCE_WEIGHTED, BALANCE_RANDOM, BALANCE_FASTEST:
+		return true
+	}
+	return false
+}
+
+// updateEWMA adds a query result to the latency EWMA. called with u.mu held.
+func (u *Upstream) updateEWMA(latency time.Duration, err error) {
+	if err != nil {
+		latency = BALANCE_ERROR_PENALTY
+	}
+	if u.ewma == 0 {
+		u.ewma = latency
+		return
+	}
+	u.ewma = time.Duration(BALANCE_EWMA_ALPHA*float64(latency) + (1-BALANCE_EWMA_ALPHA)*float64(u.ewma))
+}
+
+func (u *Upstream) latencyEWMA() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ewma
+}
+
+// balance orders the healthy upstreams by the strategy.
+func (p *UpstreamPool) balance(list []*Upstream) {
+	if len(list) < 2 {
+		return
+	}
+
+	switch p.strategy {
+	case BALANCE_ROUND_ROBIN:
+		n := int(atomic.AddUint64(&p.next, 1) % uint64(len(list)))
+		rotated := append(append([]*Upstream{}, list[n:]...), list[:n]...)
+		copy(list, rotated)
+
+	case BALANCE_WEIGHTED:
+		// weighted random 순서: key = rand^(1/weight) 가 큰 순서 (Efraimidis-Spirakis)
+		keys := map[*Upstream]float64{}
+		for _, u := range list {
+			keys[u] = math.Pow(rand.Float64(), 1/float64(u.weight))
+		}
+		sort.SliceStable(list, func(i, j int) bool { return keys[list[i]] > keys[list[j]] })
+
+	case BALANCE_RANDOM:
+		rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+
+	case BALANCE_FASTEST:
+		if rand.Float64() < BALANCE_EXPLORE {
+			rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+			return
+		}
+		ewma := map[*Upstream]time.Duration{}
+		for _, u := range list {
+			ewma[u] = u.latencyEWMA()
+		}
+		sort.SliceStable(list, func(i, j int) bool { return ewma[list[i]] < ewma[list[j]] })
+	}
+}
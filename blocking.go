@@ -0,0 +1,89 @@
+package main
+
+// Answer for blocked names.
+//
+//   refused    REFUSED (기본값)
+//   nxdomain   NXDOMAIN. 이름이 없는 것으로 처리되어 대부분의 클라이언트가 바로 포기한다.
+//   null_ip    A 0.0.0.0, AAAA ::  연결이 바로 실패한다.
+//   custom_ip  A ipv4, AAAA ipv6 (ipv6를 비워 두면 레코드 없음)
+//
+// null_ip, custom_ip 에서 A/AAAA가 아닌 쿼리는 레코드 없이(NOERROR) 응답한다.
+// [sinkhole]이 켜져 있으면 A/AAAA는 sinkhole 주소로 응답한다.
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	BLOCK_REFUSED   = "refused"
+	BLOCK_NXDOMAIN  = "nxdomain"
+	BLOCK_NULL_IP   = "null_ip"
+	BLOCK_CUSTOM_IP = "custom_ip"
+)
+
+const BLOCK_TTL = 10 // seconds, the same as SINKHOLE_TTL
+
+type BlockResponse struct {
+	mode string
+	ipv4 net.IP
+	ipv6 net.IP // nil: AAAA answered with no records
+}
+
+// NewBlockResponse parses the [blocking] settings.
+func NewBlockResponse(cfg BlockingConfig) (*BlockResponse, error) {
+	b := &BlockResponse{mode: cfg.Mode}
+	switch cfg.Mode {
+	case BLOCK_REFUSED, BLOCK_NXDOMAIN:
+	case BLOCK_NULL_IP:
+		b.ipv4, b.ipv6 = net.IPv4zero.To4(), net.IPv6unspecified
+	case BLOCK_CUSTOM_IP:
+		if b.ipv4 = net.ParseIP(cfg.IPv4).To4(); b.ipv4 == nil {
+			return nil, newErr("Invalid blocking.ipv4 address: " + cfg.IPv4)
+		}
+		if cfg.IPv6 != "" {
+			if b.ipv6 = net.ParseIP(cfg.IPv6); b.ipv6 == nil || b.ipv6.To4() != nil {
+				return nil, newErr("Invalid blocking.ipv6 address: " + cfg.IPv6)
+			}
+		}
+	default:
+		return nil, newErr("Unknown blocking.mode '" + cfg.Mode + "'. (refused, nxdomain, null_ip, custom_ip)")
+	}
+	return b, nil
+}
+
+// Reply returns the answer for the blocked query r.
+func (b *BlockResponse) Reply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	switch b.mode {
+	case BLOCK_REFUSED:
+		m.SetRcode(r, dns.RcodeRefused)
+		return m
+	case BLOCK_NXDOMAIN:
+		m.SetRcode(r, dns.RcodeNameError)
+	default:
+		m.SetReply(r)
+	}
+	if len(r.Question) == 0 {
+		return m
+	}
+
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: BLOCK_TTL}
+	switch {
+	case b.mode == BLOCK_NXDOMAIN || q.Qclass != dns.ClassINET:
+	case q.Qtype == dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: b.ipv4})
+	case q.Qtype == dns.TypeAAAA && b.ipv6 != nil:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: b.ipv6})
+	}
+	if len(m.Answer) == 0 {
+		// negative answer: the SOA limits the negative cache time of the client. (RFC 2308)
+		soa := specialSOA(q.Name)
+		soa.Header().Ttl = BLOCK_TTL
+		soa.(*dns.SOA).Minttl = BLOCK_TTL
+		m.Ns = append(m.Ns, soa)
+	}
+	return m
+}
@@ -0,0 +1,489 @@
+package main
+
+// Remote blocklists with delta updates.
+//
+// 목록은 한 줄에 도메인 하나(하위 도메인 포함)이며, 받은 목록은 디렉토리에 보관하여
+// 서비스를 다시 시작할 때 다시 받지 않는다.
+// format = "hosts" 이면 hosts 파일 형식("0.0.0.0 ads.example.com")의 이름을 읽는다.
+// 목록의 규칙에는 wildcard(ad*.example.com)와 정규식(/^ad[0-9]+\./)을 사용할 수 있다. (see DomainRules)
+// format = "adblock" 이면 AdGuard/EasyList 형식의 규칙(||domain^, 예외 @@||domain^)을 읽는다.
+// 예외 규칙은 모든 목록보다 우선한다.
+// url 대신 file을 지정하면 로컬 파일을 읽고, 파일이 바뀌면 interval 안에 다시 읽는다.
+//
+// 갱신 방법:
+//   - delta_url이 있고 이전 sequence를 알면 변경분만 받는다.
+//       GET <delta_url의 {seq}를 sequence로 바꾼 URL>
+//       200 : "+domain" (추가), "-domain" (삭제) 줄, 응답 헤더 X-Sequence에 새 sequence
+//       304 : 변경 없음
+//       그 외 : 전체 목록을 다시 받는다.
+//   - 전체 목록은 ETag(If-None-Match)로 변경된 경우에만 받는다.
+//     응답 헤더 X-Sequence가 있으면 다음 갱신부터 delta를 사용한다.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const BLOCKLIST_SEQUENCE_HEADER = "X-Sequence"
+const BLOCKLIST_TIMEOUT = 5 * time.Minute
+const BLOCKLIST_RETRY = 5 * time.Minute // after a failed update
+const BLOCKLIST_DEFAULT_INTERVAL = 24 * time.Hour
+const BLOCKLIST_FILE_INTERVAL = 1 * time.Minute // default check of a local file
+const BLOCKLIST_DIR = "blocklists"              // cached lists, in the executable's directory
+
+// list formats
+const (
+	BLOCKLIST_FORMAT_DOMAINS = "domains" // one domain per line
+	BLOCKLIST_FORMAT_HOSTS   = "hosts"   // hosts file: "0.0.0.0 name [name...]"
+	BLOCKLIST_FORMAT_ADBLOCK = "adblock" // ||name^ and @@||name^ exceptions
+)
+
+type blocklistState struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Sequence     string    `json:"sequence,omitempty"`
+	Updated      time.Time `json:"updated"`
+}
+
+type blocklist struct {
+	cfg   BlocklistConfig
+	path  string // cached list
+	state string // cached state
+
+	mu       sync.RWMutex
+	names    *DomainSet
+	allow    *DomainSet   // exceptions of an adblock list
+	patterns *DomainRules // wildcard and regular expression rules
+	st       blocklistState
+	modTime  time.Time // of the local file
+	disabled int32     // atomic. 1: not matched
+}
+
+type BlocklistStatus struct {
+	Name       string    `json:"name"`
+	Entries    int       `json:"entries"`
+	Exceptions int       `json:"exceptions,omitempty"` // adblock @@ rules
+	Sequence   string    `json:"sequence,omitempty"`
+	Updated    time.Time `json:"updated"`
+	Disabled   bool      `json:"disabled,omitempty"`
+}
+
+type Blocklists struct {
+	lists  []*blocklist
+	client *http.Client
+}
+
+func NewBlocklists(cfgs []BlocklistConfig, dir string) (*Blocklists, error) {
+	b := &Blocklists{client: &http.Client{Timeout: BLOCKLIST_TIMEOUT}}
+	if len(cfgs) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range cfgs {
+		if c.Name == "" || (c.URL == "") == (c.File == "") {
+			return nil, newErr("Blocklist needs a name and an url or a file.")
+		}
+		switch c.Format {
+		case "":
+			c.Format = BLOCKLIST_FORMAT_DOMAINS
+		case BLOCKLIST_FORMAT_DOMAINS, BLOCKLIST_FORMAT_HOSTS, BLOCKLIST_FORMAT_ADBLOCK:
+		default:
+			return nil, newErr("Blocklist '" + c.Name + "': unknown format '" + c.Format + "'. (domains, hosts, adblock)")
+		}
+		if c.Interval.Duration == 0 {
+			c.Interval.Duration = BLOCKLIST_DEFAULT_INTERVAL
+			if c.File != "" {
+				c.Interval.Duration = BLOCKLIST_FILE_INTERVAL
+			}
+		} else if c.Interval.Duration < 0 {
+			return nil, newErr("Blocklist '" + c.Name + "': invalid interval.")
+		}
+		bl := &blocklist{
+			cfg:   c,
+			path:  filepath.Join(dir, c.Name+".txt"),
+			state: filepath.Join(dir, c.Name+".state"),
+			names: NewDomainSet(),
+			allow: NewDomainSet(),
+
+			patterns: NewDomainRules(),
+		}
+		if c.Disabled {
+			bl.disabled = 1
+		}
+		if c.File != "" {
+			bl.path, bl.state = resolveAppPath(c.File), ""
+			if err := bl.readFile(); err != nil {
+				return nil, newErr("Blocklist '" + c.Name + "': " + err.Error())
+			}
+		} else {
+			bl.load()
+		}
+		b.lists = append(b.lists, bl)
+	}
+	return b, nil
+}
+
+// load reads the cached list. 실패하면 다음 갱신에서 전체 목록을 받는다.
+func (bl *blocklist) load() {
+	data, err := ioutil.ReadFile(bl.state)
+	if err != nil {
+		return
+	}
+	var st blocklistState
+	if json.Unmarshal(data, &st) != nil {
+		return
+	}
+	f, err := os.Open(bl.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	names, allow, patterns := NewDomainSet(), NewDomainSet(), NewDomainRules()
+	if bl.cfg.Format == BLOCKLIST_FORMAT_ADBLOCK {
+		err = AddAdblockReader(names, allow, patterns, f)
+	} else {
+		err = addDomainLines(names, patterns, f)
+	}
+	if err != nil {
+		return
+	}
+	bl.names, bl.allow, bl.patterns, bl.st = names, allow, patterns, st
+	log.Printf("Blocklist %s: %d entries (cached)", bl.cfg.Name, names.Len())
+}
+
+// readFile reads the local file of the list if it has changed.
+func (bl *blocklist) readFile() error {
+	fi, err := os.Stat(bl.path)
+	if err != nil {
+		return err
+	}
+	bl.mu.RLock()
+	unchanged := fi.ModTime().Equal(bl.modTime)
+	bl.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(bl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	names, allow, patterns := NewDomainSet(), NewDomainSet(), NewDomainRules()
+	if err := bl.parse(names, allow, patterns, f); err != nil {
+		return err
+	}
+
+	bl.mu.Lock()
+	bl.names, bl.allow, bl.patterns, bl.modTime = names, allow, patterns, fi.ModTime()
+	bl.st = blocklistState{Updated: time.Now()}
+	bl.mu.Unlock()
+	log.Printf("Blocklist %s: %d entries (%s)", bl.cfg.Name, names.Len(), bl.path)
+	return nil
+}
+
+// parse adds the names of a downloaded or local list in its format.
+// allow: exceptions of an adblock list
+func (bl *blocklist) parse(names, allow *DomainSet, patterns *DomainRules, r io.Reader) error {
+	switch bl.cfg.Format {
+	case BLOCKLIST_FORMAT_HOSTS:
+		return names.AddHostsReader(r)
+	case BLOCKLIST_FORMAT_ADBLOCK:
+		return AddAdblockReader(names, allow, patterns, r)
+	}
+	return addDomainLines(names, patterns, r)
+}
+
+// addDomainLines reads a list of one rule per line. '#' starts a comment.
+// Invalid regular expressions are skipped.
+func addDomainLines(names *DomainSet, patterns *DomainRules, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		addRule(names, patterns, line)
+	}
+	return sc.Err()
+}
+
+func addRule(names *DomainSet, patterns *DomainRules, rule string) {
+	rule = strings.TrimSpace(rule)
+	if isPatternRule(rule) {
+		patterns.Add(rule)
+	} else {
+		names.Add(rule)
+	}
+}
+
+// save writes the list and the state. called with mu held.
+func (bl *blocklist) save() error {
+	f, err := os.Create(bl.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if bl.cfg.Format == BLOCKLIST_FORMAT_ADBLOCK {
+		if _, err = bl.names.WriteRulesTo(f, "||", "^"); err == nil {
+			_, err = bl.allow.WriteRulesTo(f, "@@||", "^")
+		}
+	} else {
+		_, err = bl.names.WriteTo(f)
+	}
+	if err == nil {
+		err = bl.patterns.WritePatternsTo(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(bl.path+".tmp", bl.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(bl.st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bl.state, data, 0644)
+}
+
+// fetchDelta applies the changes since the last sequence.
+// Returns false if the full list must be downloaded.
+func (bl *blocklist) fetchDelta(client *http.Client) (bool, error) {
+	bl.mu.RLock()
+	seq := bl.st.Sequence
+	bl.mu.RUnlock()
+	if bl.cfg.DeltaURL == "" || seq == "" {
+		return false, nil
+	}
+
+	resp, err := client.Get(strings.Replace(bl.cfg.DeltaURL, "{seq}", url.QueryEscape(seq), -1))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return true, nil
+	case http.StatusOK:
+	default:
+		// 서버가 오래된 sequence의 변경분을 더 이상 갖고 있지 않은 경우 등
+		return false, nil
+	}
+	newSeq := resp.Header.Get(BLOCKLIST_SEQUENCE_HEADER)
+	if newSeq == "" {
+		return false, nil
+	}
+
+	// 받는 도중 실패하면 적용하지 않도록 먼저 모두 읽는다.
+	var adds, removes []string
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "+"):
+			adds = append(adds, line[1:])
+		case strings.HasPrefix(line, "-"):
+			removes = append(removes, line[1:])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return false, err
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	for _, name := range removes {
+		bl.names.Remove(name)
+	}
+	for _, name := range adds {
+		addRule(bl.names, bl.patterns, name)
+	}
+	bl.st.Sequence = newSeq
+	bl.st.Updated = time.Now()
+	log.Printf("Blocklist %s: +%d -%d (sequence %s), %d entries", bl.cfg.Name, len(adds), len(removes), newSeq, bl.names.Len())
+	return true, bl.save()
+}
+
+// fetchFull downloads the full list if it has changed.
+func (bl *blocklist) fetchFull(client *http.Client) error {
+	req, err := http.NewRequest(http.MethodGet, bl.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	bl.mu.RLock()
+	if bl.names.Len() > 0 {
+		if bl.st.ETag != "" {
+			req.Header.Set("If-None-Match", bl.st.ETag)
+		}
+		if bl.st.LastModified != "" {
+			req.Header.Set("If-Modified-Since", bl.st.LastModified)
+		}
+	}
+	bl.mu.RUnlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newErr("HTTP error code " + resp.Status)
+	}
+
+	names, allow, patterns := NewDomainSet(), NewDomainSet(), NewDomainRules()
+	if err := bl.parse(names, allow, patterns, io.LimitReader(resp.Body, 1<<30)); err != nil {
+		return err
+	}
+
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.names, bl.allow, bl.patterns = names, allow, patterns
+	bl.st = blocklistState{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Sequence:     resp.Header.Get(BLOCKLIST_SEQUENCE_HEADER),
+		Updated:      time.Now(),
+	}
+	log.Printf("Blocklist %s: %d entries", bl.cfg.Name, names.Len())
+	return bl.save()
+}
+
+func (bl *blocklist) update(client *http.Client) error {
+	if bl.cfg.File != "" {
+		return bl.readFile()
+	}
+	done, err := bl.fetchDelta(client)
+	if err != nil {
+		WriteErrorLogMsg("Blocklist "+bl.cfg.Name+": delta update failed.", err)
+	}
+	if done {
+		return err
+	}
+	return bl.fetchFull(client)
+}
+
+func (bl *blocklist) run(client *http.Client, stop <-chan struct{}) {
+	// 보관된 목록이 최근에 갱신된 것이면 다음 주기까지 기다린다.
+	bl.mu.RLock()
+	wait := bl.cfg.Interval.Duration - time.Since(bl.st.Updated)
+	bl.mu.RUnlock()
+	if wait > 0 {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+
+	for {
+		wait := bl.cfg.Interval.Duration
+		if err := bl.update(client); err != nil {
+			WriteErrorLogMsg("Blocklist "+bl.cfg.Name+": update failed.", err)
+			if BLOCKLIST_RETRY < wait {
+				wait = BLOCKLIST_RETRY
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Run updates the lists on their intervals until stop is closed.
+func (b *Blocklists) Run(stop <-chan struct{}) {
+	for _, bl := range b.lists {
+		go bl.run(b.client, stop)
+	}
+}
+
+// SetEnabled enables or disables the list name.
+// 비활성화된 목록도 계속 갱신하므로 다시 활성화하면 바로 적용된다.
+func (b *Blocklists) SetEnabled(name string, enabled bool) error {
+	for _, bl := range b.lists {
+		if bl.cfg.Name == name {
+			var v int32
+			if !enabled {
+				v = 1
+			}
+			atomic.StoreInt32(&bl.disabled, v)
+			return nil
+		}
+	}
+	return newErr("Unknown blocklist '" + name + "'")
+}
+
+// checked returns whether Match checks the list.
+func (bl *blocklist) checked(lists map[string]bool) bool {
+	return atomic.LoadInt32(&bl.disabled) == 0 && (lists == nil || lists[bl.cfg.Name])
+}
+
+// Match returns the name of the first list that contains name.
+// lists: names of the lists to check. nil: every list
+func (b *Blocklists) Match(name string, lists map[string]bool) (string, bool) {
+	// exceptions of the adblock lists win over every list
+	for _, bl := range b.lists {
+		if !bl.checked(lists) {
+			continue
+		}
+		bl.mu.RLock()
+		ok := bl.allow.Match(name)
+		bl.mu.RUnlock()
+		if ok {
+			return "", false
+		}
+	}
+	for _, bl := range b.lists {
+		if !bl.checked(lists) {
+			continue
+		}
+		bl.mu.RLock()
+		ok := bl.names.Match(name) || bl.patterns.Match(name)
+		bl.mu.RUnlock()
+		if ok {
+			return bl.cfg.Name, true
+		}
+	}
+	return "", false
+}
+
+func (b *Blocklists) Status() []BlocklistStatus {
+	list := []BlocklistStatus{}
+	for _, bl := range b.lists {
+		bl.mu.RLock()
+		list = append(list, BlocklistStatus{
+			Name:       bl.cfg.Name,
+			Entries:    bl.names.Len() + bl.patterns.Len(),
+			Exceptions: bl.allow.Len(),
+			Sequence:   bl.st.Sequence,
+			Updated:    bl.st.Updated,
+			Disabled:   atomic.LoadInt32(&bl.disabled) == 1,
+		})
+		bl.mu.RUnlock()
+	}
+	return list
+}
@@ -0,0 +1,497 @@
+package main
+
+// DNS response cache.
+//
+// 모든 타입의 응답을 (이름, 타입, 클래스)로 캐시한다. (see cacheKey)
+// 응답은 레코드의 TTL(가장 작은 값) 동안 캐시하며, [cache]의 min_ttl, max_ttl로 제한한다.
+// 캐시된 응답의 TTL은 캐시된 후 지난 시간만큼 줄여서 보낸다.
+// rewrite_ttl: 업스트림 응답의 레코드 TTL도 min_ttl ~ max_ttl로 바꾸어 캐시하고 클라이언트에 보낸다.
+//
+// NXDOMAIN, NODATA(NOERROR, 응답 레코드 없음) 응답은 authority section의 SOA에 따라
+// min(SOA TTL, SOA MINIMUM) 동안 캐시한다. (RFC 2308 5, 최대 negative_max_ttl)
+//
+// Serve-stale (RFC 8767): 만료된 응답은 stale_max_age 동안 더 보관하며, 업스트림 질의에
+// 실패하면 이 응답(TTL CACHE_STALE_TTL)으로 대신 응답하고 업스트림이 복구되면 다시 가져온다.
+//
+// Prefetch: TTL 동안 prefetch_min_hits 회 이상 쿼리된 응답은 남은 TTL이 CACHE_PREFETCH_PERCENT %
+// 미만일 때 쿼리되면 백그라운드에서 미리 다시 가져온다. 자주 쿼리되는 이름은 캐시 miss가 없다.
+//
+// persist: 서비스를 중지할 때 캐시를 파일(CACHE_FILE)에 저장하고 시작할 때 다시 읽는다.
+//
+// 응답은 wire format으로 보관하며, 캐시 hit마다 새 메시지로 풀어서 보낸다.
+// 같은 항목을 동시에 응답해도 캐시된 메시지가 바뀌지 않는다.
+//
+// 항목 수(max_entries)와 메모리 사용량(max_size, 메시지 크기로 추정)을 넘으면
+// 가장 오래 사용되지 않은 항목부터 지운다. (LRU)
+
+import (
+	"container/list"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const CACHE_STALE_TTL = 30                   // TTL of stale answers (RFC 8767 4)
+const CACHE_STALE_REFRESH = 10 * time.Second // retry interval of the refresh after a stale answer
+const CACHE_FILE = "dns-cache.json"
+const CACHE_PREFETCH_PERCENT = 10 // prefetched when less than this percent of the TTL is left
+const CACHE_ENTRY_OVERHEAD = 200  // estimated bytes of an entry besides the message
+
+type DNSCache struct {
+	lruMu      sync.Mutex
+	entries    map[string]*list.Element // key -> *cacheEntry
+	lru        *list.List               // front: most recently used
+	size       int                      // estimated bytes
+	maxEntries int
+	maxSize    int
+
+	minTTL    time.Duration
+	maxTTL    time.Duration
+	negMaxTTL time.Duration
+	rewrite   bool          // rewrite the record TTLs to minTTL ~ maxTTL
+	staleAge  time.Duration // 0: serve-stale disabled
+
+	prefetchHits int32 // 0: prefetch disabled
+
+	path string // CACHE_FILE, "": not persisted
+
+	mu         sync.Mutex
+	refreshing map[string]bool // keys refreshed in the background
+}
+
+type cacheEntry struct {
+	key     string
+	wire    []byte // packed response. never modified, each hit unpacks a new message
+	stored  time.Time
+	expires time.Time
+	keep    time.Time // removed after this time (expires + stale_max_age)
+	size    int
+	hits    int32 // atomic
+}
+
+// msg returns a new message unpacked from the entry, nil if it is broken.
+func (e *cacheEntry) msg() *dns.Msg {
+	m := new(dns.Msg)
+	if m.Unpack(e.wire) != nil {
+		return nil
+	}
+	return m
+}
+
+// CacheStats is the cache usage in /api/stats.
+type CacheStats struct {
+	Entries    int `json:"entries"`
+	Size       int `json:"size"` // estimated bytes
+	MaxEntries int `json:"max_entries"`
+	MaxSize    int `json:"max_size"`
+}
+
+// cacheFileEntry is a cache entry in CACHE_FILE.
+type cacheFileEntry struct {
+	Key     string    `json:"key"`
+	Wire    []byte    `json:"wire"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewDNSCache creates the cache. path: CACHE_FILE if persisted, otherwise ""
+func NewDNSCache(cfg CacheConfig, path string) *DNSCache {
+	c := &DNSCache{
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		maxEntries: cfg.MaxEntries,
+		maxSize:    cfg.MaxSize,
+		minTTL:     cfg.MinTTL.Duration,
+		maxTTL:     cfg.MaxTTL.Duration,
+		negMaxTTL:  cfg.NegativeMaxTTL.Duration,
+		rewrite:    cfg.RewriteTTL,
+		refreshing: map[string]bool{},
+	}
+	if cfg.ServeStale {
+		c.staleAge = cfg.StaleMaxAge.Duration
+	}
+	if cfg.Prefetch {
+		c.prefetchHits = int32(cfg.PrefetchMinHits)
+	}
+	if path != "" {
+		c.path = path
+		c.load()
+	}
+	return c
+}
+
+// cacheKey returns the cache key of the question of r: name/type/class,
+// and the DO, CD bits that change the answer. (DNSSEC records, validation)
+func cacheKey(r *dns.Msg) string {
+	q := r.Question[0]
+	key := strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(int(q.Qclass))
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		key += "/do"
+	}
+	if r.CheckingDisabled {
+		key += "/cd"
+	}
+	return key
+}
+
+// cachePath returns the cache file path, or "" if the cache is not persisted.
+func cachePath(cfg CacheConfig) string {
+	if !cfg.Persist {
+		return ""
+	}
+	return appPath(CACHE_FILE)
+}
+
+// load reads the entries saved by Save, except the expired ones.
+func (c *DNSCache) load() {
+	data, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var entries []cacheFileEntry
+	if err == nil {
+		err = json.Unmarshal(data, &entries)
+	}
+	if err != nil {
+		WriteErrorLogMsg("Can't read the cache file.", err)
+		return
+	}
+	c.restore(entries)
+}
+
+// restore stores the entries, except the expired ones.
+func (c *DNSCache) restore(entries []cacheFileEntry) {
+	now := time.Now()
+	for _, fe := range entries {
+		keep := fe.Expires.Add(c.staleAge).Sub(now)
+		if keep <= 0 {
+			continue
+		}
+		if new(dns.Msg).Unpack(fe.Wire) != nil {
+			continue
+		}
+		c.store(&cacheEntry{key: fe.Key, wire: fe.Wire, stored: fe.Stored, expires: fe.Expires, keep: now.Add(keep)})
+	}
+}
+
+// snapshot returns the entries from the least recently used.
+func (c *DNSCache) snapshot() []cacheFileEntry {
+	var entries []cacheFileEntry
+	c.lruMu.Lock()
+	// 뒤에서부터 저장하여 읽을 때 LRU 순서가 유지되도록 한다.
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*cacheEntry)
+		entries = append(entries, cacheFileEntry{Key: e.key, Wire: e.wire, Stored: e.stored, Expires: e.expires})
+	}
+	c.lruMu.Unlock()
+	return entries
+}
+
+// CopyFrom stores the entries of old. (configuration reload)
+func (c *DNSCache) CopyFrom(old *DNSCache) {
+	c.restore(old.snapshot())
+}
+
+// Save writes the entries to the cache file if persisted.
+func (c *DNSCache) Save() {
+	if c.path == "" {
+		return
+	}
+	data, err := json.Marshal(c.snapshot())
+	if err == nil {
+		tmp := c.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, c.path)
+		}
+	}
+	if err != nil {
+		WriteErrorLogMsg("Can't write the cache file.", err)
+	}
+}
+
+// negative returns whether m is an NXDOMAIN or NODATA response.
+func negative(m *dns.Msg) bool {
+	return m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+}
+
+// negativeTTL returns the negative caching TTL from the SOA record of m.
+func negativeTTL(m *dns.Msg) (ttl time.Duration, ok bool) {
+	for _, rr := range m.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			min := soa.Hdr.Ttl
+			if soa.Minttl < min {
+				min = soa.Minttl
+			}
+			return time.Duration(min) * time.Second, true
+		}
+	}
+	// SOA가 없으면 캐시하지 않는다.
+	return 0, false
+}
+
+// msgTTL returns the smallest TTL of the answer records,
+// or the negative caching TTL.
+// ok: false if m has no answer to cache.
+func msgTTL(m *dns.Msg) (ttl time.Duration, ok bool) {
+	if m.Truncated {
+		return 0, false
+	}
+	if negative(m) {
+		return negativeTTL(m)
+	}
+	if m.Rcode != dns.RcodeSuccess {
+		return 0, false
+	}
+	min := m.Answer[0].Header().Ttl
+	for _, rr := range m.Answer[1:] {
+		if t := rr.Header().Ttl; t < min {
+			min = t
+		}
+	}
+	return time.Duration(min) * time.Second, true
+}
+
+// store adds or replaces an entry, and evicts the least recently used
+// entries over the limits.
+func (c *DNSCache) store(e *cacheEntry) {
+	e.size = len(e.wire) + len(e.key) + CACHE_ENTRY_OVERHEAD
+
+	c.lruMu.Lock()
+	defer c.lruMu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+
+	for c.lru.Len() > 1 && (c.lru.Len() > c.maxEntries || c.size > c.maxSize) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry. called with lruMu held.
+func (c *DNSCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// lookup returns the entry of key, or nil.
+// used: count as a use for LRU
+func (c *DNSCache) lookup(key string, used bool) *cacheEntry {
+	c.lruMu.Lock()
+	defer c.lruMu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.keep) {
+		c.remove(el)
+		return nil
+	}
+	if used {
+		c.lru.MoveToFront(el)
+	}
+	return e
+}
+
+// Flush removes the entries of domain and its subdomains, or all entries if
+// domain is "". returns the number of removed entries.
+func (c *DNSCache) Flush(domain string) int {
+	domain = strings.ToLower(dns.Fqdn(domain))
+
+	c.lruMu.Lock()
+	defer c.lruMu.Unlock()
+	removed := 0
+	for key, el := range c.entries {
+		name := key[:strings.IndexByte(key, '/')]
+		if domain == "." || name == domain || strings.HasSuffix(name, "."+domain) {
+			c.remove(el)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Stats returns the cache usage.
+func (c *DNSCache) Stats() *CacheStats {
+	c.lruMu.Lock()
+	defer c.lruMu.Unlock()
+	return &CacheStats{Entries: c.lru.Len(), Size: c.size, MaxEntries: c.maxEntries, MaxSize: c.maxSize}
+}
+
+// Set caches m for its TTL.
+func (c *DNSCache) Set(key string, m *dns.Msg) {
+	ttl, ok := msgTTL(m)
+	if !ok {
+		return
+	}
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if negative(m) && ttl > c.negMaxTTL {
+		ttl = c.negMaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	wire, err := m.Pack()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	c.store(&cacheEntry{key: key, wire: wire, stored: now, expires: now.Add(ttl), keep: now.Add(ttl + c.staleAge)})
+}
+
+// Get returns the cached response for key, with the TTLs reduced by its age.
+func (c *DNSCache) Get(key string) (*dns.Msg, bool) {
+	e := c.lookup(key, true)
+	if e == nil || time.Now().After(e.expires) {
+		return nil, false
+	}
+	atomic.AddInt32(&e.hits, 1)
+	m := e.msg()
+	if m == nil {
+		return nil, false
+	}
+	ageTTLs(m, uint32(time.Since(e.stored)/time.Second))
+	return m, true
+}
+
+// Stale returns the expired response for key kept for serve-stale.
+func (c *DNSCache) Stale(key string) (*dns.Msg, bool) {
+	e := c.lookup(key, true)
+	if e == nil {
+		return nil, false
+	}
+	m := e.msg()
+	if m == nil {
+		return nil, false
+	}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			rr.Header().Ttl = CACHE_STALE_TTL
+		}
+	}
+	return m, true
+}
+
+// startRefresh marks key as refreshed in the background.
+// false: already being refreshed
+func (c *DNSCache) startRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+func (c *DNSCache) endRefresh(key string) {
+	c.mu.Lock()
+	delete(c.refreshing, key)
+	c.mu.Unlock()
+}
+
+// Prefetch queries the upstream for key in the background if the entry is
+// queried often and about to expire. Call after a cache hit.
+func (c *DNSCache) Prefetch(key string, query func() (*dns.Msg, error)) {
+	if c.prefetchHits == 0 {
+		return
+	}
+	e := c.lookup(key, false)
+	if e == nil {
+		return
+	}
+	ttl := e.expires.Sub(e.stored)
+	if atomic.LoadInt32(&e.hits) < c.prefetchHits || time.Until(e.expires) >= ttl*CACHE_PREFETCH_PERCENT/100 {
+		return
+	}
+	if !c.startRefresh(key) {
+		return
+	}
+	go func() {
+		defer c.endRefresh(key)
+		if m, err := query(); err == nil {
+			c.Set(key, m)
+		}
+	}()
+}
+
+// Refresh queries the upstream for key in the background until it answers,
+// or the stale entry is removed. 같은 key에 대해서는 하나만 실행한다.
+func (c *DNSCache) Refresh(key string, query func() (*dns.Msg, error), stop <-chan struct{}) {
+	if !c.startRefresh(key) {
+		return
+	}
+
+	go func() {
+		defer c.endRefresh(key)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(CACHE_STALE_REFRESH):
+			}
+			if c.lookup(key, false) == nil {
+				return
+			}
+			if m, err := query(); err == nil {
+				c.Set(key, m)
+				return
+			}
+		}
+	}()
+}
+
+// ClampTTLs rewrites the record TTLs of an upstream response to min_ttl ~ max_ttl,
+// if rewrite_ttl is enabled.
+func (c *DNSCache) ClampTTLs(m *dns.Msg) {
+	if !c.rewrite {
+		return
+	}
+	min := uint32(c.minTTL / time.Second)
+	max := uint32(c.maxTTL / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl < min {
+				h.Ttl = min
+			} else if h.Ttl > max {
+				h.Ttl = max
+			}
+		}
+	}
+}
+
+// ageTTLs reduces the record TTLs of m by age seconds.
+func ageTTLs(m *dns.Msg, age uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > age {
+				h.Ttl -= age
+			} else {
+				h.Ttl = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+// Command line interface.
+// 명령은 실행 중인 서비스의 로컬 API를 통해 처리된다.
+// 명령 앞의 플래그(flags.go)는 명령에도 적용된다. (e.g. -config)
+//
+//   SecureDNS.exe config export [file]
+//   SecureDNS.exe config import <file>
+//   SecureDNS.exe backup [list]
+//   SecureDNS.exe restore <backup file>
+//   SecureDNS.exe query <name> [type] [@server]
+//   SecureDNS.exe cache flush [domain]
+//   SecureDNS.exe reload
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: SecureDNS [options] [command]")
+	fmt.Fprintln(os.Stderr, "Options:")
+	fmt.Fprintln(os.Stderr, "  -config <file>                   config file (default: sec-dns.toml in the program directory)")
+	fmt.Fprintln(os.Stderr, "  -listen <ip:port>                DNS listen address, repeatable or comma separated")
+	fmt.Fprintln(os.Stderr, "  -upstream <url>                  upstream server (https://, tls://, quic://, sdns://), repeatable")
+	fmt.Fprintln(os.Stderr, "  -cache-min-ttl <duration>        minimum cache TTL (e.g. 30s)")
+	fmt.Fprintln(os.Stderr, "  -cache-max-ttl <duration>        maximum cache TTL (e.g. 24h)")
+	fmt.Fprintln(os.Stderr, "  -cache-negative-max-ttl <duration>")
+	fmt.Fprintln(os.Stderr, "                                   maximum TTL of NXDOMAIN, NODATA responses")
+	fmt.Fprintln(os.Stderr, "  -log-level <info|error>          service log level")
+	fmt.Fprintln(os.Stderr, "Without a command, SecureDNS runs the DNS service (in the console if not started as a service).")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  SecureDNS config export [file]   export the running configuration")
+	fmt.Fprintln(os.Stderr, "  SecureDNS config import <file>   import a configuration (restart required)")
+	fmt.Fprintln(os.Stderr, "  SecureDNS backup                 create a backup now")
+	fmt.Fprintln(os.Stderr, "  SecureDNS backup list            list backups")
+	fmt.Fprintln(os.Stderr, "  SecureDNS restore <file>         restore a backup (restart required)")
+	fmt.Fprintln(os.Stderr, "  SecureDNS query <name> [type] [@server]")
+	fmt.Fprintln(os.Stderr, "                                   query the running service (default),")
+	fmt.Fprintln(os.Stderr, "                                   or an upstream directly (@<name> or @<url>)")
+	fmt.Fprintln(os.Stderr, "  SecureDNS cache flush [domain]   flush the cache, or the domain and its subdomains")
+	fmt.Fprintln(os.Stderr, "  SecureDNS reload                 reload the configuration file")
+}
+
+// apiURL returns the URL of path on the local API of the running service,
+// and the API token.
+func apiURL(path string) (string, string, error) {
+	cfg, err := loadServiceConfig()
+	if err != nil {
+		return "", "", err
+	}
+	if !cfg.API.Enabled {
+		return "", "", newErr("API server is disabled in " + configPath())
+	}
+
+	host, port, err := net.SplitHostPort(cfg.API.Listen)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	token, err := apiToken(cfg.API, false)
+	if err != nil {
+		return "", "", newErr("Can't read the API token: " + err.Error())
+	}
+	return "http://" + net.JoinHostPort(host, port) + path, token, nil
+}
+
+// dnsServerAddr returns the address of the DNS server of the running service.
+func dnsServerAddr() (string, error) {
+	cfg, err := loadServiceConfig()
+	if err != nil {
+		return "", err
+	}
+
+	host, port, err := net.SplitHostPort(cfg.DNS.Listen[0])
+	if err != nil {
+		return "", err
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// apiCall sends a request to the local API and returns the response body.
+func apiCall(method, path string, body []byte) ([]byte, error) {
+	url, token, err := apiURL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if path == "/api/config" && body != nil {
+		req.Header.Set("Content-Type", API_CONFIG_CONTENT_TYPE)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newErr(resp.Status + ": " + string(bytes.TrimSpace(respBody)))
+	}
+	return respBody, nil
+}
+
+func cliConfig(args []string) error {
+	if len(args) < 1 {
+		printUsage()
+		return newErr("missing config command")
+	}
+
+	switch args[0] {
+	case "export":
+		data, err := apiCall(http.MethodGet, "/api/config", nil)
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			return ioutil.WriteFile(args[1], data, 0644)
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+
+	case "import":
+		if len(args) < 2 {
+			return newErr("missing config file")
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		resp, err := apiCall(http.MethodPut, "/api/config", data)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(resp)
+		return err
+	}
+
+	printUsage()
+	return newErr("unknown config command: " + args[0])
+}
+
+func cliBackup(args []string) error {
+	if len(args) > 0 && args[0] == "list" {
+		// 서비스가 실행 중이 아니어도 목록을 볼 수 있도록 직접 읽는다.
+		cfg, err := loadServiceConfig()
+		if err != nil {
+			return err
+		}
+		list, err := ListBackups(resolveAppPath(cfg.Backup.Dir))
+		if err != nil {
+			return err
+		}
+		for _, p := range list {
+			fmt.Println(p)
+		}
+		return nil
+	}
+
+	resp, err := apiCall(http.MethodPost, "/api/backup", nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(resp)
+	return err
+}
+
+func cliCache(args []string) error {
+	if len(args) < 1 || args[0] != "flush" {
+		printUsage()
+		return newErr("unknown cache command")
+	}
+
+	path := "/api/cache/flush"
+	if len(args) > 1 {
+		path += "?domain=" + url.QueryEscape(args[1])
+	}
+	resp, err := apiCall(http.MethodPost, path, nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(resp)
+	return err
+}
+
+func cliReload() error {
+	resp, err := apiCall(http.MethodPost, "/api/reload", nil)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(resp)
+	return err
+}
+
+// cliRestore restores the backup files directly, so that a broken
+// configuration can be restored while the service can't start.
+func cliRestore(args []string) error {
+	if len(args) < 1 {
+		return newErr("missing backup file")
+	}
+
+	restored, err := RestoreBackup(args[0], confirmRestore)
+	for _, p := range restored {
+		fmt.Println("restored:", p)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Restart the SecureDNS service to apply the restored settings.")
+	return nil
+}
+
+// confirmRestore asks whether to restore a file outside the program directory.
+func confirmRestore(path string) bool {
+	fmt.Printf("%s is outside the program directory. Restore it? [y/N] ", path)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// cliQuery sends a query and prints the response like dig.
+// 업스트림을 지정하면 서비스와 같은 클라이언트 코드로 직접 질의한다. (캐시를 거치지 않음)
+func cliQuery(args []string) error {
+	var name, server string
+	qtype := dns.TypeA
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			server = arg[1:]
+		case name == "":
+			name = arg
+		default:
+			t, ok := dns.StringToType[strings.ToUpper(arg)]
+			if !ok {
+				return newErr("unknown query type: " + arg)
+			}
+			qtype = t
+		}
+	}
+	if name == "" {
+		printUsage()
+		return newErr("missing name")
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+
+	var resp *dns.Msg
+	var err error
+	start := time.Now()
+
+	if server == "" {
+		if server, err = dnsServerAddr(); err != nil {
+			return err
+		}
+		resp, _, err = new(dns.Client).Exchange(r, server)
+	} else {
+		url := server
+		if !strings.Contains(server, "://") {
+			cfg, err := loadServiceConfig()
+			if err != nil {
+				return err
+			}
+			url = ""
+			for _, sc := range cfg.Upstream.Servers {
+				if sc.Name == server {
+					url = sc.URL
+				}
+			}
+			if url == "" {
+				return newErr("unknown upstream: " + server)
+			}
+		}
+		server = url
+		resp, err = exchangeURL(url, r, (&net.Dialer{Timeout: 10 * time.Second}).DialContext)
+	}
+	elapsed := time.Since(start)
+
+	if err != nil {
+		return err
+	}
+
+	size := 0
+	if wire, err := resp.Pack(); err == nil {
+		size = len(wire)
+	}
+	fmt.Println(resp.String())
+	fmt.Printf(";; Query time: %d msec\n", elapsed/time.Millisecond)
+	fmt.Printf(";; SERVER: %s\n", server)
+	fmt.Printf(";; WHEN: %s\n", start.Format(time.RFC1123Z))
+	fmt.Printf(";; MSG SIZE  rcvd: %d\n", size)
+	return nil
+}
+
+// runCLI runs a command and returns the process exit code.
+func runCLI(args []string) int {
+	var err error
+
+	switch args[0] {
+	case "config":
+		err = cliConfig(args[1:])
+	case "backup":
+		err = cliBackup(args[1:])
+	case "restore":
+		err = cliRestore(args[1:])
+	case "query":
+		err = cliQuery(args[1:])
+	case "cache":
+		err = cliCache(args[1:])
+	case "reload":
+		err = cliReload()
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		printUsage()
+		err = newErr("unknown command: " + args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
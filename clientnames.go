@@ -0,0 +1,95 @@
+package main
+
+// Client names for the query log and statistics.
+//
+// 설정한 이름(IP, MAC 주소, 기기 id)을 먼저 사용하고, learn_names = true 이면
+// LAN 클라이언트 주소의 PTR 레코드에서 이름을 배운다. PTR 쿼리는 서비스 자신이 응답하므로
+// [local], [hosts] 레코드나 공유기로 전달한 역방향 zone([[forward]])의 DHCP 이름이 사용된다.
+// 공인 주소의 PTR은 업스트림으로 보내지 않는다.
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const CLIENT_NAME_TTL = 1 * time.Hour
+const CLIENT_NAME_RETRY = 10 * time.Minute // after a failed PTR lookup
+
+type ClientNames struct {
+	names   map[string]string // IP, MAC address or device id -> name
+	learned *cache.Cache      // IP -> name learned from PTR. "": lookup failed or started
+	resolve func(*dns.Msg) *dns.Msg
+}
+
+// NewClientNames creates the registry. resolve answers the PTR queries;
+// nil if names are not learned.
+func NewClientNames(cfgs []ClientNameConfig, resolve func(*dns.Msg) *dns.Msg) (*ClientNames, error) {
+	cn := &ClientNames{
+		names:   map[string]string{},
+		learned: cache.New(CLIENT_NAME_TTL, 10*time.Minute),
+		resolve: resolve,
+	}
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, newErr("Client name of " + strings.Join(c.IDs, ", ") + " is empty.")
+		}
+		for _, id := range c.IDs {
+			if ip := net.ParseIP(id); ip != nil {
+				id = ip.String()
+			} else if mac, err := net.ParseMAC(id); err == nil {
+				id = mac.String()
+			}
+			cn.names[id] = c.Name
+		}
+	}
+	return cn, nil
+}
+
+// Lookup returns the name of the client, or "".
+// An unknown LAN address starts a PTR lookup in the background.
+func (cn *ClientNames) Lookup(c *clientID) string {
+	for _, id := range []string{c.Device, c.MAC, c.IP} {
+		if name, ok := cn.names[id]; ok && id != "" {
+			return name
+		}
+	}
+	if cn.resolve == nil {
+		return ""
+	}
+
+	ip := net.ParseIP(c.IP)
+	if ip == nil || !(ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+		return ""
+	}
+	if name, ok := cn.learned.Get(c.IP); ok {
+		return name.(string)
+	}
+	if cn.learned.Add(c.IP, "", CLIENT_NAME_RETRY) == nil {
+		go cn.learn(c.IP)
+	}
+	return ""
+}
+
+func (cn *ClientNames) learn(ip string) {
+	rev, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(rev, dns.TypePTR)
+
+	m := cn.resolve(q)
+	if m == nil || m.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, rr := range m.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			cn.learned.Set(ip, strings.TrimSuffix(ptr.Ptr, "."), CLIENT_NAME_TTL)
+			return
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+// Coalescing of concurrent identical upstream queries.
+//
+// 캐시에 없는 같은 이름을 여러 클라이언트가 동시에 질의하면, 업스트림에는 하나의 쿼리만
+// 보내고 기다리던 쿼리는 그 응답을 함께 사용한다. (key: 캐시 key)
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+type coalescedCall struct {
+	done     chan struct{}
+	m        *dns.Msg
+	err      error
+	upstream string
+	ede      *extendedError
+}
+
+type queryCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{calls: map[string]*coalescedCall{}}
+}
+
+// Do runs query once for the concurrent calls with the same key.
+// The callers that waited get a copy of the response. shared: the caller waited.
+func (c *queryCoalescer) Do(key string, info *queryInfo, query func() (*dns.Msg, error)) (m *dns.Msg, shared bool, err error) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if call.upstream != "" {
+			info.upstream = call.upstream
+		}
+		if call.ede != nil {
+			info.ede = call.ede
+		}
+		if call.err != nil {
+			return nil, true, call.err
+		}
+		return call.m.Copy(), true, nil
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.m, call.err = query()
+	if call.m != nil {
+		// 기다리던 쿼리가 복사하기 전에 바뀌지 않도록 따로 보관한다.
+		m, call.m = call.m, call.m.Copy()
+	}
+	call.upstream, call.ede = info.upstream, info.ede
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+	return m, false, call.err
+}
@@ -0,0 +1,105 @@
+package main
+
+// Adaptive (AIMD) concurrency limit toward an upstream.
+//
+// 업스트림이 timeout, 429, 5xx로 응답하면 동시에 보낼 수 있는 쿼리 수(window)를 절반으로
+// 줄이고(multiplicative decrease), 성공하면 조금씩 늘린다(additive increase).
+// window가 가득 차면 쿼리는 wait 동안 기다린 후 실패한다.
+// 어려움을 겪는 업스트림에 모든 쿼리를 계속 보내지 않고 천천히 회복시킨다.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const AIMD_DECREASE_INTERVAL = 1 * time.Second // at most one decrease per interval
+
+type aimdLimiter struct {
+	cfg ConcurrencyConfig
+
+	mu           sync.Mutex
+	limit        float64
+	inflight     int
+	lastDecrease time.Time
+	released     chan struct{} // closed and replaced on every release
+}
+
+func newAIMDLimiter(cfg ConcurrencyConfig) *aimdLimiter {
+	return &aimdLimiter{
+		cfg:      cfg,
+		limit:    float64(cfg.Initial),
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire waits for a free slot in the window. false: timed out
+func (l *aimdLimiter) Acquire() bool {
+	deadline := time.Now().Add(l.cfg.Wait.Duration)
+	for {
+		l.mu.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.mu.Unlock()
+			return true
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false
+		}
+		select {
+		case <-released:
+		case <-time.After(wait):
+			return false
+		}
+	}
+}
+
+// Release frees the slot and adjusts the window with the result of the query.
+func (l *aimdLimiter) Release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	switch {
+	case congested(err):
+		if time.Since(l.lastDecrease) >= AIMD_DECREASE_INTERVAL {
+			l.limit /= 2
+			l.lastDecrease = time.Now()
+		}
+	case err == nil:
+		l.limit += 1 / l.limit
+	}
+	if l.limit < float64(l.cfg.Min) {
+		l.limit = float64(l.cfg.Min)
+	}
+	if l.limit > float64(l.cfg.Max) {
+		l.limit = float64(l.cfg.Max)
+	}
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *aimdLimiter) state() (limit int, inflight int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit), l.inflight
+}
+
+// congested reports whether err means the upstream is overloaded: timeout, 429 or 5xx.
+func congested(err error) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*DohError); ok {
+		return e.timeout || e.status == 429 || e.status >= 500
+	}
+	if e, ok := err.(net.Error); ok {
+		return e.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/miekg/dns"
+)
+
+// 설정 파일은 실행 파일과 같은 디렉토리에 위치한다.
+const CONFIG_FILE = "sec-dns.toml"
+
+type Config struct {
+	DNS       DNSServerConfig `toml:"dns"`
+	API       APIConfig       `toml:"api"`
+	Metrics   MetricsConfig   `toml:"metrics"`
+	QueryLog  QueryLogConfig  `toml:"querylog"`
+	Log       LogConfig       `toml:"log"`
+	GeoIP     GeoIPConfig     `toml:"geoip"`
+	Upstream  UpstreamConfig  `toml:"upstream"`
+	Firewall  FirewallConfig  `toml:"firewall"`
+	Allowlist AllowlistConfig `toml:"allowlist"`
+	Clients   ClientsConfig   `toml:"clients"`
+
+	DoTServer LocalServerConfig `toml:"dot_server"`
+	DoHServer LocalServerConfig `toml:"doh_server"`
+
+	Schedule []ScheduleConfig  `toml:"schedule"`
+	Backup   BackupConfig      `toml:"backup"`
+	Quotas   []QuotaRuleConfig `toml:"quota"`
+	Canary   CanaryConfig      `toml:"canary"`
+
+	SpecialUse SpecialUseConfig `toml:"special_use"`
+	Tunneling  TunnelingConfig  `toml:"tunneling"`
+	DGA        DGAConfig        `toml:"dga"`
+
+	IPSets     []IPSetConfig    `toml:"ipset"`
+	Blocking   BlockingConfig   `toml:"blocking"`
+	SafeSearch SafeSearchConfig `toml:"safesearch"`
+	Rebinding  RebindConfig     `toml:"rebinding"`
+	Sinkhole   SinkholeConfig   `toml:"sinkhole"`
+
+	Local         LocalConfig           `toml:"local"`
+	ClientRecords []ClientRecordsConfig `toml:"client_records"`
+
+	RRL       RRLConfig       `toml:"rrl"`
+	RateLimit RateLimitConfig `toml:"ratelimit"`
+	Watchdog  WatchdogConfig  `toml:"watchdog"`
+	Audit     AuditConfig     `toml:"audit"`
+	Cache     CacheConfig     `toml:"cache"`
+
+	Blocklists []BlocklistConfig `toml:"blocklist"`
+	Offline    OfflineConfig     `toml:"offline"`
+	Views      []ViewConfig      `toml:"view"`
+	StubZones  []StubZoneConfig  `toml:"stub_zone"`
+	Forwards   []ForwardConfig   `toml:"forward"`
+	Search     SearchConfig      `toml:"search"`
+	NXHijack   NXHijackConfig    `toml:"nxdomain_hijack"`
+	Chaos      ChaosConfig       `toml:"chaos"`
+	Hosts      HostsConfig       `toml:"hosts"`
+	DDR        DDRConfig         `toml:"ddr"`
+	Policy     PolicyConfig      `toml:"policy"`
+	Fault      FaultConfig       `toml:"fault_injection"`
+	DNSSEC     DNSSECConfig      `toml:"dnssec"`
+}
+
+// DNS server (UDP, TCP)
+type DNSServerConfig struct {
+	Listen       []string `toml:"listen"`        // ip:port. ":53": all interfaces
+	TCP          bool     `toml:"tcp"`           // TCP listener next to UDP
+	TCPKeepAlive duration `toml:"tcp_keepalive"` // idle timeout, advertised with edns-tcp-keepalive
+}
+
+// Local control/query API (dashboard, CLI)
+type APIConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Listen  string `toml:"listen"`
+	Token   string `toml:"token"` // bearer token of the changing requests. "": generated in API_TOKEN_FILE
+}
+
+// In-memory query log
+type QueryLogConfig struct {
+	Size int `toml:"size"` // max number of stored entries
+
+	// per-query log file (querylog_file.go). "": disabled
+	File       string `toml:"file"`        // relative to the executable's directory
+	Format     string `toml:"format"`      // text, json
+	MaxSize    int    `toml:"max_size"`    // megabytes
+	MaxBackups int    `toml:"max_backups"` // rotated files kept
+	MaxAge     int    `toml:"max_age"`     // days
+	Compress   bool   `toml:"compress"`    // gzip rotated files
+}
+
+// Service log file
+type LogConfig struct {
+	File       string `toml:"file"`        // relative to the executable's directory
+	Level      string `toml:"level"`       // info, error
+	MaxSize    int    `toml:"max_size"`    // megabytes
+	MaxBackups int    `toml:"max_backups"` // rotated files kept
+	MaxAge     int    `toml:"max_age"`     // days
+	Compress   bool   `toml:"compress"`    // gzip the rotated files
+}
+
+// GeoIP annotation of answers in the query log
+type GeoIPConfig struct {
+	Enabled   bool     `toml:"enabled"`
+	Databases []string `toml:"databases"` // mmdb files, relative to the executable's directory
+}
+
+// DoH upstream
+type UpstreamConfig struct {
+	Host      string   `toml:"host"`       // DoH host name to bootstrap and rank. "": host of the first upstream
+	HostAddrs []string `toml:"host_addrs"` // static addresses of the DoH host, no bootstrap query
+	Bootstrap []string `toml:"bootstrap"`  // plain DNS servers (ip:port, BOOTSTRAP_SYSTEM) for the DoH host address, in order
+
+	MaxAttempts int    `toml:"max_attempts"` // upstreams tried per query (failover). 1: no failover
+	Strategy    string `toml:"strategy"`     // load balancing, see balance.go
+	Race        int    `toml:"race"`         // upstreams queried at the same time. 0, 1: off
+	CAFile      string `toml:"ca_file"`      // PEM CA bundle for the upstream certificates. "": system CA
+	Padding     bool   `toml:"padding"`      // EDNS(0) padding of the queries (RFC 7830)
+	ECS         string `toml:"ecs"`          // EDNS Client Subnet: strip, forward, set (see ecs.go)
+	ECSSubnet   string `toml:"ecs_subnet"`   // for ecs = "set". e.g. "203.0.113.0/24"
+
+	ProbeInterval        duration `toml:"probe_interval"`         // endpoint latency re-evaluation
+	NetworkCheckInterval duration `toml:"network_check_interval"` // local network change detection
+
+	SLO         SLOConfig              `toml:"slo"`
+	Concurrency ConcurrencyConfig      `toml:"concurrency"`
+	HealthCheck HealthCheckConfig      `toml:"health_check"`
+	HTTP        HTTPClientConfig       `toml:"http"`
+	Servers     []UpstreamServerConfig `toml:"servers"`
+}
+
+type UpstreamServerConfig struct {
+	Name string `toml:"name"`
+	URL  string `toml:"url"`
+
+	// per-upstream SLO. zero value: use [upstream.slo]
+	LatencyP95 duration `toml:"latency_p95"`
+	ErrorRate  float64  `toml:"error_rate"`
+
+	Weight int `toml:"weight"` // for the weighted strategy. default 1
+
+	SPKIPins []string `toml:"spki_pins"` // base64 SHA-256 of a SubjectPublicKeyInfo in the chain
+
+	Addrs []string `toml:"addrs"` // static addresses of the server host (ODoH: the proxy)
+}
+
+// HTTP client of the DoH upstreams
+type HTTPClientConfig struct {
+	MaxIdleConns    int      `toml:"max_idle_conns"`    // idle connections kept per upstream
+	IdleConnTimeout duration `toml:"idle_conn_timeout"` // idle connections are closed after this
+	Timeout         duration `toml:"timeout"`           // per request, including the connection
+	HTTP3           bool     `toml:"http3"`             // HTTP/3 first, falling back to HTTP/2
+	Method          string   `toml:"method"`            // DOH_METHOD_POST, DOH_METHOD_GET
+
+	LegacyContentType bool `toml:"legacy_content_type"` // application/dns-udpwireformat for old servers
+}
+
+// Upstream SLO and demotion hysteresis
+type SLOConfig struct {
+	LatencyP95       duration `toml:"latency_p95"`
+	ErrorRate        float64  `toml:"error_rate"` // 0.0 ~ 1.0
+	EvaluateInterval duration `toml:"evaluate_interval"`
+	MinSamples       int      `toml:"min_samples"`   // per window
+	DemoteAfter      int      `toml:"demote_after"`  // consecutive violating windows
+	PromoteAfter     int      `toml:"promote_after"` // consecutive healthy windows
+}
+
+// Active upstream health check
+type HealthCheckConfig struct {
+	Enabled      bool     `toml:"enabled"`
+	Interval     duration `toml:"interval"`
+	Name         string   `toml:"name"` // query
+	Type         string   `toml:"type"`
+	FailAfter    int      `toml:"fail_after"`    // consecutive failures to mark down
+	RecoverAfter int      `toml:"recover_after"` // consecutive successes to mark up
+}
+
+// Adaptive (AIMD) concurrency limit per upstream
+type ConcurrencyConfig struct {
+	Enabled bool     `toml:"enabled"`
+	Initial int      `toml:"initial"` // initial window (queries in flight)
+	Min     int      `toml:"min"`
+	Max     int      `toml:"max"`
+	Wait    duration `toml:"wait"` // max wait for a free slot
+}
+
+// Default-deny DNS firewall
+type FirewallConfig struct {
+	DefaultDeny bool     `toml:"default_deny"`
+	Allow       []string `toml:"allow"`       // domain names. subdomains are also allowed
+	AllowFiles  []string `toml:"allow_files"` // one domain per line
+}
+
+// Names never blocked by the filters
+type AllowlistConfig struct {
+	Domains []string `toml:"domains"` // example.com, *.example.com (subdomains)
+	Files   []string `toml:"files"`   // one rule per line
+}
+
+// Client identification
+type ClientsConfig struct {
+	IdentifyByMAC   bool     `toml:"identify_by_mac"`  // ARP/NDP lookup
+	NeighborRefresh duration `toml:"neighbor_refresh"` // neighbor table refresh interval
+
+	Devices []DeviceConfig `toml:"devices"`
+
+	Names      []ClientNameConfig `toml:"names"`
+	LearnNames bool               `toml:"learn_names"` // PTR lookup of LAN addresses
+}
+
+// Client name shown in the query log and statistics
+type ClientNameConfig struct {
+	Name string   `toml:"name"`
+	IDs  []string `toml:"ids"` // IP, MAC address or device id
+}
+
+// Device identified by DoT server name or DoH path
+type DeviceConfig struct {
+	ID      string `toml:"id"`
+	Profile string `toml:"profile"`
+}
+
+// Local DoT/DoH server for downstream clients
+type LocalServerConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	Listen   string `toml:"listen"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	Hostname string `toml:"hostname"` // device names: <device>.<hostname>
+	Path     string `toml:"path"`     // DoH only. device paths: <path>/<device>
+
+	KeepAlive duration `toml:"keepalive"` // DoT only. idle timeout advertised with edns-tcp-keepalive
+
+	// client authentication
+	ClientCAFile string   `toml:"client_ca_file"` // require client certificates issued by this CA
+	AuthTokens   []string `toml:"auth_tokens"`    // DoH only. accepted bearer tokens
+}
+
+// Scheduled configuration change
+type ScheduleConfig struct {
+	Name   string   `toml:"name"`
+	Cron   string   `toml:"cron"` // minute hour day-of-month month day-of-week
+	Action string   `toml:"action"`
+	Args   []string `toml:"args"`
+}
+
+// Automatic backups
+type BackupConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	Interval duration `toml:"interval"`
+	Dir      string   `toml:"dir"`  // relative to the executable's directory
+	Keep     int      `toml:"keep"` // number of backups to keep. 0: keep all
+}
+
+// Query quota
+type QuotaRuleConfig struct {
+	Name          string   `toml:"name"`
+	Scope         string   `toml:"scope"`   // global, client, profile
+	Profile       string   `toml:"profile"` // scope = profile. empty: every profile
+	Period        string   `toml:"period"`  // hour, day
+	Limit         int      `toml:"limit"`
+	Action        string   `toml:"action"` // refuse, throttle, alert
+	ThrottleDelay duration `toml:"throttle_delay"`
+}
+
+// Canary domains answered with NXDOMAIN
+type CanaryConfig struct {
+	Enabled bool     `toml:"enabled"`
+	Domains []string `toml:"domains"`
+}
+
+// Special-use domains (RFC 6761) answered locally
+type SpecialUseConfig struct {
+	Enabled bool     `toml:"enabled"`
+	Forward []string `toml:"forward"` // special-use zones to forward anyway
+}
+
+// Search-domain expansion of single-label names
+type SearchConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	Suffixes []string `toml:"suffixes"` // tried in order
+}
+
+// CHAOS class server identification (version.bind, id.server, hostname.bind)
+type ChaosConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	Action   string `toml:"action"` // answer, refuse
+	Version  string `toml:"version"`
+	ID       string `toml:"id"`       // id.server. empty: computer name
+	Hostname string `toml:"hostname"` // hostname.bind. empty: id
+}
+
+// DNS tunneling detection
+type TunnelingConfig struct {
+	Enabled          bool     `toml:"enabled"`
+	Action           string   `toml:"action"`            // flag, block
+	Threshold        float64  `toml:"threshold"`         // score 0 ~ 100
+	UniqueSubdomains int      `toml:"unique_subdomains"` // per minute, for the full score
+	QueryRate        int      `toml:"query_rate"`        // per minute, for the full score
+	Ignore           []string `toml:"ignore"`            // domains never scored
+}
+
+// DGA domain detection
+type DGAConfig struct {
+	Enabled   bool     `toml:"enabled"`
+	Action    string   `toml:"action"`     // alert, block
+	Threshold float64  `toml:"threshold"`  // score 0 ~ 100
+	ModelFile string   `toml:"model_file"` // bigram model (JSON). empty: built-in
+	Ignore    []string `toml:"ignore"`
+}
+
+// Resolved-IP set exported for firewall integration
+type IPSetConfig struct {
+	Name        string   `toml:"name"`
+	Domains     []string `toml:"domains"`      // subdomains are also included
+	DomainFiles []string `toml:"domain_files"` // one domain per line
+	MinTTL      duration `toml:"min_ttl"`      // minimum lifetime of an address in the set
+	Format      string   `toml:"format"`       // nftables, ipset, json. empty: API only
+	File        string   `toml:"file"`         // export file, relative to the executable's directory
+	Table       string   `toml:"table"`        // nftables only. default "inet filter"
+}
+
+// Answer for blocked names (see blocking.go)
+type BlockingConfig struct {
+	Mode string `toml:"mode"` // refused, nxdomain, null_ip, custom_ip
+	IPv4 string `toml:"ipv4"` // custom_ip
+	IPv6 string `toml:"ipv6"` // custom_ip. empty: AAAA answered with no records
+}
+
+// SafeSearch enforcement of search sites
+type SafeSearchConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	Services []string `toml:"services"` // google, bing, youtube, duckduckgo
+	YouTube  string   `toml:"youtube"`  // strict, moderate
+}
+
+// DNS rebinding protection (see rebind.go)
+type RebindConfig struct {
+	Enabled bool     `toml:"enabled"`
+	Action  string   `toml:"action"` // strip, block
+	Allow   []string `toml:"allow"`  // names allowed to have LAN addresses
+}
+
+// Sinkhole answers for blocked names and the block page
+type SinkholeConfig struct {
+	Enabled bool   `toml:"enabled"`
+	IPv4    string `toml:"ipv4"` // address of this computer
+	IPv6    string `toml:"ipv6"` // empty: AAAA answered with no records
+
+	// block page
+	Listen        string   `toml:"listen"`     // HTTP. empty: disabled
+	ListenTLS     string   `toml:"listen_tls"` // HTTPS. empty: disabled
+	CertFile      string   `toml:"cert_file"`
+	KeyFile       string   `toml:"key_file"`
+	Password      string   `toml:"password"` // temporary allow from the HTTPS block page. empty: disabled
+	AllowDuration duration `toml:"allow_duration"`
+}
+
+// Local static records
+type LocalConfig struct {
+	Records []string `toml:"records"` // zone file format. "*.<domain>" for wildcards
+}
+
+// OS hosts file imported as local records
+type HostsConfig struct {
+	Enabled        bool     `toml:"enabled"`
+	File           string   `toml:"file"` // empty: the system hosts file
+	ReloadInterval duration `toml:"reload_interval"`
+}
+
+// Static records for specific clients
+type ClientRecordsConfig struct {
+	Name     string   `toml:"name"`
+	Clients  []string `toml:"clients"` // IP, network (CIDR), MAC or device id
+	Profiles []string `toml:"profiles"`
+	Records  []string `toml:"records"` // zone file format
+}
+
+// Response rate limiting (UDP)
+type RRLConfig struct {
+	Enabled            bool     `toml:"enabled"`
+	ResponsesPerSecond float64  `toml:"responses_per_second"` // per prefix, name and type. 0: unlimited
+	NXDomainsPerSecond float64  `toml:"nxdomains_per_second"` // per prefix and zone
+	ErrorsPerSecond    float64  `toml:"errors_per_second"`    // per prefix
+	Window             int      `toml:"window"`               // seconds of debt an account can build up
+	Slip               int      `toml:"slip"`                 // every slip-th limited response is truncated. 0: drop all
+	IPv4Prefix         int      `toml:"ipv4_prefix"`
+	IPv6Prefix         int      `toml:"ipv6_prefix"`
+	Exempt             []string `toml:"exempt"`      // networks (CIDR) never limited
+	MinimalANY         bool     `toml:"minimal_any"` // RFC 8482 answer to ANY over UDP
+}
+
+// Per-client query rate limiting (token bucket)
+type RateLimitConfig struct {
+	Enabled          bool     `toml:"enabled"`
+	QueriesPerSecond float64  `toml:"queries_per_second"` // per client IP
+	Burst            int      `toml:"burst"`              // queries allowed at once
+	Action           string   `toml:"action"`             // refuse, drop
+	Exempt           []string `toml:"exempt"`             // networks (CIDR) never limited
+}
+
+// DNS hijack watchdog
+type WatchdogConfig struct {
+	Enabled   bool     `toml:"enabled"`
+	Interval  duration `toml:"interval"`
+	Reference string   `toml:"reference"` // independent server: DoH URL or DNS server address (ip:port)
+	Sentinels []string `toml:"sentinels"`
+	Threshold float64  `toml:"threshold"` // ratio of divergent sentinels, 0.0 ~ 1.0
+	Rounds    int      `toml:"rounds"`    // consecutive divergent checks before alerting
+	Action    string   `toml:"action"`    // alert, failover
+}
+
+// Consistency audit against a secondary upstream
+type AuditConfig struct {
+	Enabled    bool    `toml:"enabled"`
+	Upstream   string  `toml:"upstream"`    // name in [[upstream.servers]] or DoH URL
+	SampleRate float64 `toml:"sample_rate"` // ratio of mirrored queries, 0.0 ~ 1.0
+}
+
+// Response cache
+type CacheConfig struct {
+	MinTTL duration `toml:"min_ttl"` // responses are cached for the record TTL within min_ttl ~ max_ttl
+	MaxTTL duration `toml:"max_ttl"`
+
+	RewriteTTL bool `toml:"rewrite_ttl"` // also rewrite the TTLs of the responses to min_ttl ~ max_ttl
+
+	NegativeMaxTTL duration `toml:"negative_max_ttl"` // NXDOMAIN, NODATA
+
+	ServeStale  bool     `toml:"serve_stale"`   // answer with expired responses if the upstream fails
+	StaleMaxAge duration `toml:"stale_max_age"` // how long expired responses are kept
+
+	Prefetch        bool `toml:"prefetch"`          // refresh popular responses before they expire
+	PrefetchMinHits int  `toml:"prefetch_min_hits"` // hits within the TTL
+
+	Persist bool `toml:"persist"` // saved to CACHE_FILE on stop, loaded on start
+
+	MaxEntries int      `toml:"max_entries"`
+	MaxSize    int      `toml:"max_size"` // estimated bytes of the cached messages
+	Pinned     []string `toml:"pinned"`   // names whose last good answers never expire
+}
+
+// Remote blocklist
+type BlocklistConfig struct {
+	Name     string   `toml:"name"`
+	URL      string   `toml:"url"`       // full list, one domain per line
+	File     string   `toml:"file"`      // local list instead of url
+	Format   string   `toml:"format"`    // domains (default), hosts
+	DeltaURL string   `toml:"delta_url"` // changes since {seq}. empty: full downloads only
+	Interval duration `toml:"interval"`  // default 24h
+	Disabled bool     `toml:"disabled"`  // kept up to date but not matched. (blocklist.enable schedule)
+}
+
+// Offline mode
+type OfflineConfig struct {
+	Enabled       bool     `toml:"enabled"`
+	Failures      int      `toml:"failures"`       // consecutive upstream failures to go offline
+	ProbeInterval duration `toml:"probe_interval"` // upstream check while offline
+	StaleMaxAge   duration `toml:"stale_max_age"`  // how long responses are kept for offline use
+}
+
+// View: local records and policies for a listener, interface or client network
+type ViewConfig struct {
+	Name       string   `toml:"name"`
+	Listeners  []string `toml:"listeners"`  // udp, tcp, dot, doh. empty: every listener
+	Interfaces []string `toml:"interfaces"` // clients in the networks of these interfaces
+	Networks   []string `toml:"networks"`   // client networks (CIDR) or addresses. no interfaces and networks: every client
+	Records    []string `toml:"records"`    // local records of the view (zone file format)
+	HideLocal  bool     `toml:"hide_local"` // don't answer from [local] and [[client_records]]
+	Refuse     []string `toml:"refuse"`     // domains refused in the view
+	Blocklists []string `toml:"blocklists"` // blocklists applied in the view. omitted: every blocklist
+	Upstreams  []string `toml:"upstreams"`  // upstream names used in the view. omitted: every upstream
+	Log        string   `toml:"log"`        // query log: all (default), blocked, none
+}
+
+// Fault injection into upstream queries (testing only)
+type FaultConfig struct {
+	Enabled      bool     `toml:"enabled"`
+	Upstreams    []string `toml:"upstreams"` // empty: every upstream
+	Latency      duration `toml:"latency"`   // added to every query
+	Jitter       duration `toml:"jitter"`    // random additional latency, up to
+	ErrorRate    float64  `toml:"error_rate"`
+	TruncateRate float64  `toml:"truncate_rate"`
+	LossRate     float64  `toml:"loss_rate"`
+	LossTimeout  duration `toml:"loss_timeout"` // wait before a lost query fails
+}
+
+// Signed remote policy for managed deployments
+type PolicyConfig struct {
+	URL       string   `toml:"url"`        // https. signature: <url>.sig
+	PublicKey string   `toml:"public_key"` // Ed25519, base64
+	Interval  duration `toml:"interval"`
+}
+
+// Discovery of Designated Resolvers (RFC 9462)
+type DDRConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	Resolver string `toml:"resolver"` // unencrypted resolver (ip or ip:port). empty: the bootstrap DNS server
+}
+
+// Upstream NXDOMAIN hijack detection
+type NXHijackConfig struct {
+	Enabled  bool     `toml:"enabled"`
+	Interval duration `toml:"interval"`
+	Probes   int      `toml:"probes"` // random names per check
+	Action   string   `toml:"action"` // alert, strip
+}
+
+// DNSSEC validation of upstream answers
+type DNSSECConfig struct {
+	Enabled      bool     `toml:"enabled"`
+	TrustAnchors []string `toml:"trust_anchors"` // DS records. empty: the root zone KSKs
+}
+
+// Stub zone sent to its authoritative servers
+type StubZoneConfig struct {
+	Zone          string   `toml:"zone"`
+	Servers       []string `toml:"servers"` // ip or ip:port
+	TSIGName      string   `toml:"tsig_name"`
+	TSIGAlgorithm string   `toml:"tsig_algorithm"` // hmac-sha256 (default), hmac-sha512, hmac-sha1, hmac-md5
+	TSIGSecret    string   `toml:"tsig_secret"`    // base64
+}
+
+// Conditional forwarding to internal DNS servers
+type ForwardConfig struct {
+	Zones   []string `toml:"zones"`   // "corp.example" or "*.corp.example": the zone and its subdomains
+	Servers []string `toml:"servers"` // ip[:port], tcp://ip[:port], upstream url, or "router"
+}
+
+// duration is a time.Duration that can be read from a TOML string ("10m", "1h30m").
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err == nil {
+		d.Duration = v
+	}
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Prometheus metrics (metrics.go)
+type MetricsConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Listen  string `toml:"listen"`
+}
+
+// DefaultConfig returns the settings used when no config file exists.
+func DefaultConfig() *Config {
+	return &Config{
+		DNS: DNSServerConfig{
+			Listen:       []string{":53"},
+			TCP:          true,
+			TCPKeepAlive: duration{10 * time.Second},
+		},
+		API: APIConfig{
+			Enabled: true,
+			Listen:  "127.0.0.1:8053",
+		},
+		Metrics: MetricsConfig{
+			Listen: "127.0.0.1:9153",
+		},
+		QueryLog: QueryLogConfig{
+			Size:       10000,
+			Format:     QUERYLOG_FORMAT_TEXT,
+			MaxSize:    10,
+			MaxBackups: 3,
+			MaxAge:     7,
+		},
+		Log: LogConfig{
+			File:       "sec-dns.log",
+			Level:      LOG_LEVEL_INFO,
+			MaxSize:    10,
+			MaxBackups: 1,
+			MaxAge:     28,
+			Compress:   false,
+		},
+		GeoIP: GeoIPConfig{
+			Enabled:   false,
+			Databases: []string{"GeoLite2-Country.mmdb", "GeoLite2-ASN.mmdb"},
+		},
+		Clients: ClientsConfig{
+			IdentifyByMAC:   false,
+			NeighborRefresh: duration{1 * time.Minute},
+		},
+		DoTServer: LocalServerConfig{
+			Enabled:   false,
+			Listen:    ":853",
+			KeepAlive: duration{2 * time.Minute},
+		},
+		DoHServer: LocalServerConfig{
+			Enabled: false,
+			Listen:  ":443",
+			Path:    "/dns-query",
+		},
+		Backup: BackupConfig{
+			Enabled:  true,
+			Interval: duration{24 * time.Hour},
+			Dir:      "backup",
+			Keep:     7,
+		},
+		Canary: CanaryConfig{
+			Enabled: true,
+			Domains: []string{"use-application-dns.net"},
+		},
+		SpecialUse: SpecialUseConfig{
+			Enabled: true,
+		},
+		Fault: FaultConfig{
+			Enabled:     false,
+			LossTimeout: duration{5 * time.Second},
+		},
+		Policy: PolicyConfig{
+			Interval: duration{1 * time.Hour},
+		},
+		Hosts: HostsConfig{
+			Enabled:        false,
+			ReloadInterval: duration{10 * time.Second},
+		},
+		Chaos: ChaosConfig{
+			Enabled: true,
+			Action:  "answer",
+			Version: "SecureDNS",
+		},
+		Search: SearchConfig{
+			Enabled:  false,
+			Suffixes: []string{"home.arpa"},
+		},
+		Tunneling: TunnelingConfig{
+			Enabled:          false,
+			Action:           "flag",
+			Threshold:        70,
+			UniqueSubdomains: 100,
+			QueryRate:        300,
+		},
+		DGA: DGAConfig{
+			Enabled:   false,
+			Action:    "alert",
+			Threshold: 65,
+		},
+		Blocking: BlockingConfig{
+			Mode: BLOCK_REFUSED,
+		},
+		SafeSearch: SafeSearchConfig{
+			Enabled:  false,
+			Services: []string{"google", "bing", "youtube", "duckduckgo"},
+			YouTube:  SAFESEARCH_YOUTUBE_STRICT,
+		},
+		Rebinding: RebindConfig{
+			Enabled: false,
+			Action:  REBIND_STRIP,
+		},
+		Sinkhole: SinkholeConfig{
+			Enabled:       false,
+			Listen:        ":80",
+			AllowDuration: duration{10 * time.Minute},
+		},
+		RRL: RRLConfig{
+			Enabled:            false,
+			ResponsesPerSecond: 5,
+			NXDomainsPerSecond: 5,
+			ErrorsPerSecond:    5,
+			Window:             15,
+			Slip:               2,
+			IPv4Prefix:         24,
+			IPv6Prefix:         56,
+			Exempt:             []string{"127.0.0.0/8", "::1/128"},
+			MinimalANY:         true,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:          false,
+			QueriesPerSecond: 20,
+			Burst:            100,
+			Action:           RATELIMIT_REFUSE,
+			Exempt:           []string{"127.0.0.0/8", "::1/128"},
+		},
+		Watchdog: WatchdogConfig{
+			Enabled:   false,
+			Interval:  duration{10 * time.Minute},
+			Reference: "9.9.9.9:53",
+			Sentinels: []string{"example.com", "dns.google", "one.one.one.one"},
+			Threshold: 0.5,
+			Rounds:    2,
+			Action:    "alert",
+		},
+		NXHijack: NXHijackConfig{
+			Enabled:  false,
+			Interval: duration{1 * time.Hour},
+			Probes:   3,
+			Action:   "alert",
+		},
+		DNSSEC: DNSSECConfig{
+			Enabled: false,
+		},
+		Audit: AuditConfig{
+			Enabled:    false,
+			SampleRate: 0.05,
+		},
+		Cache: CacheConfig{
+			MinTTL: duration{0},
+			MaxTTL: duration{24 * time.Hour},
+
+			NegativeMaxTTL: duration{1 * time.Hour},
+
+			ServeStale:  true,
+			StaleMaxAge: duration{24 * time.Hour},
+
+			Prefetch:        true,
+			PrefetchMinHits: 3,
+
+			Persist: true,
+
+			MaxEntries: 50000,
+			MaxSize:    64 << 20,
+		},
+		Offline: OfflineConfig{
+			Enabled:       true,
+			Failures:      3,
+			ProbeInterval: duration{10 * time.Second},
+			StaleMaxAge:   duration{24 * time.Hour},
+		},
+		Upstream: UpstreamConfig{
+			Padding:              true,
+			ECS:                  ECS_STRIP,
+			ProbeInterval:        duration{30 * time.Minute},
+			NetworkCheckInterval: duration{30 * time.Second},
+			SLO: SLOConfig{
+				LatencyP95:       duration{500 * time.Millisecond},
+				ErrorRate:        0.05,
+				EvaluateInterval: duration{1 * time.Minute},
+				MinSamples:       20,
+				DemoteAfter:      3,
+				PromoteAfter:     5,
+			},
+			Concurrency: ConcurrencyConfig{
+				Enabled: true,
+				Initial: 32,
+				Min:     2,
+				Max:     512,
+				Wait:    duration{2 * time.Second},
+			},
+			HealthCheck: HealthCheckConfig{
+				Enabled:      true,
+				Interval:     duration{30 * time.Second},
+				Name:         ".",
+				Type:         "NS",
+				FailAfter:    2,
+				RecoverAfter: 2,
+			},
+			HTTP: HTTPClientConfig{
+				MaxIdleConns:    HTTP_IDLE_CONNS,
+				IdleConnTimeout: duration{HTTP_IDLE_TIMEOUT},
+				Timeout:         duration{HTTP_TIMEOUT},
+				Method:          DOH_METHOD_POST,
+			},
+			Bootstrap:   []string{CLOUDFLARE_DNS, CLOUDFLARE_DNS6},
+			MaxAttempts: 3,
+			Strategy:    BALANCE_FAILOVER,
+			Servers: []UpstreamServerConfig{
+				{Name: "cloudflare", URL: CLOUDFLARE_DOH_URL},
+			},
+		},
+	}
+}
+
+// decodeOver decodes a config document over cfg.
+// toml은 이미 있는 slice의 항목 위에 값을 덮어쓰므로(문서의 [[upstream.servers]]에 name이
+// 없으면 기본값 "cloudflare"가 남는다), 값이 있는 slice는 비운 후 decode하고
+// 문서에 없는 slice만 이전 값으로 되돌린다.
+func decodeOver(cfg *Config, data string) error {
+	type savedSlice struct {
+		field reflect.Value
+		value reflect.Value
+		key   []string
+	}
+	var saved []savedSlice
+	var clear func(v reflect.Value, key []string)
+	clear = func(v reflect.Value, key []string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("toml"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			k := append(append([]string{}, key...), tag)
+			switch f := v.Field(i); f.Kind() {
+			case reflect.Struct:
+				clear(f, k)
+			case reflect.Slice:
+				if f.Len() > 0 {
+					saved = append(saved, savedSlice{f, reflect.ValueOf(f.Interface()), k})
+					f.Set(reflect.Zero(f.Type()))
+				}
+			}
+		}
+	}
+	clear(reflect.ValueOf(cfg).Elem(), nil)
+
+	md, err := toml.Decode(data, cfg)
+	if err != nil {
+		return err
+	}
+	for _, s := range saved {
+		if !md.IsDefined(s.key...) {
+			s.field.Set(s.value)
+		}
+	}
+	nameUpstreams(cfg.Upstream.Servers)
+	return nil
+}
+
+// upstreamName returns the name of an upstream without a name: the host of the url.
+func upstreamName(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return rawurl
+}
+
+// nameUpstreams gives a name to the upstreams without a name.
+// 같은 이름이 이미 있으면 순서 번호를 붙인다.
+func nameUpstreams(servers []UpstreamServerConfig) {
+	names := map[string]bool{}
+	for _, sc := range servers {
+		names[sc.Name] = true
+	}
+	for i := range servers {
+		if servers[i].Name != "" {
+			continue
+		}
+		name := upstreamName(servers[i].URL)
+		if names[name] {
+			name += "-" + strconv.Itoa(i+1)
+		}
+		names[name] = true
+		servers[i].Name = name
+	}
+}
+
+// DecodeConfig reads a config document over the default settings.
+func DecodeConfig(data string) (*Config, error) {
+	cfg := DefaultConfig()
+	if err := decodeOver(cfg, data); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Encode writes cfg as a TOML document.
+func (cfg *Config) Encode(w io.Writer) error {
+	return toml.NewEncoder(w).Encode(cfg)
+}
+
+// SaveConfig writes cfg to path.
+// 쓰기 도중 실패하더라도 기존 파일이 손상되지 않도록 임시 파일에 쓴 후 교체한다.
+func SaveConfig(path string, cfg *Config) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.Encode(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadConfig reads the config file at path over the default settings.
+// A missing file is not an error.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return cfg, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeOver(cfg, string(data)); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	if len(cfg.Upstream.Servers) == 0 {
+		return newErr("No upstream server in config.")
+	}
+	if cfg.Upstream.MaxAttempts < 1 {
+		return newErr("upstream.max_attempts must be 1 or more.")
+	}
+	if cfg.Upstream.Race < 0 {
+		return newErr("upstream.race must be 0 or more.")
+	}
+	if !validBalanceStrategy(cfg.Upstream.Strategy) {
+		return newErr("Unknown upstream strategy '" + cfg.Upstream.Strategy + "'.")
+	}
+	if len(cfg.Upstream.Bootstrap) == 0 {
+		return newErr("No bootstrap DNS server in config.")
+	}
+	for _, server := range cfg.Upstream.Bootstrap {
+		if server == BOOTSTRAP_SYSTEM {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return newErr("Invalid bootstrap DNS server '" + server + "'. (ip:port, system)")
+		}
+	}
+	if _, err := parseIPs(cfg.Upstream.HostAddrs); err != nil {
+		return newErr("upstream.host_addrs: " + err.Error())
+	}
+	if host, _ := cfg.Upstream.dohHost(); host == "" {
+		return newErr("No DoH host name. Set upstream.host.")
+	}
+	upstreamNames := map[string]bool{}
+	for _, sc := range cfg.Upstream.Servers {
+		if sc.Name == "" {
+			return newErr("Upstream server " + sc.URL + " has no name.")
+		}
+		if upstreamNames[sc.Name] {
+			return newErr("Duplicate upstream server name '" + sc.Name + "'.")
+		}
+		upstreamNames[sc.Name] = true
+		if sc.URL == "" {
+			return newErr("Upstream server '" + sc.Name + "' has no url.")
+		}
+		t, err := newTransport(sc.URL, nil, transportOptions{})
+		if err != nil {
+			return err
+		}
+		t.Close()
+		if _, err := upstreamTLSConfig(nil, sc.SPKIPins); err != nil {
+			return newErr("Upstream server '" + sc.Name + "': " + err.Error())
+		}
+		if _, err := parseIPs(sc.Addrs); err != nil {
+			return newErr("Upstream server '" + sc.Name + "': " + err.Error())
+		}
+		if len(sc.Addrs) > 0 && sc.dialHost() == "" {
+			return newErr("Upstream server '" + sc.Name + "': addrs requires a host name in the url.")
+		}
+	}
+	if h := cfg.Upstream.HTTP; h.MaxIdleConns < 1 || h.IdleConnTimeout.Duration <= 0 || h.Timeout.Duration <= 0 {
+		return newErr("upstream.http: max_idle_conns >= 1, idle_conn_timeout and timeout > 0 required.")
+	}
+	if _, err := NewECSPolicy(cfg.Upstream.ECS, cfg.Upstream.ECSSubnet); err != nil {
+		return err
+	}
+	upstreams := map[string]bool{}
+	for _, sc := range cfg.Upstream.Servers {
+		upstreams[sc.Name] = true
+	}
+	for _, v := range cfg.Views {
+		if v.Upstreams != nil && len(v.Upstreams) == 0 {
+			return newErr("View '" + v.Name + "' has no upstream.")
+		}
+		for _, name := range v.Upstreams {
+			if !upstreams[name] {
+				return newErr("View '" + v.Name + "': unknown upstream " + name)
+			}
+		}
+	}
+	if cfg.Log.Level != LOG_LEVEL_INFO && cfg.Log.Level != LOG_LEVEL_ERROR {
+		return newErr("Unknown log.level '" + cfg.Log.Level + "'. (info, error)")
+	}
+	if cfg.Log.File == "" || cfg.Log.MaxSize < 1 {
+		return newErr("log: file and max_size >= 1 required.")
+	}
+	if f := cfg.QueryLog.Format; f != QUERYLOG_FORMAT_TEXT && f != QUERYLOG_FORMAT_JSON {
+		return newErr("Unknown querylog.format '" + f + "'. (text, json)")
+	}
+	if cfg.QueryLog.File != "" && cfg.QueryLog.MaxSize < 1 {
+		return newErr("querylog.max_size must be 1 or more.")
+	}
+	if c := cfg.Sinkhole; c.Enabled && c.Password != "" && c.ListenTLS == "" {
+		return newErr("sinkhole.password requires listen_tls. (the password is sent in clear text over HTTP)")
+	}
+	if _, err := NewBlockResponse(cfg.Blocking); err != nil {
+		return err
+	}
+	if _, err := NewSafeSearch(cfg.SafeSearch); err != nil {
+		return err
+	}
+	if _, err := NewRebindProtection(cfg.Rebinding); err != nil {
+		return err
+	}
+	if m := cfg.Upstream.HTTP.Method; m != DOH_METHOD_POST && m != DOH_METHOD_GET {
+		return newErr("Unknown upstream.http.method '" + m + "'. (post, get)")
+	}
+	if c := cfg.Upstream.Concurrency; c.Enabled && (c.Min < 1 || c.Max < c.Min || c.Initial < c.Min || c.Initial > c.Max) {
+		return newErr("upstream.concurrency: 1 <= min <= initial <= max required.")
+	}
+	if hc := cfg.Upstream.HealthCheck; hc.Enabled {
+		if hc.Interval.Duration <= 0 || hc.FailAfter < 1 || hc.RecoverAfter < 1 {
+			return newErr("upstream.health_check: interval, fail_after and recover_after must be positive.")
+		}
+		if _, ok := dns.StringToType[hc.Type]; !ok {
+			return newErr("upstream.health_check: unknown type '" + hc.Type + "'.")
+		}
+		if _, ok := dns.IsDomainName(hc.Name); !ok {
+			return newErr("upstream.health_check: invalid name '" + hc.Name + "'.")
+		}
+	}
+	if cfg.Tunneling.Action != "flag" && cfg.Tunneling.Action != "block" {
+		return newErr("Unknown tunneling action: " + cfg.Tunneling.Action)
+	}
+	if cfg.DGA.Action != "alert" && cfg.DGA.Action != "block" {
+		return newErr("Unknown dga action: " + cfg.DGA.Action)
+	}
+	if cfg.Chaos.Action != "answer" && cfg.Chaos.Action != "refuse" {
+		return newErr("Unknown chaos action: " + cfg.Chaos.Action)
+	}
+	if len(cfg.DNS.Listen) == 0 {
+		return newErr("No dns.listen address.")
+	}
+	for _, addr := range cfg.DNS.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return newErr("Invalid dns.listen address '" + addr + "'. (ip:port)")
+		}
+	}
+	if cfg.DNS.TCP && cfg.DNS.TCPKeepAlive.Duration <= 0 {
+		return newErr("dns.tcp_keepalive must be positive.")
+	}
+	if c := cfg.Cache; c.MinTTL.Duration < 0 || c.MaxTTL.Duration <= 0 || c.MinTTL.Duration > c.MaxTTL.Duration {
+		return newErr("cache: 0 <= min_ttl <= max_ttl and max_ttl > 0 required.")
+	}
+	if cfg.Cache.NegativeMaxTTL.Duration < 0 {
+		return newErr("cache.negative_max_ttl must be 0 or more.")
+	}
+	if cfg.Cache.ServeStale && cfg.Cache.StaleMaxAge.Duration <= 0 {
+		return newErr("cache.stale_max_age must be positive.")
+	}
+	if cfg.Cache.MaxEntries < 1 || cfg.Cache.MaxSize < 1 {
+		return newErr("cache.max_entries and cache.max_size must be positive.")
+	}
+	if cfg.Cache.Prefetch && cfg.Cache.PrefetchMinHits < 1 {
+		return newErr("cache.prefetch_min_hits must be 1 or more.")
+	}
+	if cfg.Offline.Enabled && (cfg.Offline.Failures < 1 || cfg.Offline.ProbeInterval.Duration <= 0) {
+		return newErr("offline.failures and offline.probe_interval must be positive.")
+	}
+	if cfg.Tunneling.UniqueSubdomains < 1 || cfg.Tunneling.QueryRate < 1 {
+		return newErr("tunneling.unique_subdomains and tunneling.query_rate must be positive.")
+	}
+	return nil
+}
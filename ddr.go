@@ -0,0 +1,269 @@
+package main
+
+// Discovery of Designated Resolvers (DDR, RFC 9462).
+//
+// bootstrap DNS 서버에 _dns.resolver.arpa SVCB를 질의하여 같은 운영자의
+// 암호화된 resolver(DoH, DoT, DoQ)를 찾고, 인증서가 bootstrap 서버의 IP 주소를 포함하는지
+// 확인(verified discovery)한 후 가장 우선하는 업스트림으로 사용한다.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const DDR_NAME = "_dns.resolver.arpa."
+const DDR_UPSTREAM = "ddr" // name of the discovered upstream
+const DDR_TIMEOUT = 5 * time.Second
+
+// SVCB (RFC 9460). miekg/dns v1.1.29는 SVCB를 알지 못하므로 RFC 3597 형식을 직접 해석한다.
+const (
+	TypeSVCB = 64
+
+	SVCB_KEY_ALPN     = 1
+	SVCB_KEY_PORT     = 3
+	SVCB_KEY_IPV4HINT = 4
+	SVCB_KEY_IPV6HINT = 6
+	SVCB_KEY_DOHPATH  = 7
+)
+
+// ALPN of the protocols used, in order of preference
+var ddrProtocols = []string{"h2", "dot", DOQ_ALPN}
+
+type designatedResolver struct {
+	Priority uint16
+	Target   string // fqdn
+	Port     string // "": the default port of the protocol
+	ALPN     []string
+	DoHPath  string // URI template, e.g. "/dns-query{?dns}"
+	Hints    []net.IP
+}
+
+func parseSVCB(rr dns.RR) (*designatedResolver, error) {
+	unknown, ok := rr.(*dns.RFC3597)
+	if !ok || rr.Header().Rrtype != TypeSVCB {
+		return nil, newErr("Not a SVCB record.")
+	}
+	b, err := hex.DecodeString(unknown.Rdata)
+	if err != nil || len(b) < 3 {
+		return nil, newErr("Invalid SVCB record.")
+	}
+
+	d := &designatedResolver{Priority: binary.BigEndian.Uint16(b)}
+	target, off, err := dns.UnpackDomainName(b, 2)
+	if err != nil {
+		return nil, err
+	}
+	d.Target = target
+
+	for off+4 <= len(b) {
+		key := binary.BigEndian.Uint16(b[off:])
+		n := int(binary.BigEndian.Uint16(b[off+2:]))
+		off += 4
+		if off+n > len(b) {
+			return nil, newErr("Invalid SVCB parameter.")
+		}
+		val := b[off : off+n]
+		off += n
+
+		switch key {
+		case SVCB_KEY_ALPN:
+			for len(val) > 0 && int(val[0]) < len(val) {
+				d.ALPN = append(d.ALPN, string(val[1:1+val[0]]))
+				val = val[1+val[0]:]
+			}
+		case SVCB_KEY_PORT:
+			if n == 2 {
+				d.Port = strconv.Itoa(int(binary.BigEndian.Uint16(val)))
+			}
+		case SVCB_KEY_IPV4HINT:
+			for i := 0; i+4 <= n; i += 4 {
+				d.Hints = append(d.Hints, net.IP(append([]byte{}, val[i:i+4]...)))
+			}
+		case SVCB_KEY_IPV6HINT:
+			for i := 0; i+16 <= n; i += 16 {
+				d.Hints = append(d.Hints, net.IP(append([]byte{}, val[i:i+16]...)))
+			}
+		case SVCB_KEY_DOHPATH:
+			d.DoHPath = string(val)
+		}
+	}
+	return d, nil
+}
+
+// protocol returns the ALPN of the most preferred protocol of the resolver,
+// or "" if it has none of ddrProtocols.
+func (d *designatedResolver) protocol() string {
+	if d.Target == "." {
+		return ""
+	}
+	for _, proto := range ddrProtocols {
+		for _, p := range d.ALPN {
+			if p == proto && (p != "h2" || d.DoHPath != "") {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// port returns the port of the resolver for the protocol proto.
+func (d *designatedResolver) port(proto string) string {
+	switch {
+	case d.Port != "":
+		return d.Port
+	case proto == "h2":
+		return "443"
+	case proto == "dot":
+		return DOT_PORT
+	}
+	return DOQ_PORT
+}
+
+// upstreamURL returns the upstream URL of the resolver for the protocol proto.
+func (d *designatedResolver) upstreamURL(proto string) string {
+	host := strings.TrimSuffix(d.Target, ".")
+	switch proto {
+	case "h2":
+		path := d.DoHPath
+		if i := strings.Index(path, "{"); i >= 0 {
+			path = path[:i] // "{?dns}": POST만 사용하므로 변수는 필요 없다.
+		}
+		if port := d.port(proto); port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		return "https://" + host + path
+	case "dot":
+		return "tls://" + net.JoinHostPort(host, d.port(proto))
+	}
+	return "quic://" + net.JoinHostPort(host, d.port(proto))
+}
+
+// discoverDDR returns the designated resolvers of server in order of priority.
+func discoverDDR(server string) ([]*designatedResolver, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(DDR_NAME, TypeSVCB)
+
+	client := &dns.Client{Timeout: DDR_TIMEOUT}
+	r, _, err := client.Exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*designatedResolver
+	for _, rr := range r.Answer {
+		d, err := parseSVCB(rr)
+		if err != nil || d.Priority == 0 {
+			// AliasMode는 DDR에서 사용하지 않는다.
+			continue
+		}
+		list = append(list, d)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Priority < list[j].Priority })
+	return list, nil
+}
+
+// verifyDesignated checks that the certificate of the designated resolver
+// is valid for its name and also covers the IP address of the unencrypted resolver.
+// roots: the CA of the upstreams (ca_file), nil: system CA
+func verifyDesignated(d *designatedResolver, proto string, roots *x509.CertPool, addr string, resolverIP string) error {
+	tlsConfig := &tls.Config{
+		RootCAs:    roots,
+		ServerName: strings.TrimSuffix(d.Target, "."),
+		NextProtos: []string{proto},
+	}
+	addr = net.JoinHostPort(addr, d.port(proto))
+
+	var certs []*x509.Certificate
+	if proto == DOQ_ALPN {
+		ctx, cancel := context.WithTimeout(context.Background(), DDR_TIMEOUT)
+		defer cancel()
+		conn, err := quic.DialAddr(ctx, addr, tlsConfig, &quic.Config{HandshakeIdleTimeout: DDR_TIMEOUT})
+		if err != nil {
+			return err
+		}
+		defer conn.CloseWithError(0, "")
+		certs = conn.ConnectionState().TLS.PeerCertificates
+	} else {
+		dialer := &net.Dialer{Timeout: DDR_TIMEOUT}
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		certs = conn.ConnectionState().PeerCertificates
+	}
+	if len(certs) == 0 {
+		return newErr("No certificate.")
+	}
+	return certs[0].VerifyHostname(resolverIP)
+}
+
+// upgradeDDR discovers the designated encrypted resolver of the bootstrap DNS
+// server and makes it the preferred upstream.
+func (s *SecHandler) upgradeDDR(cfg DDRConfig) {
+	server := cfg.Resolver
+	for _, b := range s.Config.Upstream.Bootstrap {
+		if server == "" && b != BOOTSTRAP_SYSTEM {
+			server = b
+		}
+	}
+	if server == "" {
+		WriteErrorLogMsg("DDR discovery failed.", newErr("No resolver. Set ddr.resolver."))
+		return
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	resolverIP, _, _ := net.SplitHostPort(server)
+
+	list, err := discoverDDR(server)
+	if err != nil {
+		WriteErrorLogMsg("DDR discovery failed.", err)
+		return
+	}
+
+	for _, d := range list {
+		proto := d.protocol()
+		if proto == "" {
+			continue
+		}
+		url := d.upstreamURL(proto)
+
+		// 힌트 주소가 없으면 bootstrap 서버의 주소로 연결한다.
+		addrs := d.Hints
+		if len(addrs) == 0 {
+			addrs = []net.IP{net.ParseIP(resolverIP)}
+		}
+		var verr error
+		for _, ip := range addrs {
+			if verr = verifyDesignated(d, proto, s.Upstreams.opts.TLS.RootCAs, ip.String(), resolverIP); verr == nil {
+				break
+			}
+		}
+		if verr != nil {
+			log.Printf("[DDR] %s: not verified: %s", url, verr)
+			continue
+		}
+
+		s.Endpoints.AddHost(d.Target, addrs)
+		if err := s.Upstreams.AddFirst(DDR_UPSTREAM, url); err != nil {
+			WriteErrorLog(err)
+			return
+		}
+		log.Printf("[DDR] upgraded to the designated resolver of %s: %s", resolverIP, url)
+		return
+	}
+	log.Printf("[DDR] no verified designated resolver for %s", resolverIP)
+}
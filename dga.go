@@ -0,0 +1,184 @@
+package main
+
+// DGA (domain generation algorithm) domain detection.
+//
+// 등록 도메인 레이블(example.com -> "example")의 특징으로 점수(0~100)를 계산한다.
+//   - 문자 엔트로피
+//   - 연속된 자음의 길이
+//   - 숫자와 문자가 섞인 정도
+//   - 흔하지 않은 문자 bigram의 비율 (n-gram model)
+// n-gram model은 내장된 영어 bigram 목록을 사용하며, JSON 파일로 대체할 수 있다.
+//   {"bigrams": {"th": 0.0356, "he": 0.0307, ...}, "rare_below": 0.001}
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const DGA_MIN_LENGTH = 7 // shorter labels are not scored
+
+// The most common English letter bigrams.
+const COMMON_BIGRAMS = "th he in er an re on at en nd ti es or te of ed is it al ar st to nt ng " +
+	"se ha as ou io le ve co me de hi ri ro ic ne ea ra ce li ch ll be ma si om ur ca el ta la " +
+	"ns di fo ho pe ec pr no ct us ac ot il tr ly nc et ut ss so rs un lo wa ge ie wh ee wi em " +
+	"ad ol rt po we na ul ni ts mo ow pa im mi ai sh ir su id os iv ia am fi ci vi pl ig tu ev " +
+	"ld ry mp fe bl ab gh ty op wo sa ay ex ke fr oo av ag if ap gr od bo sp rd do uc bu ei ov " +
+	"by rm ep tt oc fa ef cu rn sc gi da yo cr cl du ga qu ue ff ba ey ls va um pp ua up lu go"
+
+type dgaModel struct {
+	Bigrams   map[string]float64 `json:"bigrams"`
+	RareBelow float64            `json:"rare_below"`
+}
+
+func builtinDGAModel() *dgaModel {
+	m := &dgaModel{Bigrams: map[string]float64{}, RareBelow: 0.5}
+	for _, bg := range strings.Fields(COMMON_BIGRAMS) {
+		m.Bigrams[bg] = 1
+	}
+	return m
+}
+
+func loadDGAModel(path string) (*dgaModel, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &dgaModel{RareBelow: 0.001}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if len(m.Bigrams) == 0 {
+		return nil, newErr("No bigrams in DGA model " + path)
+	}
+	return m, nil
+}
+
+func (m *dgaModel) rareRatio(label string) float64 {
+	total, rare := 0, 0
+	for i := 0; i+1 < len(label); i++ {
+		bg := label[i : i+2]
+		l0, l1 := isLetter(bg[0]), isLetter(bg[1])
+		switch {
+		case l0 && l1:
+			total++
+			if m.Bigrams[bg] < m.RareBelow {
+				rare++
+			}
+		case l0 != l1:
+			// letter-digit transition
+			total++
+			rare++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(rare) / float64(total)
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isVowel(c byte) bool {
+	return strings.IndexByte("aeiouy", c) >= 0
+}
+
+func maxConsonantRun(label string) int {
+	run, best := 0, 0
+	for i := 0; i < len(label); i++ {
+		if isLetter(label[i]) && !isVowel(label[i]) {
+			run++
+			if run > best {
+				best = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	return best
+}
+
+// digit/letter mix: highest when both are present in similar amounts
+func digitMix(label string) float64 {
+	digits, letters := 0, 0
+	for i := 0; i < len(label); i++ {
+		switch c := label[i]; {
+		case c >= '0' && c <= '9':
+			digits++
+		case isLetter(c):
+			letters++
+		}
+	}
+	if digits == 0 || letters == 0 {
+		return 0
+	}
+	return 2 * math.Min(float64(digits), float64(letters)) / float64(digits+letters)
+}
+
+type DGADetector struct {
+	cfg    DGAConfig
+	model  *dgaModel
+	ignore *DomainSet
+}
+
+func NewDGADetector(cfg DGAConfig) (*DGADetector, error) {
+	d := &DGADetector{cfg: cfg, model: builtinDGAModel(), ignore: NewDomainSet()}
+
+	if cfg.ModelFile != "" {
+		m, err := loadDGAModel(resolveAppPath(cfg.ModelFile))
+		if err != nil {
+			return nil, err
+		}
+		d.model = m
+		log.Printf("DGA model loaded: %d bigrams.", len(m.Bigrams))
+	}
+	for _, name := range cfg.Ignore {
+		d.ignore.Add(name)
+	}
+	return d, nil
+}
+
+// Score returns the DGA likelihood of name (0 ~ 100).
+func (d *DGADetector) Score(name string) float64 {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if d.ignore.Match(name) {
+		return 0
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return 0
+	}
+	label := domain[:strings.IndexByte(domain, '.')]
+	if strings.HasPrefix(label, "xn--") {
+		// IDN (punycode)
+		return 0
+	}
+	label = strings.Replace(label, "-", "", -1)
+	if len(label) < DGA_MIN_LENGTH {
+		return 0
+	}
+
+	score := 25*clamp01((labelEntropy(label)-2.5)/1.5) +
+		20*clamp01(float64(maxConsonantRun(label)-3)/3) +
+		15*digitMix(label) +
+		40*clamp01((d.model.rareRatio(label)-0.3)/0.5)
+
+	return math.Round(score*10) / 10
+}
+
+// Check reports whether name scores above the threshold.
+func (d *DGADetector) Check(name string) bool {
+	score := d.Score(name)
+	if score < d.cfg.Threshold {
+		return false
+	}
+	log.Printf("[DGA] suspected DGA domain: %s (score %.1f)", name, score)
+	return true
+}
@@ -0,0 +1,338 @@
+package main
+
+// DNSCrypt v2 upstream.
+//
+// 서버는 DNS stamp로 지정한다. (https://dnscrypt.info/stamps-specifications)
+//   sdns://AQcAAAAAAAAADjIxMi40Ny4yMjguMTM2IOgBuE6mBr-wusDOQ0RbsV66ZLAvo8SqMa4QY2oHkDJNHzIuZG5zY3J5cHQtY2VydC5mci5kbnNjcnlwdC5vcmc
+//
+// 인증서는 provider name의 TXT 레코드로 서버에서 직접 받고, stamp의 provider 공개키(Ed25519)로 검증한다.
+// 쿼리는 X25519-XSalsa20Poly1305(es_version 1)로 암호화하여 UDP로 보내며,
+// 응답이 잘린 경우 TCP로 다시 보낸다. 쿼리마다 새 클라이언트 키를 사용한다.
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const DNSCRYPT_STAMP_PREFIX = "sdns://"
+const DNSCRYPT_STAMP_PROTOCOL = 0x01
+const DNSCRYPT_DEFAULT_PORT = "443"
+const DNSCRYPT_TIMEOUT = 5 * time.Second
+const DNSCRYPT_CERT_REFRESH = 1 * time.Hour
+
+const DNSCRYPT_CERT_MAGIC = "DNSC"
+const DNSCRYPT_RESOLVER_MAGIC = "r6fnvWj8"
+const DNSCRYPT_ES_XSALSA20POLY1305 = 0x0001
+const DNSCRYPT_CERT_SIZE = 124 // without extensions
+
+const DNSCRYPT_HALF_NONCE = 12
+const DNSCRYPT_QUERY_MIN = 256 // minimum padded query size over UDP
+const DNSCRYPT_PAD_BLOCK = 64
+
+// dnscryptStamp is a parsed DNSCrypt server stamp.
+type dnscryptStamp struct {
+	addr     string // ip:port
+	pk       ed25519.PublicKey
+	provider string // fqdn
+}
+
+func parseDNSCryptStamp(stamp string) (*dnscryptStamp, error) {
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(stamp, DNSCRYPT_STAMP_PREFIX))
+	if err != nil {
+		return nil, newErr("Invalid DNS stamp: " + err.Error())
+	}
+	// protocol(1) props(8) LP(addr) LP(pk) LP(provider name)
+	if len(bin) < 9 || bin[0] != DNSCRYPT_STAMP_PROTOCOL {
+		return nil, newErr("Unsupported DNS stamp. (DNSCrypt only)")
+	}
+	bin = bin[9:]
+
+	var fields [3][]byte
+	for i := range fields {
+		if len(bin) < 1 || len(bin) < 1+int(bin[0]) {
+			return nil, newErr("Invalid DNS stamp.")
+		}
+		fields[i] = bin[1 : 1+int(bin[0])]
+		bin = bin[1+int(bin[0]):]
+	}
+
+	s := &dnscryptStamp{addr: string(fields[0]), pk: ed25519.PublicKey(fields[1]), provider: dns.Fqdn(string(fields[2]))}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		s.addr = net.JoinHostPort(strings.Trim(s.addr, "[]"), DNSCRYPT_DEFAULT_PORT)
+	}
+	if len(s.pk) != ed25519.PublicKeySize {
+		return nil, newErr("Invalid DNS stamp: bad provider public key.")
+	}
+	if _, ok := dns.IsDomainName(s.provider); !ok {
+		return nil, newErr("Invalid DNS stamp: bad provider name.")
+	}
+	return s, nil
+}
+
+// dnscryptCert is a verified resolver certificate.
+type dnscryptCert struct {
+	serial      uint32
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	notAfter    time.Time
+	fetched     time.Time
+}
+
+// parseDNSCryptCert verifies a certificate with the provider key.
+func parseDNSCryptCert(b []byte, pk ed25519.PublicKey, now time.Time) (*dnscryptCert, error) {
+	if len(b) < DNSCRYPT_CERT_SIZE || string(b[:4]) != DNSCRYPT_CERT_MAGIC {
+		return nil, newErr("Invalid DNSCrypt certificate.")
+	}
+	if binary.BigEndian.Uint16(b[4:]) != DNSCRYPT_ES_XSALSA20POLY1305 {
+		return nil, newErr("Unsupported DNSCrypt certificate version.")
+	}
+	if !ed25519.Verify(pk, b[72:], b[8:72]) {
+		return nil, newErr("DNSCrypt certificate signature mismatch.")
+	}
+
+	c := &dnscryptCert{
+		serial:   binary.BigEndian.Uint32(b[112:]),
+		notAfter: time.Unix(int64(binary.BigEndian.Uint32(b[120:])), 0),
+		fetched:  now,
+	}
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(b[116:])), 0)
+	if now.Before(notBefore) || now.After(c.notAfter) {
+		return nil, newErr("DNSCrypt certificate is not valid now.")
+	}
+	copy(c.resolverPK[:], b[72:104])
+	copy(c.clientMagic[:], b[104:112])
+	return c, nil
+}
+
+// txtBytes returns the raw bytes of a TXT string. (miekg/dns escapes non-printable bytes)
+func txtBytes(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n, _ := strconv.Atoi(s[i+1 : i+4])
+			b = append(b, byte(n))
+			i += 3
+		} else {
+			b = append(b, s[i+1])
+			i++
+		}
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type dnscryptTransport struct {
+	stamp *dnscryptStamp
+	dial  dialFunc
+
+	mu   sync.Mutex
+	cert *dnscryptCert
+}
+
+func newDNSCryptTransport(stamp string, dial dialFunc) (*dnscryptTransport, error) {
+	s, err := parseDNSCryptStamp(stamp)
+	if err != nil {
+		return nil, err
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &dnscryptTransport{stamp: s, dial: dial}, nil
+}
+
+func (t *dnscryptTransport) connect(network string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DNSCRYPT_TIMEOUT)
+	defer cancel()
+	conn, err := t.dial(ctx, network, t.stamp.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DNSCRYPT_TIMEOUT))
+	return conn, nil
+}
+
+// getCert returns the current certificate, fetching it if needed.
+// 유효한 인증서가 여러 개이면 serial이 가장 큰 것을 사용한다.
+func (t *dnscryptTransport) getCert(refresh bool) (*dnscryptCert, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if c := t.cert; c != nil && !refresh && now.Before(c.notAfter) && now.Sub(c.fetched) < DNSCRYPT_CERT_REFRESH {
+		return c, nil
+	}
+
+	conn, err := t.connect("udp")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion(t.stamp.provider, dns.TypeTXT)
+	co := &dns.Conn{Conn: conn, UDPSize: dns.DefaultMsgSize}
+	if err := co.WriteMsg(q); err != nil {
+		return nil, err
+	}
+	m, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	err = newErr("No DNSCrypt certificate for " + t.stamp.provider)
+	for _, rr := range m.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		c, cerr := parseDNSCryptCert(txtBytes(strings.Join(txt.Txt, "")), t.stamp.pk, now)
+		if cerr != nil {
+			err = cerr
+			continue
+		}
+		if best == nil || c.serial > best.serial {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, err
+	}
+	t.cert = best
+	return best, nil
+}
+
+func (t *dnscryptTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	cert, err := t.getCert(false)
+	if err != nil {
+		return nil, err
+	}
+	m, err := t.query(cert, r)
+	if err == errDNSCryptDecrypt {
+		// 서버의 키가 바뀌었을 수 있다.
+		if cert, err = t.getCert(true); err != nil {
+			return nil, err
+		}
+		m, err = t.query(cert, r)
+	}
+	return m, err
+}
+
+func (t *dnscryptTransport) query(cert *dnscryptCert, r *dns.Msg) (*dns.Msg, error) {
+	m, err := t.exchange(cert, r, "udp")
+	if err == nil && m.Truncated {
+		return t.exchange(cert, r, "tcp")
+	}
+	return m, err
+}
+
+var errDNSCryptDecrypt = newErr("DNSCrypt: can't decrypt the response.")
+
+func (t *dnscryptTransport) exchange(cert *dnscryptCert, r *dns.Msg, network string) (*dns.Msg, error) {
+	wire, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	clientPK, clientSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var shared [32]byte
+	box.Precompute(&shared, &cert.resolverPK, clientSK)
+
+	// nonce: client half(12) || 0(12)
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:DNSCRYPT_HALF_NONCE]); err != nil {
+		return nil, err
+	}
+
+	// padding: 0x80, 0x00... (UDP: 최소 DNSCRYPT_QUERY_MIN)
+	size := len(wire) + 1
+	if network == "udp" && size < DNSCRYPT_QUERY_MIN {
+		size = DNSCRYPT_QUERY_MIN
+	}
+	size = (size + DNSCRYPT_PAD_BLOCK - 1) / DNSCRYPT_PAD_BLOCK * DNSCRYPT_PAD_BLOCK
+	padded := make([]byte, size)
+	copy(padded, wire)
+	padded[len(wire)] = 0x80
+
+	query := concatBytes(cert.clientMagic[:], clientPK[:], nonce[:DNSCRYPT_HALF_NONCE])
+	query = box.SealAfterPrecomputation(query, padded, &nonce, &shared)
+
+	conn, err := t.connect(network)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var resp []byte
+	if network == "tcp" {
+		if _, err := conn.Write(concatBytes(u16(len(query)), query)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp = buf[:n]
+	}
+
+	// resolver magic(8) || client nonce(12) || server nonce(12) || box
+	if len(resp) < 8+24+box.Overhead || string(resp[:8]) != DNSCRYPT_RESOLVER_MAGIC ||
+		!bytes.Equal(resp[8:8+DNSCRYPT_HALF_NONCE], nonce[:DNSCRYPT_HALF_NONCE]) {
+		return nil, newErr("DNSCrypt: invalid response.")
+	}
+	copy(nonce[:], resp[8:32])
+	plain, ok := box.OpenAfterPrecomputation(nil, resp[32:], &nonce, &shared)
+	if !ok {
+		return nil, errDNSCryptDecrypt
+	}
+
+	end := bytes.LastIndexByte(plain, 0x80)
+	if end < 0 || len(bytes.Trim(plain[end+1:], "\x00")) != 0 {
+		return nil, newErr("DNSCrypt: invalid response padding.")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(plain[:end]); err != nil {
+		return nil, newErr("Can't unpack message from wireformat.")
+	}
+	return m, nil
+}
+
+func (t *dnscryptTransport) Close() error {
+	return nil
+}
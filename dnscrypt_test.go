@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testStamp builds a DNSCrypt stamp from raw fields.
+func testStamp(protocol byte, addr string, pk []byte, provider string) string {
+	b := append([]byte{protocol}, make([]byte, 8)...)
+	for _, f := range [][]byte{[]byte(addr), pk, []byte(provider)} {
+		b = append(append(b, byte(len(f))), f...)
+	}
+	return DNSCRYPT_STAMP_PREFIX + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestParseDNSCryptStamp(t *testing.T) {
+	pk := bytes.Repeat([]byte{0xab}, ed25519.PublicKeySize)
+	valid := testStamp(DNSCRYPT_STAMP_PROTOCOL, "9.9.9.9:8443", pk, "2.dnscrypt-cert.quad9.net")
+	bin, _ := base64.RawURLEncoding.DecodeString(valid[len(DNSCRYPT_STAMP_PREFIX):])
+
+	tests := []struct {
+		name     string
+		stamp    string
+		addr     string
+		provider string
+		ok       bool
+	}{
+		{"valid", valid, "9.9.9.9:8443", "2.dnscrypt-cert.quad9.net.", true},
+		{"default port", testStamp(DNSCRYPT_STAMP_PROTOCOL, "9.9.9.9", pk, "2.dnscrypt-cert.quad9.net"), "9.9.9.9:443", "2.dnscrypt-cert.quad9.net.", true},
+		{"ipv6 default port", testStamp(DNSCRYPT_STAMP_PROTOCOL, "[2620:fe::fe]", pk, "2.dnscrypt-cert.quad9.net"), "[2620:fe::fe]:443", "2.dnscrypt-cert.quad9.net.", true},
+		{"bad base64", DNSCRYPT_STAMP_PREFIX + "%%%", "", "", false},
+		{"doh stamp", testStamp(0x02, "9.9.9.9", pk, "dns.quad9.net"), "", "", false},
+		{"no props", DNSCRYPT_STAMP_PREFIX + base64.RawURLEncoding.EncodeToString([]byte{DNSCRYPT_STAMP_PROTOCOL, 0}), "", "", false},
+		{"truncated", DNSCRYPT_STAMP_PREFIX + base64.RawURLEncoding.EncodeToString(bin[:len(bin)-3]), "", "", false},
+		{"missing provider", DNSCRYPT_STAMP_PREFIX + base64.RawURLEncoding.EncodeToString(bin[:9+1+12+1+32]), "", "", false},
+		{"short key", testStamp(DNSCRYPT_STAMP_PROTOCOL, "9.9.9.9", pk[:31], "2.dnscrypt-cert.quad9.net"), "", "", false},
+		{"bad provider", testStamp(DNSCRYPT_STAMP_PROTOCOL, "9.9.9.9", pk, "a..b"), "", "", false},
+	}
+	for _, tt := range tests {
+		s, err := parseDNSCryptStamp(tt.stamp)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if s.addr != tt.addr || s.provider != tt.provider || !bytes.Equal(s.pk, pk) {
+			t.Errorf("%s: got %s %s %x", tt.name, s.addr, s.provider, s.pk)
+		}
+	}
+}
+
+// testCert builds a signed certificate. (es_version, serial, ts_start, ts_end)
+func testCert(priv ed25519.PrivateKey, version uint16, serial uint32, notBefore, notAfter time.Time) []byte {
+	b := make([]byte, DNSCRYPT_CERT_SIZE)
+	copy(b, DNSCRYPT_CERT_MAGIC)
+	binary.BigEndian.PutUint16(b[4:], version)
+	copy(b[72:104], bytes.Repeat([]byte{0x11}, 32))
+	copy(b[104:112], "magic!!!")
+	binary.BigEndian.PutUint32(b[112:], serial)
+	binary.BigEndian.PutUint32(b[116:], uint32(notBefore.Unix()))
+	binary.BigEndian.PutUint32(b[120:], uint32(notAfter.Unix()))
+	copy(b[8:72], ed25519.Sign(priv, b[72:]))
+	return b
+}
+
+func TestParseDNSCryptCert(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Unix(1700000000, 0)
+	day := 24 * time.Hour
+
+	valid := testCert(priv, DNSCRYPT_ES_XSALSA20POLY1305, 7, now.Add(-day), now.Add(day))
+	badMagic := append([]byte{}, valid...)
+	copy(badMagic, "XXXX")
+	tampered := append([]byte{}, valid...)
+	tampered[113] ^= 0xff
+
+	tests := []struct {
+		name string
+		cert []byte
+		pk   ed25519.PublicKey
+		ok   bool
+	}{
+		{"valid", valid, pub, true},
+		{"truncated", valid[:DNSCRYPT_CERT_SIZE-1], pub, false},
+		{"bad magic", badMagic, pub, false},
+		{"xchacha20", testCert(priv, 0x0002, 7, now.Add(-day), now.Add(day)), pub, false},
+		{"other provider key", valid, otherPub, false},
+		{"tampered", tampered, pub, false},
+		{"expired", testCert(priv, DNSCRYPT_ES_XSALSA20POLY1305, 7, now.Add(-2*day), now.Add(-day)), pub, false},
+		{"not yet valid", testCert(priv, DNSCRYPT_ES_XSALSA20POLY1305, 7, now.Add(day), now.Add(2*day)), pub, false},
+	}
+	for _, tt := range tests {
+		c, err := parseDNSCryptCert(tt.cert, tt.pk, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if c.serial != 7 || !c.notAfter.Equal(now.Add(day)) ||
+			c.resolverPK != [32]byte(bytes.Repeat([]byte{0x11}, 32)) || string(c.clientMagic[:]) != "magic!!!" {
+			t.Errorf("%s: got %+v", tt.name, c)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+// DNSSEC validation of upstream answers.
+//
+// 업스트림에 DO 비트를 설정하여 질의하고, 응답의 RRSIG를 루트 trust anchor부터
+// DS -> DNSKEY 체인으로 검증한다. 검증된 응답에는 AD 비트를 설정하고, 서명이 잘못되었거나
+// 서명된 영역의 응답에서 서명이 제거된 경우(bogus) SERVFAIL(EDE 6)로 응답한다.
+// DS가 없다는 응답(insecure delegation)은 NSEC/NSEC3의 서명만 확인하며, 부정 응답에는
+// AD 비트를 설정하지 않는다.
+// 쿼리에 CD 비트가 있으면 검증하지 않는다. (RFC 4035 3.2.2)
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const DNSSEC_UDP_SIZE = 1232
+const DNSSEC_KEY_MAX_TTL = 1 * time.Hour // validated DNSKEY/DS sets and zone cuts are kept at most this long
+const DNSSEC_BOGUS_TTL = 1 * time.Minute // bogus zones are not checked again for this time
+
+// The root zone KSKs (https://data.iana.org/root-anchors/root-anchors.xml)
+var dnssecRootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// dnssecError is a validation failure (bogus). Upstream errors are returned as they are.
+type dnssecError struct {
+	msg string
+}
+
+func (e *dnssecError) Error() string {
+	return e.msg
+}
+
+func bogus(msg string) error {
+	return &dnssecError{msg}
+}
+
+// Validated keys of a zone
+type zoneKeys struct {
+	keys   []*dns.DNSKEY
+	secure bool  // false: insecure zone (no DS in the parent)
+	err    error // bogus
+}
+
+type DNSSECValidator struct {
+	anchors map[string][]*dns.DS // zone -> trusted DS
+	query   func(r *dns.Msg) (*dns.Msg, error)
+	keys    *cache.Cache // zone -> *zoneKeys
+	zones   *cache.Cache // owner name -> enclosing zone
+}
+
+// NewDNSSECValidator creates a validator.
+// query: sends a query to the upstream without validation
+func NewDNSSECValidator(cfg DNSSECConfig, query func(r *dns.Msg) (*dns.Msg, error)) (*DNSSECValidator, error) {
+	anchors := cfg.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = dnssecRootAnchors
+	}
+	v := &DNSSECValidator{
+		anchors: map[string][]*dns.DS{},
+		query:   query,
+		keys:    cache.New(DNSSEC_KEY_MAX_TTL, 10*time.Minute),
+		zones:   cache.New(DNSSEC_KEY_MAX_TTL, 10*time.Minute),
+	}
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, newErr("Invalid DNSSEC trust anchor: " + err.Error())
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, newErr("DNSSEC trust anchor is not a DS record: " + s)
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	return v, nil
+}
+
+// Validate checks the signatures of the answer and authority sections.
+// secure: every answer is signed and verified up to a trust anchor
+// err: *dnssecError if bogus
+func (v *DNSSECValidator) Validate(m *dns.Msg) (secure bool, err error) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+
+	secure = m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0
+	for _, set := range rrsets(m.Answer) {
+		ok, err := v.verifySet(set, m.Answer)
+		if err != nil {
+			return false, err
+		}
+		secure = secure && ok
+	}
+
+	signed := false
+	for _, set := range rrsets(m.Ns) {
+		sigs := signatures(set, m.Ns)
+		if len(sigs) == 0 {
+			continue // delegation NS, glue
+		}
+		signed = true
+		if _, err := v.verifyRRset(set, sigs); err != nil {
+			return false, err
+		}
+	}
+
+	// negative answer: the SOA and NSEC/NSEC3 of a signed zone are signed.
+	if negative(m) && !signed {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if _, zoneSecure, err := v.zoneKeys(soa.Hdr.Name); err != nil {
+					return false, err
+				} else if zoneSecure {
+					return false, bogus("Unsigned negative answer from the signed zone " + soa.Hdr.Name)
+				}
+			}
+		}
+	}
+	return secure, nil
+}
+
+// verifySet verifies an RRset of the answer section.
+// Unsigned RRsets are bogus if the enclosing zone is signed.
+func (v *DNSSECValidator) verifySet(set []dns.RR, section []dns.RR) (bool, error) {
+	if sigs := signatures(set, section); len(sigs) > 0 {
+		return v.verifyRRset(set, sigs)
+	}
+
+	name := strings.ToLower(set[0].Header().Name)
+	zone, err := v.zoneOf(name)
+	if err != nil || zone == "" {
+		return false, err
+	}
+	if _, zoneSecure, err := v.zoneKeys(zone); err != nil {
+		return false, err
+	} else if zoneSecure {
+		return false, bogus("Missing signature: " + name + " " + dns.TypeToString[set[0].Header().Rrtype])
+	}
+	return false, nil
+}
+
+// verifyRRset checks that one of the signatures is valid.
+// false, nil: the signer zone is insecure
+func (v *DNSSECValidator) verifyRRset(set []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	name := set[0].Header().Name
+	err := bogus("No valid signature: " + name + " " + dns.TypeToString[set[0].Header().Rrtype])
+	now := time.Now()
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, name) {
+			continue
+		}
+		keys, zoneSecure, kerr := v.zoneKeys(sig.SignerName)
+		if kerr != nil {
+			return false, kerr
+		}
+		if !zoneSecure {
+			return false, nil
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if sig.Verify(k, set) == nil && sig.ValidityPeriod(now) {
+				return true, nil
+			}
+		}
+	}
+	return false, err
+}
+
+// zoneKeys returns the validated DNSKEYs of a zone.
+func (v *DNSSECValidator) zoneKeys(zone string) ([]*dns.DNSKEY, bool, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if x, ok := v.keys.Get(zone); ok {
+		zk := x.(*zoneKeys)
+		return zk.keys, zk.secure, zk.err
+	}
+
+	zk, ttl, err := v.fetchKeys(zone)
+	if err != nil {
+		if _, ok := err.(*dnssecError); !ok {
+			return nil, false, err // upstream error: not cached
+		}
+		zk, ttl = &zoneKeys{err: err}, DNSSEC_BOGUS_TTL
+	}
+	if ttl > DNSSEC_KEY_MAX_TTL {
+		ttl = DNSSEC_KEY_MAX_TTL
+	}
+	v.keys.Set(zone, zk, ttl)
+	return zk.keys, zk.secure, zk.err
+}
+
+// fetchKeys queries the DS and DNSKEY sets of a zone and validates them.
+func (v *DNSSECValidator) fetchKeys(zone string) (*zoneKeys, time.Duration, error) {
+	ds, ok := v.anchors[zone]
+	if !ok {
+		if zone == "." {
+			return &zoneKeys{}, DNSSEC_KEY_MAX_TTL, nil // no trust anchor for the root
+		}
+		var secure bool
+		var err error
+		if ds, secure, err = v.fetchDS(zone); err != nil {
+			return nil, 0, err
+		} else if !secure {
+			return &zoneKeys{}, DNSSEC_KEY_MAX_TTL, nil
+		}
+	}
+
+	m, err := v.exchange(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	var set []dns.RR
+	var keys []*dns.DNSKEY
+	ttl := DNSSEC_KEY_MAX_TTL
+	for _, rr := range m.Answer {
+		if k, ok := rr.(*dns.DNSKEY); ok && strings.EqualFold(k.Hdr.Name, zone) {
+			set = append(set, k)
+			if k.Flags&dns.ZONE != 0 {
+				keys = append(keys, k)
+			}
+			if t := time.Duration(k.Hdr.Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, 0, bogus("No DNSKEY for the signed zone " + zone)
+	}
+
+	now := time.Now()
+	for _, sig := range signatures(set, m.Answer) {
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm || !matchesDS(k, ds) {
+				continue
+			}
+			if sig.Verify(k, set) == nil && sig.ValidityPeriod(now) {
+				return &zoneKeys{keys: keys, secure: true}, ttl, nil
+			}
+		}
+	}
+	return nil, 0, bogus("DNSKEY of " + zone + " does not match the DS")
+}
+
+// fetchDS queries the DS set of a zone in the parent zone.
+// secure = false: insecure delegation, the parent is unsigned or proves that there is no DS.
+func (v *DNSSECValidator) fetchDS(zone string) ([]*dns.DS, bool, error) {
+	m, err := v.exchange(zone, dns.TypeDS)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var set []dns.RR
+	var ds []*dns.DS
+	for _, rr := range m.Answer {
+		if d, ok := rr.(*dns.DS); ok && strings.EqualFold(d.Hdr.Name, zone) {
+			set = append(set, d)
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) > 0 {
+		secure, err := v.verifyRRset(set, parentSignatures(zone, set, m.Answer))
+		return ds, secure, err
+	}
+
+	// no DS: the denial must be signed if the parent is signed.
+	for _, rr := range m.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok && strings.EqualFold(nsec.Hdr.Name, zone) {
+			for _, t := range nsec.TypeBitMap {
+				if t == dns.TypeDS {
+					return nil, false, bogus("NSEC of " + zone + " lists a DS")
+				}
+			}
+		}
+	}
+	signed := false
+	for _, set := range rrsets(m.Ns) {
+		if t := set[0].Header().Rrtype; t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		sigs := parentSignatures(zone, set, m.Ns)
+		if len(sigs) == 0 {
+			continue
+		}
+		if ok, err := v.verifyRRset(set, sigs); err != nil {
+			return nil, false, err
+		} else if ok {
+			signed = true
+		}
+	}
+	if signed {
+		return nil, false, nil
+	}
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && !strings.EqualFold(soa.Hdr.Name, zone) && dns.IsSubDomain(soa.Hdr.Name, zone) {
+			if _, parentSecure, err := v.zoneKeys(soa.Hdr.Name); err != nil {
+				return nil, false, err
+			} else if parentSecure {
+				return nil, false, bogus("Unproven missing DS of " + zone)
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+// zoneOf returns the zone that contains name, "" if unknown.
+func (v *DNSSECValidator) zoneOf(name string) (string, error) {
+	if x, ok := v.zones.Get(name); ok {
+		return x.(string), nil
+	}
+	m, err := v.exchange(name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+	zone := ""
+	for _, rr := range append(m.Answer, m.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+			zone = strings.ToLower(soa.Hdr.Name)
+		}
+	}
+	v.zones.SetDefault(name, zone)
+	return zone, nil
+}
+
+func (v *DNSSECValidator) exchange(name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(DNSSEC_UDP_SIZE, true)
+	q.CheckingDisabled = true
+	m, err := v.query(q)
+	if err != nil {
+		return nil, err
+	}
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return nil, newErr("DNSSEC " + dns.TypeToString[qtype] + " query for " + name + ": " + dns.RcodeToString[m.Rcode])
+	}
+	return m, nil
+}
+
+func matchesDS(k *dns.DNSKEY, ds []*dns.DS) bool {
+	for _, d := range ds {
+		if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+			continue
+		}
+		if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrsets groups the records of a section by name and type, except RRSIG and OPT.
+func rrsets(section []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := map[string]int{}
+	for _, rr := range section {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets
+}
+
+// signatures returns the RRSIGs of the section that cover set.
+func signatures(set []dns.RR, section []dns.RR) []*dns.RRSIG {
+	h := set[0].Header()
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == h.Rrtype && strings.EqualFold(sig.Hdr.Name, h.Name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// parentSignatures returns the signatures of set made by a zone above zone.
+func parentSignatures(zone string, set []dns.RR, section []dns.RR) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, sig := range signatures(set, section) {
+		if !strings.EqualFold(sig.SignerName, zone) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// validatedExchange sends r to the upstream with the DO bit and validates the answer.
+// Bogus answers are replaced with SERVFAIL.
+func (s *SecHandler) validatedExchange(r *dns.Msg, info *queryInfo) (*dns.Msg, error) {
+	q := r.Copy()
+	do := false
+	if opt := q.IsEdns0(); opt != nil {
+		do = opt.Do()
+		opt.SetDo()
+	} else {
+		q.SetEdns0(DNSSEC_UDP_SIZE, true)
+	}
+
+	m, err := s.exchangeUpstreams(q, info)
+	if err != nil {
+		return nil, err
+	}
+
+	secure, err := s.DNSSEC.Validate(m)
+	if err != nil {
+		if _, ok := err.(*dnssecError); !ok {
+			return nil, err
+		}
+		info.tracef("dnssec", "bogus: %s", err)
+		info.setEDE(EDE_DNSSEC_BOGUS, err.Error())
+		fail := new(dns.Msg)
+		fail.SetRcode(r, dns.RcodeServerFailure)
+		return fail, nil
+	}
+	if secure {
+		info.tracef("dnssec", "secure")
+	} else {
+		info.tracef("dnssec", "insecure")
+	}
+
+	// AD is set only for clients that understand it. (RFC 6840 5.8)
+	m.AuthenticatedData = secure && (do || r.AuthenticatedData)
+	if !do {
+		m = stripDNSSEC(m, r)
+	}
+	return m, nil
+}
+
+// stripDNSSEC removes the DNSSEC records the client did not ask for (DO bit not set),
+// and the OPT record if the query had none.
+func stripDNSSEC(m *dns.Msg, r *dns.Msg) *dns.Msg {
+	qtype := r.Question[0].Qtype
+	keep := func(section []dns.RR) []dns.RR {
+		out := section[:0]
+		for _, rr := range section {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			case dns.TypeOPT:
+				if r.IsEdns0() == nil {
+					continue
+				}
+				rr.(*dns.OPT).SetDo(false)
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	m.Answer = keep(m.Answer)
+	m.Ns = keep(m.Ns)
+	m.Extra = keep(m.Extra)
+	return m
+}
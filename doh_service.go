@@ -4,19 +4,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
-	"strconv"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/patrickmn/go-cache"
 )
 
 type DohError struct {
-	msg string
+	msg     string
+	status  int  // HTTP status code of the upstream, 0 if none
+	timeout bool // the upstream did not answer in time
 }
 
 func (e *DohError) Error() string {
@@ -24,30 +32,96 @@ func (e *DohError) Error() string {
 }
 
 func newErr(msg string) error {
-	return &DohError{msg}
+	return &DohError{msg: msg}
 }
 
 const CLOUDFLARE_DNS = "1.1.1.1:53"
-const CLOUDFLARE_DOH_HOST = "cloudflare-dns.com."
+const CLOUDFLARE_DNS6 = "[2606:4700:4700::1111]:53" // IPv6-only networks
 const CLOUDFLARE_DOH_URL = "https://cloudflare-dns.com/dns-query"
 
-// Create HTTPS request and POST.
-func makeHttpsRequest(wire []byte) (respWire []byte, err error) {
-	// disable security check for client
+const BOOTSTRAP_SYSTEM = "system" // bootstrap with the OS resolver
+const BOOTSTRAP_SYSTEM_TIMEOUT = 5 * time.Second
+
+const HTTP_IDLE_CONNS = 4                  // idle connections kept per upstream
+const HTTP_IDLE_TIMEOUT = 90 * time.Second // the connection is closed after this idle time
+const HTTP_TIMEOUT = 5 * time.Second
+
+const DOH_CONTENT_TYPE_LEGACY = "application/dns-udpwireformat" // pre-RFC draft of DOH_CONTENT_TYPE
+
+// DoH request method
+const (
+	DOH_METHOD_POST = "post"
+	DOH_METHOD_GET  = "get" // cacheable by HTTP caches. the message ID is sent as 0
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newHTTPClient creates the HTTP client of an upstream.
+// Connections are kept alive and HTTP/2 is used if the server supports it.
+// cfg.HTTP3: HTTP/3 first, see http3.go
+// tlsConfig: verifies the server certificate (see upstreamTLSConfig)
+func newHTTPClient(dial dialFunc, tlsConfig *tls.Config, cfg HTTPClientConfig) *http.Client {
+	if cfg.MaxIdleConns <= 0 {
+		cfg.MaxIdleConns = HTTP_IDLE_CONNS
+	}
+	if cfg.IdleConnTimeout.Duration <= 0 {
+		cfg.IdleConnTimeout.Duration = HTTP_IDLE_TIMEOUT
+	}
+	if cfg.Timeout.Duration <= 0 {
+		cfg.Timeout.Duration = HTTP_TIMEOUT
+	}
+
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig: tlsConfig,
+		DialContext:     dial,
+		// DialContext, TLSClientConfig를 지정하면 HTTP/2가 자동으로 사용되지 않는다.
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConns,
+		IdleConnTimeout:     cfg.IdleConnTimeout.Duration,
+		TLSHandshakeTimeout: cfg.Timeout.Duration,
 	}
-	client := &http.Client{Transport: tr}
-	buff := bytes.NewBuffer(wire)
+	if cfg.HTTP3 {
+		return &http.Client{Transport: newHTTP3Fallback(dial, tlsConfig, tr), Timeout: cfg.Timeout.Duration}
+	}
+	return &http.Client{Transport: tr, Timeout: cfg.Timeout.Duration}
+}
 
-	resp, err := client.Post(CLOUDFLARE_DOH_URL,
-		"application/dns-udpwireformat", buff)
+// Create HTTPS request and POST, or GET with the dns parameter (RFC 8484 4.1).
+// contentType: DOH_CONTENT_TYPE, or DOH_CONTENT_TYPE_LEGACY for old servers
+func makeHttpsRequest(client *http.Client, url string, wire []byte, method string, contentType string) (respWire []byte, err error) {
+	var resp *http.Response
+	if method == DOH_METHOD_GET {
+		sep := "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, url+sep+"dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", contentType)
+		resp, err = client.Do(req)
+	} else {
+		buff := bytes.NewBuffer(wire)
+
+		resp, err = client.Post(url,
+			contentType, buff)
+	}
 
 	if err == nil {
 		defer resp.Body.Close()
 
 		if resp.StatusCode != 200 {
-			return nil, newErr("HTTP error code " + resp.Status)
+			return nil, &DohError{msg: "HTTP error code " + resp.Status, status: resp.StatusCode}
+		}
+		// 서버는 두 형식 중 어느 것으로도 응답할 수 있다. (e.g. captive portal의 text/html은 거부)
+		if ct := resp.Header.Get("Content-Type"); ct != "" {
+			mt, _, _ := mime.ParseMediaType(ct)
+			if mt != DOH_CONTENT_TYPE && mt != DOH_CONTENT_TYPE_LEGACY {
+				return nil, newErr("Unexpected content type " + ct)
+			}
 		}
 
 		respBody, err := ioutil.ReadAll(resp.Body)
@@ -64,92 +138,964 @@ func makeHttpsRequest(wire []byte) (respWire []byte, err error) {
 }
 
 type SecHandler struct {
+	Config      *Config    // effective configuration, including runtime changes
+	configMu    sync.Mutex // guards Config
 	ServiceType string
-	Host        *dns.Msg
-	NameCache   *cache.Cache
+	Endpoints   *EndpointSelector
+	Upstreams   *UpstreamPool
+	NameCache   *DNSCache
+	Pinned      *PinnedCache
+	Offline     *Offline // nil if disabled
+	QueryLog    *QueryLog
+	GeoIP       *GeoIP // nil if disabled
+	Firewall    *Firewall
+	Blocklists  *Blocklists
+	Allowlist   *DomainRules      // wins over the filters
+	Neighbors   *NeighborTable    // nil if MAC identification is disabled
+	Devices     map[string]string // device id -> profile. guarded by profileMu
+	Profiles    map[string]string // other device id, MAC, IP or client name -> profile. set by profile.set, guarded by profileMu
+	profileMu   sync.RWMutex
+	Scheduler   *Scheduler
+	Quotas      *Quotas
+	Canary      *CanaryDomains     // nil if disabled
+	SpecialUse  *SpecialUseDomains // nil if disabled
+	Search      *SearchDomains     // nil if disabled
+	Chaos       *ChaosNames        // nil if disabled
+	Tunnel      *TunnelDetector    // nil if disabled
+	DGA         *DGADetector       // nil if disabled
+	IPSets      *IPSets
+	Blocking    *BlockResponse
+	SafeSearch  *SafeSearch       // nil if disabled
+	Rebind      *RebindProtection // nil if disabled
+	Sinkhole    *Sinkhole         // nil if disabled
+	ClientNames *ClientNames
+	LocalRecs   *LocalRecords
+	ClientRecs  *ClientRecords // evaluated before LocalRecs
+	Hosts       *HostsFile     // nil if disabled. evaluated after LocalRecs
+	Views       *Views
+	StubZones   *StubZones
+	Forwarders  *Forwarders        // nil if no forward rules
+	RRL         *RRL               // nil if disabled
+	RateLimit   *ClientRateLimiter // nil if disabled
+	Watchdog    *Watchdog          // nil if disabled
+	NXHijack    *NXHijack          // nil if disabled
+	Policy      *PolicyFetcher     // nil if no remote policy
+	Fault       *FaultInjector     // nil if disabled (testing only)
+	Audit       *Audit             // nil if disabled
+	DNSSEC      *DNSSECValidator   // nil if disabled
+	ECS         *ECSPolicy
+	Coalescer   *queryCoalescer
+	Stats       *Stats
+	Metrics     *Metrics // nil if disabled
+
+	done     chan struct{}  // closed on Close. stops background tasks
+	inflight sync.WaitGroup // queries being served (reload.go)
+}
+
+// Identity of the client that sent a query
+type clientID struct {
+	IP       string
+	MAC      string
+	Name     string // friendly name (clientnames.go)
+	Device   string
+	Profile  string
+	Listener string // udp, tcp, dot, doh
 }
 
-func (s SecHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	if len(r.Question) > 0 && r.Question[0].Qtype == dns.TypeA {
-		// TypeA request
+// per-query state collected while resolving, used for the query log.
+type queryInfo struct {
+	client   clientID
+	cached   bool
+	blocked  bool
+	reason   string // why blocked or flagged
+	upstream string
+	view     *view       // nil if no view matches
+	trace    *queryTrace // nil unless tracing (debug API)
+	ede      *extendedError
+	err      error // why the query failed, for the query log
+}
 
-		if r.Question[0].Name == CLOUDFLARE_DOH_HOST {
-			// Cloudflare DNS over HTTPS server name
-			s.Host.SetReply(r)
-			w.WriteMsg(s.Host)
-		} else {
-			// Other TypeA request
-			requestedName := r.Question[0].Name
-
-			if x, found := s.NameCache.Get(requestedName); found {
-				// Cache hit:
-				cachedMsg := x.(*dns.Msg)
-				cachedMsg.SetReply(r)
-				w.WriteMsg(cachedMsg)
-			} else {
-				// Cache miss:
-				respMsg, err := s.QueryOverHTTPS(r)
-
-				if err == nil {
-					s.NameCache.SetDefault(requestedName, respMsg)
-					respMsg.SetReply(r)
-					w.WriteMsg(respMsg)
-				} else {
-					log.Printf("requested name = %s", requestedName)
-					WriteErrorLog(err)
-					dns.HandleFailed(w, r)
-				}
+func (s *SecHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	info := queryInfo{client: s.identifyClient(w)}
+
+	var respMsg *dns.Msg
+	if s.RateLimit != nil && !s.RateLimit.Allow(info.client.IP) {
+		info.reason = "ratelimit"
+		if s.Config.RateLimit.Action == RATELIMIT_DROP {
+			s.logQuery(w, r, nil, &info, start)
+			return
+		}
+		info.setEDE(EDE_PROHIBITED, "Client query rate limit exceeded")
+		respMsg = new(dns.Msg)
+		respMsg.SetRcode(r, dns.RcodeRefused)
+	} else if m := s.checkQuota(r, &info); m != nil {
+		respMsg = m
+	} else if s.RRL != nil && s.Config.RRL.MinimalANY && listenerName(w) == "udp" && minimalANY(r) {
+		// RFC 8482: ANY 쿼리는 증폭 공격에 자주 사용되므로 UDP에서는 작은 응답만 보낸다.
+		respMsg = anyReply(r)
+	} else {
+		respMsg = s.resolve(r, &info)
+	}
+	if s.Search != nil {
+		respMsg = s.Search.Expand(r, respMsg, func(expanded *dns.Msg) *dns.Msg {
+			sub := queryInfo{client: info.client, trace: info.trace}
+			info.tracef("search", "trying %s", expanded.Question[0].Name)
+			m := s.resolve(expanded, &sub)
+			if m != nil && m.Rcode == dns.RcodeSuccess {
+				info.cached, info.blocked, info.reason = sub.cached, sub.blocked, sub.reason
+				info.upstream, info.view = sub.upstream, sub.view
 			}
+			return m
+		})
+	}
+	if s.RRL != nil {
+		// SERVFAIL 응답도 errors_per_second로 제한한다.
+		limited := respMsg
+		if limited == nil {
+			limited = new(dns.Msg)
+			limited.SetRcode(r, dns.RcodeServerFailure)
+		}
+		switch s.RRL.Check(w.RemoteAddr(), limited) {
+		case RRL_DROP:
+			info.reason = "rrl"
+			s.logQuery(w, r, respMsg, &info, start)
+			return
+		case RRL_SLIP:
+			info.reason = "rrl"
+			tc := new(dns.Msg)
+			tc.SetReply(r)
+			tc.Truncated = true
+			w.WriteMsg(replyEDNS(r, tc))
+			s.logQuery(w, r, respMsg, &info, start)
+			return
+		}
+	}
+	if respMsg != nil {
+		out := withEDE(r, replyEDNS(r, respMsg), info.ede)
+		if listenerName(w) == "udp" {
+			out = truncateUDP(r, out)
+		}
+		w.WriteMsg(out)
+		if !info.blocked && len(r.Question) > 0 {
+			s.IPSets.Observe(r.Question[0].Name, respMsg)
+		}
+		if s.Audit != nil && info.upstream != "" && !info.cached {
+			s.Audit.Mirror(r, respMsg)
 		}
 	} else {
-		// all other request: just relay
-		respMsg, err := s.QueryOverHTTPS(r)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(withEDE(r, replyEDNS(r, m), info.ede))
+	}
+
+	s.logQuery(w, r, respMsg, &info, start)
+}
+
+// checkQuota counts a client query in the quotas. Returns the REFUSED reply
+// if a quota is exceeded, or nil after the throttle delay.
+func (s *SecHandler) checkQuota(r *dns.Msg, info *queryInfo) *dns.Msg {
+	action, delay := s.Quotas.Check(&info.client)
+	if action == QUOTA_THROTTLE {
+		if s.Quotas.Throttle(delay) {
+			info.tracef("quota", "exceeded: throttled %s", delay)
+			return nil
+		}
+		// 지연 중인 쿼리가 너무 많으면 goroutine이 쌓이지 않도록 거부한다.
+		action = QUOTA_REFUSE
+	}
+	if action != QUOTA_REFUSE {
+		return nil
+	}
+	info.reason = "quota"
+	info.setEDE(EDE_PROHIBITED, "Query quota exceeded")
+	info.tracef("quota", "exceeded: refused")
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeRefused)
+	return m
+}
+
+func (s *SecHandler) resolve(r *dns.Msg, info *queryInfo) *dns.Msg {
+	if s.Chaos != nil {
+		if m := s.Chaos.Reply(r); m != nil {
+			info.tracef("chaos", "CHAOS class: %s", dns.RcodeToString[m.Rcode])
+			return m
+		}
+	}
+
+	info.view = s.Views.Select(&info.client)
+	if v := info.view; v != nil && len(r.Question) > 0 {
+		info.tracef("view", "%s", v.cfg.Name)
+		if v.refuse.Match(r.Question[0].Name) {
+			info.tracef("view", "refused in view %s", v.cfg.Name)
+			return s.block(r, info, "view:"+v.cfg.Name)
+		}
+		if m := v.records.Reply(r); m != nil {
+			info.tracef("view", "answered from the records of view %s", v.cfg.Name)
+			return m
+		}
+	}
+
+	if len(r.Question) > 0 && (info.view == nil || !info.view.cfg.HideLocal) {
+		if m := s.ClientRecs.Reply(&info.client, r); m != nil {
+			info.tracef("client_records", "answered locally")
+			return m
+		}
+		if m := s.LocalRecs.Reply(r); m != nil {
+			info.tracef("local_records", "answered locally")
+			return m
+		}
+		if s.Hosts != nil {
+			if m := s.Hosts.Reply(r); m != nil {
+				info.tracef("hosts", "answered from the hosts file")
+				return m
+			}
+		}
+	}
+
+	// stub zone: 캐시와 업스트림을 거치지 않고 권한 서버에 직접 질의한다.
+	if len(r.Question) > 0 {
+		if z := s.StubZones.Lookup(r.Question[0].Name); z != nil {
+			info.upstream = "stub:" + z.zone
+			m, err := z.Exchange(r)
+			if err != nil {
+				info.tracef("stub_zone", "%s: %s", z.zone, err)
+				info.setEDE(EDE_NO_REACHABLE_AUTHORITY, "Stub zone servers unreachable")
+				info.err = err
+				if !s.QueryLog.ToFile() {
+					WriteErrorLogMsg("Stub zone "+z.zone+" query failed.", err)
+				}
+				return nil
+			}
+			info.tracef("stub_zone", "%s: %s", z.zone, dns.RcodeToString[m.Rcode])
+			return m
+		}
+	}
+
+	if s.Canary != nil {
+		if m := s.Canary.Reply(r); m != nil {
+			info.reason = "canary"
+			info.tracef("canary", "canary domain: NXDOMAIN")
+			return m
+		}
+	}
+
+	// 내부 이름이 업스트림으로 유출되지 않도록 로컬에서 응답한다.
+	if s.SpecialUse != nil && (len(r.Question) == 0 || s.Forwarders.Lookup(r.Question[0].Name) == nil) {
+		if m := s.SpecialUse.Reply(r); m != nil {
+			info.tracef("special_use", "special-use domain: answered locally")
+			return m
+		}
+	}
+
+	// 차단 페이지에서 일시 허용된 이름
+	allowed := len(r.Question) == 0 || (s.Sinkhole != nil && s.Sinkhole.Allowed(r.Question[0].Name))
+	if allowed && len(r.Question) > 0 {
+		info.tracef("sinkhole", "temporarily allowed: filters skipped")
+	}
+	if !allowed && s.Allowlist.Match(r.Question[0].Name) {
+		allowed = true
+		info.tracef("allowlist", "allowed: filters skipped")
+	}
+
+	if !allowed && s.DGA != nil {
+		if s.DGA.Check(r.Question[0].Name) {
+			info.reason = "dga"
+			info.tracef("dga", "suspected DGA domain (score %.1f, action %s)", s.DGA.Score(r.Question[0].Name), s.Config.DGA.Action)
+			if s.Config.DGA.Action == "block" {
+				return s.block(r, info, "dga")
+			}
+		} else if info.tracing() {
+			info.tracef("dga", "pass (score %.1f)", s.DGA.Score(r.Question[0].Name))
+		}
+	}
+
+	if !allowed && s.Tunnel != nil {
+		if s.Tunnel.Observe(r.Question[0].Name, r.Question[0].Qtype) {
+			info.reason = "tunneling"
+			info.tracef("tunneling", "suspected DNS tunneling (action %s)", s.Config.Tunneling.Action)
+			if s.Config.Tunneling.Action == "block" {
+				return s.block(r, info, "tunneling")
+			}
+		} else {
+			info.tracef("tunneling", "pass")
+		}
+	}
+
+	if !allowed && s.Firewall.Enabled() {
+		if !s.Firewall.Allowed(r.Question[0].Name) {
+			// default-deny: not in the allowlist
+			info.tracef("firewall", "default-deny: not in the allowlist")
+			return s.block(r, info, "firewall")
+		}
+		info.tracef("firewall", "allowed")
+	}
+
+	if !allowed {
+		var lists map[string]bool
+		if info.view != nil {
+			lists = info.view.blocklists
+		}
+		if list, ok := s.Blocklists.Match(r.Question[0].Name, lists); ok {
+			info.tracef("blocklist", "listed in %s", list)
+			return s.block(r, info, "blocklist:"+list)
+		}
+	}
+
+	if s.SafeSearch != nil && len(r.Question) > 0 && r.Question[0].Qclass == dns.ClassINET {
+		if target := s.SafeSearch.Target(r.Question[0].Name); target != "" {
+			info.reason = "safesearch"
+			info.tracef("safesearch", "rewritten to %s", target)
+			return s.SafeSearch.Rewrite(r, target, func(rewritten *dns.Msg) *dns.Msg {
+				sub := queryInfo{client: info.client, trace: info.trace}
+				m := s.resolve(rewritten, &sub)
+				info.cached, info.upstream, info.ede, info.err = sub.cached, sub.upstream, sub.ede, sub.err
+				return m
+			})
+		}
+	}
+
+	if len(r.Question) == 1 && r.Opcode == dns.OpcodeQuery {
+		key := cacheKey(r) + s.ECS.keySuffix(r) + info.view.keySuffix()
+
+		if cachedMsg, found := s.NameCache.Get(key); found {
+			// Cache hit:
+			info.tracef("cache", "hit")
+			s.Metrics.RecordCache(true)
+			s.NameCache.Prefetch(key, s.backgroundQuery(r, info))
+			cachedMsg.SetReply(r)
+			info.cached = true
+			return cachedMsg
+		}
+		info.tracef("cache", "miss")
+		s.Metrics.RecordCache(false)
+
+		// Cache miss: 같은 쿼리가 이미 업스트림에 보내졌으면 그 응답을 기다린다.
+		respMsg, shared, err := s.Coalescer.Do(key, info, func() (*dns.Msg, error) {
+			return s.QueryOverHTTPS(r, info)
+		})
+		if shared {
+			info.tracef("coalesce", "answered by a concurrent identical query")
+		}
+		if err == errRebinding {
+			return s.block(r, info, "rebinding")
+		}
 
 		if err == nil {
+			s.NameCache.ClampTTLs(respMsg)
+			if !shared {
+				s.NameCache.Set(key, respMsg)
+				s.Pinned.Store(respMsg)
+			}
 			respMsg.SetReply(r)
-			w.WriteMsg(respMsg)
-		} else {
-			dns.HandleFailed(w, r)
+			return respMsg
+		}
+
+		info.err = err
+		// 쿼리 로그 파일이 있으면 쿼리별 오류는 그 파일에만 기록한다.
+		if !s.QueryLog.ToFile() && (s.Offline == nil || !s.Offline.Offline()) {
+			log.Printf("requested name = %s %s", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
+			WriteErrorLog(err)
+		}
+		if staleMsg, found := s.NameCache.Stale(key); found {
+			info.cached = true
+			info.setEDE(EDE_STALE_ANSWER, "Upstream failed: stale answer")
+			info.tracef("cache", "upstream failed: served a stale answer")
+			s.NameCache.Refresh(key, s.backgroundQuery(r, info), s.done)
+			staleMsg.SetReply(r)
+			return staleMsg
 		}
+		return s.pinnedReply(r, info)
+	}
+
+	// all other request: just relay
+	respMsg, err := s.QueryOverHTTPS(r, info)
+	if err == errRebinding {
+		return s.block(r, info, "rebinding")
+	}
+
+	if err == nil {
+		s.Pinned.Store(respMsg)
+		respMsg.SetReply(r)
+		return respMsg
 	}
+	return s.pinnedReply(r, info)
 }
 
-func (s SecHandler) QueryOverHTTPS(r *dns.Msg) (*dns.Msg, error) {
-	wire, err := r.Pack()
+// backgroundQuery returns a function that sends the question of r to the
+// upstream, for cache refreshes after r is answered.
+func (s *SecHandler) backgroundQuery(r *dns.Msg, info *queryInfo) func() (*dns.Msg, error) {
+	client, view := info.client, info.view
+	q := new(dns.Msg)
+	q.SetQuestion(r.Question[0].Name, r.Question[0].Qtype)
+	q.Question[0].Qclass = r.Question[0].Qclass
+	q.CheckingDisabled = r.CheckingDisabled // part of the cache key
+	if opt := r.IsEdns0(); opt != nil {
+		q.SetEdns0(opt.UDPSize(), opt.Do())
+		if e := clientSubnet(r); e != nil {
+			q.IsEdns0().Option = append(q.IsEdns0().Option, e)
+		}
+	}
+	return func() (*dns.Msg, error) {
+		return s.QueryOverHTTPS(q, &queryInfo{client: client, view: view})
+	}
+}
+
+// pinnedReply answers after an upstream failure with the last good response of a
+// pinned name, or a stale response if offline mode is enabled.
+func (s *SecHandler) pinnedReply(r *dns.Msg, info *queryInfo) *dns.Msg {
+	if m := s.Pinned.Reply(r); m != nil {
+		info.cached = true
+		info.setEDE(EDE_STALE_ANSWER, "Upstream failed: last good answer")
+		info.tracef("pinned", "upstream failed: served the last good answer")
+		return m
+	}
+	if s.Offline != nil {
+		if m := s.Offline.Reply(r); m != nil {
+			info.cached = true
+			info.setEDE(EDE_STALE_ANSWER, "Upstream unreachable: stale answer")
+			info.tracef("offline", "upstream failed: served a stale answer")
+			return m
+		}
+	}
+	return nil
+}
+
+// block answers a blocked query with the sinkhole address if enabled, otherwise REFUSED.
+func (s *SecHandler) block(r *dns.Msg, info *queryInfo, reason string) *dns.Msg {
+	info.blocked = true
+	info.reason = reason
+	info.setEDE(EDE_BLOCKED, "Blocked by policy ("+reason+")")
+	if s.Sinkhole != nil {
+		if m := s.Sinkhole.Reply(r, reason); m != nil {
+			return m
+		}
+	}
+	return s.Blocking.Reply(r)
+}
+
+func (s *SecHandler) identifyClient(w dns.ResponseWriter) clientID {
+	c := clientID{}
+
+	ip, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		ip = w.RemoteAddr().String()
+	}
+	// dual-stack 소켓의 IPv4 클라이언트는 IPv4-mapped 주소(::ffff:a.b.c.d)로 받는다.
+	// link-local 주소의 zone(fe80::1%eth0)은 버린다.
+	if i := strings.IndexByte(ip, '%'); i >= 0 {
+		ip = ip[:i]
+	}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+	c.IP = ip
+	c.Listener = listenerName(w)
+
+	if s.Neighbors != nil {
+		c.MAC = s.Neighbors.Lookup(ip)
+	}
+
+	if d, ok := w.(deviceIdentifier); ok && d.Device() != "" {
+		c.Device = d.Device()
+	}
+	if s.ClientNames != nil {
+		c.Name = s.ClientNames.Lookup(&c)
+	}
+	c.Profile = s.clientProfile(&c)
+	return c
+}
+
+// clientProfile returns the profile of the device, or the profile set by
+// profile.set for the device or the client.
+func (s *SecHandler) clientProfile(c *clientID) string {
+	s.profileMu.RLock()
+	defer s.profileMu.RUnlock()
+	for _, id := range []string{c.Device, c.MAC, c.IP, c.Name} {
+		if p, ok := s.Profiles[id]; ok && id != "" {
+			return p
+		}
+	}
+	return s.Devices[c.Device]
+}
+
+// SetProfile sets the profile of a device or a client (MAC, IP or client name).
+// 설정된 기기의 profile은 적용된 설정에도 반영한다.
+func (s *SecHandler) SetProfile(id, profile string) {
+	s.profileMu.Lock()
+	_, device := s.Devices[id]
+	if device {
+		s.Devices[id] = profile
+	} else {
+		s.Profiles[id] = profile
+	}
+	s.profileMu.Unlock()
+
+	if device {
+		s.UpdateConfig(func(cfg *Config) {
+			for i := range cfg.Clients.Devices {
+				if cfg.Clients.Devices[i].ID == id {
+					cfg.Clients.Devices[i].Profile = profile
+				}
+			}
+		})
+	}
+}
+
+func (s *SecHandler) logQuery(w dns.ResponseWriter, r *dns.Msg, resp *dns.Msg, info *queryInfo, start time.Time) {
+	s.Stats.Record(info, resp == nil)
+	s.Metrics.RecordQuery(r, resp, info)
+
+	if len(r.Question) == 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	s.Stats.RecordLatency(r.Question[0].Name, info, elapsed)
+	if !info.view.logged(info.blocked) {
+		return
+	}
+
+	rcode := dns.RcodeServerFailure
+	var answers []AnswerInfo
+	if resp != nil {
+		rcode = resp.Rcode
+		answers = s.GeoIP.Annotate(resp)
+	}
+
+	s.QueryLog.Add(QueryLogEntry{
+		Time:       start,
+		Client:     info.client.IP,
+		ClientMAC:  info.client.MAC,
+		ClientName: info.client.Name,
+		Device:     info.client.Device,
+		Profile:    info.client.Profile,
+		View:       viewName(info.view),
+		Name:       strings.ToLower(r.Question[0].Name),
+		Qtype:      dns.TypeToString[r.Question[0].Qtype],
+		Rcode:      dns.RcodeToString[rcode],
+		Blocked:    info.blocked,
+		Reason:     info.reason,
+		Cached:     info.cached,
+		Upstream:   info.upstream,
+		ElapsedMs:  float64(elapsed) / float64(time.Millisecond),
+		Error:      errString(info.err),
+		Answers:    answers,
+	})
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func viewName(v *view) string {
+	if v == nil {
+		return ""
+	}
+	return v.cfg.Name
+}
+
+func (s *SecHandler) QueryOverHTTPS(r *dns.Msg, info *queryInfo) (*dns.Msg, error) {
+	// conditional forwarding: 내부 DNS 서버로 보낸다. (ECS, DNSSEC 검증 없음)
+	if len(r.Question) > 0 {
+		if z := s.Forwarders.Lookup(r.Question[0].Name); z != nil {
+			m, server, err := s.Forwarders.Exchange(z, r)
+			info.upstream = "forward:" + server
+			if err != nil {
+				info.tracef("forward", "%s: %s", z.zone, err)
+				info.setEDE(EDE_NETWORK_ERROR, "Forward servers unreachable")
+				return nil, err
+			}
+			info.tracef("forward", "%s via %s: %s", z.zone, server, dns.RcodeToString[m.Rcode])
+			return m, nil
+		}
+	}
+
+	if s.Offline != nil && s.Offline.Offline() {
+		info.tracef("offline", "offline: upstream skipped")
+		info.setEDE(EDE_NO_REACHABLE_AUTHORITY, "Upstream unreachable (offline)")
+		return nil, newErr("Offline.")
+	}
+
+	r = s.ECS.Apply(r)
+
+	var m *dns.Msg
+	var err error
+	if s.DNSSEC != nil && !r.CheckingDisabled {
+		m, err = s.validatedExchange(r, info)
+	} else {
+		m, err = s.exchangeUpstreams(r, info)
+	}
+
+	if s.Offline != nil {
+		s.Offline.Record(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Rebind != nil && len(r.Question) > 0 {
+		if found, block := s.Rebind.Check(r.Question[0].Name, m); block {
+			// 차단 응답은 캐시, pinned, offline에 저장되지 않도록 오류로 반환한다.
+			info.tracef("rebinding", "LAN address in the upstream answer: blocked")
+			return nil, errRebinding
+		} else if found {
+			info.reason = "rebinding"
+			info.tracef("rebinding", "LAN address in the upstream answer: removed")
+		}
+	}
+
+	if s.Offline != nil {
+		s.Offline.Store(m)
+	}
+	return m, nil
+}
+
+// errRebinding is returned by QueryOverHTTPS if the upstream answer is blocked by
+// the rebinding protection. The caller answers with s.block.
+var errRebinding = newErr("LAN address in the upstream answer.")
+
+// exchangeUpstreams sends r to the selected upstreams.
+func (s *SecHandler) exchangeUpstreams(r *dns.Msg, info *queryInfo) (*dns.Msg, error) {
+	// 오류나 timeout이면 다음 업스트림으로 다시 보낸다. (최대 max_attempts 개)
+	var m *dns.Msg
+	var err error
+	var overloaded bool
+	var names map[string]bool
+	if info.view != nil {
+		names = info.view.upstreams
+	}
+	list := s.Upstreams.SelectNamed(names)
+	i := 0
+	if n := s.Config.Upstream.Race; n > 1 && len(list) > 1 {
+		if n > len(list) {
+			n = len(list)
+		}
+		m, err = s.raceUpstreams(list[:n], r, info)
+		overloaded = err == errConcurrencyLimit
+		i = n
+	}
+	for ; err != nil || m == nil; i++ {
+		if i >= len(list) || i >= s.Config.Upstream.MaxAttempts {
+			break
+		}
+		u := list[i]
+		if i > 0 {
+			info.tracef("upstream", "failing over to %s", u.Name)
+		}
+		info.upstream = u.Name
+		if m, err = s.exchangeUpstream(u, r, info); err == nil {
+			break
+		}
+		overloaded = err == errConcurrencyLimit
+	}
+
+	if overloaded {
+		info.setEDE(EDE_NETWORK_ERROR, "Upstream overloaded")
+	} else if err != nil {
+		info.setEDE(EDE_NETWORK_ERROR, "Upstream network error")
+	}
+	return m, err
+}
+
+var errConcurrencyLimit = newErr("Upstream concurrency limit reached.")
+
+// raceUpstreams sends r to the upstreams at the same time and returns the first
+// successful answer. 늦게 도착한 응답은 버린다.
+func (s *SecHandler) raceUpstreams(list []*Upstream, r *dns.Msg, info *queryInfo) (*dns.Msg, error) {
+	type result struct {
+		u   *Upstream
+		sub *queryInfo
+		m   *dns.Msg
+		err error
+	}
+	results := make(chan result, len(list))
+	start := time.Now()
+	for _, u := range list {
+		go func(u *Upstream) {
+			// trace는 동시에 기록할 수 없으므로 결과만 기록한다.
+			sub := &queryInfo{client: info.client}
+			m, err := s.exchangeUpstream(u, r, sub)
+			results <- result{u, sub, m, err}
+		}(u)
+	}
+
+	var err error
+	for range list {
+		res := <-results
+		if res.err != nil {
+			info.tracef("upstream", "race: %s failed after %s: %s", res.u.Name, time.Since(start), res.err)
+			err = res.err
+			continue
+		}
+		info.tracef("upstream", "race: %s won, %s in %s", res.u.Name, dns.RcodeToString[res.m.Rcode], time.Since(start))
+		info.upstream = res.u.Name
+		if res.sub.ede != nil {
+			info.ede = res.sub.ede
+		}
+		return res.m, nil
+	}
+	return nil, err
+}
+
+// exchangeUpstream sends r to a single upstream.
+func (s *SecHandler) exchangeUpstream(u *Upstream, r *dns.Msg, info *queryInfo) (*dns.Msg, error) {
+	info.tracef("upstream", "%s (%s)", u.Name, u.URL)
+
+	if !u.Acquire() {
+		info.tracef("upstream", "%s: concurrency limit reached", u.Name)
+		return nil, errConcurrencyLimit
+	}
+
+	start := time.Now()
+	var m *dns.Msg
+	var err error
+	if s.Fault != nil {
+		m, err = s.Fault.Exchange(u.Name, r, func() (*dns.Msg, error) {
+			return u.Exchange(r)
+		})
+	} else {
+		m, err = u.Exchange(r)
+	}
+	if err == nil {
+		// 질문이 다른 응답은 업스트림의 오류로 처리한다.
+		err = checkResponse(r, m)
+	}
+	u.Record(time.Since(start), err)
+	s.Metrics.RecordUpstream(u.Name, time.Since(start), err)
+	u.Release(err)
+	if err != nil {
+		info.tracef("upstream", "%s failed after %s: %s", u.Name, time.Since(start), err)
+		return nil, err
+	}
+
+	if n := sanitizeResponse(r, m); n > 0 {
+		info.tracef("upstream", "%s: %d out-of-bailiwick records removed", u.Name, n)
+	}
+	if s.NXHijack != nil {
+		if _, stripped := s.NXHijack.Filter(u.Name, m); stripped {
+			info.setEDE(EDE_FILTERED, "Upstream wildcard answer removed")
+			info.tracef("nxdomain_hijack", "wildcard answer of %s replaced with NXDOMAIN", u.Name)
+		}
+	}
+	info.tracef("upstream", "%s in %s", dns.RcodeToString[m.Rcode], time.Since(start))
+	return m, nil
+}
+
+// exchangeHTTPS sends r to the DoH server at url.
+// method: DOH_METHOD_POST or DOH_METHOD_GET
+func exchangeHTTPS(client *http.Client, url string, r *dns.Msg, method string, contentType string) (*dns.Msg, error) {
+	q := r
+	if method == DOH_METHOD_GET && r.Id != 0 {
+		// ID가 다르면 같은 쿼리도 HTTP 캐시에서 다른 URL이 된다.
+		q = r.Copy()
+		q.Id = 0
+	}
+	wire, err := q.Pack()
 
 	if err == nil {
-		resp, err := makeHttpsRequest(wire)
+		resp, err := makeHttpsRequest(client, url, wire, method, contentType)
+
 		if err == nil {
 			// Good response then
 			m := new(dns.Msg)
 			err := m.Unpack(resp)
 			if err == nil {
+				m.Id = r.Id
 				return m, nil
 			}
 			return nil, newErr("Can't unpack message from wireformat.")
 		}
-		return nil, newErr("HTTPS Request failed.")
+		e := &DohError{msg: "HTTPS Request failed: " + err.Error()}
+		if de, ok := err.(*DohError); ok {
+			e.status = de.status
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			e.timeout = true
+		}
+		return nil, e
 	}
 	return nil, newErr("Can't pack message from wireformat.")
 }
 
-func getDohHostAddr() (*dns.Msg, error) {
+// dohHost returns the DoH host name (FQDN) and port whose addresses are
+// bootstrapped and ranked by the endpoint selector.
+func (c *UpstreamConfig) dohHost() (host string, port string) {
+	if c.Host != "" {
+		return dns.Fqdn(strings.ToLower(c.Host)), "443"
+	}
+	for _, sc := range c.Servers {
+		if strings.HasPrefix(sc.URL, DNSCRYPT_STAMP_PREFIX) {
+			continue
+		}
+		u, err := url.Parse(sc.URL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		port = u.Port()
+		if port == "" && u.Scheme == "tls" {
+			port = DOT_PORT
+		} else if port == "" {
+			port = "443"
+		}
+		return dns.Fqdn(strings.ToLower(u.Hostname())), port
+	}
+	return "", ""
+}
+
+// getDohHostAddr obtains the A and AAAA records of the DoH host from the
+// bootstrap servers, in order.
+// IPv6만 사용하는 네트워크에서는 IPv4 DNS 서버에 연결할 수 없으므로
+// 다음 서버(e.g. IPv6 DNS 서버)로 다시 시도한다.
+func getDohHostAddr(host string, servers []string) (*dns.Msg, error) {
+	if ip := net.ParseIP(strings.TrimSuffix(host, ".")); ip != nil {
+		// 주소로 지정된 업스트림은 bootstrap이 필요 없다.
+		return hostAddrMsg(host, ip), nil
+	}
+
+	var err error
+	for _, server := range servers {
+		var h *dns.Msg
+		if h, err = bootstrapHost(host, server); err == nil {
+			return h, nil
+		}
+	}
+	return nil, err
+}
+
+// hostAddrMsg returns a message with an address record of host.
+func hostAddrMsg(host string, ip net.IP) *dns.Msg {
 	m := new(dns.Msg)
-	m.SetQuestion(CLOUDFLARE_DOH_HOST, dns.TypeA)
+	if ip4 := ip.To4(); ip4 != nil {
+		m.SetQuestion(host, dns.TypeA)
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: LOCAL_RECORD_TTL}, A: ip4})
+	} else {
+		m.SetQuestion(host, dns.TypeAAAA)
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: LOCAL_RECORD_TTL}, AAAA: ip})
+	}
+	return m
+}
 
+// bootstrapHost returns a message with the A and AAAA records of host.
+// server: ip:port, or BOOTSTRAP_SYSTEM
+func bootstrapHost(host string, server string) (*dns.Msg, error) {
+	if server == BOOTSTRAP_SYSTEM {
+		return systemLookupHost(host)
+	}
 	client := new(dns.Client)
-	r, _, err := client.Exchange(m, CLOUDFLARE_DNS)
-	return r, err
+
+	var result *dns.Msg
+	var err error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(host, qtype)
+
+		r, _, e := client.Exchange(m, server)
+		if e != nil {
+			err = e
+			continue
+		}
+		if result == nil {
+			result = r
+		} else {
+			result.Answer = append(result.Answer, r.Answer...)
+		}
+	}
+	if result == nil {
+		return nil, err
+	}
+	if len(result.Answer) == 0 {
+		return nil, newErr("No address of " + host + " from " + server)
+	}
+	return result, nil
+}
+
+// systemLookupHost returns a message with the addresses of host from the OS resolver.
+// OS의 DNS 서버가 이 서비스이더라도 DoH 호스트는 EndpointSelector가 응답하므로 순환하지 않는다.
+func systemLookupHost(host string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BOOTSTRAP_SYSTEM_TIMEOUT)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, strings.TrimSuffix(host, "."))
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, newErr("No address of " + host + " from the system resolver")
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return hostAddrsMsg(host, ips), nil
+}
+
+// hostAddrsMsg returns a message with the address records of host.
+func hostAddrsMsg(host string, ips []net.IP) *dns.Msg {
+	result := hostAddrMsg(host, ips[0])
+	for _, ip := range ips[1:] {
+		result.Answer = append(result.Answer, hostAddrMsg(host, ip).Answer...)
+	}
+	return result
+}
+
+// parseIPs parses the IP addresses of the configuration.
+func parseIPs(addrs []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, newErr("Invalid IP address '" + a + "'.")
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// dialHost returns the host name dialed for the upstream. (ODoH: the proxy)
+func (sc *UpstreamServerConfig) dialHost() string {
+	if strings.HasPrefix(sc.URL, DNSCRYPT_STAMP_PREFIX) {
+		return ""
+	}
+	u, err := url.Parse(sc.URL)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "odoh" {
+		if u, err = url.Parse(u.Query().Get("proxy")); err != nil {
+			return ""
+		}
+	}
+	return u.Hostname()
 }
 
 type SvrStopFunc func() error
 type SvrErrorHandlerFunc func(err error)
 
-func RunDNS(port int, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+// NewSecHandler obtains the DOH host address and creates the request handler.
+func NewSecHandler(cfg *Config) (*SecHandler, error) {
+	pinned := NewPinnedCache(cfg.Cache.Pinned, appPath(PINNED_CACHE_FILE))
+
 	// get DOH host address
-	h, e := getDohHostAddr()
+	host, port := cfg.Upstream.dohHost()
+	lookupHost := func() (*dns.Msg, error) {
+		return getDohHostAddr(host, cfg.Upstream.Bootstrap)
+	}
+	if len(cfg.Upstream.HostAddrs) > 0 {
+		// 주소가 지정되면 bootstrap 쿼리를 보내지 않는다. (TLS의 SNI, 인증서 검증은 호스트 이름으로)
+		ips, err := parseIPs(cfg.Upstream.HostAddrs)
+		if err != nil {
+			return nil, err
+		}
+		lookupHost = func() (*dns.Msg, error) {
+			return hostAddrsMsg(host, ips), nil
+		}
+	}
+	h, e := lookupHost()
 	if e != nil {
-		WriteErrorLogMsg("Failed to obtain Cloudflare's DOH server address.", e)
+		WriteErrorLogMsg("Failed to obtain the DOH server address of "+host, e)
 
 		// 2019.3.5. DOH 서버 주소를 가져오는데 실패하였을 경우 잠시 기다린 후
 		// 다시 시도한다. (5회까지)
@@ -160,40 +1106,487 @@ func RunDNS(port int, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
 			time.Sleep(time.Second * 1)
 
 			log.Printf("retry %d...", i)
-			h, e = getDohHostAddr()
+			h, e = lookupHost()
 
 			if e != nil {
-				WriteErrorLogMsg("Failed to obtain Cloudflare's DOH server address.", e)
+				WriteErrorLogMsg("Failed to obtain the DOH server address of "+host, e)
 			} else {
 				break
 			}
 		}
 
 		if e != nil {
-			return nil, newErr("Failed to obtain Cloudflare's DOH server address. The DNS service could not be started.")
+			// DoH 호스트 이름이 pinned 이면 마지막으로 얻은 주소를 사용한다.
+			q := new(dns.Msg)
+			q.SetQuestion(host, dns.TypeA)
+			if h = pinned.Reply(q); h == nil {
+				return nil, newErr("Failed to obtain the DOH server address of " + host + ". The DNS service could not be started.")
+			}
+			log.Printf("Using the pinned address of %s.", host)
+		}
+	}
+	if e == nil {
+		pinned.Store(h)
+	}
+
+	endpoints := NewEndpointSelector(host, port, h)
+	endpoints.Probe()
+
+	for i := range cfg.Upstream.Servers {
+		sc := &cfg.Upstream.Servers[i]
+		if len(sc.Addrs) == 0 {
+			continue
+		}
+		ips, err := parseIPs(sc.Addrs)
+		if err != nil {
+			return nil, err
+		}
+		endpoints.AddHost(sc.dialHost(), ips)
+	}
+
+	upstreams, err := NewUpstreamPool(&cfg.Upstream, endpoints.DialContext)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &SecHandler{
+		Upstreams:   upstreams,
+		Config:      cfg,
+		ServiceType: "UDP",
+		Endpoints:   endpoints,
+		NameCache:   NewDNSCache(cfg.Cache, cachePath(cfg.Cache)),
+		Pinned:      pinned,
+		QueryLog:    NewQueryLog(cfg.QueryLog),
+		Devices:     map[string]string{},
+		Profiles:    map[string]string{},
+		Stats:       NewStats(),
+		done:        make(chan struct{}),
+		Coalescer:   newQueryCoalescer(),
+	}
+	if cfg.Metrics.Enabled {
+		handler.Metrics = NewMetrics()
+	}
+
+	ecs, err := NewECSPolicy(cfg.Upstream.ECS, cfg.Upstream.ECSSubnet)
+	if err != nil {
+		return nil, err
+	}
+	handler.ECS = ecs
+
+	blocking, err := NewBlockResponse(cfg.Blocking)
+	if err != nil {
+		return nil, err
+	}
+	handler.Blocking = blocking
+
+	if cfg.Rebinding.Enabled {
+		rebind, err := NewRebindProtection(cfg.Rebinding)
+		if err != nil {
+			return nil, err
+		}
+		handler.Rebind = rebind
+	}
+
+	if cfg.SafeSearch.Enabled {
+		safeSearch, err := NewSafeSearch(cfg.SafeSearch)
+		if err != nil {
+			return nil, err
+		}
+		handler.SafeSearch = safeSearch
+	}
+
+	for _, d := range cfg.Clients.Devices {
+		handler.Devices[d.ID] = d.Profile
+	}
+
+	if cfg.GeoIP.Enabled {
+		var paths []string
+		for _, p := range cfg.GeoIP.Databases {
+			paths = append(paths, resolveAppPath(p))
+		}
+
+		g, err := OpenGeoIP(paths)
+		if err != nil {
+			// GeoIP는 부가 기능이므로 서비스는 계속 실행한다.
+			WriteErrorLogMsg("Can't open GeoIP database. GeoIP annotation is disabled.", err)
+		} else {
+			handler.GeoIP = g
+		}
+	}
+
+	var resolvePTR func(*dns.Msg) *dns.Msg
+	if cfg.Clients.LearnNames {
+		resolvePTR = func(q *dns.Msg) *dns.Msg {
+			return handler.resolve(q, &queryInfo{client: clientID{IP: "127.0.0.1", Listener: "udp"}})
+		}
+	}
+	clientNames, err := NewClientNames(cfg.Clients.Names, resolvePTR)
+	if err != nil {
+		return nil, err
+	}
+	handler.ClientNames = clientNames
+
+	if cfg.Clients.IdentifyByMAC {
+		handler.Neighbors = NewNeighborTable(cfg.Clients.NeighborRefresh.Duration)
+	}
+
+	handler.Allowlist = NewDomainRules()
+	for _, rule := range cfg.Allowlist.Domains {
+		if err := handler.Allowlist.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range cfg.Allowlist.Files {
+		if err := handler.Allowlist.AddFile(resolveAppPath(p)); err != nil {
+			return nil, err
+		}
+	}
+
+	fw, err := NewFirewall(&cfg.Firewall, host)
+	if err != nil {
+		return nil, err
+	}
+	handler.Firewall = fw
+	if fw.Enabled() {
+		log.Printf("Default-deny firewall mode: %d allowed domains.", fw.allow.Len())
+	}
+
+	handler.LocalRecs = NewLocalRecords()
+	for _, rec := range cfg.Local.Records {
+		if err := handler.LocalRecs.Add(rec); err != nil {
+			return nil, err
+		}
+	}
+	// DNS over HTTPS server name: answered with the ranked endpoints
+	endpoints.OnChange(handler.LocalRecs.SetDynamic)
+	if cfg.Hosts.Enabled {
+		hosts, err := NewHostsFile(cfg.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		handler.Hosts = hosts
+	}
+
+	if cfg.RRL.Enabled {
+		rl, err := NewRRL(cfg.RRL)
+		if err != nil {
+			return nil, err
+		}
+		handler.RRL = rl
+	}
+	if cfg.RateLimit.Enabled {
+		limiter, err := NewClientRateLimiter(cfg.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		handler.RateLimit = limiter
+	}
+
+	stubs, err := NewStubZones(cfg.StubZones)
+	if err != nil {
+		return nil, err
+	}
+	handler.StubZones = stubs
+
+	if len(cfg.Forwards) > 0 {
+		forwarders, err := NewForwarders(cfg.Forwards, endpoints.DialContext)
+		if err != nil {
+			return nil, err
+		}
+		handler.Forwarders = forwarders
+	}
+
+	views, err := NewViews(cfg.Views)
+	if err != nil {
+		return nil, err
+	}
+	handler.Views = views
+
+	crs, err := NewClientRecords(cfg.ClientRecords)
+	if err != nil {
+		return nil, err
+	}
+	handler.ClientRecs = crs
+
+	bls, err := NewBlocklists(cfg.Blocklists, appPath(BLOCKLIST_DIR))
+	if err != nil {
+		return nil, err
+	}
+	handler.Blocklists = bls
+
+	if cfg.Sinkhole.Enabled {
+		sh, err := NewSinkhole(cfg.Sinkhole)
+		if err != nil {
+			return nil, err
+		}
+		handler.Sinkhole = sh
+	}
+
+	if cfg.Chaos.Enabled {
+		handler.Chaos = NewChaosNames(cfg.Chaos)
+	}
+	if cfg.Search.Enabled {
+		handler.Search = NewSearchDomains(cfg.Search.Suffixes)
+	}
+	if cfg.Canary.Enabled {
+		handler.Canary = NewCanaryDomains(cfg.Canary.Domains)
+	}
+
+	if cfg.DGA.Enabled {
+		dga, err := NewDGADetector(cfg.DGA)
+		if err != nil {
+			return nil, err
+		}
+		handler.DGA = dga
+	}
+
+	if cfg.Tunneling.Enabled {
+		handler.Tunnel = NewTunnelDetector(cfg.Tunneling)
+	}
+
+	if cfg.SpecialUse.Enabled {
+		handler.SpecialUse = NewSpecialUseDomains(cfg.SpecialUse.Forward)
+	}
+
+	quotas, err := NewQuotas(cfg.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	handler.Quotas = quotas
+
+	ipsets, err := NewIPSets(cfg.IPSets)
+	if err != nil {
+		return nil, err
+	}
+	handler.IPSets = ipsets
+
+	sch, err := NewScheduler(handler, cfg.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	handler.Scheduler = sch
+
+	if cfg.Offline.Enabled {
+		handler.Offline = NewOffline(cfg.Offline)
+	}
+
+	if cfg.Audit.Enabled {
+		audit, err := NewAudit(cfg.Audit, cfg.Upstream.Servers, endpoints.DialContext)
+		if err != nil {
+			return nil, err
+		}
+		handler.Audit = audit
+	}
+
+	if cfg.Watchdog.Enabled {
+		wd, err := NewWatchdog(cfg.Watchdog, handler)
+		if err != nil {
+			return nil, err
+		}
+		handler.Watchdog = wd
+	}
+
+	if cfg.Fault.Enabled {
+		f, err := NewFaultInjector(cfg.Fault)
+		if err != nil {
+			return nil, err
+		}
+		handler.Fault = f
+	}
+
+	if cfg.DNSSEC.Enabled {
+		v, err := NewDNSSECValidator(cfg.DNSSEC, func(r *dns.Msg) (*dns.Msg, error) {
+			return handler.exchangeUpstreams(r, &queryInfo{})
+		})
+		if err != nil {
+			return nil, err
 		}
+		handler.DNSSEC = v
+	}
+
+	if cfg.NXHijack.Enabled {
+		nx, err := NewNXHijack(cfg.NXHijack, handler)
+		if err != nil {
+			return nil, err
+		}
+		handler.NXHijack = nx
+	}
+
+	handler.start(cfg, lookupHost)
+	return handler, nil
+}
+
+// start starts the background loops, after every part of the handler is
+// created. 설정 다시 읽기에 실패한 핸들러가 실행 중인 goroutine을 남기지 않는다.
+// Close stops them.
+func (s *SecHandler) start(cfg *Config, lookupHost func() (*dns.Msg, error)) {
+	go s.Endpoints.Watch(cfg.Upstream.ProbeInterval.Duration,
+		cfg.Upstream.NetworkCheckInterval.Duration, lookupHost)
+	s.Upstreams.Start()
+	if s.Hosts != nil {
+		go s.Hosts.Run(s.done)
+	}
+	s.Blocklists.Run(s.done)
+	go s.IPSets.Run(s.done)
+	if s.Offline != nil {
+		go s.Offline.Run(s.probeUpstream, s.done)
+	}
+	if s.Watchdog != nil {
+		go s.Watchdog.Run(s.done)
+	}
+	if s.NXHijack != nil {
+		go s.NXHijack.Run(s.done)
+	}
+	if cfg.DDR.Enabled {
+		go s.upgradeDDR(cfg.DDR)
+	}
+	if cfg.Backup.Enabled {
+		go RunBackups(cfg.Backup, s, s.done)
+	}
+
+	// 마지막으로: 예약된 작업은 설정을 바꿀 수 있다.
+	s.Scheduler.catchUp(time.Now())
+	go s.Scheduler.Run()
+}
+
+// probeUpstream checks that the preferred upstream answers.
+func (s *SecHandler) probeUpstream() error {
+	r := new(dns.Msg)
+	r.SetQuestion(".", dns.TypeNS)
+	_, err := s.Upstreams.Select()[0].Exchange(r)
+	return err
+}
+
+// UpdateConfig applies a runtime change to the effective configuration.
+func (s *SecHandler) UpdateConfig(update func(cfg *Config)) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	update(s.Config)
+}
+
+// EncodeConfig writes the effective configuration.
+func (s *SecHandler) EncodeConfig(w io.Writer) error {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	return s.Config.Encode(w)
+}
+
+// Close releases resources held by the handler.
+func (s *SecHandler) Close() {
+	close(s.done)
+	s.NameCache.Save()
+	s.QueryLog.Close()
+	s.Endpoints.Stop()
+	s.Upstreams.Stop()
+	s.Scheduler.Stop()
+	if s.GeoIP != nil {
+		s.GeoIP.Close()
 	}
+}
 
-	handler := SecHandler{
-		"UDP",
-		h,
-		cache.New(1*time.Hour, 10*time.Minute),
+func RunDNS(cfg *DNSServerConfig, handler dns.Handler, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+	var servers []*dns.Server
+	shutdown := func() error {
+		var err error
+		for _, srv := range servers {
+			if e := srv.Shutdown(); err == nil {
+				err = e
+			}
+		}
+		return err
 	}
-	srv := new(dns.Server)
-	srv.Addr = ":" + strconv.Itoa(port)
-	srv.Net = "udp"
-	srv.Handler = handler
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			errHandler(err)
+	// 주소마다 UDP, TCP 서버를 시작한다. 하나라도 실패하면 모두 중지한다.
+	for _, addr := range cfg.Listen {
+		network := listenNetwork(addr)
+		pc, err := net.ListenPacket("udp"+network, addr)
+		if err != nil {
+			shutdown()
+			return nil, err
 		}
-	}()
+		servers = append(servers, &dns.Server{PacketConn: pc, Net: "udp", Handler: handler})
 
-	return func() error {
-		if srv != nil {
-			return srv.Shutdown()
+		// TCP: 잘린(TC) 응답을 받은 클라이언트가 다시 쿼리한다.
+		if cfg.TCP {
+			ln, err := net.Listen("tcp"+network, addr)
+			if err != nil {
+				pc.Close()
+				shutdown()
+				return nil, err
+			}
+			idle := cfg.TCPKeepAlive.Duration
+			servers = append(servers, &dns.Server{
+				Listener:    ln,
+				Net:         "tcp",
+				Handler:     &tcpHandler{handler, idle},
+				IdleTimeout: func() time.Duration { return idle },
+			})
 		}
-		return newErr("No DNS server instance.")
-	}, nil
+		log.Printf("DNS server listening on %s", addr)
+	}
+
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			if err := srv.ActivateAndServe(); err != nil {
+				errHandler(err)
+			}
+		}(srv)
+	}
+	return shutdown, nil
+}
+
+// listenNetwork returns the network suffix for a listen address.
+// IPv4, IPv6 주소는 그 주소 체계만 사용하므로 "0.0.0.0:53", "[::]:53"을 함께 지정할 수 있다.
+// 주소를 생략하면(":53") dual-stack으로 IPv4, IPv6 모두 받는다.
+func listenNetwork(addr string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "4"
+	}
+	return "6"
+}
+
+// tcpHandler passes the TCP queries to the handler, with edns-tcp-keepalive.
+type tcpHandler struct {
+	handler   dns.Handler
+	keepalive time.Duration
+}
+
+type tcpResponseWriter struct {
+	dns.ResponseWriter
+	keepalive time.Duration // 0: no edns-tcp-keepalive option
+}
+
+func (w *tcpResponseWriter) WriteMsg(m *dns.Msg) error {
+	if w.keepalive > 0 {
+		m = setKeepalive(m, w.keepalive)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (h *tcpHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	keepalive := time.Duration(0)
+	if wantsKeepalive(r) {
+		keepalive = h.keepalive
+	}
+	h.handler.ServeDNS(&tcpResponseWriter{w, keepalive}, r)
+}
+
+// truncateUDP returns m truncated to the UDP payload size of the client
+// (EDNS0, 512 without EDNS0). 잘린 응답은 TC 비트가 설정되어 클라이언트가 TCP로 다시 쿼리한다.
+func truncateUDP(r *dns.Msg, m *dns.Msg) *dns.Msg {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if m.Len() <= size {
+		return m
+	}
+	m = m.Copy()
+	m.Truncate(size)
+	return m
 }
@@ -0,0 +1,152 @@
+package main
+
+// JSON DoH transport (application/dns-json), the API of Cloudflare and Google.
+//
+//   https+json://cloudflare-dns.com/dns-query
+//   https+json://dns.google/resolve
+//
+// 쿼리는 GET ?name=&type= 으로 보내고, JSON 응답을 dns.Msg로 변환한다.
+// JSON API는 EDNS option을 전달하지 않는다. (DO, CD 비트만 전달)
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const DOH_JSON_SCHEME = "https+json"
+const DOH_JSON_CONTENT_TYPE = "application/dns-json"
+
+type dohJSONResponse struct {
+	Status     int
+	TC, RD, RA bool
+	AD, CD     bool
+	Answer     []dohJSONRecord
+	Authority  []dohJSONRecord
+	Additional []dohJSONRecord
+}
+
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+type dohJSONTransport struct {
+	url    string // https://...
+	client *http.Client
+}
+
+func newDoHJSONTransport(u *url.URL, client *http.Client) *dohJSONTransport {
+	hu := *u
+	hu.Scheme = "https"
+	return &dohJSONTransport{url: hu.String(), client: client}
+}
+
+func (t *dohJSONTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	if len(r.Question) != 1 {
+		return nil, newErr("JSON DoH: one question required.")
+	}
+	q := r.Question[0]
+
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	params.Set("name", q.Name)
+	params.Set("type", strconv.Itoa(int(q.Qtype)))
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		params.Set("do", "1")
+	}
+	if r.CheckingDisabled {
+		params.Set("cd", "1")
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", DOH_JSON_CONTENT_TYPE)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		e := &DohError{msg: "JSON DoH request failed: " + err.Error()}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			e.timeout = true
+		}
+		return nil, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &DohError{msg: "JSON DoH: HTTP error code " + resp.Status, status: resp.StatusCode}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var jr dohJSONResponse
+	if err := json.Unmarshal(data, &jr); err != nil {
+		return nil, newErr("JSON DoH: can't parse the response: " + err.Error())
+	}
+	return jr.msg(r)
+}
+
+func (t *dohJSONTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// msg converts the JSON response to the reply of r.
+func (jr *dohJSONResponse) msg(r *dns.Msg) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Rcode = jr.Status
+	m.Truncated = jr.TC
+	m.RecursionDesired = jr.RD
+	m.RecursionAvailable = jr.RA
+	m.AuthenticatedData = jr.AD
+	m.CheckingDisabled = jr.CD
+
+	var err error
+	if m.Answer, err = dohJSONRRs(jr.Answer); err != nil {
+		return nil, err
+	}
+	if m.Ns, err = dohJSONRRs(jr.Authority); err != nil {
+		return nil, err
+	}
+	if m.Extra, err = dohJSONRRs(jr.Additional); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// dohJSONRRs parses the records from the presentation format of the data.
+func dohJSONRRs(records []dohJSONRecord) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, rec := range records {
+		if rec.Type == dns.TypeOPT {
+			continue
+		}
+		typ, ok := dns.TypeToString[rec.Type]
+		if !ok {
+			typ = "TYPE" + strconv.Itoa(int(rec.Type))
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), rec.TTL, typ, rec.Data))
+		if err != nil || rr == nil {
+			return nil, newErr("JSON DoH: invalid " + typ + " record of " + rec.Name + ": " + rec.Data)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+// EDNS Client Subnet (RFC 7871) of the upstream queries.
+//
+//   strip    클라이언트가 보낸 ECS를 업스트림에 보내지 않는다. (기본값)
+//   forward  클라이언트가 보낸 ECS를 그대로 보낸다. 캐시는 서브넷별로 나뉜다.
+//   set      ecs_subnet을 모든 쿼리에 넣는다. CDN이 가까운 서버 주소를 응답하도록 할 때 사용한다.
+//
+// LAN 클라이언트의 주소는 사설 주소이므로 자동으로 ECS를 만들지 않는다.
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ECS_STRIP   = "strip"
+	ECS_FORWARD = "forward"
+	ECS_SET     = "set"
+)
+
+type ECSPolicy struct {
+	mode   string
+	subnet *dns.EDNS0_SUBNET // ECS_SET
+}
+
+// NewECSPolicy parses the ecs settings of [upstream].
+func NewECSPolicy(mode string, subnet string) (*ECSPolicy, error) {
+	p := &ECSPolicy{mode: mode}
+	switch mode {
+	case ECS_STRIP, ECS_FORWARD:
+	case ECS_SET:
+		_, ipnet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, newErr("upstream.ecs_subnet: " + err.Error())
+		}
+		ones, _ := ipnet.Mask.Size()
+		p.subnet = &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			Address:       ipnet.IP,
+		}
+		if ipnet.IP.To4() == nil {
+			p.subnet.Family = 2
+		}
+	default:
+		return nil, newErr("Unknown upstream.ecs '" + mode + "'. (strip, forward, set)")
+	}
+	return p, nil
+}
+
+// Apply returns the query to send to the upstream.
+func (p *ECSPolicy) Apply(r *dns.Msg) *dns.Msg {
+	if p.mode == ECS_FORWARD || (p.mode == ECS_STRIP && clientSubnet(r) == nil) {
+		return r
+	}
+
+	r = r.Copy()
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(EDNS_UDP_SIZE, false)
+		opt = r.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	if p.mode == ECS_SET {
+		subnet := *p.subnet
+		opt.Option = append(opt.Option, &subnet)
+	}
+	return r
+}
+
+// keySuffix returns the part of the cache key for the subnet forwarded to the upstream.
+func (p *ECSPolicy) keySuffix(r *dns.Msg) string {
+	if p.mode != ECS_FORWARD {
+		return ""
+	}
+	if e := clientSubnet(r); e != nil {
+		return "/ecs=" + e.Address.String() + "/" + strconv.Itoa(int(e.SourceNetmask))
+	}
+	return ""
+}
+
+// clientSubnet returns the ECS option of r, nil if none.
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
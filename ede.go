@@ -0,0 +1,55 @@
+package main
+
+// Extended DNS Errors (RFC 8914).
+//
+// 응답이 실패하거나 정책에 의해 바뀐 이유를 EDE 옵션으로 알려준다.
+// 쿼리에 EDNS(OPT)가 있는 경우에만 포함한다.
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+const EDNS0_EDE = 15 // EDNS option code
+
+// EDE info codes
+const (
+	EDE_OTHER                  = 0
+	EDE_STALE_ANSWER           = 3
+	EDE_DNSSEC_BOGUS           = 6
+	EDE_BLOCKED                = 15
+	EDE_FILTERED               = 17
+	EDE_PROHIBITED             = 18
+	EDE_NO_REACHABLE_AUTHORITY = 22
+	EDE_NETWORK_ERROR          = 23
+)
+
+type extendedError struct {
+	code uint16
+	text string
+}
+
+// setEDE sets the extended error of the response. A later call replaces it.
+func (info *queryInfo) setEDE(code uint16, text string) {
+	info.ede = &extendedError{code, text}
+}
+
+// withEDE returns a copy of m with the extended error, if the query has EDNS.
+func withEDE(r *dns.Msg, m *dns.Msg, e *extendedError) *dns.Msg {
+	if e == nil || r.IsEdns0() == nil {
+		return m
+	}
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(r.IsEdns0().UDPSize(), false)
+		opt = m.IsEdns0()
+	}
+
+	data := make([]byte, 2+len(e.text))
+	binary.BigEndian.PutUint16(data, e.code)
+	copy(data[2:], e.text)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0_EDE, Data: data})
+	return m
+}
@@ -0,0 +1,62 @@
+package main
+
+// EDNS(0) of the responses (RFC 6891).
+//
+// 업스트림, 캐시, 로컬 레코드에서 만든 응답의 OPT 레코드를 클라이언트의 쿼리에 맞춘다.
+// 쿼리에 OPT가 없으면 응답에서도 제거하고, 있으면 DO 비트를 쿼리와 같게 하여 이 서버의
+// UDP 크기를 알려준다. 업스트림과의 연결에만 해당하는 옵션(cookie, keepalive, padding)은 버린다.
+
+import (
+	"github.com/miekg/dns"
+)
+
+const EDNS_UDP_SIZE = 1232 // advertised UDP payload size (DNS flag day 2020)
+
+// hop-by-hop options of the upstream connection
+var ednsHopOptions = map[uint16]bool{
+	dns.EDNS0COOKIE:       true,
+	dns.EDNS0TCPKEEPALIVE: true,
+	dns.EDNS0PADDING:      true,
+}
+
+// replyEDNS returns m with the OPT record for the query r.
+func replyEDNS(r *dns.Msg, m *dns.Msg) *dns.Msg {
+	ropt := r.IsEdns0()
+	if ropt == nil && m.IsEdns0() == nil {
+		return m
+	}
+
+	m = m.Copy()
+	var opt *dns.OPT
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			opt = o
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+	if ropt == nil {
+		return m
+	}
+
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if ednsHopOptions[o.Option()] {
+			continue
+		}
+		if o.Option() == dns.EDNS0SUBNET && clientSubnet(r) == nil {
+			continue // ecs = "set": the client did not send one
+		}
+		options = append(options, o)
+	}
+	opt.Option = options
+	opt.SetUDPSize(EDNS_UDP_SIZE)
+	opt.SetDo(ropt.Do())
+	m.Extra = append(m.Extra, opt)
+	return m
+}
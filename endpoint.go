@@ -0,0 +1,289 @@
+package main
+
+// Select the nearest DoH endpoint among the addresses of the DoH host.
+// Cloudflare의 DOH 호스트는 여러 개의 anycast 주소를 가지므로
+// 각 주소의 연결 시간을 측정하여 가장 빠른 주소를 사용한다.
+// IPv4와 IPv6 주소를 함께 측정하므로, IPv6만 사용하는 네트워크에서는
+// 연결할 수 없는 IPv4 주소가 뒤로 밀려 IPv6 주소가 사용된다.
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const PROBE_TIMEOUT = 2 * time.Second
+const PROBE_COUNT = 3
+
+type endpoint struct {
+	ip      net.IP
+	latency time.Duration // 0 if unreachable
+}
+
+type EndpointSelector struct {
+	mu        sync.RWMutex
+	host      string // DoH host name (FQDN)
+	port      string
+	hostMsg   *dns.Msg            // bootstrap answer for the DoH host
+	endpoints []endpoint          // sorted by latency, unreachable last
+	hosts     map[string][]net.IP // other hosts with known addresses (fqdn)
+	publish   func(host string, rrs []dns.RR)
+
+	stop chan struct{}
+}
+
+func NewEndpointSelector(host string, port string, hostMsg *dns.Msg) *EndpointSelector {
+	e := &EndpointSelector{
+		host:  host,
+		port:  port,
+		hosts: map[string][]net.IP{},
+		stop:  make(chan struct{}),
+	}
+	e.update(hostMsg)
+	return e
+}
+
+// update replaces the endpoint list with the addresses in the bootstrap answer.
+func (e *EndpointSelector) update(hostMsg *dns.Msg) {
+	var eps []endpoint
+	for _, rr := range hostMsg.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			eps = append(eps, endpoint{ip: v.A})
+		case *dns.AAAA:
+			eps = append(eps, endpoint{ip: v.AAAA})
+		}
+	}
+
+	e.mu.Lock()
+	e.hostMsg = hostMsg
+	e.endpoints = eps
+	e.mu.Unlock()
+	e.notify()
+}
+
+// OnChange sets the function called with the DoH host records, nearest first,
+// now and whenever the endpoints change. (LocalRecords.SetDynamic)
+func (e *EndpointSelector) OnChange(publish func(host string, rrs []dns.RR)) {
+	e.mu.Lock()
+	e.publish = publish
+	e.mu.Unlock()
+	e.notify()
+}
+
+func (e *EndpointSelector) notify() {
+	e.mu.RLock()
+	publish := e.publish
+	e.mu.RUnlock()
+	if publish != nil {
+		publish(e.host, e.hostRecords())
+	}
+}
+
+func probeLatency(addr string) time.Duration {
+	var best time.Duration
+	for i := 0; i < PROBE_COUNT; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, PROBE_TIMEOUT)
+		if err != nil {
+			continue
+		}
+		d := time.Since(start)
+		conn.Close()
+
+		if best == 0 || d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// Probe measures the connect time of all endpoints and reorders them.
+func (e *EndpointSelector) Probe() {
+	e.mu.RLock()
+	eps := make([]endpoint, len(e.endpoints))
+	copy(eps, e.endpoints)
+	e.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for i := range eps {
+		wg.Add(1)
+		go func(ep *endpoint) {
+			defer wg.Done()
+			ep.latency = probeLatency(net.JoinHostPort(ep.ip.String(), e.port))
+		}(&eps[i])
+	}
+	wg.Wait()
+
+	sort.SliceStable(eps, func(i, j int) bool {
+		li, lj := eps[i].latency, eps[j].latency
+		if li == 0 || lj == 0 {
+			return lj == 0 && li != 0
+		}
+		return li < lj
+	})
+
+	e.mu.Lock()
+	prev := ""
+	if len(e.endpoints) > 0 {
+		prev = e.endpoints[0].ip.String()
+	}
+	e.endpoints = eps
+	e.mu.Unlock()
+	e.notify()
+
+	if len(eps) > 0 && eps[0].ip.String() != prev {
+		log.Printf("DoH endpoint selected: %s (%v)", eps[0].ip, eps[0].latency)
+	}
+}
+
+// Host returns the DoH host name (FQDN).
+func (e *EndpointSelector) Host() string {
+	return e.host
+}
+
+// hostRecords returns the A and AAAA records of the DoH host, nearest first.
+func (e *EndpointSelector) hostRecords() []dns.RR {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var rrs []dns.RR
+	for _, rr := range e.hostMsg.Answer {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			rr = dns.Copy(rr)
+			rr.Header().Name = e.host
+			rrs = append(rrs, rr)
+		}
+	}
+	sort.SliceStable(rrs, func(i, j int) bool {
+		return e.rank(rrs[i]) < e.rank(rrs[j])
+	})
+	return rrs
+}
+
+func (e *EndpointSelector) rank(rr dns.RR) int {
+	var ip net.IP
+	switch v := rr.(type) {
+	case *dns.A:
+		ip = v.A
+	case *dns.AAAA:
+		ip = v.AAAA
+	}
+	for i, ep := range e.endpoints {
+		if ep.ip.Equal(ip) {
+			return i
+		}
+	}
+	return len(e.endpoints)
+}
+
+// AddHost sets the addresses of another host dialed without name resolution.
+func (e *EndpointSelector) AddHost(host string, ips []net.IP) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hosts[dns.Fqdn(strings.ToLower(host))] = ips
+}
+
+// DialContext dials the DoH host through the selected endpoints,
+// and the hosts added with AddHost through their addresses.
+// Other addresses are dialed directly.
+func (e *EndpointSelector) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	fqdn := dns.Fqdn(strings.ToLower(host))
+
+	var eps []endpoint
+	e.mu.RLock()
+	if fqdn == e.host {
+		eps = make([]endpoint, len(e.endpoints))
+		copy(eps, e.endpoints)
+	} else if ips, ok := e.hosts[fqdn]; ok {
+		for _, ip := range ips {
+			eps = append(eps, endpoint{ip: ip})
+		}
+	} else {
+		e.mu.RUnlock()
+		return dialer.DialContext(ctx, network, addr)
+	}
+	e.mu.RUnlock()
+
+	if len(eps) == 0 {
+		return nil, newErr("No DoH endpoint address.")
+	}
+
+	for _, ep := range eps {
+		conn, err2 := dialer.DialContext(ctx, network, net.JoinHostPort(ep.ip.String(), port))
+		if err2 == nil {
+			return conn, nil
+		}
+		err = err2
+	}
+	return nil, err
+}
+
+// network signature: changes when an interface address is added or removed.
+func networkSignature() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+
+	var list []string
+	for _, a := range addrs {
+		list = append(list, a.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// Watch re-probes the endpoints every probeInterval, and re-bootstraps and
+// re-probes immediately when the local network changes.
+func (e *EndpointSelector) Watch(probeInterval, checkInterval time.Duration, bootstrap func() (*dns.Msg, error)) {
+	if checkInterval <= 0 {
+		return
+	}
+
+	sig := networkSignature()
+	lastProbe := time.Now()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if s := networkSignature(); s != sig {
+			sig = s
+			log.Println("Network change detected. Re-evaluating DoH endpoints.")
+
+			if h, err := bootstrap(); err == nil {
+				e.update(h)
+			} else {
+				WriteErrorLogMsg("Failed to obtain the DOH server address of "+e.host, err)
+			}
+		} else if time.Since(lastProbe) < probeInterval {
+			continue
+		}
+
+		e.Probe()
+		lastProbe = time.Now()
+	}
+}
+
+func (e *EndpointSelector) Stop() {
+	close(e.stop)
+}
@@ -0,0 +1,129 @@
+package main
+
+// Configuration from environment variables. (containers)
+//
+// SECUREDNS_<섹션>_<키> 환경 변수는 설정 파일의 값보다 우선한다. 이름은 설정 파일의 키를
+// 대문자로 바꾸고 '_'로 이은 것이며, 목록은 쉼표로 구분한다.
+//   SECUREDNS_DNS_LISTEN=0.0.0.0:53
+//   SECUREDNS_CACHE_MAX_TTL=1h
+//   SECUREDNS_UPSTREAM_SLO_LATENCY_P95=300ms
+// SECUREDNS_UPSTREAM_SERVERS는 업스트림 URL의 목록이며, SECUREDNS_CONFIG는 설정 파일의 경로이다.
+// 테이블의 배열([[blocklist]] 등)은 환경 변수로 지정할 수 없다.
+
+import (
+	"encoding"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const ENV_PREFIX = "SECUREDNS_"
+const ENV_CONFIG = ENV_PREFIX + "CONFIG"
+const ENV_UPSTREAM_SERVERS = ENV_PREFIX + "UPSTREAM_SERVERS"
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// applyEnv overrides the values of cfg with the environment variables.
+// Returns false if no variable changes cfg.
+func applyEnv(cfg *Config) (bool, error) {
+	changed := false
+	// host, host_addrs를 지우므로 SECUREDNS_UPSTREAM_HOST보다 먼저 적용한다.
+	if s, ok := os.LookupEnv(ENV_UPSTREAM_SERVERS); ok {
+		setUpstreams(cfg, splitEnvList(s))
+		changed = true
+	}
+	c, err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), ENV_PREFIX)
+	return changed || c, err
+}
+
+func applyEnvStruct(v reflect.Value, prefix string) (bool, error) {
+	changed := false
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("toml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Struct && !fv.Addr().Type().Implements(textUnmarshalerType) {
+			c, err := applyEnvStruct(fv, name+"_")
+			if err != nil {
+				return changed, err
+			}
+			changed = changed || c
+			continue
+		}
+
+		s, ok := os.LookupEnv(name)
+		if !ok || name == ENV_UPSTREAM_SERVERS {
+			continue
+		}
+		if err := setEnvValue(fv, s); err != nil {
+			return changed, newErr("Invalid " + name + ": " + err.Error())
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// setEnvValue sets a config value from the text of an environment variable.
+func setEnvValue(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return newErr("not supported by environment variables")
+		}
+		list := splitEnvList(s)
+		sv := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, item := range list {
+			sv.Index(i).SetString(item)
+		}
+		v.Set(sv)
+	default:
+		return newErr("not supported by environment variables")
+	}
+	return nil
+}
+
+// splitEnvList splits a comma separated list.
+func splitEnvList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,67 @@
+package main
+
+// Fault injection for resilience testing.
+//
+// 업스트림 쿼리에 지연, HTTP 오류, 잘린(TC) 응답, 패킷 손실(timeout)을 주입하여
+// failover, serve-stale, offline mode 등의 동작을 실제 경로에서 확인한다.
+// 테스트 전용. 운영 환경에서는 사용하지 않는다.
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type FaultInjector struct {
+	cfg       FaultConfig
+	upstreams map[string]bool // nil: every upstream
+}
+
+func NewFaultInjector(cfg FaultConfig) (*FaultInjector, error) {
+	for _, r := range []float64{cfg.ErrorRate, cfg.TruncateRate, cfg.LossRate} {
+		if r < 0 || r > 1 {
+			return nil, newErr("Fault injection rates must be between 0 and 1.")
+		}
+	}
+	f := &FaultInjector{cfg: cfg}
+	if len(cfg.Upstreams) > 0 {
+		f.upstreams = map[string]bool{}
+		for _, name := range cfg.Upstreams {
+			f.upstreams[name] = true
+		}
+	}
+	log.Printf("[FAULT] fault injection enabled: latency %s (+%s), error %.0f%%, truncate %.0f%%, loss %.0f%%. For testing only.",
+		cfg.Latency.Duration, cfg.Jitter.Duration, cfg.ErrorRate*100, cfg.TruncateRate*100, cfg.LossRate*100)
+	return f, nil
+}
+
+// Exchange runs the upstream exchange with the configured faults.
+func (f *FaultInjector) Exchange(upstream string, r *dns.Msg, exchange func() (*dns.Msg, error)) (*dns.Msg, error) {
+	if f.upstreams != nil && !f.upstreams[upstream] {
+		return exchange()
+	}
+
+	delay := f.cfg.Latency.Duration
+	if f.cfg.Jitter.Duration > 0 {
+		delay += time.Duration(rand.Int63n(int64(f.cfg.Jitter.Duration)))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	switch p := rand.Float64(); {
+	case p < f.cfg.LossRate:
+		time.Sleep(f.cfg.LossTimeout.Duration)
+		return nil, &DohError{msg: "Timeout (injected packet loss).", timeout: true}
+	case p < f.cfg.LossRate+f.cfg.ErrorRate:
+		return nil, &DohError{msg: "HTTP error code 503 Service Unavailable (injected)", status: 503}
+	case p < f.cfg.LossRate+f.cfg.ErrorRate+f.cfg.TruncateRate:
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		return m, nil
+	}
+	return exchange()
+}
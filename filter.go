@@ -0,0 +1,356 @@
+package main
+
+// Domain filtering
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// DomainSet matches a name and all of its subdomains.
+type DomainSet struct {
+	names map[string]struct{}
+}
+
+func NewDomainSet() *DomainSet {
+	return &DomainSet{names: map[string]struct{}{}}
+}
+
+func domainSetKey(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "*.")
+	if name == "" {
+		return ""
+	}
+	return dns.Fqdn(strings.ToLower(name))
+}
+
+func (d *DomainSet) Add(name string) {
+	if key := domainSetKey(name); key != "" {
+		d.names[key] = struct{}{}
+	}
+}
+
+func (d *DomainSet) Remove(name string) {
+	delete(d.names, domainSetKey(name))
+}
+
+// AddFile adds names in file, one per line. '#' starts a comment.
+func (d *DomainSet) AddFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.AddReader(f)
+}
+
+// AddReader adds names read from r, one per line. '#' starts a comment.
+func (d *DomainSet) AddReader(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		d.Add(line)
+	}
+	return sc.Err()
+}
+
+// names of the hosts file that are not blocked domains
+var hostsFileLocalNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// AddHostsReader adds the names of a hosts file ("0.0.0.0 ads.example.com") read from r.
+// '#' starts a comment. localhost entries are skipped.
+func (d *DomainSet) AddHostsReader(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if !hostsFileLocalNames[strings.ToLower(name)] {
+				d.Add(name)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// AddAdblockReader reads a filter list in the adblock syntax (AdGuard DNS filter, EasyList):
+//
+//	||example.com^      example.com and its subdomains are blocked
+//	@@||example.com^    exception, added to allow
+//	example.com, 0.0.0.0 example.com   plain and hosts file lines
+//
+// '!' and '#' start a comment. Wildcard (||ad*.example.com^) and regular expression
+// (/^ad[0-9]+\./) rules are added to patterns, except exceptions. Rules with modifiers ($...)
+// other than $important, URL paths and element hiding rules are skipped.
+func AddAdblockReader(block, allow *DomainSet, patterns *DomainRules, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' || strings.Contains(line, "##") || strings.Contains(line, "#@#") {
+			continue
+		}
+		set := block
+		if strings.HasPrefix(line, "@@") {
+			set, line = allow, line[2:]
+		}
+		if isRegexRule(line) {
+			if set == block {
+				patterns.Add(line)
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, '$'); i >= 0 {
+			if line[i+1:] != "important" {
+				continue
+			}
+			line = line[:i]
+		}
+		if fields := strings.Fields(line); len(fields) == 2 && net.ParseIP(fields[0]) != nil {
+			line = fields[1] // hosts file line
+		}
+		subdomains := strings.HasPrefix(line, "||")
+		if subdomains {
+			line = strings.TrimSuffix(strings.TrimSuffix(line[2:], "|"), "^")
+		}
+		if isPatternRule(line) && validRuleDomain(strings.Replace(line, "*", "", -1)) {
+			if set == block {
+				patterns.Add(line)
+				if subdomains {
+					patterns.Add("*." + line)
+				}
+			}
+			continue
+		}
+		if validRuleDomain(line) && !hostsFileLocalNames[strings.ToLower(line)] {
+			set.Add(line)
+		}
+	}
+	return sc.Err()
+}
+
+// validRuleDomain reports whether a rule is a plain domain name (no wildcard, path or regex).
+func validRuleDomain(name string) bool {
+	if name == "" || strings.Trim(name, ".") == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DomainSet) Len() int {
+	return len(d.names)
+}
+
+// WriteTo writes the names, one per line.
+func (d *DomainSet) WriteTo(w io.Writer) (int64, error) {
+	return d.WriteRulesTo(w, "", "")
+}
+
+// WriteRulesTo writes the names between prefix and suffix, one per line.
+func (d *DomainSet) WriteRulesTo(w io.Writer, prefix, suffix string) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for name := range d.names {
+		c, err := bw.WriteString(prefix + strings.TrimSuffix(name, ".") + suffix + "\n")
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// Match reports whether name or one of its parent domains is in the set.
+func (d *DomainSet) Match(name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := d.names[name[off:]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DomainRules matches exact names, wildcards and regular expressions.
+//
+//	example.com      example.com only
+//	*.example.com    subdomains of example.com
+//	ad*.example.com  '*' matches any characters, including dots
+//	/^ad[0-9]+\./    regular expression (RE2, case-insensitive) on the name without the last dot
+//
+// 이름과 *.domain 규칙은 map으로 찾고, 그 밖의 규칙은 미리 컴파일한 정규식으로 확인한다.
+type DomainRules struct {
+	exact    map[string]struct{}
+	wild     *DomainSet
+	patterns []*regexp.Regexp
+	sources  []string // rules of patterns
+}
+
+func NewDomainRules() *DomainRules {
+	return &DomainRules{exact: map[string]struct{}{}, wild: NewDomainSet()}
+}
+
+// isPatternRule reports whether a rule needs a regular expression. (see DomainRules)
+func isPatternRule(rule string) bool {
+	if isRegexRule(rule) {
+		return true
+	}
+	return strings.Contains(strings.TrimPrefix(rule, "*."), "*")
+}
+
+func isRegexRule(rule string) bool {
+	return len(rule) > 2 && rule[0] == '/' && rule[len(rule)-1] == '/'
+}
+
+// Add adds a rule. Returns an error for an invalid regular expression.
+func (d *DomainRules) Add(rule string) error {
+	rule = strings.TrimSpace(rule)
+	if !isPatternRule(rule) {
+		if strings.HasPrefix(rule, "*.") {
+			d.wild.Add(rule)
+		} else if key := domainSetKey(rule); key != "" {
+			d.exact[key] = struct{}{}
+		}
+		return nil
+	}
+
+	var expr string
+	if isRegexRule(rule) {
+		expr = "(?i)" + rule[1:len(rule)-1]
+	} else {
+		glob := strings.ToLower(strings.TrimSuffix(rule, "."))
+		expr = "^" + strings.Replace(regexp.QuoteMeta(glob), `\*`, ".*", -1) + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return newErr("Invalid rule '" + rule + "': " + err.Error())
+	}
+	d.patterns = append(d.patterns, re)
+	d.sources = append(d.sources, rule)
+	return nil
+}
+
+// AddFile adds the rules in file, one per line. '#' starts a comment.
+func (d *DomainRules) AddFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if err := d.Add(line); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (d *DomainRules) Len() int {
+	return len(d.exact) + d.wild.Len() + len(d.patterns)
+}
+
+// WritePatternsTo writes the wildcard and regular expression rules, one per line.
+func (d *DomainRules) WritePatternsTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, rule := range d.sources {
+		if _, err := bw.WriteString(rule + "\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Match reports whether name matches one of the rules.
+func (d *DomainRules) Match(name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	if _, ok := d.exact[name]; ok {
+		return true
+	}
+	// wildcard: parent domains only
+	if off, end := dns.NextLabel(name, 0); !end && d.wild.Match(name[off:]) {
+		return true
+	}
+	if len(d.patterns) == 0 {
+		return false
+	}
+	name = strings.TrimSuffix(name, ".")
+	for _, re := range d.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Firewall refuses every name not explicitly allowed.
+// (default-deny mode: servers, kiosks, IoT networks)
+type Firewall struct {
+	allow   *DomainSet
+	enabled int32 // atomic. can be switched at runtime (schedule)
+}
+
+// dohHost: the DoH host name, always allowed
+func NewFirewall(cfg *FirewallConfig, dohHost string) (*Firewall, error) {
+	allow := NewDomainSet()
+	for _, name := range cfg.Allow {
+		allow.Add(name)
+	}
+	for _, p := range cfg.AllowFiles {
+		if err := allow.AddFile(resolveAppPath(p)); err != nil {
+			return nil, err
+		}
+	}
+
+	// DoH 호스트 주소는 서비스 자신이 사용하므로 항상 허용한다.
+	allow.Add(dohHost)
+
+	fw := &Firewall{allow: allow}
+	fw.SetEnabled(cfg.DefaultDeny)
+	return fw, nil
+}
+
+func (f *Firewall) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&f.enabled, v)
+}
+
+func (f *Firewall) Enabled() bool {
+	return atomic.LoadInt32(&f.enabled) == 1
+}
+
+func (f *Firewall) Allowed(name string) bool {
+	return !f.Enabled() || f.allow.Match(name)
+}
@@ -0,0 +1,155 @@
+package main
+
+// Command line flags.
+//
+// 설정 파일을 만들지 않아도 실행할 수 있도록 주요 설정을 명령줄에서 지정한다.
+// 플래그는 설정 파일과 환경 변수(env.go)의 값보다 우선하며, 설정을 다시 읽을 때(reload.go)도 적용된다.
+//   SecureDNS.exe -listen 127.0.0.1:53 -upstream https://1.1.1.1/dns-query -log-level error
+// 서비스로 실행하면 서비스의 실행 파일 경로(binPath)에 지정한다.
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stringList is a flag that can be repeated or separated by commas.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, splitEnvList(v)...)
+	return nil
+}
+
+type cmdFlags struct {
+	config    string // "": CONFIG_FILE in the program directory
+	listen    stringList
+	upstreams stringList
+	minTTL    time.Duration
+	maxTTL    time.Duration
+	negMaxTTL time.Duration
+	logLevel  string
+
+	set map[string]bool // flags given on the command line
+}
+
+var cmdline = cmdFlags{set: map[string]bool{}}
+
+// parseFlags parses the flags before the command, and returns the command.
+func parseFlags(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("SecureDNS", flag.ContinueOnError)
+	fs.Usage = printUsage
+	fs.StringVar(&cmdline.config, "config", "", "")
+	fs.Var(&cmdline.listen, "listen", "")
+	fs.Var(&cmdline.upstreams, "upstream", "")
+	fs.DurationVar(&cmdline.minTTL, "cache-min-ttl", 0, "")
+	fs.DurationVar(&cmdline.maxTTL, "cache-max-ttl", 0, "")
+	fs.DurationVar(&cmdline.negMaxTTL, "cache-negative-max-ttl", 0, "")
+	fs.StringVar(&cmdline.logLevel, "log-level", "", "")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) { cmdline.set[f.Name] = true })
+
+	if cmdline.config != "" {
+		// 서비스의 작업 디렉토리는 system32이므로 절대 경로로 바꿔 둔다.
+		abs, err := filepath.Abs(cmdline.config)
+		if err != nil {
+			return nil, err
+		}
+		cmdline.config = abs
+	}
+	return fs.Args(), nil
+}
+
+// configPathGiven returns whether the path of the config file is given by
+// -config or SECUREDNS_CONFIG. 이 경우 파일이 없으면 오류이다.
+func configPathGiven() bool {
+	return cmdline.config != "" || os.Getenv(ENV_CONFIG) != ""
+}
+
+// configPath returns the path of the config file.
+func configPath() string {
+	if cmdline.config != "" {
+		return cmdline.config
+	}
+	if path := os.Getenv(ENV_CONFIG); path != "" {
+		return resolveAppPath(path)
+	}
+	return appPath(CONFIG_FILE)
+}
+
+// apply overrides the values of cfg with the command line flags.
+// Returns false if no flag changes cfg.
+func (f *cmdFlags) apply(cfg *Config) bool {
+	changed := false
+	if f.set["listen"] {
+		cfg.DNS.Listen = f.listen
+		changed = true
+	}
+	if f.set["upstream"] {
+		setUpstreams(cfg, f.upstreams)
+		changed = true
+	}
+	if f.set["cache-min-ttl"] {
+		cfg.Cache.MinTTL = duration{f.minTTL}
+		changed = true
+	}
+	if f.set["cache-max-ttl"] {
+		cfg.Cache.MaxTTL = duration{f.maxTTL}
+		changed = true
+	}
+	if f.set["cache-negative-max-ttl"] {
+		cfg.Cache.NegativeMaxTTL = duration{f.negMaxTTL}
+		changed = true
+	}
+	if f.set["log-level"] {
+		cfg.Log.Level = f.logLevel
+		changed = true
+	}
+	return changed
+}
+
+// setUpstreams replaces the upstream servers with urls.
+// 이전 업스트림의 host, host_addrs는 새 업스트림에 맞지 않으므로 지운다.
+func setUpstreams(cfg *Config, urls []string) {
+	cfg.Upstream.Servers = nil
+	cfg.Upstream.Host = ""
+	cfg.Upstream.HostAddrs = nil
+	for _, s := range urls {
+		cfg.Upstream.Servers = append(cfg.Upstream.Servers, UpstreamServerConfig{URL: s})
+	}
+	nameUpstreams(cfg.Upstream.Servers)
+}
+
+// loadServiceConfig loads the config file and applies the environment
+// variables (env.go) and the command line flags, in this order.
+// CONFIG_FILE in the program directory is optional (defaults).
+func loadServiceConfig() (*Config, error) {
+	path := configPath()
+	if configPathGiven() {
+		if _, err := os.Stat(path); err != nil {
+			return nil, newErr("Can't read the config file: " + err.Error())
+		}
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := applyEnv(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cmdline.apply(cfg) || changed {
+		if err := cfg.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
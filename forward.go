@@ -0,0 +1,222 @@
+package main
+
+// Conditional forwarding.
+//
+// 지정한 도메인의 쿼리를 DoH 업스트림 대신 내부 DNS 서버(사내 DNS, 공유기 등)로 보낸다.
+// stub zone과 달리 재귀 질의(RD)를 보내며, 필터와 캐시는 그대로 적용된다.
+// 서버는 "ip[:port]"(UDP, 잘린 응답은 TCP), "tcp://ip[:port]", 업스트림 URL 또는
+// "router"(기본 게이트웨이) 중 하나로 지정한다.
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const FORWARD_TIMEOUT = 3 * time.Second
+const FORWARD_ROUTER = "router"
+const FORWARD_ROUTER_TTL = time.Minute // the default gateway is looked up again after this
+
+type forwardServer struct {
+	name string
+	addr string    // host:port of a plain DNS server. "" for router and upstream URLs
+	t    transport // upstream URL
+}
+
+type forwardZone struct {
+	zone    string // lowercase fqdn
+	servers []*forwardServer
+}
+
+type Forwarders struct {
+	zones  map[string]*forwardZone
+	udp    *dns.Client
+	tcp    *dns.Client
+	router *defaultGateway
+}
+
+func NewForwarders(cfgs []ForwardConfig, dial dialFunc) (*Forwarders, error) {
+	f := &Forwarders{
+		zones:  map[string]*forwardZone{},
+		udp:    &dns.Client{Net: "udp", Timeout: FORWARD_TIMEOUT},
+		tcp:    &dns.Client{Net: "tcp", Timeout: FORWARD_TIMEOUT},
+		router: &defaultGateway{},
+	}
+	for _, c := range cfgs {
+		if len(c.Servers) == 0 {
+			return nil, newErr("Forward rule " + strings.Join(c.Zones, ", ") + " has no server.")
+		}
+		var servers []*forwardServer
+		for _, s := range c.Servers {
+			fs, err := newForwardServer(s, dial)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, fs)
+		}
+
+		for _, z := range c.Zones {
+			zone := dns.Fqdn(strings.ToLower(strings.TrimPrefix(z, "*.")))
+			if _, ok := dns.IsDomainName(zone); !ok || z == "" {
+				return nil, newErr("Invalid forward zone name '" + z + "'")
+			}
+			f.zones[zone] = &forwardZone{zone: zone, servers: servers}
+		}
+	}
+	return f, nil
+}
+
+func newForwardServer(s string, dial dialFunc) (*forwardServer, error) {
+	fs := &forwardServer{name: s}
+	switch {
+	case s == FORWARD_ROUTER:
+	case strings.HasPrefix(s, "tcp://"):
+		fs.addr = withDNSPort(strings.TrimPrefix(s, "tcp://"))
+		fs.t = &plainTransport{client: &dns.Client{Net: "tcp", Timeout: FORWARD_TIMEOUT}, addr: fs.addr}
+	case strings.Contains(s, "://"):
+		t, err := newTransport(s, dial, transportOptions{})
+		if err != nil {
+			return nil, err
+		}
+		fs.t = t
+	default:
+		fs.addr = withDNSPort(s)
+		if host, _, _ := net.SplitHostPort(fs.addr); net.ParseIP(host) == nil {
+			return nil, newErr("Invalid forward server '" + s + "'. (ip[:port], tcp://ip[:port], upstream url, router)")
+		}
+	}
+	return fs, nil
+}
+
+func withDNSPort(s string) string {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return net.JoinHostPort(strings.Trim(s, "[]"), "53")
+	}
+	return s
+}
+
+// Lookup returns the closest forward zone of name, or nil.
+func (f *Forwarders) Lookup(name string) *forwardZone {
+	if f == nil || len(f.zones) == 0 {
+		return nil
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z, ok := f.zones[name[off:]]; ok {
+			return z
+		}
+	}
+	return nil
+}
+
+// Exchange sends r to the servers of the zone in order.
+func (f *Forwarders) Exchange(z *forwardZone, r *dns.Msg) (m *dns.Msg, server string, err error) {
+	err = newErr("No forward server.")
+	for _, s := range z.servers {
+		server = s.name
+		switch {
+		case s.t != nil:
+			m, err = s.t.Exchange(r)
+		case s.addr != "":
+			m, err = f.exchangePlain(r, s.addr)
+		default:
+			var gw net.IP
+			if gw, err = f.router.Get(); err == nil {
+				server = FORWARD_ROUTER + "(" + gw.String() + ")"
+				m, err = f.exchangePlain(r, net.JoinHostPort(gw.String(), "53"))
+			}
+		}
+		if err == nil {
+			err = checkResponse(r, m)
+		}
+		if err == nil {
+			sanitizeResponse(r, m)
+			m.Id = r.Id
+			return m, server, nil
+		}
+	}
+	return nil, server, err
+}
+
+func (f *Forwarders) exchangePlain(r *dns.Msg, addr string) (*dns.Msg, error) {
+	m, _, err := f.udp.Exchange(r, addr)
+	if err == nil && m.Truncated {
+		m, _, err = f.tcp.Exchange(r, addr)
+	}
+	return m, err
+}
+
+// plainTransport is a DNS server over TCP. (tcp://)
+type plainTransport struct {
+	client *dns.Client
+	addr   string
+}
+
+func (t *plainTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	m, _, err := t.client.Exchange(r, t.addr)
+	return m, err
+}
+
+func (t *plainTransport) Close() error {
+	return nil
+}
+
+// defaultGateway is the IPv4 default gateway, looked up from the route table.
+type defaultGateway struct {
+	mu      sync.Mutex
+	ip      net.IP
+	updated time.Time
+}
+
+func (g *defaultGateway) Get() (net.IP, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ip != nil && time.Since(g.updated) < FORWARD_ROUTER_TTL {
+		return g.ip, nil
+	}
+
+	var out []byte
+	var err error
+	if runtime.GOOS == "windows" {
+		out, err = exec.Command("route", "print", "-4", "0.0.0.0").Output()
+	} else {
+		out, err = exec.Command("ip", "-4", "route", "show", "default").Output()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ip := parseDefaultGateway(out)
+	if ip == nil {
+		return nil, newErr("No default gateway.")
+	}
+	g.ip, g.updated = ip, time.Now()
+	return ip, nil
+}
+
+// parseDefaultGateway reads the gateway from the output of
+// `route print -4 0.0.0.0` ("0.0.0.0 0.0.0.0 <gateway> <interface> <metric>")
+// or `ip -4 route show default` ("default via <gateway> dev eth0").
+func parseDefaultGateway(out []byte) net.IP {
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		var gw string
+		switch {
+		case len(fields) >= 3 && fields[0] == "0.0.0.0" && fields[1] == "0.0.0.0":
+			gw = fields[2]
+		case len(fields) >= 3 && fields[0] == "default" && fields[1] == "via":
+			gw = fields[2]
+		}
+		if ip := net.ParseIP(gw).To4(); ip != nil && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+// GeoIP annotation of answers using local MaxMind DB (mmdb) files.
+// e.g. GeoLite2-Country.mmdb, GeoLite2-ASN.mmdb
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+type AnswerInfo struct {
+	IP      string `json:"ip"`
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+type GeoIP struct {
+	readers []*maxminddb.Reader
+}
+
+// OpenGeoIP opens all given databases.
+// Lookup results of each database are merged, so a country DB and an ASN DB
+// can be used together.
+func OpenGeoIP(paths []string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, p := range paths {
+		r, err := maxminddb.Open(p)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.readers = append(g.readers, r)
+	}
+	return g, nil
+}
+
+func (g *GeoIP) Close() {
+	for _, r := range g.readers {
+		r.Close()
+	}
+	g.readers = nil
+}
+
+func (g *GeoIP) lookup(ip net.IP) AnswerInfo {
+	info := AnswerInfo{IP: ip.String()}
+
+	for _, r := range g.readers {
+		var rec geoRecord
+		if err := r.Lookup(ip, &rec); err != nil {
+			continue
+		}
+		if rec.Country.ISOCode != "" {
+			info.Country = rec.Country.ISOCode
+		}
+		if rec.ASN != 0 {
+			info.ASN = rec.ASN
+			info.ASOrg = rec.ASOrg
+		}
+	}
+	return info
+}
+
+// Annotate returns the addresses in the answer section of m.
+// If g is nil, the addresses are returned without annotation.
+func (g *GeoIP) Annotate(m *dns.Msg) []AnswerInfo {
+	var answers []AnswerInfo
+
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		if g == nil {
+			answers = append(answers, AnswerInfo{IP: ip.String()})
+		} else {
+			answers = append(answers, g.lookup(ip))
+		}
+	}
+	return answers
+}
@@ -0,0 +1,87 @@
+package main
+
+// Active upstream health checks.
+//
+// 주기마다 각 업스트림에 알려진 쿼리(기본: ". NS")를 보내고, fail_after 회 연속 실패한
+// 업스트림은 down으로 표시하여 선택하지 않는다. down인 업스트림도 계속 확인하며
+// recover_after 회 연속 성공하면 다시 사용한다.
+// 모든 업스트림이 down이면 down인 업스트림도 선택한다.
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// checkHealth probes the upstream once and updates its state.
+func (u *Upstream) checkHealth(cfg *HealthCheckConfig) {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(cfg.Name), dns.StringToType[cfg.Type])
+	r.RecursionDesired = true
+
+	start := time.Now()
+	m, err := u.Exchange(r)
+	latency := time.Since(start)
+	if err == nil && m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		err = newErr("health check answered " + dns.RcodeToString[m.Rcode])
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.lastCheck = time.Now()
+	if err != nil {
+		u.lastCheckErr = err.Error()
+		u.checkOKs = 0
+		u.checkFails++
+		if !u.down && u.checkFails >= cfg.FailAfter {
+			u.down = true
+			log.Printf("Upstream %s is down: %s", u.Name, err)
+		}
+		return
+	}
+
+	u.lastCheckErr = ""
+	u.updateEWMA(latency, nil)
+	u.checkFails = 0
+	if u.down {
+		u.checkOKs++
+		if u.checkOKs >= cfg.RecoverAfter {
+			u.down = false
+			u.checkOKs = 0
+			log.Printf("Upstream %s is up again (%v).", u.Name, latency)
+		}
+	}
+}
+
+func (u *Upstream) Down() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.down
+}
+
+// runHealthCheck probes every upstream on the interval until the pool is stopped.
+func (p *UpstreamPool) runHealthCheck(cfg HealthCheckConfig) {
+	ticker := time.NewTicker(cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, u := range p.list() {
+			wg.Add(1)
+			go func(u *Upstream) {
+				defer wg.Done()
+				u.checkHealth(&cfg)
+			}(u)
+		}
+		wg.Wait()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
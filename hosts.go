@@ -0,0 +1,189 @@
+package main
+
+// OS hosts file import.
+//
+// hosts 파일의 항목을 로컬 레코드(A/AAAA, 첫 번째 이름의 PTR)로 바꾸어 응답한다.
+// 파일이 바뀌면 다시 읽으므로 SecureDNS를 시스템 resolver로 사용해도
+// 기존의 hosts 파일 설정이 그대로 적용된다.
+//   Windows : %SystemRoot%\System32\drivers\etc\hosts
+//   그 외   : /etc/hosts
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const HOSTS_DEFAULT_INTERVAL = 10 * time.Second
+
+func systemHostsFile() string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+type HostsFile struct {
+	path     string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	records *LocalRecords
+	modTime time.Time
+	size    int64
+}
+
+func NewHostsFile(cfg HostsConfig) (*HostsFile, error) {
+	h := &HostsFile{
+		path:     cfg.File,
+		interval: cfg.ReloadInterval.Duration,
+		records:  NewLocalRecords(),
+	}
+	if h.path == "" {
+		h.path = systemHostsFile()
+	} else {
+		h.path = resolveAppPath(h.path)
+	}
+	if h.interval <= 0 {
+		h.interval = HOSTS_DEFAULT_INTERVAL
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parseHosts converts the hosts file entries into local records.
+func parseHosts(f *os.File) (*LocalRecords, error) {
+	lr := NewLocalRecords()
+	ptrs := map[string]bool{}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// "fe80::1%lo0" 형식의 zone은 무시한다.
+		ip := net.ParseIP(strings.SplitN(fields[0], "%", 2)[0])
+		if ip == nil {
+			continue
+		}
+
+		for i, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); !ok {
+				continue
+			}
+			name = dns.Fqdn(strings.ToLower(name))
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: LOCAL_RECORD_TTL}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				lr.addRR(&dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				lr.addRR(&dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+
+			// 역방향 이름은 주소의 첫 번째 이름. 차단용 항목(0.0.0.0, ::)은 제외한다.
+			if i > 0 || ip.IsUnspecified() {
+				continue
+			}
+			rev, err := dns.ReverseAddr(ip.String())
+			if err != nil || ptrs[rev] {
+				continue
+			}
+			ptrs[rev] = true
+			lr.addRR(&dns.PTR{
+				Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: LOCAL_RECORD_TTL},
+				Ptr: name,
+			})
+		}
+	}
+	return lr, sc.Err()
+}
+
+// load reads the file. A missing file is an empty hosts file, so the file
+// can be created (or removed) while the service is running.
+func (h *HostsFile) load() error {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		h.mu.Lock()
+		h.records, h.modTime, h.size = NewLocalRecords(), time.Time{}, 0
+		h.mu.Unlock()
+		log.Printf("Hosts file %s: not found", h.path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	records, err := parseHosts(f)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.records, h.modTime, h.size = records, fi.ModTime(), fi.Size()
+	h.mu.Unlock()
+	log.Printf("Hosts file %s: %d names", h.path, records.Len())
+	return nil
+}
+
+func (h *HostsFile) changed() bool {
+	fi, err := os.Stat(h.path)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if err != nil {
+		return os.IsNotExist(err) && !h.modTime.IsZero()
+	}
+	return !fi.ModTime().Equal(h.modTime) || fi.Size() != h.size
+}
+
+// Run re-reads the file when it changes until stop is closed.
+func (h *HostsFile) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !h.changed() {
+				continue
+			}
+			if err := h.load(); err != nil {
+				WriteErrorLogMsg("Can't read hosts file "+h.path+".", err)
+			}
+		}
+	}
+}
+
+// Reply answers r from the hosts file, or returns nil.
+func (h *HostsFile) Reply(r *dns.Msg) *dns.Msg {
+	h.mu.RLock()
+	records := h.records
+	h.mu.RUnlock()
+	return records.Reply(r)
+}
@@ -0,0 +1,88 @@
+package main
+
+// HTTP/3 (QUIC) for the DoH upstreams, with fallback to HTTP/2.
+// HTTP/3 요청이 실패하면 같은 요청을 HTTP/2로 보내고, 일정 시간 동안 HTTP/2만 사용한다.
+// (UDP가 막힌 네트워크에서 매 쿼리마다 HTTP/3 연결을 기다리지 않도록)
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const HTTP3_HANDSHAKE_TIMEOUT = 2 * time.Second // HTTP/2 fallback has the rest of the request timeout
+const HTTP3_RETRY_AFTER = 5 * time.Minute       // HTTP/3 is not tried for this time after a failure
+
+type http3Fallback struct {
+	h3 *http3.Transport
+	h2 *http.Transport
+
+	mu      sync.Mutex
+	h2Until time.Time // HTTP/3 failed, use HTTP/2 until this time
+}
+
+// newHTTP3Fallback creates a round tripper that tries HTTP/3 first.
+// dial: finds the server address, h2: the fallback transport
+func newHTTP3Fallback(dial dialFunc, tlsConfig *tls.Config, h2 *http.Transport) *http3Fallback {
+	h3 := &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: HTTP3_HANDSHAKE_TIMEOUT,
+			MaxIdleTimeout:       h2.IdleConnTimeout,
+		},
+	}
+	if dial != nil {
+		h3.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			// 서버 주소는 dial로 찾는다. (UDP socket은 주소를 얻는 데만 사용)
+			raw, err := dial(ctx, "udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			addr = raw.RemoteAddr().String()
+			raw.Close()
+			return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+		}
+	}
+	return &http3Fallback{h3: h3, h2: h2}
+}
+
+func (t *http3Fallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	useH3 := time.Now().After(t.h2Until)
+	t.mu.Unlock()
+	if !useH3 {
+		return t.h2.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+	if req.Context().Err() != nil || (req.Body != nil && req.GetBody == nil) {
+		return nil, err
+	}
+
+	log.Printf("HTTP/3 request to %s failed, using HTTP/2 for %s: %s", req.URL.Host, HTTP3_RETRY_AFTER, err)
+	t.mu.Lock()
+	t.h2Until = time.Now().Add(HTTP3_RETRY_AFTER)
+	t.mu.Unlock()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.h2.RoundTrip(retry)
+}
+
+func (t *http3Fallback) CloseIdleConnections() {
+	t.h3.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+}
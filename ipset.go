@@ -0,0 +1,287 @@
+package main
+
+// Resolved-IP sets for firewall integration.
+//
+// 설정된 도메인 그룹(e.g. "streaming")에 대한 응답의 A/AAAA 주소를 이름 있는 IP 집합으로 모아
+// nftables, ipset 또는 JSON 파일로 내보낸다. 방화벽(라우터 등)은 이 파일이나
+// GET /api/ipsets 를 읽어 도메인 기반으로 트래픽을 제어할 수 있다.
+// 주소는 레코드의 TTL(최소 min_ttl)이 지나면 집합에서 제거된다.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const IPSET_EXPORT_INTERVAL = 30 * time.Second
+const IPSET_MAX_ENTRIES = 65536 // per set and address family
+
+const (
+	IPSET_FORMAT_NFTABLES = "nftables"
+	IPSET_FORMAT_IPSET    = "ipset"
+	IPSET_FORMAT_JSON     = "json"
+)
+
+type ipSet struct {
+	cfg     IPSetConfig
+	domains *DomainSet
+	v4      map[string]time.Time // address -> expiry
+	v6      map[string]time.Time
+	dirty   bool // changed since the last export
+}
+
+type IPSetStatus struct {
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated"`
+	IPv4    []string  `json:"ipv4"`
+	IPv6    []string  `json:"ipv6"`
+}
+
+type IPSets struct {
+	mu   sync.Mutex
+	sets []*ipSet
+}
+
+func NewIPSets(cfgs []IPSetConfig) (*IPSets, error) {
+	s := &IPSets{}
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, newErr("IP set has no name.")
+		}
+		switch c.Format {
+		case "":
+		case IPSET_FORMAT_NFTABLES, IPSET_FORMAT_IPSET, IPSET_FORMAT_JSON:
+			if c.File == "" {
+				return nil, newErr("IP set '" + c.Name + "': no export file.")
+			}
+		default:
+			return nil, newErr("IP set '" + c.Name + "': unknown format " + c.Format)
+		}
+
+		set := &ipSet{
+			cfg:     c,
+			domains: NewDomainSet(),
+			v4:      map[string]time.Time{},
+			v6:      map[string]time.Time{},
+		}
+		for _, d := range c.Domains {
+			set.domains.Add(d)
+		}
+		for _, p := range c.DomainFiles {
+			if err := set.domains.AddFile(resolveAppPath(p)); err != nil {
+				return nil, err
+			}
+		}
+		s.sets = append(s.sets, set)
+	}
+	return s, nil
+}
+
+// Observe adds the addresses in the answer to the sets matching the query name.
+func (s *IPSets) Observe(name string, resp *dns.Msg) {
+	if len(s.sets) == 0 || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, set := range s.sets {
+		if !set.domains.Match(name) {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			ttl := time.Duration(rr.Header().Ttl) * time.Second
+			if ttl < set.cfg.MinTTL.Duration {
+				ttl = set.cfg.MinTTL.Duration
+			}
+			switch v := rr.(type) {
+			case *dns.A:
+				set.add(set.v4, v.A.String(), now.Add(ttl))
+			case *dns.AAAA:
+				set.add(set.v6, v.AAAA.String(), now.Add(ttl))
+			}
+		}
+	}
+}
+
+func (set *ipSet) add(m map[string]time.Time, ip string, expiry time.Time) {
+	if old, ok := m[ip]; ok {
+		if expiry.After(old) {
+			m[ip] = expiry
+		}
+		return
+	}
+	if len(m) >= IPSET_MAX_ENTRIES {
+		return
+	}
+	m[ip] = expiry
+	set.dirty = true
+}
+
+// expire removes the expired addresses.
+func (set *ipSet) expire(now time.Time) {
+	for _, m := range []map[string]time.Time{set.v4, set.v6} {
+		for ip, expiry := range m {
+			if now.After(expiry) {
+				delete(m, ip)
+				set.dirty = true
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]time.Time) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (set *ipSet) status(now time.Time) IPSetStatus {
+	return IPSetStatus{
+		Name:    set.cfg.Name,
+		Updated: now,
+		IPv4:    sortedKeys(set.v4),
+		IPv6:    sortedKeys(set.v6),
+	}
+}
+
+// nftables: 주소 family별로 <name>_v4, <name>_v6 집합을 사용한다.
+// (nft -f <file>, 집합은 미리 만들어 두어야 한다)
+func formatNftables(st IPSetStatus, table string) []byte {
+	var b bytes.Buffer
+	for _, fam := range []struct {
+		suffix string
+		ips    []string
+	}{{"_v4", st.IPv4}, {"_v6", st.IPv6}} {
+		set := st.Name + fam.suffix
+		fmt.Fprintf(&b, "flush set %s %s\n", table, set)
+		for i := 0; i < len(fam.ips); i += 1000 {
+			end := i + 1000
+			if end > len(fam.ips) {
+				end = len(fam.ips)
+			}
+			fmt.Fprintf(&b, "add element %s %s { ", table, set)
+			for j, ip := range fam.ips[i:end] {
+				if j > 0 {
+					b.WriteString(", ")
+				}
+				b.WriteString(ip)
+			}
+			b.WriteString(" }\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// ipset: ipset restore < <file>
+func formatIPSet(st IPSetStatus) []byte {
+	var b bytes.Buffer
+	for _, fam := range []struct {
+		suffix string
+		family string
+		ips    []string
+	}{{"_v4", "inet", st.IPv4}, {"_v6", "inet6", st.IPv6}} {
+		set := st.Name + fam.suffix
+		fmt.Fprintf(&b, "create %s hash:ip family %s -exist\n", set, fam.family)
+		fmt.Fprintf(&b, "flush %s\n", set)
+		for _, ip := range fam.ips {
+			fmt.Fprintf(&b, "add %s %s\n", set, ip)
+		}
+	}
+	return b.Bytes()
+}
+
+func (set *ipSet) export(st IPSetStatus) error {
+	var data []byte
+	switch set.cfg.Format {
+	case IPSET_FORMAT_NFTABLES:
+		table := set.cfg.Table
+		if table == "" {
+			table = "inet filter"
+		}
+		data = formatNftables(st, table)
+	case IPSET_FORMAT_IPSET:
+		data = formatIPSet(st)
+	case IPSET_FORMAT_JSON:
+		var err error
+		if data, err = json.MarshalIndent(st, "", "  "); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	path := resolveAppPath(set.cfg.File)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Export expires old addresses and writes the changed sets.
+func (s *IPSets) Export() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, set := range s.sets {
+		set.expire(now)
+		if !set.dirty {
+			continue
+		}
+		if err := set.export(set.status(now)); err != nil {
+			WriteErrorLogMsg("Can't export IP set "+set.cfg.Name+".", err)
+			continue
+		}
+		set.dirty = false
+	}
+}
+
+// Run exports the sets every IPSET_EXPORT_INTERVAL until stop is closed.
+func (s *IPSets) Run(stop <-chan struct{}) {
+	if len(s.sets) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(IPSET_EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Export()
+		}
+	}
+}
+
+// Status returns the current sets. name: a single set, "" for all.
+func (s *IPSets) Status(name string) []IPSetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []IPSetStatus{}
+	now := time.Now()
+	for _, set := range s.sets {
+		if name != "" && set.cfg.Name != name {
+			continue
+		}
+		set.expire(now)
+		list = append(list, set.status(now))
+	}
+	return list
+}
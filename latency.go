@@ -0,0 +1,171 @@
+package main
+
+// Resolution latency percentiles per path and per domain.
+//
+// 경로(cache, upstream, local)별, 등록 도메인(example.com)별로 최근 응답 시간을 모아
+// 느린 응답이 특정 zone, 캐시, 업스트림 중 어디에서 오는지 확인할 수 있게 한다.
+// 도메인 수는 top-K(space-saving)로 제한한다: 목록이 가득 차면 쿼리 수가 가장 적은
+// 도메인을 새 도메인으로 바꾼다.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const LATENCY_TOP_DOMAINS = 200 // tracked domains
+const LATENCY_SAMPLES = 256     // recent samples per domain and path
+
+const (
+	LATENCY_PATH_CACHE    = "cache"
+	LATENCY_PATH_UPSTREAM = "upstream"
+	LATENCY_PATH_LOCAL    = "local" // local records, blocked, special names
+)
+
+// latencyRing keeps the most recent samples.
+type latencyRing struct {
+	samples []time.Duration
+	next    int
+	count   int64
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.count++
+	if len(r.samples) < LATENCY_SAMPLES {
+		r.samples = append(r.samples, d)
+		return
+	}
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % LATENCY_SAMPLES
+}
+
+type LatencySummary struct {
+	Count int64   `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+}
+
+func (r *latencyRing) summary() LatencySummary {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return LatencySummary{
+		Count: r.count,
+		P50Ms: ms(percentile(r.samples, 0.50)),
+		P95Ms: ms(percentile(r.samples, 0.95)),
+		P99Ms: ms(percentile(r.samples, 0.99)),
+	}
+}
+
+type domainLatency struct {
+	all      latencyRing
+	upstream latencyRing
+	count    int64 // space-saving count, including the count inherited on replacement
+}
+
+type DomainLatency struct {
+	Domain   string          `json:"domain"`
+	All      LatencySummary  `json:"all"`
+	Upstream *LatencySummary `json:"upstream,omitempty"`
+}
+
+type LatencySnapshot struct {
+	Paths   map[string]LatencySummary `json:"paths"`
+	Domains []DomainLatency           `json:"domains"` // by query count
+}
+
+type LatencyStats struct {
+	mu      sync.Mutex
+	paths   map[string]*latencyRing
+	domains map[string]*domainLatency
+}
+
+func NewLatencyStats() *LatencyStats {
+	return &LatencyStats{
+		paths:   map[string]*latencyRing{},
+		domains: map[string]*domainLatency{},
+	}
+}
+
+func registeredDomain(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if d, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		return d
+	}
+	return name
+}
+
+func latencyPath(info *queryInfo) string {
+	switch {
+	case info.cached:
+		return LATENCY_PATH_CACHE
+	case info.upstream != "":
+		return LATENCY_PATH_UPSTREAM
+	}
+	return LATENCY_PATH_LOCAL
+}
+
+// Record adds the resolution time of a query.
+func (ls *LatencyStats) Record(name string, info *queryInfo, elapsed time.Duration) {
+	path := latencyPath(info)
+	domain := registeredDomain(name)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	pr, ok := ls.paths[path]
+	if !ok {
+		pr = &latencyRing{}
+		ls.paths[path] = pr
+	}
+	pr.add(elapsed)
+
+	d, ok := ls.domains[domain]
+	if !ok {
+		d = &domainLatency{}
+		if len(ls.domains) >= LATENCY_TOP_DOMAINS {
+			// space-saving: 가장 적은 도메인을 바꾸고 그 쿼리 수를 이어받는다.
+			minName, minCount := "", int64(-1)
+			for n, v := range ls.domains {
+				if minCount < 0 || v.count < minCount {
+					minName, minCount = n, v.count
+				}
+			}
+			delete(ls.domains, minName)
+			d.count = minCount
+		}
+		ls.domains[domain] = d
+	}
+	d.count++
+	d.all.add(elapsed)
+	if path == LATENCY_PATH_UPSTREAM {
+		d.upstream.add(elapsed)
+	}
+}
+
+func (ls *LatencyStats) Snapshot() LatencySnapshot {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	snap := LatencySnapshot{Paths: map[string]LatencySummary{}, Domains: []DomainLatency{}}
+	for path, r := range ls.paths {
+		snap.Paths[path] = r.summary()
+	}
+
+	counts := map[string]int64{}
+	for name, d := range ls.domains {
+		dl := DomainLatency{Domain: name, All: d.all.summary()}
+		if d.upstream.count > 0 {
+			s := d.upstream.summary()
+			dl.Upstream = &s
+		}
+		snap.Domains = append(snap.Domains, dl)
+		counts[name] = d.count
+	}
+	sort.Slice(snap.Domains, func(i, j int) bool {
+		return counts[snap.Domains[i].Domain] > counts[snap.Domains[j].Domain]
+	})
+	return snap
+}
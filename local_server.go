@@ -0,0 +1,456 @@
+package main
+
+// Local DoT (RFC 7858) and DoH (RFC 8484) servers for downstream clients.
+//
+// 기기별로 고유한 DoT 호스트 이름(SNI) 또는 DoH URL 경로를 발급하면
+// 모든 기기가 같은 NAT 주소를 사용하더라도 기기를 구분할 수 있다.
+//   DoT : <device>.<hostname>
+//   DoH : https://<hostname><path>/<device>
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const DOH_CONTENT_TYPE = "application/dns-message"
+
+// deviceIdentifier is implemented by response writers that know the device id.
+type deviceIdentifier interface {
+	Device() string
+}
+
+// deviceFromHostname returns the device id in the TLS server name.
+// "kidtablet.dns.example.com" with hostname "dns.example.com" -> "kidtablet"
+func deviceFromHostname(serverName, hostname string) string {
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if hostname == "" || !strings.HasSuffix(serverName, "."+hostname) {
+		return ""
+	}
+
+	device := strings.TrimSuffix(serverName, "."+hostname)
+	if strings.Contains(device, ".") {
+		return ""
+	}
+	return device
+}
+
+// loadTLSConfig returns the TLS settings of a local server.
+// cert_file, key_file이 없으면 자동으로 발급한 인증서를 사용한다. (see autocert.go)
+func loadTLSConfig(cfg *LocalServerConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CertFile == "" && cfg.KeyFile == "" {
+		ac, err := newAutoCert(cfg.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = ac.GetCertificate
+	} else {
+		cert, err := tls.LoadX509KeyPair(resolveAppPath(cfg.CertFile), resolveAppPath(cfg.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// mTLS: only clients with a certificate issued by the CA are accepted.
+	if cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(resolveAppPath(cfg.ClientCAFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, newErr("No certificate in client CA file " + cfg.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// edns-tcp-keepalive (RFC 7828)
+//
+// 클라이언트가 쿼리에 옵션을 포함하면 응답에 연결 유지 시간(idle timeout)을 알려준다.
+// 클라이언트는 그 시간 동안 연결을 닫지 않고 다음 쿼리에 다시 사용할 수 있다.
+
+const TCP_KEEPALIVE_MAX = 0xffff * 100 * time.Millisecond
+
+// wantsKeepalive reports whether the query has the edns-tcp-keepalive option.
+func wantsKeepalive(r *dns.Msg) bool {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0TCPKEEPALIVE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setKeepalive returns a copy of m with the idle timeout in the edns-tcp-keepalive option.
+func setKeepalive(m *dns.Msg, timeout time.Duration) *dns.Msg {
+	if timeout > TCP_KEEPALIVE_MAX {
+		timeout = TCP_KEEPALIVE_MAX
+	}
+	m = m.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_TCP_KEEPALIVE{
+		Code:    dns.EDNS0TCPKEEPALIVE,
+		Length:  2,
+		Timeout: uint16(timeout / (100 * time.Millisecond)),
+	})
+	return m
+}
+
+// DoT server
+
+const DOT_MAX_PIPELINED = 16 // queries answered at the same time per connection
+
+type dotHandler struct {
+	handler   dns.Handler
+	hostname  string
+	keepalive time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*dotConn // remote address ->
+}
+
+// dotConn limits the pipelined queries of one connection.
+type dotConn struct {
+	sem  chan struct{}
+	refs int
+}
+
+func newDoTHandler(handler dns.Handler, hostname string, keepalive time.Duration) *dotHandler {
+	return &dotHandler{
+		handler:   handler,
+		hostname:  hostname,
+		keepalive: keepalive,
+		conns:     map[string]*dotConn{},
+	}
+}
+
+// acquire waits until less than DOT_MAX_PIPELINED queries of the connection are
+// being answered. 기다리는 동안 연결에서 다음 쿼리를 읽지 않는다.
+func (h *dotHandler) acquire(key string) *dotConn {
+	h.mu.Lock()
+	c := h.conns[key]
+	if c == nil {
+		c = &dotConn{sem: make(chan struct{}, DOT_MAX_PIPELINED)}
+		h.conns[key] = c
+	}
+	c.refs++
+	h.mu.Unlock()
+
+	c.sem <- struct{}{}
+	return c
+}
+
+func (h *dotHandler) release(key string, c *dotConn) {
+	<-c.sem
+	h.mu.Lock()
+	c.refs--
+	if c.refs == 0 {
+		delete(h.conns, key)
+	}
+	h.mu.Unlock()
+}
+
+type dotResponseWriter struct {
+	dns.ResponseWriter
+	device    string
+	keepalive time.Duration // 0: no edns-tcp-keepalive option
+}
+
+func (w *dotResponseWriter) Device() string {
+	return w.device
+}
+
+func (w *dotResponseWriter) WriteMsg(m *dns.Msg) error {
+	if w.keepalive > 0 {
+		m = setKeepalive(m, w.keepalive)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (h *dotHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	device := ""
+	if cs, ok := w.(dns.ConnectionStater); ok {
+		if st := cs.ConnectionState(); st != nil {
+			device = deviceFromHostname(st.ServerName, h.hostname)
+		}
+	}
+	keepalive := time.Duration(0)
+	if h.keepalive > 0 && wantsKeepalive(r) {
+		keepalive = h.keepalive
+	}
+	// Pipelined queries (Android Private DNS) are answered out of order, so a slow
+	// upstream does not hold up the rest of the connection. (RFC 7766 6.2.1.1)
+	key := w.RemoteAddr().String()
+	c := h.acquire(key)
+	go func() {
+		defer h.release(key, c)
+		h.handler.ServeDNS(&dotResponseWriter{w, device, keepalive}, r)
+	}()
+}
+
+// dotConnWriter serializes the responses written to one connection.
+type dotConnWriter struct {
+	mu sync.Mutex
+	dns.Writer
+}
+
+func (w *dotConnWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.Writer.Write(b)
+}
+
+func RunDoT(cfg *LocalServerConfig, handler dns.Handler, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.NextProtos = []string{"dot"}
+
+	ln, err := tls.Listen("tcp", cfg.Listen, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &dns.Server{
+		Listener: ln,
+		Net:      "tcp-tls",
+		Handler:  newDoTHandler(handler, cfg.Hostname, cfg.KeepAlive.Duration),
+		// Stubs keep one connection open; do not close it after 128 queries.
+		MaxTCPQueries: -1,
+		DecorateWriter: func(w dns.Writer) dns.Writer {
+			return &dotConnWriter{Writer: w}
+		},
+	}
+	if cfg.KeepAlive.Duration > 0 {
+		idle := cfg.KeepAlive.Duration
+		srv.IdleTimeout = func() time.Duration { return idle }
+	}
+
+	go func() {
+		if err := srv.ActivateAndServe(); err != nil {
+			errHandler(err)
+		}
+	}()
+
+	log.Printf("DoT server listening on %s", cfg.Listen)
+	return srv.Shutdown, nil
+}
+
+// DoH server
+
+// dohResponseWriter passes a DoH request to the dns.Handler and keeps the reply.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	device string
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohResponseWriter) Device() string       { return w.device }
+func (w *dohResponseWriter) Close() error         { return nil }
+func (w *dohResponseWriter) TsigStatus() error    { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)  {}
+func (w *dohResponseWriter) Hijack()              {}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func tcpAddr(hostport string) net.Addr {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+type dohHandler struct {
+	handler  dns.Handler
+	hostname string
+	path     string
+	tokens   []string // accepted bearer tokens. empty: no token required
+	local    net.Addr
+}
+
+func (h *dohHandler) authorized(r *http.Request) bool {
+	if len(h.tokens) == 0 {
+		return true
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	for _, t := range h.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	device := ""
+	if r.URL.Path != h.path {
+		if !strings.HasPrefix(r.URL.Path, h.path+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		device = strings.Trim(strings.TrimPrefix(r.URL.Path, h.path), "/")
+	}
+	if device == "" && r.TLS != nil {
+		device = deviceFromHostname(r.TLS.ServerName, h.hostname)
+	}
+
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DOH_CONTENT_TYPE {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(wire)
+	}
+	if err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{
+		local:  h.local,
+		remote: tcpAddr(r.RemoteAddr),
+		device: device,
+	}
+	h.handler.ServeDNS(rw, req)
+
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	resp, err := rw.msg.Pack()
+	if err != nil {
+		http.Error(w, "can't pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", DOH_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(rw.msg))))
+	w.Write(resp)
+}
+
+// minTTL returns the smallest TTL in the answer section. (0 if empty)
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	for i, rr := range m.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+func RunDoH(cfg *LocalServerConfig, handler dns.Handler, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		TLSConfig: tlsConfig,
+		Handler: &dohHandler{
+			handler:  handler,
+			hostname: cfg.Hostname,
+			path:     strings.TrimSuffix(cfg.Path, "/"),
+			tokens:   cfg.AuthTokens,
+			local:    ln.Addr(),
+		},
+	}
+
+	go func() {
+		// certificates are in TLSConfig
+		if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			errHandler(err)
+		}
+	}()
+
+	log.Printf("DoH server listening on %s", cfg.Listen)
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+// Service log file (sec-dns.log).
+//
+// 파일은 max_size(MB)마다 교체되며 max_backups 개, max_age 일 동안 보관한다.
+// level = "error" 이면 [ERROR] 줄만 기록한다.
+
+import (
+	"bytes"
+	"io"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	LOG_LEVEL_INFO  = "info"
+	LOG_LEVEL_ERROR = "error"
+)
+
+// levelWriter drops the log lines below the error level.
+type levelWriter struct {
+	w io.Writer
+}
+
+func (lw *levelWriter) Write(p []byte) (int, error) {
+	if !bytes.Contains(p, []byte("[ERROR]")) {
+		return len(p), nil
+	}
+	return lw.w.Write(p)
+}
+
+// newLogWriter returns the writer of the service log.
+func newLogWriter(cfg LogConfig) io.Writer {
+	var w io.Writer = &lumberjack.Logger{
+		Filename:   resolveAppPath(cfg.File),
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress,
+	}
+	if cfg.Level == LOG_LEVEL_ERROR {
+		w = &levelWriter{w}
+	}
+	return w
+}
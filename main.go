@@ -1,17 +1,27 @@
 package main
 
 import (
+	"flag"
 	"golang.org/x/sys/windows/svc"
-	//"golang.org/x/sys/windows/svc/debug"
-	"gopkg.in/natefinch/lumberjack.v2"
+	"golang.org/x/sys/windows/svc/debug"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
 type ServContext struct {
+	ref        *HandlerRef
 	dnsSvcStop SvrStopFunc
+	subServers []subServer // optional servers (API, DoT, DoH, block page)
+}
+
+type subServer struct {
+	name string
+	stop SvrStopFunc
 }
 
 // svc.Handler 인터페이스 구현
@@ -22,23 +32,37 @@ func (srv *ServContext) Execute(args []string, req <-chan svc.ChangeRequest, sta
 	stopChan := make(chan bool, 1)
 	srv.runBody()
 
-	stat <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	stat <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+
+	// SIGHUP: 설정 다시 읽기 (Windows 서비스는 sc control SecDNS paramchange)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
 
 LOOP:
 	for {
 		// 서비스 변경 요청에 대해 핸들링
-		switch r := <-req; r.Cmd {
-		case svc.Stop, svc.Shutdown:
-			stopChan <- true
-			break LOOP
-
-		case svc.Interrogate:
-			stat <- r.CurrentStatus
-			time.Sleep(100 * time.Millisecond)
-			stat <- r.CurrentStatus
-
-			//case svc.Pause:
-			//case svc.Continue:
+		select {
+		case <-hup:
+			srv.reload()
+
+		case r := <-req:
+			switch r.Cmd {
+			case svc.Stop, svc.Shutdown:
+				stopChan <- true
+				break LOOP
+
+			case svc.ParamChange:
+				srv.reload()
+
+			case svc.Interrogate:
+				stat <- r.CurrentStatus
+				time.Sleep(100 * time.Millisecond)
+				stat <- r.CurrentStatus
+
+				//case svc.Pause:
+				//case svc.Continue:
+			}
 		}
 	}
 
@@ -47,6 +71,15 @@ LOOP:
 	// Stop DNS server
 	log.Println("Shutting down...")
 
+	for _, sub := range srv.subServers {
+		se := sub.stop()
+		if se != nil {
+			WriteErrorLogMsg(sub.name+" server shutdown error: ", se)
+		} else {
+			log.Println(sub.name + " server stopped.")
+		}
+	}
+
 	de := srv.dnsSvcStop()
 	if de != nil {
 		WriteErrorLogMsg("DNS service shutdown error: ", de)
@@ -54,14 +87,29 @@ LOOP:
 		log.Println("DNS service stopped.")
 	}
 
+	srv.ref.Close()
+
 	log.Println("SecDNS was stopped.")
 	return
 }
 
 func (srv *ServContext) runBody() {
+	cfg, err := loadServiceConfig()
+	if err != nil {
+		WriteErrorLogMsgF("Can't load config file. ", err)
+	}
+
+	handler, err := newServiceHandler(cfg)
+	if err != nil {
+		WriteErrorLogMsgF("Can't start DNS service. ", err)
+	}
+	handler.QueryLog.OpenFile(handler.Config.QueryLog)
+	cfg = handler.Config
+	srv.ref = NewHandlerRef(handler)
+
 	// DNS 서버를 go routine으로 시작하고
 	// 서버 종료를 위한 함수를 얻어 저장한다.
-	stopFunc, err := RunDNS(53, func(err error) {
+	stopFunc, err := RunDNS(&cfg.DNS, srv.ref, func(err error) {
 		WriteErrorLogMsg("DNS service error: ", err)
 	})
 
@@ -71,9 +119,78 @@ func (srv *ServContext) runBody() {
 		srv.dnsSvcStop = stopFunc
 		log.Println("SecDNS service started.")
 	}
+
+	if cfg.API.Enabled {
+		srv.startSubServer("API", func(errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+			return RunAPI(cfg.API, srv.ref, errHandler)
+		})
+	}
+	if cfg.Metrics.Enabled {
+		srv.startSubServer("Metrics", func(errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+			return RunMetrics(cfg.Metrics.Listen, srv.ref, errHandler)
+		})
+	}
+	if cfg.DoTServer.Enabled {
+		srv.startSubServer("DoT", func(errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+			return RunDoT(&cfg.DoTServer, srv.ref, errHandler)
+		})
+	}
+	if handler.Sinkhole != nil && cfg.Sinkhole.Listen != "" {
+		srv.startSubServer("Block page", func(errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+			return RunBlockPage(&cfg.Sinkhole, handler.Sinkhole, errHandler)
+		})
+	}
+	if cfg.DoHServer.Enabled {
+		srv.startSubServer("DoH", func(errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+			return RunDoH(&cfg.DoHServer, srv.ref, errHandler)
+		})
+	}
 }
 
-func logPath(filename string) string {
+// newServiceHandler applies the remote policy to cfg and creates the handler.
+func newServiceHandler(cfg *Config) (*SecHandler, error) {
+	cfg, policyVersion := LoadPolicy(cfg, appPath(POLICY_FILE))
+
+	handler, err := NewSecHandler(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Policy.URL != "" {
+		pf, err := NewPolicyFetcher(cfg.Policy, appPath(POLICY_FILE), policyVersion)
+		if err != nil {
+			WriteErrorLogMsg("Can't fetch remote policy. ", err)
+		} else {
+			handler.Policy = pf
+			go pf.Run(handler.done)
+		}
+	}
+	return handler, nil
+}
+
+// reload reloads the configuration. 실패하면 실행 중인 설정을 계속 사용한다.
+func (srv *ServContext) reload() {
+	if _, err := srv.ref.Reload(); err != nil {
+		WriteErrorLogMsg("Reload failed. The running configuration is kept.", err)
+	}
+}
+
+// startSubServer starts an optional server.
+// 부가 서버의 시작에 실패하더라도 DNS 서비스는 계속 실행한다.
+func (srv *ServContext) startSubServer(name string, run func(SvrErrorHandlerFunc) (SvrStopFunc, error)) {
+	stop, err := run(func(err error) {
+		WriteErrorLogMsg(name+" server error: ", err)
+	})
+
+	if err != nil {
+		WriteErrorLogMsg("Can't start "+name+" server. ", err)
+	} else {
+		srv.subServers = append(srv.subServers, subServer{name, stop})
+	}
+}
+
+// appPath returns the path of filename in the executable's directory.
+func appPath(filename string) string {
 	ex, err := os.Executable()
 	if err != nil {
 		ex = "." // current working directory
@@ -83,19 +200,52 @@ func logPath(filename string) string {
 	return filepath.Join(exPath, filename)
 }
 
+// resolveAppPath resolves a relative path in the config file
+// against the executable's directory.
+func resolveAppPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return appPath(path)
+}
+
 func main() {
-	log.SetOutput(&lumberjack.Logger{
-		Filename:   logPath("sec-dns.log"),
-		MaxSize:    10, // megabytes
-		MaxBackups: 1,
-		MaxAge:     28,    //days
-		Compress:   false, // disabled by default
-	})
+	args, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+
+	// command line interface
+	if len(args) > 0 {
+		os.Exit(runCLI(args))
+	}
+
+	// 설정 파일을 읽을 수 없으면 기본 설정으로 기록하고, runBody에서 오류를 기록한다.
+	logCfg := DefaultConfig().Log
+	if cfg, err := loadServiceConfig(); err == nil {
+		logCfg = cfg.Log
+	}
+	logWriter := newLogWriter(logCfg)
+	log.SetOutput(logWriter)
+
+	// 서비스로 시작하지 않았으면 콘솔에서 실행한다. (Ctrl+C로 종료)
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		WriteErrorLogMsgF("Can't determine the session type: ", err)
+	}
+	if !isService {
+		log.SetOutput(io.MultiWriter(os.Stderr, logWriter))
+	}
 
 	log.Println("Initializing...")
 
-	err := svc.Run("SecDNS", &ServContext{})
-	//err = debug.Run("DummyService", &dummyService{}) //콘솔출력 디버깅시
+	if isService {
+		err = svc.Run("SecDNS", &ServContext{})
+	} else {
+		err = debug.Run("SecDNS", &ServContext{})
+	}
 	if err != nil {
 		WriteErrorLogMsgF("Fatal service error: ", err)
 		panic(err)
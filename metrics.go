@@ -0,0 +1,229 @@
+package main
+
+// Prometheus metrics. (GET /metrics)
+//
+// [metrics] listen 주소에서 Prometheus text format으로 쿼리 수(type, rcode별), 캐시 hit/miss,
+// 업스트림별 응답 시간 histogram과 오류 수, 차단된 쿼리 수를 제공한다. (Grafana 등에서 사용)
+// 값은 서비스를 시작한 후의 누적값이며, 설정을 다시 읽어도(reload.go) 이어서 센다.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream latency histogram buckets (seconds)
+var metricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type latencyHistogram struct {
+	counts []int64 // per bucket, not cumulative. last: +Inf
+	sum    float64 // seconds
+	count  int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(metricsLatencyBuckets, sec)
+	h.counts[i]++
+	h.sum += sec
+	h.count++
+}
+
+type Metrics struct {
+	started     time.Time
+	cacheHits   int64
+	cacheMisses int64
+	blocked     int64
+
+	mu        sync.Mutex
+	queries   map[[2]string]int64 // qtype, rcode
+	latency   map[string]*latencyHistogram
+	errors    map[string]int64 // upstream name
+	upstreams []string         // in the order first seen
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		started: time.Now(),
+		queries: map[[2]string]int64{},
+		latency: map[string]*latencyHistogram{},
+		errors:  map[string]int64{},
+	}
+}
+
+// metricsLabel returns the name of a type or rcode, "other" if unknown,
+// so that the clients can't create any number of series.
+func metricsLabel(names map[uint16]string, v uint16) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return "other"
+}
+
+// RecordQuery counts a query answered to a client. resp: nil if not answered
+func (mt *Metrics) RecordQuery(r *dns.Msg, resp *dns.Msg, info *queryInfo) {
+	if mt == nil {
+		return
+	}
+	if info.blocked {
+		atomic.AddInt64(&mt.blocked, 1)
+	}
+	qtype, rcode := "none", "none"
+	if len(r.Question) > 0 {
+		qtype = metricsLabel(dns.TypeToString, r.Question[0].Qtype)
+	}
+	if resp != nil {
+		rcode = "other"
+		if name, ok := dns.RcodeToString[resp.Rcode]; ok {
+			rcode = name
+		}
+	}
+	mt.mu.Lock()
+	mt.queries[[2]string{qtype, rcode}]++
+	mt.mu.Unlock()
+}
+
+// RecordCache counts a cache lookup.
+func (mt *Metrics) RecordCache(hit bool) {
+	if mt == nil {
+		return
+	}
+	if hit {
+		atomic.AddInt64(&mt.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&mt.cacheMisses, 1)
+	}
+}
+
+// RecordUpstream counts an exchange with an upstream.
+func (mt *Metrics) RecordUpstream(name string, elapsed time.Duration, err error) {
+	if mt == nil {
+		return
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	h := mt.latency[name]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]int64, len(metricsLatencyBuckets)+1)}
+		mt.latency[name] = h
+		mt.upstreams = append(mt.upstreams, name)
+	}
+	if err != nil {
+		mt.errors[name]++
+		return
+	}
+	h.observe(elapsed)
+}
+
+func metricsHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// metricsQuote escapes a label value.
+func metricsQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (mt *Metrics) Write(w io.Writer, cache *CacheStats) {
+	metricsHeader(w, "securedns_uptime_seconds", "gauge", "Seconds since the service started.")
+	fmt.Fprintf(w, "securedns_uptime_seconds %.0f\n", time.Since(mt.started).Seconds())
+
+	metricsHeader(w, "securedns_blocked_queries_total", "counter", "Queries blocked by the filters.")
+	fmt.Fprintf(w, "securedns_blocked_queries_total %d\n", atomic.LoadInt64(&mt.blocked))
+
+	metricsHeader(w, "securedns_cache_hits_total", "counter", "Queries answered from the cache.")
+	fmt.Fprintf(w, "securedns_cache_hits_total %d\n", atomic.LoadInt64(&mt.cacheHits))
+	metricsHeader(w, "securedns_cache_misses_total", "counter", "Queries not found in the cache.")
+	fmt.Fprintf(w, "securedns_cache_misses_total %d\n", atomic.LoadInt64(&mt.cacheMisses))
+	metricsHeader(w, "securedns_cache_entries", "gauge", "Entries in the cache.")
+	fmt.Fprintf(w, "securedns_cache_entries %d\n", cache.Entries)
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	keys := make([][2]string, 0, len(mt.queries))
+	for k := range mt.queries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	metricsHeader(w, "securedns_queries_total", "counter", "Queries by type and response code.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "securedns_queries_total{qtype=\"%s\",rcode=\"%s\"} %d\n", k[0], k[1], mt.queries[k])
+	}
+
+	metricsHeader(w, "securedns_upstream_errors_total", "counter", "Failed exchanges by upstream.")
+	for _, name := range mt.upstreams {
+		fmt.Fprintf(w, "securedns_upstream_errors_total{upstream=\"%s\"} %d\n", metricsQuote(name), mt.errors[name])
+	}
+
+	metricsHeader(w, "securedns_upstream_latency_seconds", "histogram", "Response time of the successful exchanges by upstream.")
+	for _, name := range mt.upstreams {
+		h := mt.latency[name]
+		label := metricsQuote(name)
+		var cumulative int64
+		for i, le := range metricsLatencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "securedns_upstream_latency_seconds_bucket{upstream=\"%s\",le=\"%g\"} %d\n", label, le, cumulative)
+		}
+		fmt.Fprintf(w, "securedns_upstream_latency_seconds_bucket{upstream=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "securedns_upstream_latency_seconds_sum{upstream=\"%s\"} %g\n", label, h.sum)
+		fmt.Fprintf(w, "securedns_upstream_latency_seconds_count{upstream=\"%s\"} %d\n", label, h.count)
+	}
+}
+
+type metricsHandler struct {
+	ref *HandlerRef
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+	handler := h.ref.Get()
+	if handler.Metrics == nil {
+		http.Error(w, "metrics are disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	handler.Metrics.Write(w, handler.NameCache.Stats())
+}
+
+func RunMetrics(addr string, ref *HandlerRef, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: &metricsHandler{ref}}
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errHandler(err)
+		}
+	}()
+
+	log.Printf("Metrics server listening on %s", addr)
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+// IP to MAC address lookup from the OS neighbor tables (ARP, NDP).
+// LAN의 클라이언트를 IP 대신 MAC 주소로 식별하여, DHCP로 주소가 바뀌어도
+// 같은 클라이언트로 취급할 수 있게 한다.
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum interval between table refreshes on unknown addresses.
+const NEIGHBOR_MIN_REFRESH = 5 * time.Second
+
+type NeighborTable struct {
+	mu          sync.Mutex
+	macs        map[string]string // IP -> MAC
+	lastRefresh time.Time
+	refreshing  bool
+	interval    time.Duration
+}
+
+func NewNeighborTable(interval time.Duration) *NeighborTable {
+	n := &NeighborTable{
+		macs:     map[string]string{},
+		interval: interval,
+	}
+	n.refresh()
+	return n
+}
+
+// parseNeighbors reads "IP MAC ..." lines from the output of
+// `arp -a` and `netsh interface ipv6 show neighbors`.
+func parseNeighbors(out []byte, macs map[string]string) {
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsMulticast() {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[1])
+		if err != nil {
+			continue
+		}
+		if mac.String() == "ff:ff:ff:ff:ff:ff" || mac.String() == "00:00:00:00:00:00" {
+			continue
+		}
+		macs[ip.String()] = mac.String()
+	}
+}
+
+func (n *NeighborTable) refresh() {
+	macs := map[string]string{}
+
+	if out, err := exec.Command("arp", "-a").Output(); err == nil {
+		parseNeighbors(out, macs)
+	} else {
+		WriteErrorLog(err)
+	}
+	if out, err := exec.Command("netsh", "interface", "ipv6", "show", "neighbors").Output(); err == nil {
+		parseNeighbors(out, macs)
+	} else {
+		WriteErrorLog(err)
+	}
+
+	n.mu.Lock()
+	n.macs = macs
+	n.lastRefresh = time.Now()
+	n.refreshing = false
+	n.mu.Unlock()
+}
+
+// Lookup returns the MAC address of ip, or "" if unknown.
+// An unknown address or an old table starts a background refresh.
+func (n *NeighborTable) Lookup(ip string) string {
+	n.mu.Lock()
+	mac, ok := n.macs[ip]
+	if (!ok || time.Since(n.lastRefresh) > n.interval) && !n.refreshing &&
+		time.Since(n.lastRefresh) > NEIGHBOR_MIN_REFRESH {
+		n.refreshing = true
+		go n.refresh()
+	}
+	n.mu.Unlock()
+
+	return mac
+}
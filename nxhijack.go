@@ -0,0 +1,179 @@
+package main
+
+// Upstream NXDOMAIN hijack detection.
+//
+// 일부 ISP/DNS 서비스는 존재하지 않는 이름에 NXDOMAIN 대신 검색 페이지 주소를 응답한다.
+// 주기적으로 무작위로 만든 존재하지 않는 이름을 각 업스트림에 질의하여 A 레코드가
+// 응답되면 경고하고, action = "strip" 이면 그 주소만으로 된 응답을 NXDOMAIN으로 바꾼다.
+
+import (
+	"crypto/rand"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const NXHIJACK_LABEL_LENGTH = 16
+
+var nxhijackTLDs = []string{"com", "net", "org"}
+
+type NXHijackResult struct {
+	Upstream  string    `json:"upstream"`
+	Hijacked  bool      `json:"hijacked"`
+	Addresses []string  `json:"addresses"` // wildcard answers
+	Error     string    `json:"error,omitempty"`
+	Checked   time.Time `json:"checked"`
+}
+
+type NXHijack struct {
+	mu      sync.RWMutex
+	cfg     NXHijackConfig
+	handler *SecHandler
+	results map[string]*NXHijackResult // upstream name ->
+	wild    map[string]map[string]bool // upstream name -> wildcard addresses
+}
+
+func NewNXHijack(cfg NXHijackConfig, handler *SecHandler) (*NXHijack, error) {
+	if cfg.Interval.Duration <= 0 {
+		return nil, newErr("Invalid nxdomain_hijack interval.")
+	}
+	if cfg.Probes <= 0 {
+		cfg.Probes = len(nxhijackTLDs)
+	}
+	switch cfg.Action {
+	case "alert", "strip":
+	default:
+		return nil, newErr("Unknown nxdomain_hijack action: " + cfg.Action)
+	}
+	return &NXHijack{
+		cfg:     cfg,
+		handler: handler,
+		results: map[string]*NXHijackResult{},
+		wild:    map[string]map[string]bool{},
+	}, nil
+}
+
+// randomName returns a name that should not exist.
+func randomName(tld string) string {
+	b := make([]byte, NXHIJACK_LABEL_LENGTH)
+	rand.Read(b)
+	for i := range b {
+		b[i] = 'a' + b[i]%26
+	}
+	return string(b) + "." + tld + "."
+}
+
+// Check probes every upstream once.
+func (h *NXHijack) Check() []NXHijackResult {
+	for _, u := range h.handler.Upstreams.Select() {
+		res := &NXHijackResult{Upstream: u.Name, Addresses: []string{}, Checked: time.Now()}
+		wild := map[string]bool{}
+
+		for i := 0; i < h.cfg.Probes; i++ {
+			r := new(dns.Msg)
+			r.SetQuestion(randomName(nxhijackTLDs[i%len(nxhijackTLDs)]), dns.TypeA)
+
+			m, err := u.Exchange(r)
+			if err != nil {
+				res.Error = err.Error()
+				continue
+			}
+			for _, rr := range m.Answer {
+				if a, ok := rr.(*dns.A); ok {
+					wild[a.A.String()] = true
+				}
+			}
+		}
+		for ip := range wild {
+			res.Addresses = append(res.Addresses, ip)
+		}
+		sort.Strings(res.Addresses)
+		res.Hijacked = len(wild) > 0
+
+		h.mu.Lock()
+		prev := h.results[u.Name]
+		if res.Error != "" && !res.Hijacked && prev != nil {
+			// 질의에 실패하면 이전 판정을 유지한다.
+			res.Hijacked, res.Addresses = prev.Hijacked, prev.Addresses
+			wild = h.wild[u.Name]
+		}
+		if res.Hijacked && (prev == nil || !prev.Hijacked) {
+			log.Printf("[NXHIJACK] upstream %s answers nonexistent names with %v instead of NXDOMAIN", u.Name, res.Addresses)
+		} else if !res.Hijacked && prev != nil && prev.Hijacked {
+			log.Printf("[NXHIJACK] upstream %s answers NXDOMAIN again.", u.Name)
+		}
+		h.results[u.Name] = res
+		h.wild[u.Name] = wild
+		h.mu.Unlock()
+	}
+	return h.Status()
+}
+
+// Run checks every interval until stop is closed.
+func (h *NXHijack) Run(stop <-chan struct{}) {
+	h.Check()
+
+	ticker := time.NewTicker(h.cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.Check()
+		}
+	}
+}
+
+// Filter replaces an answer that consists only of the wildcard addresses
+// of the upstream with NXDOMAIN. (action = "strip")
+func (h *NXHijack) Filter(upstream string, m *dns.Msg) (*dns.Msg, bool) {
+	if h.cfg.Action != "strip" || m.Rcode != dns.RcodeSuccess {
+		return m, false
+	}
+
+	h.mu.RLock()
+	wild := h.wild[upstream]
+	h.mu.RUnlock()
+	if len(wild) == 0 {
+		return m, false
+	}
+
+	found := false
+	for _, rr := range m.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			if !wild[v.A.String()] {
+				return m, false
+			}
+			found = true
+		case *dns.CNAME:
+		default:
+			return m, false
+		}
+	}
+	if !found {
+		return m, false
+	}
+
+	m.Rcode = dns.RcodeNameError
+	m.Answer = nil
+	return m, true
+}
+
+func (h *NXHijack) Status() []NXHijackResult {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	list := []NXHijackResult{}
+	for _, u := range h.handler.Upstreams.Select() {
+		if res, ok := h.results[u.Name]; ok {
+			list = append(list, *res)
+		}
+	}
+	return list
+}
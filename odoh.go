@@ -0,0 +1,377 @@
+package main
+
+// Oblivious DNS over HTTPS (RFC 9230).
+//
+// 쿼리를 target의 공개키로 암호화(HPKE)하여 proxy를 통해 보낸다.
+// proxy는 클라이언트의 주소를 알지만 쿼리를 볼 수 없고, target은 쿼리를 보지만
+// 클라이언트의 주소를 알 수 없다.
+//
+//   odoh://target/path?proxy=https://proxy/path
+//   e.g. "odoh://odoh.cloudflare-dns.com/dns-query?proxy=https://odoh-relay.example/proxy"
+//
+// target의 ObliviousDoHConfigs는 https://target/.well-known/odohconfigs 에서 받는다.
+// (이 요청은 proxy를 거치지 않는다. 쿼리 내용은 포함되지 않는다)
+// HPKE suite: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/hkdf"
+)
+
+const ODOH_CONTENT_TYPE = "application/oblivious-dns-message"
+const ODOH_CONFIGS_PATH = "/.well-known/odohconfigs"
+const ODOH_CONFIG_TTL = 1 * time.Hour // target key is fetched again after this time
+const ODOH_VERSION = 0x0001
+const ODOH_PADDING_BLOCK = 128 // plaintext query is padded to a multiple of this
+
+const (
+	ODOH_MESSAGE_QUERY    = 0x01
+	ODOH_MESSAGE_RESPONSE = 0x02
+)
+
+// HPKE (RFC 9180) suite
+const (
+	HPKE_KEM_X25519_SHA256 = 0x0020
+	HPKE_KDF_SHA256        = 0x0001
+	HPKE_AEAD_AES128GCM    = 0x0001
+
+	HPKE_NK = 16 // AEAD key size
+	HPKE_NN = 12 // AEAD nonce size
+	HPKE_NH = 32 // KDF output size
+)
+
+// hpke labeled extract/expand. suite: "KEM"||kem_id or "HPKE"||kem_id||kdf_id||aead_id
+func hpkeExtract(suite []byte, salt []byte, label string, ikm []byte) []byte {
+	labeled := concatBytes([]byte("HPKE-v1"), suite, []byte(label), ikm)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+func hpkeExpand(suite []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeled := concatBytes(u16(length), []byte("HPKE-v1"), suite, []byte(label), info)
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, labeled), out)
+	return out
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u16(n int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(n))
+	return b
+}
+
+// hpkeContext is a sender context of HPKE base mode.
+type hpkeContext struct {
+	aead     cipher.AEAD
+	nonce    []byte
+	exporter []byte
+}
+
+// hpkeSetupBaseS encapsulates a key to pkR. Returns enc and the context.
+func hpkeSetupBaseS(pkR *ecdh.PublicKey, info []byte) ([]byte, *hpkeContext, error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+
+	// DHKEM: shared_secret = ExtractAndExpand(dh, enc || pkR)
+	kemSuite := concatBytes([]byte("KEM"), u16(HPKE_KEM_X25519_SHA256))
+	prk := hpkeExtract(kemSuite, nil, "eae_prk", dh)
+	shared := hpkeExpand(kemSuite, prk, "shared_secret", concatBytes(enc, pkR.Bytes()), HPKE_NH)
+
+	// key schedule, mode_base (psk, psk_id 없음)
+	suite := concatBytes([]byte("HPKE"), u16(HPKE_KEM_X25519_SHA256), u16(HPKE_KDF_SHA256), u16(HPKE_AEAD_AES128GCM))
+	ksc := concatBytes([]byte{0},
+		hpkeExtract(suite, nil, "psk_id_hash", nil),
+		hpkeExtract(suite, nil, "info_hash", info))
+	secret := hpkeExtract(suite, shared, "secret", nil)
+
+	aead, err := newAESGCM(hpkeExpand(suite, secret, "key", ksc, HPKE_NK))
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, &hpkeContext{
+		aead:     aead,
+		nonce:    hpkeExpand(suite, secret, "base_nonce", ksc, HPKE_NN),
+		exporter: hpkeExpand(suite, secret, "exp", ksc, HPKE_NH),
+	}, nil
+}
+
+// Seal encrypts the first (and only) message of the context.
+func (c *hpkeContext) Seal(aad, pt []byte) []byte {
+	return c.aead.Seal(nil, c.nonce, pt, aad)
+}
+
+func (c *hpkeContext) Export(exporterContext []byte, length int) []byte {
+	suite := concatBytes([]byte("HPKE"), u16(HPKE_KEM_X25519_SHA256), u16(HPKE_KDF_SHA256), u16(HPKE_AEAD_AES128GCM))
+	return hpkeExpand(suite, c.exporter, "sec", exporterContext, length)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// odohConfig is a target public key of a supported suite.
+type odohConfig struct {
+	key     *ecdh.PublicKey
+	keyID   []byte
+	fetched time.Time
+}
+
+// parseODoHConfigs returns the first config with the supported version and suite.
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, newErr("Invalid ODoH configs.")
+	}
+	data = data[2:]
+	for len(data) >= 4 {
+		version := binary.BigEndian.Uint16(data)
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			break
+		}
+		contents := data[4 : 4+length]
+		data = data[4+length:]
+
+		// ObliviousDoHConfigContents: kem_id, kdf_id, aead_id, public_key<1..2^16-1>
+		if version != ODOH_VERSION || len(contents) < 8 {
+			continue
+		}
+		if binary.BigEndian.Uint16(contents) != HPKE_KEM_X25519_SHA256 ||
+			binary.BigEndian.Uint16(contents[2:]) != HPKE_KDF_SHA256 ||
+			binary.BigEndian.Uint16(contents[4:]) != HPKE_AEAD_AES128GCM {
+			continue
+		}
+		keyLen := int(binary.BigEndian.Uint16(contents[6:]))
+		if len(contents) != 8+keyLen {
+			continue
+		}
+		key, err := ecdh.X25519().NewPublicKey(contents[8:])
+		if err != nil {
+			continue
+		}
+
+		// key_id = Expand(Extract("", contents), "odoh key id", Nh)
+		keyID := make([]byte, HPKE_NH)
+		io.ReadFull(hkdf.Expand(sha256.New, hkdf.Extract(sha256.New, contents, nil), []byte("odoh key id")), keyID)
+		return &odohConfig{key: key, keyID: keyID, fetched: time.Now()}, nil
+	}
+	return nil, newErr("No supported ODoH config.")
+}
+
+// odohMessage serializes an ObliviousDoHMessage.
+func odohMessage(msgType byte, keyID, encrypted []byte) []byte {
+	return concatBytes([]byte{msgType}, u16(len(keyID)), keyID, u16(len(encrypted)), encrypted)
+}
+
+func parseODoHMessage(data []byte) (msgType byte, keyID, encrypted []byte, err error) {
+	if len(data) < 3 {
+		return 0, nil, nil, newErr("Invalid ODoH message.")
+	}
+	msgType = data[0]
+	n := int(binary.BigEndian.Uint16(data[1:]))
+	if len(data) < 3+n+2 {
+		return 0, nil, nil, newErr("Invalid ODoH message.")
+	}
+	keyID = data[3 : 3+n]
+	data = data[3+n:]
+	if int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return 0, nil, nil, newErr("Invalid ODoH message.")
+	}
+	return msgType, keyID, data[2:], nil
+}
+
+type odohTransport struct {
+	configsURL string
+	proxy      string // proxy url with targethost and targetpath
+	client     *http.Client
+
+	mu     sync.Mutex
+	config *odohConfig
+}
+
+func newODoHTransport(u *url.URL, client *http.Client) (*odohTransport, error) {
+	proxy := u.Query().Get("proxy")
+	if u.Host == "" || proxy == "" {
+		return nil, newErr("ODoH upstream url needs a target and a proxy: '" + u.String() + "'")
+	}
+	pu, err := url.Parse(proxy)
+	if err != nil || pu.Scheme != "https" || pu.Host == "" {
+		return nil, newErr("Invalid ODoH proxy '" + proxy + "'")
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/dns-query"
+	}
+	q := pu.Query()
+	q.Set("targethost", u.Hostname())
+	q.Set("targetpath", path)
+	pu.RawQuery = q.Encode()
+
+	return &odohTransport{
+		configsURL: "https://" + u.Host + ODOH_CONFIGS_PATH,
+		proxy:      pu.String(),
+		client:     client,
+	}, nil
+}
+
+// getConfig returns the target key, fetching it if needed.
+func (t *odohTransport) getConfig(refresh bool) (*odohConfig, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.config != nil && !refresh && time.Since(t.config.fetched) < ODOH_CONFIG_TTL {
+		return t.config, nil
+	}
+
+	resp, err := t.client.Get(t.configsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &DohError{msg: "ODoH configs: HTTP error code " + resp.Status, status: resp.StatusCode}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseODoHConfigs(data)
+	if err != nil {
+		return nil, err
+	}
+	t.config = config
+	return config, nil
+}
+
+func (t *odohTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	config, err := t.getConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	m, err := t.exchange(config, r)
+	if de, ok := err.(*DohError); ok && (de.status == http.StatusUnauthorized || de.status == http.StatusBadRequest) {
+		// target의 키가 바뀌었다.
+		if config, err = t.getConfig(true); err != nil {
+			return nil, err
+		}
+		m, err = t.exchange(config, r)
+	}
+	return m, err
+}
+
+func (t *odohTransport) exchange(config *odohConfig, r *dns.Msg) (*dns.Msg, error) {
+	wire, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	// ObliviousDoHMessagePlaintext: dns_message, padding
+	pad := ODOH_PADDING_BLOCK - (len(wire)+4)%ODOH_PADDING_BLOCK
+	if pad == ODOH_PADDING_BLOCK {
+		pad = 0
+	}
+	plain := concatBytes(u16(len(wire)), wire, u16(pad), make([]byte, pad))
+
+	enc, ctx, err := hpkeSetupBaseS(config.key, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := concatBytes([]byte{ODOH_MESSAGE_QUERY}, u16(len(config.keyID)), config.keyID)
+	body := odohMessage(ODOH_MESSAGE_QUERY, config.keyID, concatBytes(enc, ctx.Seal(aad, plain)))
+
+	req, err := http.NewRequest(http.MethodPost, t.proxy, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ODOH_CONTENT_TYPE)
+	req.Header.Set("Accept", ODOH_CONTENT_TYPE)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		e := &DohError{msg: "ODoH request failed: " + err.Error()}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			e.timeout = true
+		}
+		return nil, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &DohError{msg: "ODoH: HTTP error code " + resp.Status, status: resp.StatusCode}
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536+1024))
+	if err != nil {
+		return nil, err
+	}
+
+	msgType, nonce, encrypted, err := parseODoHMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != ODOH_MESSAGE_RESPONSE {
+		return nil, newErr("ODoH: unexpected message type.")
+	}
+
+	// 응답 키: secret = Export("odoh response", Nk), salt = Q_plain || len(nonce) || nonce
+	secret := ctx.Export([]byte("odoh response"), HPKE_NK)
+	prk := hkdf.Extract(sha256.New, secret, concatBytes(plain, u16(len(nonce)), nonce))
+	key := make([]byte, HPKE_NK)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("odoh key")), key)
+	respNonce := make([]byte, HPKE_NN)
+	io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("odoh nonce")), respNonce)
+
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	respAAD := concatBytes([]byte{ODOH_MESSAGE_RESPONSE}, u16(len(nonce)), nonce)
+	rplain, err := aead.Open(nil, respNonce, encrypted, respAAD)
+	if err != nil {
+		return nil, newErr("ODoH: can't decrypt the response.")
+	}
+
+	if len(rplain) < 2 || int(binary.BigEndian.Uint16(rplain)) > len(rplain)-2 {
+		return nil, newErr("ODoH: invalid response.")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(rplain[2 : 2+binary.BigEndian.Uint16(rplain)]); err != nil {
+		return nil, newErr("Can't unpack message from wireformat.")
+	}
+	return m, nil
+}
+
+func (t *odohTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
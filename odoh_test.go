@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+// testODoHConfig builds an ObliviousDoHConfig.
+func testODoHConfig(version, kem, kdf, aead int, key []byte) []byte {
+	contents := concatBytes(u16(kem), u16(kdf), u16(aead), u16(len(key)), key)
+	return concatBytes(u16(version), u16(len(contents)), contents)
+}
+
+// testODoHConfigs wraps configs in ObliviousDoHConfigs.
+func testODoHConfigs(configs ...[]byte) []byte {
+	b := concatBytes(configs...)
+	return concatBytes(u16(len(b)), b)
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	key := priv.PublicKey().Bytes()
+	valid := testODoHConfig(ODOH_VERSION, HPKE_KEM_X25519_SHA256, HPKE_KDF_SHA256, HPKE_AEAD_AES128GCM, key)
+	p256 := testODoHConfig(ODOH_VERSION, 0x0010, HPKE_KDF_SHA256, HPKE_AEAD_AES128GCM, bytes.Repeat([]byte{4}, 65))
+
+	// key length 31 inside a config of the right length
+	badKeyLen := concatBytes(u16(ODOH_VERSION), u16(8+32),
+		u16(HPKE_KEM_X25519_SHA256), u16(HPKE_KDF_SHA256), u16(HPKE_AEAD_AES128GCM), u16(31), key)
+
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"valid", testODoHConfigs(valid), true},
+		{"after unsupported suite", testODoHConfigs(p256, valid), true},
+		{"after unsupported version", testODoHConfigs(testODoHConfig(0xff06, HPKE_KEM_X25519_SHA256, HPKE_KDF_SHA256, HPKE_AEAD_AES128GCM, key), valid), true},
+		{"empty", nil, false},
+		{"no configs", testODoHConfigs(), false},
+		{"total length mismatch", append(testODoHConfigs(valid), 0), false},
+		{"truncated", testODoHConfigs(valid[:len(valid)-1]), false},
+		{"unsupported only", testODoHConfigs(p256), false},
+		{"key length mismatch", testODoHConfigs(badKeyLen), false},
+		{"short key", testODoHConfigs(testODoHConfig(ODOH_VERSION, HPKE_KEM_X25519_SHA256, HPKE_KDF_SHA256, HPKE_AEAD_AES128GCM, key[:31])), false},
+	}
+	for _, tt := range tests {
+		c, err := parseODoHConfigs(tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if !bytes.Equal(c.key.Bytes(), key) || len(c.keyID) != HPKE_NH {
+			t.Errorf("%s: got key %x, key id %x", tt.name, c.key.Bytes(), c.keyID)
+		}
+	}
+
+	// key_id depends only on the config contents.
+	a, err1 := parseODoHConfigs(testODoHConfigs(valid))
+	b, err2 := parseODoHConfigs(testODoHConfigs(p256, valid))
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if !bytes.Equal(a.keyID, b.keyID) {
+		t.Errorf("key id differs: %x, %x", a.keyID, b.keyID)
+	}
+}
+
+func TestParseODoHMessage(t *testing.T) {
+	keyID := bytes.Repeat([]byte{0x22}, HPKE_NH)
+	encrypted := []byte("encrypted query")
+	valid := odohMessage(0x01, keyID, encrypted)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		keyID     []byte
+		encrypted []byte
+		ok        bool
+	}{
+		{"valid", valid, keyID, encrypted, true},
+		{"empty key id", odohMessage(0x02, nil, encrypted), nil, encrypted, true},
+		{"empty", nil, nil, nil, false},
+		{"no key id length", valid[:2], nil, nil, false},
+		{"truncated key id", valid[:3+HPKE_NH-1], nil, nil, false},
+		{"no encrypted length", valid[:3+HPKE_NH+1], nil, nil, false},
+		{"truncated", valid[:len(valid)-1], nil, nil, false},
+		{"trailing data", append(append([]byte{}, valid...), 0), nil, nil, false},
+	}
+	for _, tt := range tests {
+		msgType, k, e, err := parseODoHMessage(tt.data)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if msgType != tt.data[0] || !bytes.Equal(k, tt.keyID) || !bytes.Equal(e, tt.encrypted) {
+			t.Errorf("%s: got %d %x %q", tt.name, msgType, k, e)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+// Offline mode.
+//
+// 업스트림 질의가 연속으로 실패하면 네트워크를 사용할 수 없는 것으로 판단하고,
+// 업스트림에 질의하지 않고 캐시(만료된 응답 포함), 로컬 레코드로만 응답한다.
+// probe_interval 마다 업스트림을 확인하여 연결이 복구되면 자동으로 다시 전달한다.
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const OFFLINE_STALE_TTL = 30 // TTL of stale answers
+
+type Offline struct {
+	cfg      OfflineConfig
+	offline  int32 // atomic. 1: offline
+	failures int32 // atomic. consecutive upstream failures
+	stale    *cache.Cache
+}
+
+func NewOffline(cfg OfflineConfig) *Offline {
+	return &Offline{
+		cfg:   cfg,
+		stale: cache.New(cfg.StaleMaxAge.Duration, 10*time.Minute),
+	}
+}
+
+func staleKey(q dns.Question) string {
+	return strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype))
+}
+
+func (o *Offline) Offline() bool {
+	return atomic.LoadInt32(&o.offline) == 1
+}
+
+func (o *Offline) setOffline(offline bool) {
+	if offline {
+		if atomic.CompareAndSwapInt32(&o.offline, 0, 1) {
+			log.Printf("[OFFLINE] upstream unreachable: answering from the cache and local records only.")
+		}
+	} else if atomic.CompareAndSwapInt32(&o.offline, 1, 0) {
+		log.Printf("[OFFLINE] connectivity restored: forwarding to the upstream again.")
+	}
+	atomic.StoreInt32(&o.failures, 0)
+}
+
+// Record counts the result of an upstream query.
+func (o *Offline) Record(err error) {
+	if err == nil {
+		if atomic.LoadInt32(&o.failures) != 0 {
+			atomic.StoreInt32(&o.failures, 0)
+		}
+		return
+	}
+	if int(atomic.AddInt32(&o.failures, 1)) >= o.cfg.Failures {
+		o.setOffline(true)
+	}
+}
+
+// Store keeps a response to answer with while offline.
+func (o *Offline) Store(m *dns.Msg) {
+	if len(m.Question) == 0 || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return
+	}
+	o.stale.SetDefault(staleKey(m.Question[0]), m.Copy())
+}
+
+// Reply answers r with a stored (possibly expired) response, or returns nil.
+func (o *Offline) Reply(r *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	x, ok := o.stale.Get(staleKey(r.Question[0]))
+	if !ok {
+		return nil
+	}
+	m := x.(*dns.Msg).Copy()
+	m.SetReply(r)
+	for _, rr := range m.Answer {
+		rr.Header().Ttl = OFFLINE_STALE_TTL
+	}
+	return m
+}
+
+// Run probes the upstream while offline until stop is closed.
+func (o *Offline) Run(probe func() error, stop <-chan struct{}) {
+	ticker := time.NewTicker(o.cfg.ProbeInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if o.Offline() && probe() == nil {
+			o.setOffline(false)
+		}
+	}
+}
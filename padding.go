@@ -0,0 +1,43 @@
+package main
+
+// EDNS(0) padding of the upstream queries (RFC 7830, RFC 8467).
+//
+// 암호화된 연결에서도 메시지 길이로 질의한 이름을 추측할 수 있으므로, 쿼리를
+// PADDING_BLOCK 바이트의 배수가 되도록 padding 옵션을 추가한다. (Block-Length Padding)
+// DNSCrypt, ODoH는 자체 padding을 사용하고, JSON DoH는 메시지를 보내지 않으므로 제외한다.
+
+import (
+	"github.com/miekg/dns"
+)
+
+const PADDING_BLOCK = 128 // recommended query block size (RFC 8467 4.1)
+
+type paddedTransport struct {
+	transport
+}
+
+func (t *paddedTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	return t.transport.Exchange(padQuery(r))
+}
+
+// padQuery returns a copy of r padded to a multiple of PADDING_BLOCK.
+func padQuery(r *dns.Msg) *dns.Msg {
+	q := r.Copy()
+	opt := q.IsEdns0()
+	if opt == nil {
+		q.SetEdns0(EDNS_UDP_SIZE, false)
+		opt = q.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+
+	size := q.Len() + 4 // option code and length
+	pad := (PADDING_BLOCK - size%PADDING_BLOCK) % PADDING_BLOCK
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, pad)})
+	return q
+}
@@ -0,0 +1,147 @@
+package main
+
+// Pinned cache records.
+//
+// 지정한 이름(DoH 호스트, VPN 서버, NAS 등)의 마지막 정상 응답은 만료되지 않고 보관되며,
+// 업스트림 질의에 실패하면 이 응답으로 대신 응답한다.
+// 서비스를 다시 시작해도 유지되도록 파일에 저장한다.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const PINNED_CACHE_FILE = "pinned-cache.json"
+const PINNED_STALE_TTL = 30 // TTL of answers served after an upstream failure
+
+type PinnedCache struct {
+	mu    sync.Mutex
+	path  string
+	names map[string]bool     // pinned names (lowercase fqdn)
+	msgs  map[string]*dns.Msg // name/qtype -> last good response
+}
+
+func pinnedKey(name string, qtype uint16) string {
+	return strings.ToLower(name) + "/" + strconv.Itoa(int(qtype))
+}
+
+func NewPinnedCache(names []string, path string) *PinnedCache {
+	pc := &PinnedCache{path: path, names: map[string]bool{}, msgs: map[string]*dns.Msg{}}
+	for _, n := range names {
+		pc.names[dns.Fqdn(strings.ToLower(n))] = true
+	}
+	if len(pc.names) > 0 {
+		pc.load()
+	}
+	return pc
+}
+
+func (pc *PinnedCache) load() {
+	data, err := ioutil.ReadFile(pc.path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var wires map[string][]byte
+	if err == nil {
+		err = json.Unmarshal(data, &wires)
+	}
+	if err != nil {
+		WriteErrorLogMsg("Can't read the pinned cache file.", err)
+		return
+	}
+
+	for key, wire := range wires {
+		m := new(dns.Msg)
+		if m.Unpack(wire) != nil || len(m.Question) == 0 {
+			continue
+		}
+		// 설정에서 제외된 이름은 버린다.
+		if pc.names[strings.ToLower(m.Question[0].Name)] {
+			pc.msgs[key] = m
+		}
+	}
+}
+
+// save writes the records. called with mu held.
+func (pc *PinnedCache) save() {
+	wires := map[string][]byte{}
+	for key, m := range pc.msgs {
+		if wire, err := m.Pack(); err == nil {
+			wires[key] = wire
+		}
+	}
+	data, err := json.Marshal(wires)
+	if err == nil {
+		tmp := pc.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, pc.path)
+		}
+	}
+	if err != nil {
+		WriteErrorLogMsg("Can't write the pinned cache file.", err)
+	}
+}
+
+// Store keeps a successful response of a pinned name.
+func (pc *PinnedCache) Store(m *dns.Msg) {
+	if len(pc.names) == 0 || len(m.Question) == 0 || m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		return
+	}
+	q := m.Question[0]
+	if !pc.names[strings.ToLower(q.Name)] {
+		return
+	}
+
+	key := pinnedKey(q.Name, q.Qtype)
+	m = m.Copy()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	// 응답 내용이 바뀐 경우에만 파일에 저장한다.
+	old, ok := pc.msgs[key]
+	pc.msgs[key] = m
+	if !ok || !sameAnswer(old, m) {
+		pc.save()
+	}
+}
+
+func sameAnswer(a, b *dns.Msg) bool {
+	if len(a.Answer) != len(b.Answer) {
+		return false
+	}
+	for i := range a.Answer {
+		if !dns.IsDuplicate(a.Answer[i], b.Answer[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reply answers r with the last good response, or returns nil if there is none.
+func (pc *PinnedCache) Reply(r *dns.Msg) *dns.Msg {
+	if len(pc.names) == 0 || len(r.Question) == 0 {
+		return nil
+	}
+	q := r.Question[0]
+
+	pc.mu.Lock()
+	m, ok := pc.msgs[pinnedKey(q.Name, q.Qtype)]
+	pc.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	m = m.Copy()
+	m.SetReply(r)
+	for _, rr := range m.Answer {
+		rr.Header().Ttl = PINNED_STALE_TTL
+	}
+	return m
+}
@@ -0,0 +1,288 @@
+package main
+
+// Remote policy for managed deployments.
+//
+// 관리자가 여러 SecureDNS를 한 곳에서 관리할 수 있도록, 설정의 [policy] url에서
+// 서명된 정책(설정 문서, TOML)을 주기적으로 받아 로컬 설정 위에 적용한다.
+// (MDM/GPO로 배포한 sec-dns.toml에 정책 서버를 지정)
+//   <url>     : 정책 문서
+//   <url>.sig : 정책 문서의 Ed25519 서명 (base64)
+// 받은 정책은 서명과 설정을 확인한 후 policy.toml로 보관하며, 서명이 맞지 않거나
+// 잘못된 정책은 적용하지 않고 마지막으로 확인된 정책을 계속 사용한다.
+// 새 정책은 서비스를 다시 시작하거나 설정을 다시 읽을 때(reload.go) 적용된다.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const POLICY_FILE = "policy.toml"
+const POLICY_SIG_SUFFIX = ".sig"
+const POLICY_MAX_SIZE = 4 << 20
+const POLICY_TIMEOUT = 30 * time.Second
+const POLICY_DEFAULT_INTERVAL = 1 * time.Hour
+
+type PolicyStatus struct {
+	URL       string    `json:"url"`
+	Version   string    `json:"version,omitempty"` // sha256 of the policy document
+	Active    string    `json:"active,omitempty"`  // version in use
+	Updated   time.Time `json:"updated"`
+	LastCheck time.Time `json:"last_check"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type PolicyFetcher struct {
+	cfg    PolicyConfig
+	key    ed25519.PublicKey
+	path   string
+	client *http.Client
+
+	mu     sync.Mutex
+	etag   string
+	status PolicyStatus
+}
+
+func policyKey(cfg PolicyConfig) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(cfg.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, newErr("Invalid policy public key.")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func policyVersion(doc []byte) string {
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:8])
+}
+
+// verifyPolicy checks the signature and returns the config with the policy applied.
+func verifyPolicy(key ed25519.PublicKey, doc []byte, sig []byte, local *Config) (*Config, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(key, doc, raw) {
+		return nil, newErr("Invalid policy signature.")
+	}
+	return applyPolicy(local, doc)
+}
+
+// applyPolicy decodes the policy over a copy of the local config.
+// [policy] 설정은 정책으로 바꿀 수 없다.
+func applyPolicy(local *Config, doc []byte) (*Config, error) {
+	var b bytes.Buffer
+	if err := local.Encode(&b); err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	if err := decodeOver(cfg, b.String()); err != nil {
+		return nil, err
+	}
+	if err := decodeOver(cfg, string(doc)); err != nil {
+		return nil, err
+	}
+	cfg.Policy = local.Policy
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadPolicy applies the cached policy to the local config at startup
+// and returns the version of the applied policy.
+// 보관된 정책이 없거나 잘못된 경우 로컬 설정을 그대로 사용한다.
+func LoadPolicy(local *Config, path string) (*Config, string) {
+	if local.Policy.URL == "" {
+		return local, ""
+	}
+	key, err := policyKey(local.Policy)
+	if err != nil {
+		WriteErrorLog(err)
+		return local, ""
+	}
+
+	doc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return local, ""
+	}
+	sig, err := ioutil.ReadFile(path + POLICY_SIG_SUFFIX)
+	if err != nil {
+		return local, ""
+	}
+	cfg, err := verifyPolicy(key, doc, sig, local)
+	if err != nil {
+		WriteErrorLogMsg("Cached policy not applied.", err)
+		return local, ""
+	}
+	version := policyVersion(doc)
+	log.Printf("[POLICY] policy %s applied.", version)
+	return cfg, version
+}
+
+// NewPolicyFetcher creates the fetcher. active: version of the policy in use
+func NewPolicyFetcher(cfg PolicyConfig, path string, active string) (*PolicyFetcher, error) {
+	key, err := policyKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(cfg.URL, "https://") {
+		return nil, newErr("Policy url must be https.")
+	}
+	if cfg.Interval.Duration <= 0 {
+		cfg.Interval.Duration = POLICY_DEFAULT_INTERVAL
+	}
+
+	p := &PolicyFetcher{
+		cfg:    cfg,
+		key:    key,
+		path:   path,
+		client: &http.Client{Timeout: POLICY_TIMEOUT},
+		status: PolicyStatus{URL: cfg.URL, Active: active},
+	}
+	if doc, err := ioutil.ReadFile(path); err == nil {
+		p.status.Version = policyVersion(doc)
+		if fi, err := os.Stat(path); err == nil {
+			p.status.Updated = fi.ModTime()
+		}
+	}
+	return p, nil
+}
+
+func (p *PolicyFetcher) get(url string, etag string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	return p.client.Do(req)
+}
+
+func readAllLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, POLICY_MAX_SIZE+1))
+	if err == nil && len(data) > POLICY_MAX_SIZE {
+		err = newErr("Policy too large.")
+	}
+	return data, err
+}
+
+// fetch downloads the policy and keeps it if the signature and the settings are valid.
+func (p *PolicyFetcher) fetch() error {
+	p.mu.Lock()
+	etag := p.etag
+	p.mu.Unlock()
+
+	resp, err := p.get(p.cfg.URL, etag)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return newErr("HTTP error code " + resp.Status)
+	}
+	doc, err := readAllLimited(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	sresp, err := p.get(p.cfg.URL+POLICY_SIG_SUFFIX, "")
+	if err != nil {
+		return err
+	}
+	defer sresp.Body.Close()
+	if sresp.StatusCode != http.StatusOK {
+		return newErr("Policy signature: HTTP error code " + sresp.Status)
+	}
+	sig, err := readAllLimited(sresp.Body)
+	if err != nil {
+		return err
+	}
+
+	version := policyVersion(doc)
+	p.mu.Lock()
+	unchanged := version == p.status.Version
+	p.mu.Unlock()
+	if unchanged {
+		p.mu.Lock()
+		p.etag = resp.Header.Get("ETag")
+		p.mu.Unlock()
+		return nil
+	}
+
+	// 정책은 서비스를 시작할 때의 로컬 설정 위에 적용되므로 같은 방법으로 확인한다.
+	local, err := loadServiceConfig()
+	if err != nil {
+		return err
+	}
+	if _, err := verifyPolicy(p.key, doc, sig, local); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(p.path+".tmp", doc, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p.path+POLICY_SIG_SUFFIX, sig, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(p.path+".tmp", p.path); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.etag = resp.Header.Get("ETag")
+	p.status.Version = version
+	p.status.Updated = time.Now()
+	p.mu.Unlock()
+	log.Printf("[POLICY] new policy %s received. It is applied at the next service start or reload.", version)
+	return nil
+}
+
+// Check fetches the policy once.
+func (p *PolicyFetcher) Check() PolicyStatus {
+	err := p.fetch()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.LastCheck = time.Now()
+	p.status.Error = ""
+	if err != nil {
+		p.status.Error = err.Error()
+		WriteErrorLogMsg("Policy update failed. The last valid policy is kept.", err)
+	}
+	return p.status
+}
+
+// Run fetches the policy every interval until stop is closed.
+func (p *PolicyFetcher) Run(stop <-chan struct{}) {
+	p.Check()
+
+	ticker := time.NewTicker(p.cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.Check()
+		}
+	}
+}
+
+func (p *PolicyFetcher) Status() PolicyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
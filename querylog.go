@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type QueryLogEntry struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	ClientMAC  string    `json:"client_mac,omitempty"`
+	ClientName string    `json:"client_name,omitempty"`
+	Device     string    `json:"device,omitempty"`
+	Profile    string    `json:"profile,omitempty"`
+	View       string    `json:"view,omitempty"`
+	Name       string    `json:"name"`
+	Qtype      string    `json:"qtype"`
+	Rcode      string    `json:"rcode"`
+	Blocked    bool      `json:"blocked"`
+	Reason     string    `json:"reason,omitempty"` // why blocked or flagged
+	Cached     bool      `json:"cached"`
+	Upstream   string    `json:"upstream,omitempty"`
+	ElapsedMs  float64   `json:"elapsed_ms"`
+	Error      string    `json:"error,omitempty"` // why the query failed
+
+	Answers []AnswerInfo `json:"answers,omitempty"`
+}
+
+// QueryLogFilter selects entries in QueryLog.Search.
+// Zero value fields are not used for filtering.
+type QueryLogFilter struct {
+	From    time.Time
+	To      time.Time
+	Client  string // IP, MAC address, device id or client name
+	Domain  string // substring of the query name
+	Qtype   string
+	Rcode   string
+	Blocked *bool
+
+	Offset int
+	Limit  int
+}
+
+func (f *QueryLogFilter) match(e *QueryLogEntry) bool {
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+	if f.Client != "" && e.Client != f.Client &&
+		!strings.EqualFold(e.ClientMAC, f.Client) && e.Device != f.Client &&
+		!strings.EqualFold(e.ClientName, f.Client) {
+		return false
+	}
+	if f.Domain != "" && !strings.Contains(e.Name, strings.ToLower(f.Domain)) {
+		return false
+	}
+	if f.Qtype != "" && !strings.EqualFold(e.Qtype, f.Qtype) {
+		return false
+	}
+	if f.Rcode != "" && !strings.EqualFold(e.Rcode, f.Rcode) {
+		return false
+	}
+	if f.Blocked != nil && e.Blocked != *f.Blocked {
+		return false
+	}
+	return true
+}
+
+// QueryLog keeps the most recent queries in a fixed size ring buffer.
+type QueryLog struct {
+	mu      sync.RWMutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+	file    *queryLogFile // nil if no query log file
+	refs    int           // handlers using the query log (reload.go)
+}
+
+// NewQueryLog creates the in-memory query log. The file is opened by OpenFile
+// when the handler is in use, so that a failed reload leaves no file open.
+func NewQueryLog(cfg QueryLogConfig) *QueryLog {
+	size := cfg.Size
+	if size < 1 {
+		size = 1
+	}
+	return &QueryLog{entries: make([]QueryLogEntry, size), refs: 1}
+}
+
+// OpenFile starts writing the entries to the query log file of cfg.
+func (q *QueryLog) OpenFile(cfg QueryLogConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cfg.File != "" && q.file == nil {
+		q.file = newQueryLogFile(cfg)
+	}
+}
+
+// CloseFile writes the queued entries and closes the query log file.
+// 이후의 쿼리는 메모리에만 기록된다.
+func (q *QueryLog) CloseFile() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.file != nil {
+		q.file.close()
+		q.file = nil
+	}
+}
+
+// ToFile returns whether the entries are also written to the query log file.
+func (q *QueryLog) ToFile() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.file != nil
+}
+
+// retain adds a handler that uses the query log.
+func (q *QueryLog) retain() *QueryLog {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.refs++
+	return q
+}
+
+// Close releases the query log of a handler.
+// The file is closed when no handler uses it.
+func (q *QueryLog) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.refs--
+	if q.refs == 0 && q.file != nil {
+		q.file.close()
+		q.file = nil
+	}
+}
+
+func (q *QueryLog) Add(e QueryLogEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.file != nil {
+		q.file.write(e)
+	}
+	q.entries[q.next] = e
+	q.next++
+	if q.next == len(q.entries) {
+		q.next = 0
+		q.full = true
+	}
+}
+
+// Search returns matched entries, newest first, and the total number of matches.
+func (q *QueryLog) Search(f QueryLogFilter) ([]QueryLogEntry, int) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	count := q.next
+	if q.full {
+		count = len(q.entries)
+	}
+
+	result := []QueryLogEntry{}
+	total := 0
+	for i := 0; i < count; i++ {
+		// newest first
+		idx := (q.next - 1 - i + len(q.entries)) % len(q.entries)
+		e := &q.entries[idx]
+		if !f.match(e) {
+			continue
+		}
+
+		if total >= f.Offset && (f.Limit <= 0 || len(result) < f.Limit) {
+			result = append(result, *e)
+		}
+		total++
+	}
+	return result, total
+}
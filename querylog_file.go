@@ -0,0 +1,128 @@
+package main
+
+// Query log file.
+//
+// 쿼리마다 한 줄을 [querylog] file에 기록한다. 파일은 max_size(MB)마다 교체된다.
+//   text : 2026-10-14T09:30:00.123+09:00 192.168.0.10 example.com. A NOERROR 12.3ms cached=false upstream=cloudflare
+//          (차단: blocked=<reason>, 오류: error="<message>"를 덧붙임)
+//   json : QueryLogEntry (/api/querylog와 같은 형식)
+// 파일 쓰기가 쿼리 응답을 늦추지 않도록 별도의 goroutine에서 기록하며,
+// 기록이 밀리면 넘치는 줄은 버리고 버린 수를 서비스 로그에 남긴다.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	QUERYLOG_FORMAT_TEXT = "text"
+	QUERYLOG_FORMAT_JSON = "json"
+)
+
+const QUERYLOG_FILE_QUEUE = 4096
+const QUERYLOG_FLUSH_INTERVAL = time.Second
+
+type queryLogFile struct {
+	w       io.WriteCloser
+	json    bool
+	ch      chan QueryLogEntry
+	closed  chan struct{} // closed when all queued entries are written
+	dropped int64         // atomic. entries dropped since the last report
+}
+
+func newQueryLogFile(cfg QueryLogConfig) *queryLogFile {
+	f := &queryLogFile{
+		w: &lumberjack.Logger{
+			Filename:   resolveAppPath(cfg.File),
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+			Compress:   cfg.Compress,
+		},
+		json:   cfg.Format == QUERYLOG_FORMAT_JSON,
+		ch:     make(chan QueryLogEntry, QUERYLOG_FILE_QUEUE),
+		closed: make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// write queues an entry. 대기열이 가득 차면 버린다.
+func (f *queryLogFile) write(e QueryLogEntry) {
+	select {
+	case f.ch <- e:
+	default:
+		atomic.AddInt64(&f.dropped, 1)
+	}
+}
+
+func (f *queryLogFile) reportDropped() {
+	if n := atomic.SwapInt64(&f.dropped, 0); n > 0 {
+		log.Printf("[QUERYLOG] %d entries were not written to the query log file (queue full)", n)
+	}
+}
+
+func (f *queryLogFile) run() {
+	defer close(f.closed)
+	bw := bufio.NewWriter(f.w)
+	ticker := time.NewTicker(QUERYLOG_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e, ok := <-f.ch:
+			if !ok {
+				bw.Flush()
+				f.w.Close()
+				f.reportDropped()
+				return
+			}
+			f.format(bw, &e)
+		case <-ticker.C:
+			if err := bw.Flush(); err != nil {
+				WriteErrorLogMsg("Can't write the query log file.", err)
+			}
+			f.reportDropped()
+		}
+	}
+}
+
+func (f *queryLogFile) format(w *bufio.Writer, e *QueryLogEntry) {
+	if f.json {
+		data, err := json.Marshal(e)
+		if err == nil {
+			w.Write(data)
+			w.WriteByte('\n')
+		}
+		return
+	}
+
+	upstream := e.Upstream
+	if upstream == "" {
+		upstream = "-"
+	}
+	fmt.Fprintf(w, "%s %s %s %s %s %.1fms cached=%t upstream=%s",
+		e.Time.Format(time.RFC3339Nano), e.Client, e.Name, e.Qtype, e.Rcode,
+		e.ElapsedMs, e.Cached, upstream)
+	if e.Blocked {
+		fmt.Fprintf(w, " blocked=%s", e.Reason)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(w, " error=%s", strconv.Quote(e.Error))
+	}
+	w.WriteByte('\n')
+}
+
+// close writes the queued entries and closes the file.
+func (f *queryLogFile) close() {
+	close(f.ch)
+	<-f.closed
+}
@@ -0,0 +1,186 @@
+package main
+
+// Global and per-client query quotas.
+//
+// 시간/일 단위로 쿼리 수를 세어 한도를 초과하면 설정된 동작을 수행한다.
+//   refuse   : REFUSED로 응답
+//   throttle : 응답을 지연시킴 (동시에 QUOTA_MAX_THROTTLED개까지, 넘으면 REFUSED)
+//   alert    : 로그에 경고만 기록 (기간마다 한 번)
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	QUOTA_REFUSE   = "refuse"
+	QUOTA_THROTTLE = "throttle"
+	QUOTA_ALERT    = "alert"
+)
+
+const QUOTA_MAX_THROTTLED = 100 // queries delayed at the same time
+
+type quotaCounter struct {
+	count   int
+	alerted bool
+}
+
+type quotaRule struct {
+	cfg         QuotaRuleConfig
+	periodStart time.Time
+	counters    map[string]*quotaCounter // client key ("" for global). current period only
+}
+
+type QuotaStatus struct {
+	Rule   string `json:"rule"`
+	Client string `json:"client,omitempty"`
+	Period string `json:"period"`
+	Limit  int    `json:"limit"`
+	Count  int    `json:"count"`
+}
+
+type Quotas struct {
+	mu        sync.Mutex
+	rules     []*quotaRule
+	throttled chan struct{}
+}
+
+func NewQuotas(cfgs []QuotaRuleConfig) (*Quotas, error) {
+	q := &Quotas{throttled: make(chan struct{}, QUOTA_MAX_THROTTLED)}
+	for _, c := range cfgs {
+		switch c.Scope {
+		case "global", "client", "profile":
+		default:
+			return nil, newErr("Quota '" + c.Name + "': unknown scope " + c.Scope)
+		}
+		switch c.Period {
+		case "hour", "day":
+		default:
+			return nil, newErr("Quota '" + c.Name + "': unknown period " + c.Period)
+		}
+		switch c.Action {
+		case QUOTA_REFUSE, QUOTA_THROTTLE, QUOTA_ALERT:
+		default:
+			return nil, newErr("Quota '" + c.Name + "': unknown action " + c.Action)
+		}
+
+		q.rules = append(q.rules, &quotaRule{cfg: c, counters: map[string]*quotaCounter{}})
+	}
+	return q, nil
+}
+
+func periodStart(period string, t time.Time) time.Time {
+	if period == "day" {
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+	return t.Truncate(time.Hour)
+}
+
+// clientKey returns the counter key of the client for the rule,
+// or false if the rule does not apply to the client.
+func (r *quotaRule) clientKey(c *clientID) (string, bool) {
+	switch r.cfg.Scope {
+	case "client":
+		// MAC 주소를 알 수 있으면 주소가 바뀌어도 같은 클라이언트로 센다.
+		if c.MAC != "" {
+			return c.MAC, true
+		}
+		return c.IP, true
+	case "profile":
+		if c.Profile == "" || (r.cfg.Profile != "" && r.cfg.Profile != c.Profile) {
+			return "", false
+		}
+		return c.Profile, true
+	}
+	return "", true
+}
+
+// rollover resets the counters when a new period starts.
+func (r *quotaRule) rollover(now time.Time) {
+	if start := periodStart(r.cfg.Period, now); !start.Equal(r.periodStart) {
+		r.periodStart = start
+		r.counters = map[string]*quotaCounter{}
+	}
+}
+
+// Check counts a query of the client and returns the action to take.
+// ("" if no quota is exceeded, otherwise the strongest action)
+func (q *Quotas) Check(c *clientID) (action string, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, r := range q.rules {
+		key, ok := r.clientKey(c)
+		if !ok {
+			continue
+		}
+
+		r.rollover(now)
+		cnt := r.counters[key]
+		if cnt == nil {
+			cnt = &quotaCounter{}
+			r.counters[key] = cnt
+		}
+		cnt.count++
+
+		if cnt.count <= r.cfg.Limit {
+			continue
+		}
+
+		if !cnt.alerted {
+			cnt.alerted = true
+			log.Printf("[QUOTA] %s exceeded: %s %s, %d queries per %s (action: %s)",
+				r.cfg.Name, r.cfg.Scope, key, r.cfg.Limit, r.cfg.Period, r.cfg.Action)
+		}
+
+		switch r.cfg.Action {
+		case QUOTA_REFUSE:
+			action = QUOTA_REFUSE
+		case QUOTA_THROTTLE:
+			if action != QUOTA_REFUSE {
+				action = QUOTA_THROTTLE
+				if r.cfg.ThrottleDelay.Duration > delay {
+					delay = r.cfg.ThrottleDelay.Duration
+				}
+			}
+		}
+	}
+	return action, delay
+}
+
+// Throttle waits for delay. 이미 QUOTA_MAX_THROTTLED개의 쿼리가 지연 중이면
+// 기다리지 않고 false를 반환한다.
+func (q *Quotas) Throttle(delay time.Duration) bool {
+	select {
+	case q.throttled <- struct{}{}:
+	default:
+		return false
+	}
+	time.Sleep(delay)
+	<-q.throttled
+	return true
+}
+
+func (q *Quotas) Status() []QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := []QuotaStatus{}
+	now := time.Now()
+	for _, r := range q.rules {
+		r.rollover(now)
+		for key, cnt := range r.counters {
+			list = append(list, QuotaStatus{
+				Rule:   r.cfg.Name,
+				Client: key,
+				Period: r.cfg.Period,
+				Limit:  r.cfg.Limit,
+				Count:  cnt.count,
+			})
+		}
+	}
+	return list
+}
@@ -0,0 +1,123 @@
+package main
+
+// Per-client query rate limiting.
+//
+// 클라이언트 주소별 token bucket으로 초당 쿼리 수를 제한하여, 한 기기(오작동하는 기기,
+// DNS 터널링 악성코드)가 업스트림과 캐시를 독차지하지 못하게 한다.
+// 모든 리스너(UDP, TCP, DoT, DoH)의 쿼리에 적용되며, 한도를 넘은 쿼리는
+// REFUSED로 응답하거나(refuse) 응답하지 않는다(drop).
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const RATELIMIT_MAX_CLIENTS = 100000
+const RATELIMIT_SWEEP_INTERVAL = time.Minute
+
+const (
+	RATELIMIT_REFUSE = "refuse"
+	RATELIMIT_DROP   = "drop"
+)
+
+type rateBucket struct {
+	tokens  float64
+	last    time.Time
+	limited int // queries over the limit
+}
+
+type ClientRateLimiter struct {
+	mu        sync.Mutex
+	cfg       RateLimitConfig
+	exempt    []*net.IPNet
+	buckets   map[string]*rateBucket // client IP
+	lastSweep time.Time
+}
+
+func NewClientRateLimiter(cfg RateLimitConfig) (*ClientRateLimiter, error) {
+	if cfg.QueriesPerSecond <= 0 {
+		return nil, newErr("ratelimit.queries_per_second must be more than 0.")
+	}
+	if cfg.Burst < 1 {
+		return nil, newErr("ratelimit.burst must be 1 or more.")
+	}
+	if cfg.Action != RATELIMIT_REFUSE && cfg.Action != RATELIMIT_DROP {
+		return nil, newErr("Unknown ratelimit.action '" + cfg.Action + "'. (refuse, drop)")
+	}
+	rl := &ClientRateLimiter{
+		cfg:       cfg,
+		buckets:   map[string]*rateBucket{},
+		lastSweep: time.Now(),
+	}
+	for _, e := range cfg.Exempt {
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, newErr("Invalid ratelimit exempt network: " + e)
+		}
+		rl.exempt = append(rl.exempt, n)
+	}
+	return rl, nil
+}
+
+// sweep removes the buckets that are full again.
+func (rl *ClientRateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < RATELIMIT_SWEEP_INTERVAL && len(rl.buckets) < RATELIMIT_MAX_CLIENTS {
+		return
+	}
+	rl.lastSweep = now
+	full := time.Duration(float64(rl.cfg.Burst) / rl.cfg.QueriesPerSecond * float64(time.Second))
+	for ip, b := range rl.buckets {
+		if now.Sub(b.last) > full {
+			delete(rl.buckets, ip)
+		}
+	}
+}
+
+// Allow takes a token of the client. false: the query is over the limit.
+func (rl *ClientRateLimiter) Allow(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, n := range rl.exempt {
+			if n.Contains(parsed) {
+				return true
+			}
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	b := rl.buckets[ip]
+	if b == nil {
+		if len(rl.buckets) >= RATELIMIT_MAX_CLIENTS {
+			return true
+		}
+		b = &rateBucket{tokens: float64(rl.cfg.Burst), last: now}
+		rl.buckets[ip] = b
+	}
+
+	// 초당 queries_per_second 만큼 충전되며, 최대 burst
+	b.tokens += now.Sub(b.last).Seconds() * rl.cfg.QueriesPerSecond
+	if max := float64(rl.cfg.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		if b.limited > 0 {
+			log.Printf("[RATELIMIT] stopped limiting %s (%d queries limited)", ip, b.limited)
+			b.limited = 0
+		}
+		return true
+	}
+
+	b.limited++
+	if b.limited == 1 {
+		log.Printf("[RATELIMIT] limiting queries of %s", ip)
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+// DNS rebinding protection.
+//
+// 업스트림(인터넷)의 응답에 사설, loopback, link-local 주소가 있으면 지우거나(strip)
+// 이름을 차단한다(block). 외부 웹 페이지가 자신의 이름을 LAN 주소로 바꾸어
+// 공유기, NAS 등 LAN 기기에 접근하는 공격을 막는다.
+// [[forward]] 도메인의 응답과 로컬 레코드는 확인하지 않는다.
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	REBIND_STRIP = "strip"
+	REBIND_BLOCK = "block"
+)
+
+type RebindProtection struct {
+	action string
+	allow  *DomainRules // names allowed to have LAN addresses (e.g. plex.direct)
+}
+
+func NewRebindProtection(cfg RebindConfig) (*RebindProtection, error) {
+	if cfg.Action != REBIND_STRIP && cfg.Action != REBIND_BLOCK {
+		return nil, newErr("Unknown rebinding.action '" + cfg.Action + "'. (strip, block)")
+	}
+	rp := &RebindProtection{action: cfg.Action, allow: NewDomainRules()}
+	for _, rule := range cfg.Allow {
+		if err := rp.allow.Add(rule); err != nil {
+			return nil, err
+		}
+	}
+	return rp, nil
+}
+
+// lanAddress reports whether ip is an address of the local network or host.
+func lanAddress(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+func rebindRR(rr dns.RR) bool {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return lanAddress(rr.A)
+	case *dns.AAAA:
+		return lanAddress(rr.AAAA)
+	}
+	return false
+}
+
+// Check looks for LAN addresses in the upstream answer m for name.
+// strip: they are removed from m. Returns true if m should be blocked.
+func (rp *RebindProtection) Check(name string, m *dns.Msg) (found, block bool) {
+	if rp.allow.Match(name) {
+		return false, false
+	}
+	answer := m.Answer[:0]
+	for _, rr := range m.Answer {
+		if rebindRR(rr) {
+			found = true
+			if rp.action == REBIND_STRIP {
+				continue
+			}
+		}
+		answer = append(answer, rr)
+	}
+	m.Answer = answer
+	return found, found && rp.action == REBIND_BLOCK
+}
@@ -0,0 +1,241 @@
+package main
+
+// Local static records.
+//
+// 레코드는 zone 파일 형식으로 지정한다. TTL을 생략하면 LOCAL_RECORD_TTL을 사용한다.
+//   "printer.home A 192.168.20.5"
+//   "nas.home 600 IN AAAA fd00::10"
+//   "www.home CNAME nas.home"
+//   "*.lab A 192.168.50.10"      (wildcard: every name under lab)
+// 레코드가 있는 이름은 업스트림으로 보내지 않고 로컬에서 응답한다.
+//
+// 서비스가 관리하는 레코드(DoH 호스트의 주소, 가까운 주소부터)는 SetDynamic으로 바뀌며,
+// 같은 이름의 레코드가 테이블에 있으면 테이블의 레코드로 응답한다.
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const LOCAL_RECORD_TTL = 300
+const LOCAL_CNAME_DEPTH = 8 // max CNAME chain length within the table
+
+// LocalRecords is a table of static records.
+type LocalRecords struct {
+	names map[string][]dns.RR // owner name (lowercase fqdn) -> records
+
+	mu      sync.RWMutex
+	dynamic map[string][]dns.RR // set by SetDynamic, after names
+}
+
+func NewLocalRecords() *LocalRecords {
+	return &LocalRecords{names: map[string][]dns.RR{}, dynamic: map[string][]dns.RR{}}
+}
+
+// SetDynamic replaces the records of name maintained by the service.
+// The records are not modified after this call. nil removes them.
+func (lr *LocalRecords) SetDynamic(name string, rrs []dns.RR) {
+	name = strings.ToLower(dns.Fqdn(name))
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if len(rrs) == 0 {
+		delete(lr.dynamic, name)
+		return
+	}
+	lr.dynamic[name] = rrs
+}
+
+// Add parses a record in zone file format and adds it to the table.
+func (lr *LocalRecords) Add(record string) error {
+	zp := dns.NewZoneParser(strings.NewReader(record), ".", "")
+	zp.SetDefaultTTL(LOCAL_RECORD_TTL)
+
+	rr, ok := zp.Next()
+	if err := zp.Err(); err != nil {
+		return newErr("Invalid local record '" + record + "': " + err.Error())
+	}
+	if !ok {
+		return newErr("Invalid local record '" + record + "'")
+	}
+
+	lr.addRR(rr)
+	return nil
+}
+
+func (lr *LocalRecords) addRR(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	rr.Header().Name = name
+	lr.names[name] = append(lr.names[name], rr)
+}
+
+func (lr *LocalRecords) Len() int {
+	return len(lr.names)
+}
+
+// find returns the records of name. 이름의 레코드가 없으면 가장 가까운
+// 상위 도메인의 wildcard 레코드(*.<parent>)를 name의 레코드로 바꾸어 반환한다.
+func (lr *LocalRecords) find(name string) ([]dns.RR, bool) {
+	if rrs, ok := lr.names[name]; ok {
+		return rrs, true
+	}
+	lr.mu.RLock()
+	rrs, ok := lr.dynamic[name]
+	lr.mu.RUnlock()
+	if ok {
+		return rrs, true
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		rrs, ok := lr.names["*."+name[off:]]
+		if !ok {
+			continue
+		}
+		expanded := make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			expanded[i] = dns.Copy(rr)
+			expanded[i].Header().Name = name
+		}
+		return expanded, true
+	}
+	return nil, false
+}
+
+// lookup returns the records of the name and qtype, following CNAMEs in the table.
+// found is false if the table has no record for the name.
+func (lr *LocalRecords) lookup(name string, qtype uint16) (answer []dns.RR, found bool) {
+	name = strings.ToLower(name)
+	for depth := 0; depth < LOCAL_CNAME_DEPTH; depth++ {
+		rrs, ok := lr.find(name)
+		if !ok {
+			return answer, depth > 0
+		}
+
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+				answer = append(answer, rr)
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if cname == nil || qtype == dns.TypeCNAME {
+			return answer, true
+		}
+
+		// 대상 이름의 레코드가 테이블에 없으면 CNAME만 응답한다.
+		answer = append(answer, cname)
+		name = strings.ToLower(cname.Target)
+	}
+	return answer, true
+}
+
+// Reply answers r from the table, or returns nil if the table has no record for the name.
+func (lr *LocalRecords) Reply(r *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	answer, found := lr.lookup(q.Name, q.Qtype)
+	if !found {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	for _, rr := range answer {
+		rr = dns.Copy(rr)
+		if strings.EqualFold(rr.Header().Name, q.Name) {
+			rr.Header().Name = q.Name // keep the case of the question
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+// Static records for a group of clients.
+type clientRecords struct {
+	name     string
+	nets     []*net.IPNet
+	ids      map[string]bool // IP, MAC, device id
+	profiles map[string]bool
+	records  *LocalRecords
+}
+
+func (cr *clientRecords) match(c *clientID) bool {
+	if cr.ids[c.IP] || (c.MAC != "" && cr.ids[c.MAC]) || (c.Device != "" && cr.ids[c.Device]) {
+		return true
+	}
+	if c.Profile != "" && cr.profiles[c.Profile] {
+		return true
+	}
+	if ip := net.ParseIP(c.IP); ip != nil {
+		for _, n := range cr.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClientRecords are static records that apply only to specific clients.
+// 전역 로컬 레코드보다 먼저 확인한다.
+type ClientRecords struct {
+	rules []*clientRecords
+}
+
+func NewClientRecords(cfgs []ClientRecordsConfig) (*ClientRecords, error) {
+	cr := &ClientRecords{}
+	for _, c := range cfgs {
+		rule := &clientRecords{
+			name:     c.Name,
+			ids:      map[string]bool{},
+			profiles: map[string]bool{},
+			records:  NewLocalRecords(),
+		}
+
+		for _, id := range c.Clients {
+			if strings.Contains(id, "/") {
+				_, n, err := net.ParseCIDR(id)
+				if err != nil {
+					return nil, newErr("Client records '" + c.Name + "': invalid network " + id)
+				}
+				rule.nets = append(rule.nets, n)
+			} else if ip := net.ParseIP(id); ip != nil {
+				rule.ids[ip.String()] = true
+			} else if mac, err := net.ParseMAC(id); err == nil {
+				rule.ids[mac.String()] = true
+			} else {
+				rule.ids[id] = true // device id
+			}
+		}
+		for _, p := range c.Profiles {
+			rule.profiles[p] = true
+		}
+		for _, rec := range c.Records {
+			if err := rule.records.Add(rec); err != nil {
+				return nil, err
+			}
+		}
+		cr.rules = append(cr.rules, rule)
+	}
+	return cr, nil
+}
+
+// Reply answers r from the first rule that matches the client and has the name.
+func (cr *ClientRecords) Reply(c *clientID, r *dns.Msg) *dns.Msg {
+	for _, rule := range cr.rules {
+		if !rule.match(c) {
+			continue
+		}
+		if m := rule.records.Reply(r); m != nil {
+			return m
+		}
+	}
+	return nil
+}
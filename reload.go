@@ -0,0 +1,159 @@
+package main
+
+// Reload of the configuration without restarting the listeners.
+//
+// 설정 파일과 원격 정책을 다시 읽어 새 SecHandler를 만든 후, 리스너(UDP, TCP, DoT, DoH)와
+// API가 사용하는 handler를 한 번에 바꾼다. 처리 중인 쿼리는 이전 handler로 끝까지 처리하며,
+// 모두 끝나면 이전 handler를 닫는다. 설정에 오류가 있으면 이전 handler를 계속 사용한다.
+// 캐시 항목, 쿼리 로그와 통계는 새 handler로 옮긴다.
+// 리스너 주소, API, metrics, DoT, DoH, 차단 페이지, 로그 설정은 서비스를 다시 시작해야 적용된다.
+//   POST /api/reload
+//   SecureDNS.exe reload
+//   sc control SecDNS paramchange
+//   SIGHUP
+
+import (
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HandlerRef is the running handler, replaced on reload.
+type HandlerRef struct {
+	mu       sync.RWMutex // guards cur
+	cur      *SecHandler
+	reloadMu sync.Mutex // one reload at a time
+}
+
+func NewHandlerRef(handler *SecHandler) *HandlerRef {
+	return &HandlerRef{cur: handler}
+}
+
+// Get returns the current handler.
+func (ref *HandlerRef) Get() *SecHandler {
+	ref.mu.RLock()
+	defer ref.mu.RUnlock()
+	return ref.cur
+}
+
+// acquire returns the current handler, which is not closed until release.
+func (ref *HandlerRef) acquire() *SecHandler {
+	ref.mu.RLock()
+	defer ref.mu.RUnlock()
+	// 교체 후 이전 handler의 Wait보다 먼저 Add 되도록 lock 안에서 센다.
+	ref.cur.inflight.Add(1)
+	return ref.cur
+}
+
+func (ref *HandlerRef) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h := ref.acquire()
+	defer h.inflight.Done()
+	h.ServeDNS(w, r)
+}
+
+// ReloadResult is the response of /api/reload.
+type ReloadResult struct {
+	Reloaded        time.Time `json:"reloaded"`
+	RestartRequired []string  `json:"restart_required,omitempty"` // changed sections applied at the next start
+}
+
+// Reload loads the configuration and replaces the handler.
+func (ref *HandlerRef) Reload() (*ReloadResult, error) {
+	ref.reloadMu.Lock()
+	defer ref.reloadMu.Unlock()
+
+	cfg, err := loadServiceConfig()
+	if err != nil {
+		return nil, err
+	}
+	handler, err := newServiceHandler(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	old := ref.Get()
+	handler.adopt(old)
+
+	ref.mu.Lock()
+	ref.cur = handler
+	ref.mu.Unlock()
+
+	go func() {
+		old.inflight.Wait()
+		old.Close()
+	}()
+
+	result := &ReloadResult{
+		Reloaded:        time.Now(),
+		RestartRequired: restartRequired(old.effectiveConfig(), handler.Config),
+	}
+	log.Println("Configuration reloaded.")
+	if len(result.RestartRequired) > 0 {
+		log.Printf("Restart the service to apply the changes of %v", result.RestartRequired)
+	}
+	return result, nil
+}
+
+// Close closes the current handler.
+func (ref *HandlerRef) Close() {
+	ref.reloadMu.Lock()
+	defer ref.reloadMu.Unlock()
+	h := ref.Get()
+	h.inflight.Wait()
+	h.Close()
+}
+
+// adopt takes over the state of the handler it replaces.
+func (s *SecHandler) adopt(old *SecHandler) {
+	s.NameCache.CopyFrom(old.NameCache)
+	s.Stats = old.Stats
+	if s.Metrics != nil && old.Metrics != nil {
+		s.Metrics = old.Metrics
+	}
+	if reflect.DeepEqual(s.Config.QueryLog, old.Config.QueryLog) {
+		s.QueryLog.Close()
+		s.QueryLog = old.QueryLog.retain()
+	} else {
+		// 같은 파일일 수 있으므로 이전 파일을 닫은 후 연다. (Windows에서는 열린 파일을 교체할 수 없음)
+		// 이전 handler가 처리 중인 쿼리는 메모리에만 기록된다.
+		old.QueryLog.CloseFile()
+		s.QueryLog.OpenFile(s.Config.QueryLog)
+	}
+	// 차단 페이지 서버는 다시 시작할 때까지 이전 Sinkhole을 사용한다.
+	if s.Sinkhole != nil && old.Sinkhole != nil {
+		s.Sinkhole = old.Sinkhole
+	}
+}
+
+// effectiveConfig returns a copy of the effective configuration.
+func (s *SecHandler) effectiveConfig() Config {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	return *s.Config
+}
+
+// restartRequired returns the changed sections that are not applied by a reload.
+func restartRequired(old Config, cfg *Config) []string {
+	var changed []string
+	sections := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"dns", old.DNS, cfg.DNS},
+		{"api", old.API, cfg.API},
+		{"metrics", old.Metrics, cfg.Metrics},
+		{"dot_server", old.DoTServer, cfg.DoTServer},
+		{"doh_server", old.DoHServer, cfg.DoHServer},
+		{"sinkhole", old.Sinkhole, cfg.Sinkhole},
+		{"log", old.Log, cfg.Log},
+	}
+	for _, sec := range sections {
+		if !reflect.DeepEqual(sec.old, sec.new) {
+			changed = append(changed, sec.name)
+		}
+	}
+	return changed
+}
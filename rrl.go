@@ -0,0 +1,184 @@
+package main
+
+// Response Rate Limiting (RRL)
+//
+// LAN이나 VPN에 노출된 서버가 증폭 공격(reflection)에 악용되지 않도록
+// 클라이언트 주소 대역(prefix)과 응답(이름, 타입, 응답 코드)별로 초당 응답 수를 제한한다.
+// 한도를 넘은 응답은 버리되, slip 개마다 하나는 TC 비트만 설정한 빈 응답을 보내
+// 정상 클라이언트가 TCP로 다시 질의할 수 있게 한다. (UDP만 해당)
+// SERVFAIL, REFUSED 응답도 errors_per_second로 제한하며, minimal_any = true 이면
+// UDP의 ANY 쿼리에 RFC 8482의 작은 응답(HINFO)만 보낸다.
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const RRL_MAX_BUCKETS = 100000
+const RRL_SWEEP_INTERVAL = time.Minute
+
+const (
+	RRL_OK = iota
+	RRL_DROP
+	RRL_SLIP // send a truncated response
+)
+
+type rrlBucket struct {
+	balance float64
+	last    time.Time
+	limited int // responses over the limit
+}
+
+type RRL struct {
+	mu        sync.Mutex
+	cfg       RRLConfig
+	v4mask    net.IPMask
+	v6mask    net.IPMask
+	exempt    []*net.IPNet
+	buckets   map[string]*rrlBucket
+	lastSweep time.Time
+}
+
+func NewRRL(cfg RRLConfig) (*RRL, error) {
+	rl := &RRL{
+		cfg:       cfg,
+		v4mask:    net.CIDRMask(cfg.IPv4Prefix, 32),
+		v6mask:    net.CIDRMask(cfg.IPv6Prefix, 128),
+		buckets:   map[string]*rrlBucket{},
+		lastSweep: time.Now(),
+	}
+	if rl.v4mask == nil || rl.v6mask == nil {
+		return nil, newErr("Invalid rrl prefix length.")
+	}
+	for _, e := range cfg.Exempt {
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, newErr("Invalid rrl exempt network: " + e)
+		}
+		rl.exempt = append(rl.exempt, n)
+	}
+	return rl, nil
+}
+
+// key returns the account of the response: client prefix and response category.
+// NXDOMAIN은 이름 대신 zone으로 묶어, 임의의 이름으로 한도를 우회하지 못하게 한다.
+func (rl *RRL) key(ip net.IP, resp *dns.Msg) (string, float64) {
+	var prefix string
+	if v4 := ip.To4(); v4 != nil {
+		prefix = v4.Mask(rl.v4mask).String()
+	} else {
+		prefix = ip.Mask(rl.v6mask).String()
+	}
+
+	qname, qtype := "", uint16(0)
+	if len(resp.Question) > 0 {
+		qname = strings.ToLower(resp.Question[0].Name)
+		qtype = resp.Question[0].Qtype
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		return prefix + "|" + qname + "|" + strconv.Itoa(int(qtype)), rl.cfg.ResponsesPerSecond
+	case dns.RcodeNameError:
+		if off, end := dns.NextLabel(qname, 0); !end {
+			qname = qname[off:]
+		}
+		return prefix + "|nx|" + qname, rl.cfg.NXDomainsPerSecond
+	}
+	return prefix + "|err", rl.cfg.ErrorsPerSecond
+}
+
+// sweep removes the accounts that are back to the full balance.
+func (rl *RRL) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < RRL_SWEEP_INTERVAL && len(rl.buckets) < RRL_MAX_BUCKETS {
+		return
+	}
+	rl.lastSweep = now
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > time.Duration(rl.cfg.Window)*time.Second {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// minimalANY reports whether r is an ANY query answered with anyReply.
+func minimalANY(r *dns.Msg) bool {
+	return len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeANY && r.Question[0].Qclass == dns.ClassINET
+}
+
+// anyReply is the minimal answer to an ANY query over UDP. (RFC 8482 4.2)
+func anyReply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600},
+		Cpu: "RFC8482",
+	})
+	return m
+}
+
+// Check debits the account of a response to addr and returns what to do with it.
+func (rl *RRL) Check(addr net.Addr, resp *dns.Msg) int {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return RRL_OK // TCP, DoT, DoH
+	}
+	for _, n := range rl.exempt {
+		if n.Contains(ua.IP) {
+			return RRL_OK
+		}
+	}
+
+	key, rate := rl.key(ua.IP, resp)
+	if rate <= 0 {
+		return RRL_OK
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	b := rl.buckets[key]
+	if b == nil {
+		if len(rl.buckets) >= RRL_MAX_BUCKETS {
+			return RRL_OK
+		}
+		b = &rrlBucket{balance: rate, last: now}
+		rl.buckets[key] = b
+	}
+
+	// 초당 rate 만큼 충전되며, 최대 rate, 최소 -window*rate
+	b.balance += now.Sub(b.last).Seconds() * rate
+	if b.balance > rate {
+		b.balance = rate
+	}
+	b.last = now
+	b.balance--
+	if min := -float64(rl.cfg.Window) * rate; b.balance < min {
+		b.balance = min
+	}
+	if b.balance >= 0 {
+		if b.limited > 0 {
+			log.Printf("[RRL] stopped limiting %s (%d responses limited)", key, b.limited)
+			b.limited = 0
+		}
+		return RRL_OK
+	}
+
+	b.limited++
+	if b.limited == 1 {
+		log.Printf("[RRL] limiting responses: %s", key)
+	}
+	if rl.cfg.Slip > 0 && b.limited%rl.cfg.Slip == 0 {
+		return RRL_SLIP
+	}
+	return RRL_DROP
+}
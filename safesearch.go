@@ -0,0 +1,116 @@
+package main
+
+// SafeSearch enforcement.
+//
+// 검색 사이트의 이름을 각 사이트가 제공하는 SafeSearch(제한 모드) 서버의 CNAME으로 응답하여,
+// 브라우저나 계정 설정과 관계없이 성인 콘텐츠가 걸러진 검색 결과가 표시되게 한다.
+//   www.google.com.  CNAME  forcesafesearch.google.com.
+//   forcesafesearch.google.com.  A  216.239.38.120
+// 모든 쿼리 타입에 CNAME으로 응답하므로 HTTPS 레코드(ECH, 주소 hint)로 우회되지 않는다.
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const SAFESEARCH_CNAME_TTL = 300
+
+const (
+	SAFESEARCH_YOUTUBE_STRICT   = "strict"
+	SAFESEARCH_YOUTUBE_MODERATE = "moderate"
+)
+
+var safeSearchGoogleTLDs = []string{
+	"com", "co.kr", "co.jp", "co.uk", "co.in", "com.au", "com.br", "com.hk", "com.tw",
+	"com.sg", "com.mx", "ca", "de", "fr", "es", "it", "nl", "pl", "ru", "ch", "at", "be",
+}
+
+// safeSearchServices returns the names of each service and their SafeSearch target.
+func safeSearchServices(youtube string) map[string]map[string]string {
+	google := map[string]string{}
+	for _, tld := range safeSearchGoogleTLDs {
+		google["google."+tld+"."] = "forcesafesearch.google.com."
+		google["www.google."+tld+"."] = "forcesafesearch.google.com."
+	}
+
+	yt := "restrict.youtube.com."
+	if youtube == SAFESEARCH_YOUTUBE_MODERATE {
+		yt = "restrictmoderate.youtube.com."
+	}
+	return map[string]map[string]string{
+		"google": google,
+		"bing": {
+			"bing.com.":     "strict.bing.com.",
+			"www.bing.com.": "strict.bing.com.",
+		},
+		"youtube": {
+			"www.youtube.com.":          yt,
+			"m.youtube.com.":            yt,
+			"youtubei.googleapis.com.":  yt,
+			"youtube.googleapis.com.":   yt,
+			"www.youtube-nocookie.com.": yt,
+		},
+		"duckduckgo": {
+			"duckduckgo.com.":       "safe.duckduckgo.com.",
+			"www.duckduckgo.com.":   "safe.duckduckgo.com.",
+			"start.duckduckgo.com.": "safe.duckduckgo.com.",
+			"html.duckduckgo.com.":  "safe.duckduckgo.com.",
+		},
+	}
+}
+
+type SafeSearch struct {
+	targets map[string]string // name (lowercase fqdn) -> SafeSearch name
+}
+
+func NewSafeSearch(cfg SafeSearchConfig) (*SafeSearch, error) {
+	if cfg.YouTube != SAFESEARCH_YOUTUBE_STRICT && cfg.YouTube != SAFESEARCH_YOUTUBE_MODERATE {
+		return nil, newErr("Unknown safesearch.youtube '" + cfg.YouTube + "'. (strict, moderate)")
+	}
+	services := safeSearchServices(cfg.YouTube)
+
+	ss := &SafeSearch{targets: map[string]string{}}
+	for _, name := range cfg.Services {
+		names, ok := services[strings.ToLower(name)]
+		if !ok {
+			return nil, newErr("Unknown safesearch service '" + name + "'. (google, bing, youtube, duckduckgo)")
+		}
+		for n, target := range names {
+			ss.targets[n] = target
+		}
+	}
+	return ss, nil
+}
+
+// Target returns the SafeSearch name of name, or "".
+func (ss *SafeSearch) Target(name string) string {
+	return ss.targets[strings.ToLower(dns.Fqdn(name))]
+}
+
+// Rewrite answers r with a CNAME to target and the answer of target.
+// resolve answers the query for target.
+func (ss *SafeSearch) Rewrite(r *dns.Msg, target string, resolve func(*dns.Msg) *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	reply.RecursionAvailable = true
+	reply.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: SAFESEARCH_CNAME_TTL},
+		Target: target,
+	}}
+	if q.Qtype == dns.TypeCNAME {
+		return reply
+	}
+
+	rewritten := r.Copy()
+	rewritten.Question[0].Name = target
+	m := resolve(rewritten)
+	if m == nil {
+		return nil
+	}
+	reply.Rcode = m.Rcode
+	reply.Answer = append(reply.Answer, m.Answer...)
+	reply.Ns = m.Ns
+	return reply
+}
@@ -0,0 +1,162 @@
+package main
+
+// Upstream response sanitization.
+//
+// 업스트림의 응답이 쿼리의 질문(name, type, class)에 대한 응답인지 확인하고,
+// 질문과 관계없는 레코드(out-of-bailiwick)를 캐시하기 전에 지운다.
+//   answer     : 질문 이름에서 시작하는 CNAME 체인의 레코드 (+ DNAME, RRSIG)
+//   authority  : 체인의 마지막 이름을 포함하는 zone의 SOA, NS와 DNSSEC 레코드
+//   additional : 남은 NS, MX, SRV 레코드가 가리키는 이름의 주소 (+ OPT)
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const SANITIZE_MAX_CHAIN = 16
+
+// checkResponse returns an error if m is not a response to the question of r.
+func checkResponse(r *dns.Msg, m *dns.Msg) error {
+	if !m.Response {
+		return newErr("Upstream message is not a response.")
+	}
+	if len(m.Question) != len(r.Question) {
+		return newErr("Upstream response has a different question.")
+	}
+	for i, q := range r.Question {
+		a := m.Question[i]
+		if !strings.EqualFold(a.Name, q.Name) || a.Qtype != q.Qtype || a.Qclass != q.Qclass {
+			return newErr("Upstream response has a different question: " + a.String())
+		}
+	}
+	return nil
+}
+
+// sanitizeResponse removes the records of m that are not part of the answer
+// to the question of r. Returns the number of removed records.
+func sanitizeResponse(r *dns.Msg, m *dns.Msg) int {
+	if len(r.Question) != 1 {
+		return 0
+	}
+	q := r.Question[0]
+
+	// CNAME chain
+	name := strings.ToLower(q.Name)
+	chain := map[string]bool{name: true}
+	for i := 0; i < SANITIZE_MAX_CHAIN; i++ {
+		next := ""
+		for _, rr := range m.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+				next = strings.ToLower(c.Target)
+				break
+			}
+		}
+		if next == "" || chain[next] {
+			break
+		}
+		name = next
+		chain[name] = true
+	}
+
+	inChain := func(rr dns.RR) bool {
+		owner := strings.ToLower(rr.Header().Name)
+		if rr.Header().Rrtype == dns.TypeDNAME {
+			for n := range chain {
+				if dns.IsSubDomain(owner, n) && owner != n {
+					return true
+				}
+			}
+			return false
+		}
+		return chain[owner]
+	}
+	// zones: signers and SOA/NS owners that contain the last name of the chain
+	zones := map[string]bool{}
+	inZone := func(owner string) bool {
+		for z := range zones {
+			if dns.IsSubDomain(z, owner) {
+				return true
+			}
+		}
+		return false
+	}
+	targets := map[string]bool{}
+	addTarget := func(rr dns.RR) {
+		switch rr := rr.(type) {
+		case *dns.NS:
+			targets[strings.ToLower(rr.Ns)] = true
+		case *dns.MX:
+			targets[strings.ToLower(rr.Mx)] = true
+		case *dns.SRV:
+			targets[strings.ToLower(rr.Target)] = true
+		}
+	}
+
+	removed := 0
+	answer := m.Answer[:0]
+	for _, rr := range m.Answer {
+		t := rr.Header().Rrtype
+		ok := inChain(rr) && (t == q.Qtype || q.Qtype == dns.TypeANY ||
+			t == dns.TypeCNAME || t == dns.TypeDNAME || t == dns.TypeRRSIG)
+		if !ok {
+			removed++
+			continue
+		}
+		if sig, isSig := rr.(*dns.RRSIG); isSig && dns.IsSubDomain(sig.SignerName, name) {
+			zones[strings.ToLower(sig.SignerName)] = true
+		}
+		addTarget(rr)
+		answer = append(answer, rr)
+	}
+	m.Answer = answer
+
+	for _, rr := range m.Ns {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeSOA, dns.TypeNS:
+			if owner := strings.ToLower(rr.Header().Name); dns.IsSubDomain(owner, name) {
+				zones[owner] = true
+			}
+		case dns.TypeRRSIG:
+			if sig := rr.(*dns.RRSIG); dns.IsSubDomain(sig.SignerName, name) {
+				zones[strings.ToLower(sig.SignerName)] = true
+			}
+		}
+	}
+	authority := m.Ns[:0]
+	for _, rr := range m.Ns {
+		owner := strings.ToLower(rr.Header().Name)
+		var ok bool
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNS:
+			ok = dns.IsSubDomain(owner, name)
+		case dns.TypeDS, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			ok = inZone(owner)
+		}
+		if !ok {
+			removed++
+			continue
+		}
+		addTarget(rr)
+		authority = append(authority, rr)
+	}
+	m.Ns = authority
+
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		var ok bool
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+			ok = true
+		case dns.TypeA, dns.TypeAAAA, dns.TypeRRSIG:
+			ok = targets[strings.ToLower(rr.Header().Name)]
+		}
+		if !ok {
+			removed++
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	m.Extra = extra
+	return removed
+}
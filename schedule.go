@@ -0,0 +1,374 @@
+package main
+
+// Scheduled configuration changes.
+//
+// cron 형식(분 시 일 월 요일)으로 지정한 시각에 설정 변경 동작을 실행한다.
+// 실행 결과는 모두 로그에 기록된다. (audit)
+// 서비스를 시작하거나 설정을 다시 읽으면 각 일정의 마지막 실행 시각이 지난 동작을 다시 적용하여
+// 일정에 맞는 상태로 시작한다. (upstream.rotate 제외)
+//
+//   [[schedule]]
+//   name = "night"
+//   cron = "0 22 * * *"
+//   action = "firewall.enable"
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cronField is the set of allowed values of a cron field.
+type cronField map[int]bool
+
+// parseCronField parses "*", "5", "1-5", "*/15", "0-30/10", "1,15" and combinations.
+func parseCronField(field string, min, max int) (cronField, error) {
+	set := cronField{}
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			v, err := strconv.Atoi(part[i+1:])
+			if err != nil || v < 1 {
+				return nil, newErr("Invalid cron step: " + part)
+			}
+			step = v
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			if i := strings.IndexByte(part, '-'); i >= 0 {
+				var err1, err2 error
+				lo, err1 = strconv.Atoi(part[:i])
+				hi, err2 = strconv.Atoi(part[i+1:])
+				if err1 != nil || err2 != nil {
+					return nil, newErr("Invalid cron range: " + part)
+				}
+			} else {
+				v, err := strconv.Atoi(part)
+				if err != nil {
+					return nil, newErr("Invalid cron value: " + part)
+				}
+				lo, hi = v, v
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return nil, newErr("Cron value out of range: " + part)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+type cronSpec struct {
+	minute, hour, dom, month, dow cronField
+	domStar, dowStar              bool
+}
+
+func parseCron(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, newErr("Cron spec must have 5 fields: " + spec)
+	}
+
+	c := &cronSpec{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow[7] {
+		c.dow[0] = true // 7 is also Sunday
+	}
+	return c, nil
+}
+
+// SCHEDULE_CATCHUP_DAYS is how far back the last due time of a job is searched.
+const SCHEDULE_CATCHUP_DAYS = 366
+
+func (c *cronSpec) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	return c.matchDay(t)
+}
+
+// prev returns the last matching minute at or before t, or zero if none
+// in SCHEDULE_CATCHUP_DAYS.
+func (c *cronSpec) prev(t time.Time) time.Time {
+	for i := 0; i < SCHEDULE_CATCHUP_DAYS; i++ {
+		day := time.Date(t.Year(), t.Month(), t.Day()-i, 0, 0, 0, 0, t.Location())
+		if !c.month[int(day.Month())] || !c.matchDay(day) {
+			continue
+		}
+		for h := 23; h >= 0; h-- {
+			if !c.hour[h] {
+				continue
+			}
+			for m := 59; m >= 0; m-- {
+				at := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, day.Location())
+				if c.minute[m] && !at.After(t) {
+					return at
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSpec) matchDay(t time.Time) bool {
+	// cron: if both day fields are restricted, either one may match.
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// Schedule actions. args are from the config.
+type scheduleAction func(s *SecHandler, args []string) error
+
+var scheduleActions = map[string]scheduleAction{
+	"firewall.enable": func(s *SecHandler, args []string) error {
+		s.Firewall.SetEnabled(true)
+		s.UpdateConfig(func(cfg *Config) { cfg.Firewall.DefaultDeny = true })
+		return nil
+	},
+	"firewall.disable": func(s *SecHandler, args []string) error {
+		s.Firewall.SetEnabled(false)
+		s.UpdateConfig(func(cfg *Config) { cfg.Firewall.DefaultDeny = false })
+		return nil
+	},
+	"upstream.prefer": func(s *SecHandler, args []string) error {
+		if len(args) != 1 {
+			return newErr("upstream.prefer needs an upstream name")
+		}
+		if err := s.Upstreams.Prefer(args[0]); err != nil {
+			return err
+		}
+		s.syncUpstreamOrder()
+		return nil
+	},
+	"upstream.rotate": func(s *SecHandler, args []string) error {
+		s.Upstreams.Rotate()
+		s.syncUpstreamOrder()
+		return nil
+	},
+	"blocklist.enable": func(s *SecHandler, args []string) error {
+		return s.setBlocklistEnabled(args, true)
+	},
+	"blocklist.disable": func(s *SecHandler, args []string) error {
+		return s.setBlocklistEnabled(args, false)
+	},
+	"profile.set": func(s *SecHandler, args []string) error {
+		if len(args) != 2 {
+			return newErr("profile.set needs a device or client and a profile")
+		}
+		s.SetProfile(args[0], args[1])
+		return nil
+	},
+}
+
+// scheduleRelative are the actions that depend on the current state,
+// which are not applied again on start.
+var scheduleRelative = map[string]bool{
+	"upstream.rotate": true,
+}
+
+func (s *SecHandler) setBlocklistEnabled(args []string, enabled bool) error {
+	if len(args) != 1 {
+		return newErr("blocklist.enable and blocklist.disable need a blocklist name")
+	}
+	if err := s.Blocklists.SetEnabled(args[0], enabled); err != nil {
+		return err
+	}
+	s.UpdateConfig(func(cfg *Config) {
+		for i := range cfg.Blocklists {
+			if cfg.Blocklists[i].Name == args[0] {
+				cfg.Blocklists[i].Disabled = !enabled
+			}
+		}
+	})
+	return nil
+}
+
+// syncUpstreamOrder reflects the runtime upstream order in the effective configuration.
+func (s *SecHandler) syncUpstreamOrder() {
+	names := s.Upstreams.Names()
+	s.UpdateConfig(func(cfg *Config) {
+		servers := make([]UpstreamServerConfig, 0, len(cfg.Upstream.Servers))
+		for _, name := range names {
+			for _, sc := range cfg.Upstream.Servers {
+				if sc.Name == name {
+					servers = append(servers, sc)
+				}
+			}
+		}
+		cfg.Upstream.Servers = servers
+	})
+}
+
+type scheduleJob struct {
+	name   string
+	spec   string
+	cron   *cronSpec
+	action string
+	args   []string
+
+	mu         sync.Mutex
+	lastRun    time.Time
+	lastResult string
+}
+
+type ScheduleStatus struct {
+	Name       string    `json:"name"`
+	Cron       string    `json:"cron"`
+	Action     string    `json:"action"`
+	Args       []string  `json:"args,omitempty"`
+	LastRun    time.Time `json:"last_run"`
+	LastResult string    `json:"last_result,omitempty"`
+}
+
+type Scheduler struct {
+	handler *SecHandler
+	jobs    []*scheduleJob
+	stop    chan struct{}
+}
+
+func NewScheduler(handler *SecHandler, cfgs []ScheduleConfig) (*Scheduler, error) {
+	sch := &Scheduler{
+		handler: handler,
+		stop:    make(chan struct{}),
+	}
+
+	for _, sc := range cfgs {
+		spec, err := parseCron(sc.Cron)
+		if err != nil {
+			return nil, newErr("Schedule '" + sc.Name + "': " + err.Error())
+		}
+		if _, ok := scheduleActions[sc.Action]; !ok {
+			return nil, newErr("Schedule '" + sc.Name + "': unknown action " + sc.Action)
+		}
+
+		sch.jobs = append(sch.jobs, &scheduleJob{
+			name:   sc.Name,
+			spec:   sc.Cron,
+			cron:   spec,
+			action: sc.Action,
+			args:   sc.Args,
+		})
+	}
+	return sch, nil
+}
+
+func (sch *Scheduler) run(job *scheduleJob, now time.Time) {
+	err := scheduleActions[job.action](sch.handler, job.args)
+
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	job.mu.Lock()
+	job.lastRun = now
+	job.lastResult = result
+	job.mu.Unlock()
+
+	log.Printf("[SCHEDULE] %s: %s %s -> %s", job.name, job.action, strings.Join(job.args, " "), result)
+}
+
+// catchUp runs the last due action of each job, in the order they were due,
+// so that the handler starts in the state of the schedule.
+func (sch *Scheduler) catchUp(now time.Time) {
+	type dueJob struct {
+		job *scheduleJob
+		at  time.Time
+	}
+	var due []dueJob
+	for _, job := range sch.jobs {
+		if scheduleRelative[job.action] {
+			continue
+		}
+		if at := job.cron.prev(now); !at.IsZero() {
+			due = append(due, dueJob{job, at})
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+
+	for _, d := range due {
+		log.Printf("[SCHEDULE] %s: applying the action due at %s", d.job.name, d.at.Format("2006-01-02 15:04"))
+		sch.run(d.job, d.at)
+	}
+}
+
+// Run checks the jobs at the start of every minute.
+func (sch *Scheduler) Run() {
+	if len(sch.jobs) == 0 {
+		return
+	}
+
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+
+		select {
+		case <-sch.stop:
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		for _, job := range sch.jobs {
+			if job.cron.match(next) {
+				sch.run(job, next)
+			}
+		}
+	}
+}
+
+func (sch *Scheduler) Status() []ScheduleStatus {
+	list := []ScheduleStatus{}
+	for _, job := range sch.jobs {
+		job.mu.Lock()
+		list = append(list, ScheduleStatus{
+			Name:       job.name,
+			Cron:       job.spec,
+			Action:     job.action,
+			Args:       job.args,
+			LastRun:    job.lastRun,
+			LastResult: job.lastResult,
+		})
+		job.mu.Unlock()
+	}
+	return list
+}
+
+func (sch *Scheduler) Stop() {
+	close(sch.stop)
+}
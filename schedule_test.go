@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		ok       bool
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}, true},
+		{"5", 0, 59, []int{5}, true},
+		{"1-5", 0, 59, []int{1, 2, 3, 4, 5}, true},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}, true},
+		{"0-30/10", 0, 59, []int{0, 10, 20, 30}, true},
+		{"1,15", 1, 31, []int{1, 15}, true},
+		{"1-3,20-22/2,*/10", 0, 23, []int{0, 1, 2, 3, 10, 20, 22}, true},
+		{"7", 0, 7, []int{7}, true},
+		{"", 0, 59, nil, false},
+		{"x", 0, 59, nil, false},
+		{"1-", 0, 59, nil, false},
+		{"*/0", 0, 59, nil, false},
+		{"*/x", 0, 59, nil, false},
+		{"60", 0, 59, nil, false},
+		{"0", 1, 31, nil, false},
+		{"5-1", 0, 59, nil, false},
+		{"1,,2", 0, 59, nil, false},
+	}
+	for _, tt := range tests {
+		set, err := parseCronField(tt.field, tt.min, tt.max)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v, want ok = %v", tt.field, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		want := cronField{}
+		for _, v := range tt.want {
+			want[v] = true
+		}
+		if !reflect.DeepEqual(set, want) {
+			t.Errorf("%q: got %v, want %v", tt.field, set, want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 32 * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+
+	// 7 is also Sunday.
+	c, err := parseCron("0 0 * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.dow[0] {
+		t.Errorf("7 does not match Sunday")
+	}
+}
+
+func TestCronMatchDay(t *testing.T) {
+	sat := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)  // Saturday the 1st
+	sun := time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)  // Sunday the 2nd
+	mon := time.Date(2024, 6, 10, 0, 0, 0, 0, time.UTC) // Monday the 10th
+	tests := []struct {
+		spec string
+		day  time.Time
+		want bool
+	}{
+		{"0 0 * * *", mon, true},
+		{"0 0 1 * *", sat, true},
+		{"0 0 1 * *", sun, false},
+		{"0 0 * * 0", sun, true},
+		{"0 0 * * 0", sat, false},
+		// both restricted: either one matches.
+		{"0 0 1 * 0", sat, true},
+		{"0 0 1 * 0", sun, true},
+		{"0 0 1 * 0", mon, false},
+		{"0 0 10 * 1", mon, true},
+		{"0 0 */2 * *", mon, false},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := c.matchDay(tt.day); got != tt.want {
+			t.Errorf("%q on %s: got %v, want %v", tt.spec, tt.day.Format("Mon 2"), got, tt.want)
+		}
+	}
+}
+
+func TestCronPrev(t *testing.T) {
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		now  time.Time
+		want time.Time
+	}{
+		{"0 22 * * *", at(2024, 6, 10, 23, 0), at(2024, 6, 10, 22, 0)},
+		{"0 22 * * *", at(2024, 6, 10, 22, 0), at(2024, 6, 10, 22, 0)},
+		{"0 22 * * *", at(2024, 6, 10, 21, 59), at(2024, 6, 9, 22, 0)},
+		{"*/15 * * * *", at(2024, 6, 10, 10, 44), at(2024, 6, 10, 10, 30)},
+		{"30 8 * * 1-5", at(2024, 6, 9, 12, 0), at(2024, 6, 7, 8, 30)}, // Sunday -> Friday
+		{"0 0 * * 7", at(2024, 6, 5, 12, 0), at(2024, 6, 2, 0, 0)},
+		// across month and year boundaries
+		{"0 6 1 * *", at(2024, 3, 1, 5, 0), at(2024, 2, 1, 6, 0)},
+		{"0 6 31 * *", at(2024, 5, 15, 0, 0), at(2024, 3, 31, 6, 0)},
+		{"0 6 29 2 *", at(2024, 3, 1, 0, 0), at(2024, 2, 29, 6, 0)},
+		{"59 23 * * *", at(2024, 1, 1, 0, 0), at(2023, 12, 31, 23, 59)},
+		{"0 0 1 1 *", at(2024, 6, 10, 0, 0), at(2024, 1, 1, 0, 0)},
+		// dom or dow
+		{"0 12 15 * 0", at(2024, 6, 14, 0, 0), at(2024, 6, 9, 12, 0)},
+		{"0 12 15 * 0", at(2024, 6, 15, 13, 0), at(2024, 6, 15, 12, 0)},
+		// none in SCHEDULE_CATCHUP_DAYS
+		{"0 0 30 2 *", at(2024, 6, 10, 0, 0), time.Time{}},
+		{"0 0 29 2 *", at(2025, 6, 10, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		if got := c.prev(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%q before %s: got %s, want %s", tt.spec, tt.now, got, tt.want)
+		}
+	}
+}
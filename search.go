@@ -0,0 +1,64 @@
+package main
+
+// Search-domain expansion of single-label names.
+//
+// 라우터 DNS처럼 단일 레이블 이름(e.g. "printer")이 NXDOMAIN이면 설정된 suffix를 붙인
+// 이름(printer.home.arpa)을 차례로 확인하고, 찾으면 CNAME과 함께 응답한다.
+//   printer.           CNAME  printer.home.arpa.
+//   printer.home.arpa. A      192.168.20.5
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const SEARCH_CNAME_TTL = 60
+
+type SearchDomains struct {
+	suffixes []string // fqdn
+}
+
+func NewSearchDomains(suffixes []string) *SearchDomains {
+	sd := &SearchDomains{}
+	for _, s := range suffixes {
+		s = strings.Trim(strings.ToLower(s), ".")
+		if s != "" {
+			sd.suffixes = append(sd.suffixes, s+".")
+		}
+	}
+	return sd
+}
+
+// Expand tries the suffixes for a single-label name answered with NXDOMAIN.
+// resolve answers an expanded query. Returns resp if no expanded name exists.
+func (sd *SearchDomains) Expand(r *dns.Msg, resp *dns.Msg, resolve func(*dns.Msg) *dns.Msg) *dns.Msg {
+	if resp == nil || resp.Rcode != dns.RcodeNameError || len(r.Question) == 0 {
+		return resp
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET || dns.CountLabel(q.Name) != 1 {
+		return resp
+	}
+
+	for _, suffix := range sd.suffixes {
+		expanded := r.Copy()
+		expanded.Question[0].Name = dns.Fqdn(q.Name) + suffix
+
+		m := resolve(expanded)
+		if m == nil || m.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		reply.RecursionAvailable = m.RecursionAvailable
+		reply.Answer = append([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: SEARCH_CNAME_TTL},
+			Target: expanded.Question[0].Name,
+		}}, m.Answer...)
+		reply.Ns = m.Ns
+		return reply
+	}
+	return resp
+}
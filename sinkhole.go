@@ -0,0 +1,245 @@
+package main
+
+// Sinkhole and block page.
+//
+// 차단된 이름의 A/AAAA 쿼리에 [blocking]의 응답 대신 sinkhole 주소(이 컴퓨터의 주소)로 응답하고,
+// 그 주소에서 "SecureDNS에 의해 차단됨" 페이지를 제공한다.
+// 페이지에는 차단 사유와 일시 허용 버튼이 표시되며, 일시 허용에는 비밀번호가 필요하다.
+// 비밀번호는 Basic 인증으로 보내므로 일시 허용은 HTTPS 페이지(listen_tls)에서만 가능하다.
+// 허용되는 이름은 요청의 Host(차단된 이름)이다.
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const SINKHOLE_TTL = 10 // seconds. short, so that a temporary allow takes effect soon
+const SINKHOLE_ALLOW_PATH = "/securedns/allow"
+
+type Sinkhole struct {
+	cfg     SinkholeConfig
+	ipv4    net.IP
+	ipv6    net.IP       // nil: AAAA answered with no records
+	blocked *cache.Cache // name -> reason, for the block page
+	allowed *cache.Cache // temporarily allowed names
+}
+
+func NewSinkhole(cfg SinkholeConfig) (*Sinkhole, error) {
+	sh := &Sinkhole{
+		cfg:     cfg,
+		blocked: cache.New(1*time.Hour, 10*time.Minute),
+		allowed: cache.New(cache.NoExpiration, 1*time.Minute),
+	}
+
+	if sh.ipv4 = net.ParseIP(cfg.IPv4).To4(); sh.ipv4 == nil {
+		return nil, newErr("Invalid sinkhole ipv4 address: " + cfg.IPv4)
+	}
+	if cfg.IPv6 != "" {
+		if sh.ipv6 = net.ParseIP(cfg.IPv6); sh.ipv6 == nil || sh.ipv6.To4() != nil {
+			return nil, newErr("Invalid sinkhole ipv6 address: " + cfg.IPv6)
+		}
+	}
+	return sh, nil
+}
+
+func sinkholeKey(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Reply answers a blocked A/AAAA query with the sinkhole address.
+// Returns nil for other types.
+func (sh *Sinkhole) Reply(r *dns.Msg, reason string) *dns.Msg {
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+
+	sh.blocked.SetDefault(sinkholeKey(q.Name), reason)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: SINKHOLE_TTL}
+	if q.Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: sh.ipv4})
+	} else if sh.ipv6 != nil {
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: sh.ipv6})
+	}
+	return m
+}
+
+// Allowed reports whether name was allowed temporarily from the block page.
+func (sh *Sinkhole) Allowed(name string) bool {
+	_, ok := sh.allowed.Get(sinkholeKey(name))
+	return ok
+}
+
+var blockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Blocked by SecureDNS</title></head>
+<body style="font-family: sans-serif; margin: 3em;">
+<h1>Blocked by SecureDNS</h1>
+{{if .Allowed}}
+<p><b>{{.Domain}}</b> is allowed for {{.Duration}}.</p>
+<p>It may take a few seconds to take effect. <a href="http://{{.Domain}}/">Continue</a></p>
+{{else}}
+<p><b>{{.Domain}}</b> was blocked.</p>
+<p>Rule: {{.Reason}}</p>
+{{if .CanAllow}}
+<form method="POST" action="` + SINKHOLE_ALLOW_PATH + `">
+<button type="submit">Allow for {{.Duration}}</button>
+</form>
+{{else if .AllowURL}}
+<p><a href="{{.AllowURL}}">Allow temporarily</a> (HTTPS, password required)</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+type blockPageData struct {
+	Domain   string
+	Reason   string
+	Duration time.Duration
+	CanAllow bool   // the request came over HTTPS
+	AllowURL string // HTTPS block page, for the requests over HTTP
+	Allowed  bool
+}
+
+type sinkholeHandler struct {
+	sh *Sinkhole
+}
+
+func (h *sinkholeHandler) authorized(r *http.Request) bool {
+	_, password, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(h.sh.cfg.Password)) == 1
+}
+
+// allowURL returns the URL of the HTTPS block page of domain.
+func (h *sinkholeHandler) allowURL(domain string) string {
+	host := domain
+	if _, port, err := net.SplitHostPort(h.sh.cfg.ListenTLS); err == nil && port != "443" {
+		host = net.JoinHostPort(domain, port)
+	}
+	return "https://" + host + "/"
+}
+
+func (h *sinkholeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data := blockPageData{
+		Domain:   sinkholeKey(r.Host),
+		Duration: h.sh.cfg.AllowDuration.Duration,
+	}
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		data.Domain = sinkholeKey(host)
+	}
+	if h.sh.cfg.Password != "" && h.sh.cfg.ListenTLS != "" {
+		if r.TLS != nil {
+			data.CanAllow = true
+		} else {
+			data.AllowURL = h.allowURL(data.Domain)
+		}
+	}
+
+	if r.URL.Path == SINKHOLE_ALLOW_PATH {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !data.CanAllow {
+			http.Error(w, "temporary allow requires the HTTPS block page", http.StatusForbidden)
+			return
+		}
+		if !h.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="SecureDNS"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if _, ok := dns.IsDomainName(data.Domain); !ok || data.Domain == "" || net.ParseIP(data.Domain) != nil {
+			http.Error(w, "invalid domain", http.StatusBadRequest)
+			return
+		}
+		h.sh.allowed.Set(data.Domain, true, data.Duration)
+		data.Allowed = true
+		log.Printf("[SINKHOLE] %s temporarily allowed for %s by %s", data.Domain, data.Duration, r.RemoteAddr)
+	} else {
+		data.Reason = "unknown"
+		if v, ok := h.sh.blocked.Get(data.Domain); ok {
+			data.Reason = v.(string)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !data.Allowed {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	if err := blockPage.Execute(w, data); err != nil {
+		WriteErrorLog(err)
+	}
+}
+
+// RunBlockPage starts the block page server on the sinkhole address.
+func RunBlockPage(cfg *SinkholeConfig, sh *Sinkhole, errHandler SvrErrorHandlerFunc) (SvrStopFunc, error) {
+	var servers []*http.Server
+	handler := &sinkholeHandler{sh}
+
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: handler}
+	servers = append(servers, srv)
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errHandler(err)
+		}
+	}()
+	log.Printf("Block page listening on %s", cfg.Listen)
+
+	// HTTPS 사이트는 인증서가 일치하지 않으므로 브라우저가 경고를 표시한다.
+	if cfg.ListenTLS != "" {
+		cert, err := tls.LoadX509KeyPair(resolveAppPath(cfg.CertFile), resolveAppPath(cfg.KeyFile))
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		tln, err := net.Listen("tcp", cfg.ListenTLS)
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		tsrv := &http.Server{
+			Handler:   handler,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		}
+		servers = append(servers, tsrv)
+		go func() {
+			if err := tsrv.ServeTLS(tln, "", ""); err != nil && err != http.ErrServerClosed {
+				errHandler(err)
+			}
+		}()
+		log.Printf("Block page listening on %s (HTTPS)", cfg.ListenTLS)
+	}
+
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var err error
+		for _, srv := range servers {
+			if e := srv.Shutdown(ctx); e != nil {
+				err = e
+			}
+		}
+		return err
+	}, nil
+}
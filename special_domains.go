@@ -0,0 +1,210 @@
+package main
+
+// Locally answered special names.
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Canary domains: browsers disable their own DoH when these names don't resolve.
+// https://support.mozilla.org/kb/canary-domain-use-application-dnsnet
+type CanaryDomains struct {
+	names map[string]bool
+}
+
+func NewCanaryDomains(names []string) *CanaryDomains {
+	c := &CanaryDomains{names: map[string]bool{}}
+	for _, n := range names {
+		c.names[dns.Fqdn(strings.ToLower(n))] = true
+	}
+	return c
+}
+
+// Reply returns NXDOMAIN for a canary domain, or nil.
+func (c *CanaryDomains) Reply(r *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 || !c.names[strings.ToLower(r.Question[0].Name)] {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	return m
+}
+
+// Special-use domains answered locally instead of being forwarded.
+//
+//	RFC 6761 : localhost, invalid, test
+//	RFC 6762 : local (mDNS only)
+//	RFC 7686 : onion
+//	RFC 8375 : home.arpa
+//	RFC 6303 : reverse zones of private/loopback/link-local addresses
+func specialUseZones() []string {
+	zones := []string{
+		"localhost.",
+		"invalid.",
+		"test.",
+		"local.",
+		"onion.",
+		"home.arpa.",
+		"10.in-addr.arpa.",
+		"168.192.in-addr.arpa.",
+		"127.in-addr.arpa.",
+		"254.169.in-addr.arpa.",
+		"0.in-addr.arpa.",
+		"d.f.ip6.arpa.",
+		"8.e.f.ip6.arpa.",
+		"9.e.f.ip6.arpa.",
+		"a.e.f.ip6.arpa.",
+		"b.e.f.ip6.arpa.",
+		strings.Repeat("0.", 31) + "1.ip6.arpa.",
+	}
+	for i := 16; i < 32; i++ {
+		zones = append(zones, strconv.Itoa(i)+".172.in-addr.arpa.")
+	}
+	return zones
+}
+
+const LOOPBACK_PTR = "1.0.0.127.in-addr.arpa."
+
+type SpecialUseDomains struct {
+	zones []string
+}
+
+// NewSpecialUseDomains creates the special-use zones.
+// forward: zones to keep forwarding to the upstream. (e.g. home.arpa)
+func NewSpecialUseDomains(forward []string) *SpecialUseDomains {
+	skip := map[string]bool{}
+	for _, z := range forward {
+		skip[dns.Fqdn(strings.ToLower(z))] = true
+	}
+
+	s := &SpecialUseDomains{}
+	for _, z := range specialUseZones() {
+		if !skip[z] {
+			s.zones = append(s.zones, z)
+		}
+	}
+	return s
+}
+
+func (s *SpecialUseDomains) zoneOf(name string) string {
+	zone := ""
+	for _, z := range s.zones {
+		if dns.IsSubDomain(z, name) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+// zone SOA for negative answers
+func specialSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 10800},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  10800,
+	}
+}
+
+// Reply returns the local answer for a special-use name, or nil.
+func (s *SpecialUseDomains) Reply(r *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 {
+		return nil
+	}
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+
+	zone := s.zoneOf(name)
+	if zone == "" {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 10800}
+
+	switch {
+	case zone == "localhost.":
+		// localhost 및 하위 이름은 항상 loopback 주소
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+	case name == LOOPBACK_PTR && q.Qtype == dns.TypePTR:
+		m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, Ptr: "localhost."})
+	case name == zone && (q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY):
+		m.Answer = append(m.Answer, specialSOA(zone))
+	case name == zone || name == LOOPBACK_PTR:
+		// NODATA
+	default:
+		m.Rcode = dns.RcodeNameError
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, specialSOA(zone))
+	}
+	return m
+}
+
+// CHAOS class names for identifying the server (version.bind, id.server, hostname.bind).
+// 다른 CH 쿼리는 업스트림으로 보내지 않고 REFUSED로 응답한다.
+type ChaosNames struct {
+	refuse bool
+	txt    map[string]string // name -> TXT value
+}
+
+func NewChaosNames(cfg ChaosConfig) *ChaosNames {
+	id := cfg.ID
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	hostname := cfg.Hostname
+	if hostname == "" {
+		hostname = id
+	}
+	return &ChaosNames{
+		refuse: cfg.Action == "refuse",
+		txt: map[string]string{
+			"version.bind.":   cfg.Version,
+			"version.server.": cfg.Version,
+			"id.server.":      id,
+			"hostname.bind.":  hostname,
+		},
+	}
+}
+
+// Reply answers a CHAOS class query, or returns nil for other classes.
+func (c *ChaosNames) Reply(r *dns.Msg) *dns.Msg {
+	if len(r.Question) == 0 || r.Question[0].Qclass != dns.ClassCHAOS {
+		return nil
+	}
+	q := r.Question[0]
+
+	m := new(dns.Msg)
+	value, ok := c.txt[strings.ToLower(q.Name)]
+	if c.refuse || !ok || value == "" || (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) {
+		m.SetRcode(r, dns.RcodeRefused)
+		return m
+	}
+
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{value},
+	})
+	return m
+}
@@ -0,0 +1,117 @@
+package main
+
+// Query statistics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const STATS_MAX_CLIENTS = 1000 // clients after this are not counted
+const STATS_TOP_CLIENTS = 20
+
+type Stats struct {
+	started  time.Time
+	queries  int64
+	cached   int64
+	blocked  int64
+	failures int64
+
+	latency *LatencyStats
+
+	mu      sync.Mutex
+	clients map[string]*ClientCount // client IP
+}
+
+// ClientCount is the number of queries of a client.
+type ClientCount struct {
+	Client  string `json:"client"`
+	Name    string `json:"name,omitempty"`
+	Queries int64  `json:"queries"`
+	Blocked int64  `json:"blocked"`
+}
+
+func NewStats() *Stats {
+	return &Stats{started: time.Now(), latency: NewLatencyStats(), clients: map[string]*ClientCount{}}
+}
+
+// RecordLatency adds the resolution time of a query to the latency percentiles.
+func (st *Stats) RecordLatency(name string, info *queryInfo, elapsed time.Duration) {
+	st.latency.Record(name, info, elapsed)
+}
+
+func (st *Stats) Record(info *queryInfo, failed bool) {
+	atomic.AddInt64(&st.queries, 1)
+	if info.cached {
+		atomic.AddInt64(&st.cached, 1)
+	}
+	if info.blocked {
+		atomic.AddInt64(&st.blocked, 1)
+	}
+	if failed {
+		atomic.AddInt64(&st.failures, 1)
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	c, ok := st.clients[info.client.IP]
+	if !ok {
+		if len(st.clients) >= STATS_MAX_CLIENTS {
+			return
+		}
+		c = &ClientCount{Client: info.client.IP}
+		st.clients[info.client.IP] = c
+	}
+	if info.client.Name != "" {
+		c.Name = info.client.Name
+	}
+	c.Queries++
+	if info.blocked {
+		c.Blocked++
+	}
+}
+
+// topClients returns the clients with the most queries.
+func (st *Stats) topClients() []ClientCount {
+	st.mu.Lock()
+	clients := make([]ClientCount, 0, len(st.clients))
+	for _, c := range st.clients {
+		clients = append(clients, *c)
+	}
+	st.mu.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Queries > clients[j].Queries
+	})
+	if len(clients) > STATS_TOP_CLIENTS {
+		clients = clients[:STATS_TOP_CLIENTS]
+	}
+	return clients
+}
+
+type StatsSnapshot struct {
+	Started  time.Time `json:"started"`
+	Queries  int64     `json:"queries"`
+	Cached   int64     `json:"cached"`
+	Blocked  int64     `json:"blocked"`
+	Failures int64     `json:"failures"`
+
+	Latency   LatencySnapshot `json:"latency"`
+	Clients   []ClientCount   `json:"clients"`
+	Tunneling []TunnelScore   `json:"tunneling,omitempty"`
+	Cache     *CacheStats     `json:"cache,omitempty"`
+}
+
+func (st *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Started:  st.started,
+		Queries:  atomic.LoadInt64(&st.queries),
+		Cached:   atomic.LoadInt64(&st.cached),
+		Blocked:  atomic.LoadInt64(&st.blocked),
+		Failures: atomic.LoadInt64(&st.failures),
+		Latency:  st.latency.Snapshot(),
+		Clients:  st.topClients(),
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+// Stub zones.
+//
+// 지정한 zone의 쿼리는 캐시와 DoH 업스트림을 거치지 않고 지정한 권한 서버로 직접 보낸다.
+// (Active Directory 도메인, 사설 인프라 zone 등) TSIG 서명을 사용할 수 있다.
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const STUB_TIMEOUT = 3 * time.Second
+
+type stubZone struct {
+	zone     string // lowercase fqdn
+	servers  []string
+	tsigName string // "" if TSIG is not used
+	tsigAlgo string
+	client   *dns.Client
+	tcp      *dns.Client // retry of truncated responses
+}
+
+type StubZones struct {
+	zones map[string]*stubZone
+}
+
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+func NewStubZones(cfgs []StubZoneConfig) (*StubZones, error) {
+	sz := &StubZones{zones: map[string]*stubZone{}}
+	for _, c := range cfgs {
+		zone := dns.Fqdn(strings.ToLower(c.Zone))
+		if _, ok := dns.IsDomainName(zone); !ok || c.Zone == "" {
+			return nil, newErr("Invalid stub zone name '" + c.Zone + "'")
+		}
+		if len(c.Servers) == 0 {
+			return nil, newErr("Stub zone '" + c.Zone + "' has no server.")
+		}
+
+		z := &stubZone{
+			zone:   zone,
+			client: &dns.Client{Net: "udp", Timeout: STUB_TIMEOUT},
+			tcp:    &dns.Client{Net: "tcp", Timeout: STUB_TIMEOUT},
+		}
+		for _, s := range c.Servers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(s, "53")
+			}
+			z.servers = append(z.servers, s)
+		}
+
+		if c.TSIGName != "" {
+			if c.TSIGSecret == "" {
+				return nil, newErr("Stub zone '" + c.Zone + "': no TSIG secret.")
+			}
+			if c.TSIGAlgorithm == "" {
+				c.TSIGAlgorithm = "hmac-sha256"
+			}
+			algo, ok := tsigAlgorithms[strings.ToLower(c.TSIGAlgorithm)]
+			if !ok {
+				return nil, newErr("Stub zone '" + c.Zone + "': unknown TSIG algorithm " + c.TSIGAlgorithm)
+			}
+			z.tsigName = dns.Fqdn(strings.ToLower(c.TSIGName))
+			z.tsigAlgo = algo
+			secrets := map[string]string{z.tsigName: c.TSIGSecret}
+			z.client.TsigSecret = secrets
+			z.tcp.TsigSecret = secrets
+		}
+		sz.zones[zone] = z
+	}
+	return sz, nil
+}
+
+// Lookup returns the closest stub zone of name, or nil.
+func (sz *StubZones) Lookup(name string) *stubZone {
+	if len(sz.zones) == 0 {
+		return nil
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z, ok := sz.zones[name[off:]]; ok {
+			return z
+		}
+	}
+	return nil
+}
+
+// Exchange sends r to the servers of the zone in order.
+func (z *stubZone) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	q := r.Copy()
+	q.RecursionDesired = false
+	q.Extra = nil // no OPT, no TSIG of the client
+	q.SetEdns0(dns.DefaultMsgSize, false)
+
+	var err error
+	for _, server := range z.servers {
+		if z.tsigName != "" {
+			q.SetTsig(z.tsigName, z.tsigAlgo, 300, time.Now().Unix())
+		}
+
+		var resp *dns.Msg
+		resp, _, err = z.client.Exchange(q, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = z.tcp.Exchange(q, server)
+		}
+		if err != nil {
+			continue
+		}
+
+		resp.Id = r.Id
+		resp.RecursionDesired = r.RecursionDesired
+		resp.RecursionAvailable = true
+		// TSIG, OPT는 서버와의 통신에만 사용한다.
+		resp.Extra = stripOPTAndTSIG(resp.Extra)
+		return resp, nil
+	}
+	return nil, err
+}
+
+func stripOPTAndTSIG(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeOPT, dns.TypeTSIG:
+		default:
+			out = append(out, rr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,43 @@
+package main
+
+// Per-query trace for debugging.
+//
+// "이 도메인이 왜 차단되었는가/왜 이렇게 응답했는가"를 확인할 수 있도록
+// 쿼리를 처리하는 각 단계(캐시, 필터 판정, 업스트림 선택, 응답 시간)를 기록한다.
+
+import (
+	"fmt"
+	"time"
+)
+
+type TraceStep struct {
+	Stage     string  `json:"stage"`
+	Result    string  `json:"result"`
+	ElapsedMs float64 `json:"elapsed_ms"` // since the start of the query
+}
+
+type queryTrace struct {
+	start time.Time
+	steps []TraceStep
+}
+
+func newQueryTrace() *queryTrace {
+	return &queryTrace{start: time.Now(), steps: []TraceStep{}}
+}
+
+// tracef records a step if tracing is enabled for the query.
+func (info *queryInfo) tracef(stage string, format string, args ...interface{}) {
+	t := info.trace
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, TraceStep{
+		Stage:     stage,
+		Result:    fmt.Sprintf(format, args...),
+		ElapsedMs: float64(time.Since(t.start)) / float64(time.Millisecond),
+	})
+}
+
+func (info *queryInfo) tracing() bool {
+	return info.trace != nil
+}
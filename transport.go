@@ -0,0 +1,460 @@
+package main
+
+// Upstream transports, selected by the scheme of the upstream URL.
+//
+//   https://host/path   DNS over HTTPS (RFC 8484)
+//   https+json://host/path  JSON DoH API, see dohjson.go
+//   tls://host[:port]   DNS over TLS (RFC 7858), port 853 if omitted
+//   quic://host[:port]  DNS over QUIC (RFC 9250), port 853 if omitted
+//   odoh://target/path?proxy=https://proxy/path  Oblivious DoH (RFC 9230), see odoh.go
+//   sdns://...          DNSCrypt v2 server stamp, see dnscrypt.go
+//
+// 서버 인증서는 시스템(또는 ca_file)의 CA로 검증한다. spki_pins가 있으면 인증서 체인에
+// pin과 일치하는 공개키(SubjectPublicKeyInfo의 SHA-256, base64)가 있어야 한다.
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const DOT_PORT = "853"
+const DOT_TIMEOUT = 5 * time.Second
+const DOT_IDLE_CONNS = 8 // idle connections kept per upstream
+
+const DOQ_PORT = "853"
+const DOQ_ALPN = "doq"
+const DOQ_TIMEOUT = 5 * time.Second
+const DOQ_IDLE_TIMEOUT = 30 * time.Second // the connection is closed after this idle time
+
+type transport interface {
+	Exchange(r *dns.Msg) (*dns.Msg, error)
+	Close() error // closes idle connections
+}
+
+// transportOptions are the upstream settings used by the transports.
+// The zero value uses the system CA and the default HTTP client settings.
+type transportOptions struct {
+	TLS  *tls.Config      // CA pool and pins (see upstreamTLSConfig), nil: system CA
+	HTTP HTTPClientConfig // DoH, ODoH
+
+	Padding bool // pad DoH, DoT and DoQ queries, see padding.go
+}
+
+// newTransport creates the transport for an upstream URL.
+// dial: dials the server address (host:port) without the system resolver if possible.
+func newTransport(rawurl string, dial dialFunc, opts transportOptions) (transport, error) {
+	if strings.HasPrefix(rawurl, DNSCRYPT_STAMP_PREFIX) {
+		return newDNSCryptTransport(rawurl, dial)
+	}
+	tlsConfig := opts.TLS
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, newErr("Invalid upstream url '" + rawurl + "': " + err.Error())
+	}
+
+	var t transport
+	switch u.Scheme {
+	case "https":
+		doh := &dohTransport{
+			url:         rawurl,
+			client:      newHTTPClient(dial, tlsConfig, opts.HTTP),
+			method:      opts.HTTP.Method,
+			contentType: DOH_CONTENT_TYPE,
+		}
+		if opts.HTTP.LegacyContentType {
+			doh.contentType = DOH_CONTENT_TYPE_LEGACY
+		}
+		t = doh
+	case "tls":
+		t, err = newDoTTransport(u, dial, tlsConfig)
+	case "quic":
+		t, err = newDoQTransport(u, dial, tlsConfig)
+	case "odoh":
+		return newODoHTransport(u, newHTTPClient(dial, tlsConfig, opts.HTTP))
+	case DOH_JSON_SCHEME:
+		return newDoHJSONTransport(u, newHTTPClient(dial, tlsConfig, opts.HTTP)), nil
+	default:
+		return nil, newErr("Unsupported upstream url '" + rawurl + "'. (https://, https+json://, tls://, quic://, odoh://, sdns://)")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Padding {
+		t = &paddedTransport{t}
+	}
+	return t, nil
+}
+
+// exchangeURL sends r once to the upstream at url.
+func exchangeURL(rawurl string, r *dns.Msg, dial dialFunc) (*dns.Msg, error) {
+	t, err := newTransport(rawurl, dial, transportOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	return t.Exchange(r)
+}
+
+// loadCAFile reads a PEM bundle of CA certificates.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, newErr("No certificate in CA file " + path)
+	}
+	return pool, nil
+}
+
+// upstreamTLSConfig returns the TLS settings of an upstream.
+// roots: CA pool, nil: system CA. pins: base64 SHA-256 of SubjectPublicKeyInfo
+func upstreamTLSConfig(roots *x509.CertPool, pins []string) (*tls.Config, error) {
+	c := &tls.Config{RootCAs: roots}
+	if len(pins) == 0 {
+		return c, nil
+	}
+
+	want := map[[sha256.Size]byte]bool{}
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, newErr("Invalid SPKI pin '" + pin + "'. (base64 SHA-256)")
+		}
+		var h [sha256.Size]byte
+		copy(h[:], b)
+		want[h] = true
+	}
+
+	// 체인 검증이 끝난 후 확인한다. (pin은 CA 검증을 대신하지 않는다)
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if want[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		return newErr("No certificate of " + cs.ServerName + " matches the SPKI pins.")
+	}
+	return c, nil
+}
+
+// DoH
+
+// HTTP/2 연결 하나를 재사용하므로 TLS handshake는 연결을 만들 때만 한다.
+type dohTransport struct {
+	url    string
+	client *http.Client
+	method string // DOH_METHOD_POST, DOH_METHOD_GET
+
+	contentType string
+}
+
+func (t *dohTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	return exchangeHTTPS(t.client, t.url, r, t.method, t.contentType)
+}
+
+func (t *dohTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// DoT
+
+type dotTransport struct {
+	addr      string // host:port
+	dial      dialFunc
+	tlsConfig *tls.Config
+	idle      chan *dns.Conn // reused connections
+}
+
+func newDoTTransport(u *url.URL, dial dialFunc, base *tls.Config) (*dotTransport, error) {
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return nil, newErr("No host in upstream url '" + u.String() + "'")
+	}
+	if port == "" {
+		port = DOT_PORT
+	}
+	tlsConfig := base.Clone()
+	tlsConfig.ServerName = host
+	tlsConfig.MinVersion = tls.VersionTLS12
+	// TLS session resumption: 새 연결의 handshake를 줄인다.
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(DOT_IDLE_CONNS)
+	return &dotTransport{
+		addr:      net.JoinHostPort(host, port),
+		dial:      dial,
+		tlsConfig: tlsConfig,
+		idle:      make(chan *dns.Conn, DOT_IDLE_CONNS),
+	}, nil
+}
+
+func (t *dotTransport) connect() (*dns.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DOT_TIMEOUT)
+	defer cancel()
+
+	raw, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, t.tlsConfig)
+	conn.SetDeadline(time.Now().Add(DOT_TIMEOUT))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// get returns an idle connection, or a new one. reused: the connection was idle
+func (t *dotTransport) get() (conn *dns.Conn, reused bool, err error) {
+	select {
+	case conn = <-t.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err = t.connect()
+	return conn, false, err
+}
+
+func (t *dotTransport) put(conn *dns.Conn) {
+	select {
+	case t.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (t *dotTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, reused, err := t.get()
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Now().Add(DOT_TIMEOUT))
+		m, err := t.exchange(conn, r)
+		if err == nil {
+			t.put(conn)
+			return m, nil
+		}
+		conn.Close()
+
+		// 서버가 닫은 유휴 연결이면 새 연결로 다시 시도한다.
+		if !reused {
+			return nil, err
+		}
+	}
+}
+
+func (t *dotTransport) exchange(conn *dns.Conn, r *dns.Msg) (*dns.Msg, error) {
+	if err := conn.WriteMsg(r); err != nil {
+		return nil, err
+	}
+	for {
+		m, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if m.Id == r.Id {
+			return m, nil
+		}
+		// 이전에 timeout 된 쿼리의 응답
+	}
+}
+
+func (t *dotTransport) Close() error {
+	for {
+		select {
+		case conn := <-t.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// DoQ
+
+type doqTransport struct {
+	addr      string // host:port
+	dial      dialFunc
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn quic.Connection // reused, one stream per query
+}
+
+func newDoQTransport(u *url.URL, dial dialFunc, base *tls.Config) (*doqTransport, error) {
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return nil, newErr("No host in upstream url '" + u.String() + "'")
+	}
+	if port == "" {
+		port = DOQ_PORT
+	}
+	tlsConfig := base.Clone()
+	tlsConfig.ServerName = host
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{DOQ_ALPN}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	return &doqTransport{
+		addr:      net.JoinHostPort(host, port),
+		dial:      dial,
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+func (t *doqTransport) connect(ctx context.Context) (quic.Connection, error) {
+	// 서버 주소는 dial로 찾는다. (UDP socket은 주소를 얻는 데만 사용)
+	addr := t.addr
+	if t.dial != nil {
+		raw, err := t.dial(ctx, "udp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = raw.RemoteAddr().String()
+		raw.Close()
+	}
+	return quic.DialAddr(ctx, addr, t.tlsConfig, &quic.Config{
+		HandshakeIdleTimeout: DOQ_TIMEOUT,
+		MaxIdleTimeout:       DOQ_IDLE_TIMEOUT,
+	})
+}
+
+// get returns the open connection, or a new one. reused: the connection was open
+func (t *doqTransport) get(ctx context.Context) (conn quic.Connection, reused bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		if t.conn.Context().Err() == nil {
+			return t.conn, true, nil
+		}
+		t.conn = nil
+	}
+	if conn, err = t.connect(ctx); err != nil {
+		return nil, false, err
+	}
+	t.conn = conn
+	return conn, false, nil
+}
+
+// drop closes conn if it is still the current connection.
+func (t *doqTransport) drop(conn quic.Connection) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
+
+func (t *doqTransport) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	// RFC 9250 4.2.1: Message ID는 0이어야 한다.
+	q := r.Copy()
+	q.Id = 0
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		m, reused, err := t.try(wire)
+		if err == nil {
+			m.Id = r.Id
+			return m, nil
+		}
+		// 서버가 (알리지 않고) 닫은 연결이면 새 연결로 다시 시도한다.
+		if !reused {
+			return nil, err
+		}
+	}
+}
+
+func (t *doqTransport) try(wire []byte) (m *dns.Msg, reused bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DOQ_TIMEOUT)
+	defer cancel()
+
+	conn, reused, err := t.get(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	m, err = t.exchange(ctx, conn, wire)
+	if err != nil {
+		if _, ok := err.(*quic.StreamError); ok {
+			// 서버가 stream만 취소했다. 연결은 정상이다.
+			return nil, false, err
+		}
+		t.drop(conn)
+	}
+	return m, reused, err
+}
+
+func (t *doqTransport) exchange(ctx context.Context, conn quic.Connection, wire []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(0)
+
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	// 2-octet length prefix, 쿼리를 보낸 뒤 stream의 송신 방향을 닫는다.
+	buf := make([]byte, 2+len(wire))
+	binary.BigEndian.PutUint16(buf, uint16(len(wire)))
+	copy(buf[2:], wire)
+	if _, err := stream.Write(buf); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (t *doqTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		t.conn.CloseWithError(0, "")
+		t.conn = nil
+	}
+	return nil
+}
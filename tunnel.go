@@ -0,0 +1,207 @@
+package main
+
+// DNS tunneling / exfiltration detection.
+//
+// 도메인(eTLD+1)별로 일정 시간 동안의 쿼리를 모아 점수(0~100)를 계산한다.
+//   - 하위 도메인 레이블의 엔트로피와 길이 (인코딩된 데이터)
+//   - 서로 다른 하위 도메인의 수 (unique-subdomain explosion)
+//   - TXT/NULL 쿼리의 비율
+//   - 쿼리 빈도
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+const TUNNEL_WINDOW = time.Minute
+const TUNNEL_MAX_SUBDOMAINS = 1000 // per domain per window
+const TUNNEL_MAX_DOMAINS = 10000   // tracked domains per window
+const TUNNEL_MIN_QUERIES = 10      // minimum queries in a window to be suspicious
+const TUNNEL_TOP_SCORES = 20
+
+type tunnelDomainStats struct {
+	queries    int
+	txt        int // TXT, NULL queries
+	entropySum float64
+	lengthSum  int
+	subdomains map[string]struct{}
+	flagged    bool
+}
+
+type TunnelScore struct {
+	Domain     string  `json:"domain"`
+	Score      float64 `json:"score"`
+	Queries    int     `json:"queries"`
+	Subdomains int     `json:"unique_subdomains"`
+	TXTRatio   float64 `json:"txt_ratio"`
+	Entropy    float64 `json:"entropy"`
+}
+
+type TunnelDetector struct {
+	mu          sync.Mutex
+	cfg         TunnelingConfig
+	ignore      *DomainSet
+	windowStart time.Time
+	domains     map[string]*tunnelDomainStats
+	lastScores  []TunnelScore // top scores of the previous window
+}
+
+func NewTunnelDetector(cfg TunnelingConfig) *TunnelDetector {
+	ignore := NewDomainSet()
+	for _, d := range cfg.Ignore {
+		ignore.Add(d)
+	}
+	return &TunnelDetector{
+		cfg:         cfg,
+		ignore:      ignore,
+		windowStart: time.Now(),
+		domains:     map[string]*tunnelDomainStats{},
+	}
+}
+
+// Shannon entropy (bits per character)
+func labelEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	h := 0.0
+	n := float64(len(s))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+func (t *TunnelDetector) score(domain string, st *tunnelDomainStats) TunnelScore {
+	q := float64(st.queries)
+	entropy := st.entropySum / q
+	length := float64(st.lengthSum) / q
+	txtRatio := float64(st.txt) / q
+
+	// 보통의 호스트 이름은 엔트로피가 3 정도, base32/hex 인코딩된 데이터는 4 이상.
+	score := 30*clamp01((entropy-2.5)/1.5) +
+		15*clamp01(length/50) +
+		30*clamp01(float64(len(st.subdomains))/float64(t.cfg.UniqueSubdomains)) +
+		15*txtRatio +
+		10*clamp01(q/float64(t.cfg.QueryRate))
+
+	return TunnelScore{
+		Domain:     domain,
+		Score:      math.Round(score*10) / 10,
+		Queries:    st.queries,
+		Subdomains: len(st.subdomains),
+		TXTRatio:   math.Round(txtRatio*100) / 100,
+		Entropy:    math.Round(entropy*100) / 100,
+	}
+}
+
+func topScores(scores []TunnelScore) []TunnelScore {
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score > scores[j].Score })
+	if len(scores) > TUNNEL_TOP_SCORES {
+		scores = scores[:TUNNEL_TOP_SCORES]
+	}
+	return scores
+}
+
+// rollover starts a new window, keeping the scores of the previous one.
+func (t *TunnelDetector) rollover(now time.Time) {
+	if now.Sub(t.windowStart) < TUNNEL_WINDOW {
+		return
+	}
+
+	var scores []TunnelScore
+	for d, st := range t.domains {
+		scores = append(scores, t.score(d, st))
+	}
+	t.lastScores = topScores(scores)
+	t.domains = map[string]*tunnelDomainStats{}
+	t.windowStart = now
+}
+
+// Observe records a query and reports whether the domain looks like a tunnel.
+func (t *TunnelDetector) Observe(name string, qtype uint16) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil || domain == name || t.ignore.Match(name) {
+		return false
+	}
+	sub := strings.TrimSuffix(name, "."+domain)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollover(time.Now())
+
+	st := t.domains[domain]
+	if st == nil {
+		if len(t.domains) >= TUNNEL_MAX_DOMAINS {
+			return false
+		}
+		st = &tunnelDomainStats{subdomains: map[string]struct{}{}}
+		t.domains[domain] = st
+	}
+
+	st.queries++
+	if qtype == dns.TypeTXT || qtype == dns.TypeNULL {
+		st.txt++
+	}
+	st.entropySum += labelEntropy(strings.Replace(sub, ".", "", -1))
+	st.lengthSum += len(sub)
+	if len(st.subdomains) < TUNNEL_MAX_SUBDOMAINS {
+		st.subdomains[sub] = struct{}{}
+	}
+
+	if st.queries < TUNNEL_MIN_QUERIES {
+		return false
+	}
+
+	sc := t.score(domain, st)
+	if sc.Score < t.cfg.Threshold {
+		return false
+	}
+	if !st.flagged {
+		st.flagged = true
+		log.Printf("[TUNNEL] suspected DNS tunneling: %s (score %.1f, %d queries, %d unique subdomains, entropy %.2f)",
+			domain, sc.Score, sc.Queries, sc.Subdomains, sc.Entropy)
+	}
+	return true
+}
+
+// Scores returns the top scores of the current and the previous window.
+func (t *TunnelDetector) Scores() []TunnelScore {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollover(time.Now())
+
+	seen := map[string]bool{}
+	var scores []TunnelScore
+	for d, st := range t.domains {
+		seen[d] = true
+		scores = append(scores, t.score(d, st))
+	}
+	for _, sc := range t.lastScores {
+		if !seen[sc.Domain] {
+			scores = append(scores, sc)
+		}
+	}
+	return topScores(scores)
+}
@@ -0,0 +1,420 @@
+package main
+
+// Upstream DoH servers and SLO based demotion.
+//
+// 각 업스트림의 응답 시간(p95)과 오류율을 평가 주기마다 계산하여
+// SLO를 위반한 업스트림은 뒤로 밀어낸다(demote).
+// 상태가 자주 바뀌지 않도록 연속된 위반/정상 횟수를 기준으로 한다.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type Upstream struct {
+	Name string
+	URL  string
+
+	transport transport
+
+	latencySLO   time.Duration
+	errorRateSLO float64
+
+	limiter *aimdLimiter // nil if the concurrency limit is disabled
+	weight  int          // for the weighted strategy
+
+	mu        sync.Mutex
+	latencies []time.Duration // successful queries in the current window
+	errors    int             // failed queries in the current window
+
+	demoted    bool
+	violations int           // consecutive violating windows
+	recoveries int           // consecutive healthy windows (while demoted)
+	ewma       time.Duration // latency EWMA, 0 if never used
+
+	// active health check
+	down         bool
+	checkFails   int // consecutive failed checks
+	checkOKs     int // consecutive successful checks (while down)
+	lastCheck    time.Time
+	lastCheckErr string
+
+	// result of the last evaluation
+	lastP95       time.Duration
+	lastErrorRate float64
+	lastSamples   int
+}
+
+// Exchange sends r to the upstream.
+func (u *Upstream) Exchange(r *dns.Msg) (*dns.Msg, error) {
+	return u.transport.Exchange(r)
+}
+
+// Record adds the result of a query to the current window.
+func (u *Upstream) Record(latency time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.updateEWMA(latency, err)
+	if err != nil {
+		u.errors++
+	} else {
+		u.latencies = append(u.latencies, latency)
+	}
+}
+
+// Acquire takes a slot of the concurrency window. false: the window stayed full
+func (u *Upstream) Acquire() bool {
+	if u.limiter == nil {
+		return true
+	}
+	return u.limiter.Acquire()
+}
+
+// Release frees the slot taken by Acquire.
+func (u *Upstream) Release(err error) {
+	if u.limiter != nil {
+		u.limiter.Release(err)
+	}
+}
+
+func (u *Upstream) Demoted() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.demoted
+}
+
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(float64(len(sorted))*p+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// evaluate closes the current window and applies the SLO.
+func (u *Upstream) evaluate(slo *SLOConfig) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	samples := len(u.latencies) + u.errors
+	if samples < slo.MinSamples {
+		// not enough traffic to judge. keep the window.
+		return
+	}
+
+	p95 := percentile(u.latencies, 0.95)
+	errRate := float64(u.errors) / float64(samples)
+
+	u.lastP95 = p95
+	u.lastErrorRate = errRate
+	u.lastSamples = samples
+	u.latencies = u.latencies[:0]
+	u.errors = 0
+
+	violated := (u.latencySLO > 0 && p95 > u.latencySLO) ||
+		(u.errorRateSLO > 0 && errRate > u.errorRateSLO)
+
+	if violated {
+		u.recoveries = 0
+		u.violations++
+		if !u.demoted && u.violations >= slo.DemoteAfter {
+			u.demoted = true
+			log.Printf("Upstream %s demoted: p95 %v, error rate %.1f%% (SLO p95 %v, error rate %.1f%%)",
+				u.Name, p95, errRate*100, u.latencySLO, u.errorRateSLO*100)
+		}
+	} else {
+		u.violations = 0
+		if u.demoted {
+			u.recoveries++
+			if u.recoveries >= slo.PromoteAfter {
+				u.demoted = false
+				u.recoveries = 0
+				log.Printf("Upstream %s restored: p95 %v, error rate %.1f%%",
+					u.Name, p95, errRate*100)
+			}
+		}
+	}
+}
+
+type UpstreamStatus struct {
+	Name      string  `json:"name"`
+	URL       string  `json:"url"`
+	Demoted   bool    `json:"demoted"`
+	P95Ms     float64 `json:"p95_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	Samples   int     `json:"samples"`
+
+	LatencyEWMAMs float64 `json:"latency_ewma_ms"`
+	Weight        int     `json:"weight"`
+
+	Down           bool      `json:"down"`
+	LastCheck      time.Time `json:"last_check,omitempty"`
+	LastCheckError string    `json:"last_check_error,omitempty"`
+
+	ConcurrencyLimit int `json:"concurrency_limit,omitempty"`
+	InFlight         int `json:"in_flight"`
+}
+
+func (u *Upstream) Status() UpstreamStatus {
+	u.mu.Lock()
+	st := UpstreamStatus{
+		Name:      u.Name,
+		URL:       u.URL,
+		Demoted:   u.demoted,
+		P95Ms:     float64(u.lastP95) / float64(time.Millisecond),
+		ErrorRate: u.lastErrorRate,
+		Samples:   u.lastSamples,
+
+		LatencyEWMAMs: float64(u.ewma) / float64(time.Millisecond),
+		Weight:        u.weight,
+
+		Down:           u.down,
+		LastCheck:      u.lastCheck,
+		LastCheckError: u.lastCheckErr,
+	}
+	u.mu.Unlock()
+
+	if u.limiter != nil {
+		st.ConcurrencyLimit, st.InFlight = u.limiter.state()
+	}
+	return st
+}
+
+type UpstreamPool struct {
+	mu          sync.RWMutex
+	upstreams   []*Upstream // in order of preference
+	slo         SLOConfig
+	concurrency ConcurrencyConfig
+	strategy    string
+	next        uint64 // round robin counter
+	dial        dialFunc
+	opts        transportOptions // of the upstreams added later (DDR), without SPKI pins
+	healthCheck HealthCheckConfig
+	stop        chan struct{}
+}
+
+// dial: dials the upstream servers. (see EndpointSelector.DialContext)
+func NewUpstreamPool(cfg *UpstreamConfig, dial dialFunc) (*UpstreamPool, error) {
+	p := &UpstreamPool{
+		slo:         cfg.SLO,
+		concurrency: cfg.Concurrency,
+		strategy:    cfg.Strategy,
+		dial:        dial,
+		healthCheck: cfg.HealthCheck,
+		stop:        make(chan struct{}),
+	}
+
+	var roots *x509.CertPool
+	if cfg.CAFile != "" {
+		var err error
+		if roots, err = loadCAFile(resolveAppPath(cfg.CAFile)); err != nil {
+			return nil, err
+		}
+	}
+	p.opts = transportOptions{TLS: &tls.Config{RootCAs: roots}, HTTP: cfg.HTTP, Padding: cfg.Padding}
+
+	for _, sc := range cfg.Servers {
+		tlsConfig, err := upstreamTLSConfig(roots, sc.SPKIPins)
+		if err != nil {
+			return nil, newErr("Upstream " + sc.Name + ": " + err.Error())
+		}
+		opts := p.opts
+		opts.TLS = tlsConfig
+		t, err := newTransport(sc.URL, dial, opts)
+		if err != nil {
+			return nil, err
+		}
+		u := &Upstream{
+			Name:         sc.Name,
+			URL:          sc.URL,
+			transport:    t,
+			latencySLO:   cfg.SLO.LatencyP95.Duration,
+			errorRateSLO: cfg.SLO.ErrorRate,
+			weight:       sc.Weight,
+		}
+		if u.weight <= 0 {
+			u.weight = 1
+		}
+		if sc.LatencyP95.Duration > 0 {
+			u.latencySLO = sc.LatencyP95.Duration
+		}
+		if sc.ErrorRate > 0 {
+			u.errorRateSLO = sc.ErrorRate
+		}
+		u.limiter = p.newLimiter()
+		p.upstreams = append(p.upstreams, u)
+	}
+	return p, nil
+}
+
+// Start starts the SLO evaluation and the health checks. Stop stops them.
+func (p *UpstreamPool) Start() {
+	if p.slo.EvaluateInterval.Duration > 0 {
+		go p.run()
+	}
+	if p.healthCheck.Enabled {
+		go p.runHealthCheck(p.healthCheck)
+	}
+}
+
+func (p *UpstreamPool) newLimiter() *aimdLimiter {
+	if !p.concurrency.Enabled {
+		return nil
+	}
+	return newAIMDLimiter(p.concurrency)
+}
+
+func (p *UpstreamPool) run() {
+	ticker := time.NewTicker(p.slo.EvaluateInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			for _, u := range p.list() {
+				u.evaluate(&p.slo)
+			}
+		}
+	}
+}
+
+func (p *UpstreamPool) list() []*Upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.upstreams
+}
+
+// Select returns the upstreams in order of preference, ordered by the
+// balancing strategy. Demoted upstreams are placed after the healthy ones,
+// and the upstreams down by the health check are left out unless all are down.
+func (p *UpstreamPool) Select() []*Upstream {
+	return p.SelectNamed(nil)
+}
+
+// SelectNamed is Select limited to the named upstreams. nil: every upstream
+func (p *UpstreamPool) SelectNamed(names map[string]bool) []*Upstream {
+	all := p.list()
+	list := make([]*Upstream, 0, len(all))
+	var demoted, down []*Upstream
+
+	for _, u := range all {
+		if names != nil && !names[u.Name] {
+			continue
+		}
+		if u.Down() {
+			down = append(down, u)
+		} else if u.Demoted() {
+			demoted = append(demoted, u)
+		} else {
+			list = append(list, u)
+		}
+	}
+	p.balance(list)
+	list = append(list, demoted...)
+	if len(list) == 0 {
+		return down
+	}
+	return list
+}
+
+// Prefer moves the named upstream to the front.
+func (p *UpstreamPool) Prefer(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, u := range p.upstreams {
+		if u.Name == name {
+			list := []*Upstream{u}
+			list = append(list, p.upstreams[:i]...)
+			list = append(list, p.upstreams[i+1:]...)
+			p.upstreams = list
+			return nil
+		}
+	}
+	return newErr("No upstream named '" + name + "'.")
+}
+
+// AddFirst adds an upstream in front of the others, replacing the upstream of the same name.
+// The upstream uses the ca_file, http and padding options of the pool.
+func (p *UpstreamPool) AddFirst(name, url string) error {
+	t, err := newTransport(url, p.dial, p.opts)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := []*Upstream{{
+		Name:         name,
+		URL:          url,
+		transport:    t,
+		latencySLO:   p.slo.LatencyP95.Duration,
+		errorRateSLO: p.slo.ErrorRate,
+		limiter:      p.newLimiter(),
+		weight:       1,
+	}}
+	for _, u := range p.upstreams {
+		if u.Name != name {
+			list = append(list, u)
+		} else {
+			u.transport.Close()
+		}
+	}
+	p.upstreams = list
+	return nil
+}
+
+// Rotate moves the first upstream to the end.
+func (p *UpstreamPool) Rotate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.upstreams) > 1 {
+		list := append([]*Upstream{}, p.upstreams[1:]...)
+		p.upstreams = append(list, p.upstreams[0])
+	}
+}
+
+// Names returns the upstream names in order of preference.
+func (p *UpstreamPool) Names() []string {
+	var names []string
+	for _, u := range p.list() {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	var list []UpstreamStatus
+	for _, u := range p.list() {
+		list = append(list, u.Status())
+	}
+	return list
+}
+
+func (p *UpstreamPool) Stop() {
+	close(p.stop)
+	for _, u := range p.list() {
+		u.transport.Close()
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+// DNS views.
+//
+// 쿼리를 받은 리스너(udp, tcp, dot, doh)나 인터페이스, 클라이언트 네트워크에 따라
+// 다른 로컬 레코드와 정책을 적용한다. (e.g. 게스트 VLAN에서는 내부 호스트 이름을 볼 수 없음)
+// 위에서부터 처음 일치하는 view가 적용되며, 공유 캐시보다 먼저 확인한다.
+// upstreams를 지정한 view는 응답이 다를 수 있으므로 캐시를 따로 사용한다.
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type view struct {
+	cfg        ViewConfig
+	listeners  map[string]bool // empty: every listener
+	nets       []*net.IPNet    // empty: every client
+	records    *LocalRecords
+	refuse     *DomainSet
+	blocklists map[string]bool // nil: every blocklist
+	upstreams  map[string]bool // nil: every upstream
+}
+
+const (
+	VIEW_LOG_ALL     = "all"
+	VIEW_LOG_BLOCKED = "blocked"
+	VIEW_LOG_NONE    = "none"
+)
+
+type Views struct {
+	views []*view
+}
+
+// interfaceNetworks returns the networks of a network interface.
+// 직접 연결된 네트워크의 클라이언트는 그 인터페이스로 쿼리를 보낸다.
+// (인터페이스의 주소는 서비스를 시작할 때 읽는다)
+func interfaceNetworks(name string) ([]*net.IPNet, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			nets = append(nets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+		}
+	}
+	return nets, nil
+}
+
+func NewViews(cfgs []ViewConfig) (*Views, error) {
+	vs := &Views{}
+	for _, c := range cfgs {
+		v := &view{
+			cfg:       c,
+			listeners: map[string]bool{},
+			records:   NewLocalRecords(),
+			refuse:    NewDomainSet(),
+		}
+
+		for _, l := range c.Listeners {
+			switch l {
+			case "udp", "tcp", "dot", "doh":
+				v.listeners[l] = true
+			default:
+				return nil, newErr("View '" + c.Name + "': unknown listener " + l)
+			}
+		}
+		switch c.Log {
+		case "":
+			v.cfg.Log = VIEW_LOG_ALL
+		case VIEW_LOG_ALL, VIEW_LOG_BLOCKED, VIEW_LOG_NONE:
+		default:
+			return nil, newErr("View '" + c.Name + "': unknown log " + c.Log + " (all, blocked, none)")
+		}
+		for _, cidr := range c.Networks {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					bits = 32
+				}
+				cidr += "/" + strconv.Itoa(bits)
+			}
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, newErr("View '" + c.Name + "': invalid network " + cidr)
+			}
+			v.nets = append(v.nets, n)
+		}
+		for _, name := range c.Interfaces {
+			nets, err := interfaceNetworks(name)
+			if err != nil {
+				return nil, newErr("View '" + c.Name + "': interface " + name + ": " + err.Error())
+			}
+			v.nets = append(v.nets, nets...)
+		}
+		for _, rec := range c.Records {
+			if err := v.records.Add(rec); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range c.Refuse {
+			v.refuse.Add(name)
+		}
+		if c.Blocklists != nil {
+			v.blocklists = map[string]bool{}
+			for _, name := range c.Blocklists {
+				v.blocklists[name] = true
+			}
+		}
+		if c.Upstreams != nil {
+			v.upstreams = map[string]bool{}
+			for _, name := range c.Upstreams {
+				v.upstreams[name] = true
+			}
+		}
+		vs.views = append(vs.views, v)
+	}
+	return vs, nil
+}
+
+func (v *view) match(c *clientID) bool {
+	if len(v.listeners) > 0 && !v.listeners[c.Listener] {
+		return false
+	}
+	if len(v.nets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(c.IP)
+	for _, n := range v.nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// keySuffix separates the cache of a view with its own upstreams.
+func (v *view) keySuffix() string {
+	if v == nil || v.upstreams == nil {
+		return ""
+	}
+	return "/view=" + strings.ToLower(v.cfg.Name)
+}
+
+// logged reports whether a query of the view is written to the query log.
+func (v *view) logged(blocked bool) bool {
+	if v == nil {
+		return true
+	}
+	return v.cfg.Log == VIEW_LOG_ALL || (v.cfg.Log == VIEW_LOG_BLOCKED && blocked)
+}
+
+// Select returns the first view that matches the client, or nil.
+func (vs *Views) Select(c *clientID) *view {
+	for _, v := range vs.views {
+		if v.match(c) {
+			return v
+		}
+	}
+	return nil
+}
+
+// listenerName returns the name of the listener that received the query.
+func listenerName(w dns.ResponseWriter) string {
+	switch w.(type) {
+	case *dotResponseWriter:
+		return "dot"
+	case *dohResponseWriter:
+		return "doh"
+	}
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
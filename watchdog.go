@@ -0,0 +1,200 @@
+package main
+
+// DNS hijack watchdog.
+//
+// 주기적으로 감시용 도메인(sentinel)을 현재 업스트림과 독립된 기준 서버(reference)에
+// 각각 질의하여 응답을 비교한다. 다수의 도메인에서 응답이 연속으로 달라지면
+// 업스트림의 변조나 네트워크 수준의 하이재킹을 의심하여 경고하고,
+// action = "failover" 이면 다음 업스트림으로 전환한다.
+// sentinel은 주소가 지역에 따라 달라지지 않는 도메인이어야 한다. (CDN 도메인은 부적합)
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const WATCHDOG_TIMEOUT = 10 * time.Second
+
+type SentinelResult struct {
+	Domain    string   `json:"domain"`
+	Upstream  []string `json:"upstream"`
+	Reference []string `json:"reference"`
+	Divergent bool     `json:"divergent"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type WatchdogStatus struct {
+	LastCheck   time.Time        `json:"last_check"`
+	Upstream    string           `json:"upstream"`
+	Reference   string           `json:"reference"`
+	Consecutive int              `json:"consecutive"` // consecutive divergent rounds
+	Alerted     bool             `json:"alerted"`
+	Results     []SentinelResult `json:"results"`
+}
+
+type Watchdog struct {
+	mu      sync.Mutex
+	cfg     WatchdogConfig
+	handler *SecHandler
+	status  WatchdogStatus
+}
+
+func NewWatchdog(cfg WatchdogConfig, handler *SecHandler) (*Watchdog, error) {
+	if len(cfg.Sentinels) == 0 {
+		return nil, newErr("No watchdog sentinel domain.")
+	}
+	if cfg.Interval.Duration <= 0 {
+		return nil, newErr("Invalid watchdog interval.")
+	}
+	switch cfg.Action {
+	case "alert", "failover":
+	default:
+		return nil, newErr("Unknown watchdog action: " + cfg.Action)
+	}
+	return &Watchdog{cfg: cfg, handler: handler, status: WatchdogStatus{Reference: cfg.Reference}}, nil
+}
+
+// answerSet returns the rcode and the sorted A/AAAA addresses, or an error string.
+func answerSet(m *dns.Msg, err error) (string, []string, string) {
+	if err != nil {
+		return "", nil, err.Error()
+	}
+	var ips []string
+	for _, rr := range m.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			ips = append(ips, v.A.String())
+		case *dns.AAAA:
+			ips = append(ips, v.AAAA.String())
+		}
+	}
+	sort.Strings(ips)
+	return dns.RcodeToString[m.Rcode], ips, ""
+}
+
+// queryReference sends r to the reference server: an upstream URL or a DNS server address.
+func (wd *Watchdog) queryReference(r *dns.Msg) (*dns.Msg, error) {
+	if strings.Contains(wd.cfg.Reference, "://") {
+		return exchangeURL(wd.cfg.Reference, r, (&net.Dialer{Timeout: WATCHDOG_TIMEOUT}).DialContext)
+	}
+	client := &dns.Client{Timeout: WATCHDOG_TIMEOUT}
+	m, _, err := client.Exchange(r, wd.cfg.Reference)
+	return m, err
+}
+
+// divergent: 응답 코드가 다르거나, 둘 다 주소가 있는데 공통 주소가 없는 경우
+func divergent(rcode1 string, ips1 []string, rcode2 string, ips2 []string) bool {
+	if rcode1 != rcode2 {
+		return true
+	}
+	if len(ips1) == 0 || len(ips2) == 0 {
+		return len(ips1) != len(ips2)
+	}
+	seen := map[string]bool{}
+	for _, ip := range ips1 {
+		seen[ip] = true
+	}
+	for _, ip := range ips2 {
+		if seen[ip] {
+			return false
+		}
+	}
+	return true
+}
+
+// Check compares the answers of the sentinels once.
+func (wd *Watchdog) Check() WatchdogStatus {
+	u := wd.handler.Upstreams.Select()[0]
+
+	var results []SentinelResult
+	compared, diverged := 0, 0
+	for _, domain := range wd.cfg.Sentinels {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+
+		res := SentinelResult{Domain: domain}
+		urcode, uips, uerr := answerSet(u.Exchange(r))
+		rrcode, rips, rerr := answerSet(wd.queryReference(r))
+		res.Upstream, res.Reference = uips, rips
+
+		switch {
+		case uerr != "":
+			res.Error = "upstream: " + uerr
+		case rerr != "":
+			res.Error = "reference: " + rerr
+		default:
+			compared++
+			if divergent(urcode, uips, rrcode, rips) {
+				res.Divergent = true
+				diverged++
+			}
+		}
+		results = append(results, res)
+	}
+
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	st := &wd.status
+	st.LastCheck = time.Now()
+	st.Upstream = u.Name
+	st.Results = results
+
+	// 질의에 실패한 도메인은 판정에서 제외한다.
+	if compared > 0 && float64(diverged)/float64(compared) >= wd.cfg.Threshold {
+		st.Consecutive++
+	} else {
+		if st.Alerted {
+			log.Printf("[WATCHDOG] answers of upstream %s agree with the reference again.", u.Name)
+		}
+		st.Consecutive = 0
+		st.Alerted = false
+	}
+
+	if st.Consecutive >= wd.cfg.Rounds && !st.Alerted {
+		st.Alerted = true
+		log.Printf("[WATCHDOG] possible DNS hijacking: %d of %d sentinel answers of upstream %s differ from %s",
+			diverged, compared, u.Name, wd.cfg.Reference)
+		for _, res := range results {
+			if res.Divergent {
+				log.Printf("[WATCHDOG]   %s: upstream %v, reference %v", res.Domain, res.Upstream, res.Reference)
+			}
+		}
+
+		if wd.cfg.Action == "failover" && len(wd.handler.Upstreams.Names()) > 1 {
+			wd.handler.Upstreams.Rotate()
+			wd.handler.syncUpstreamOrder()
+			log.Printf("[WATCHDOG] failed over to upstream %s", wd.handler.Upstreams.Select()[0].Name)
+			st.Consecutive = 0
+			st.Alerted = false
+		}
+	}
+	return *st
+}
+
+// Run checks every interval until stop is closed.
+func (wd *Watchdog) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(wd.cfg.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			wd.Check()
+		}
+	}
+}
+
+func (wd *Watchdog) Status() WatchdogStatus {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	return wd.status
+}